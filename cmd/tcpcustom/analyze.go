@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"custom-tcp-fingerprint/internal/analyzer"
+	"custom-tcp-fingerprint/internal/logging"
+	"custom-tcp-fingerprint/internal/p0f"
+	"custom-tcp-fingerprint/internal/policy"
+)
+
+// diffShownValues - сколько самых частых значений поля выводит analyze diff.
+const diffShownValues = 4
+
+func runAnalyze(args []string) int {
+	if len(args) > 0 && args[0] == "diff" {
+		return runAnalyzeDiff(args[1:])
+	}
+
+	fs := flag.NewFlagSet("analyze", flag.ExitOnError)
+	dbFile := fs.String("p0f", "configs/p0f.fp", "p0f v3 fingerprint database (p0f.fp)")
+	expect := fs.String("expect", "", "Fail unless every SYN is classified as this p0f label")
+	synAck := fs.Bool("synack", false, "Also classify SYN-ACK packets")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s analyze [flags] file.pcap\n", os.Args[0])
+		fmt.Fprintf(fs.Output(), "       %s analyze diff [flags] a.pcap b.pcap\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	db, err := p0f.Load(*dbFile)
+	if err != nil {
+		logging.Errorf("не удалось загрузить базу p0f: %v", err)
+		return 1
+	}
+
+	results, err := analyzer.ClassifyPcapFile(fs.Arg(0), db)
+	if err != nil {
+		logging.Errorf("не удалось проанализировать pcap: %v", err)
+		return 1
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "TYPE\tSRC\tDST\tTTL\tWIN\tOLAYOUT\tOS\tQUALITY\tDIST\tDIFF")
+
+	syns, failed := 0, 0
+	for _, r := range results {
+		seg := r.Segment
+		kind := "SYN"
+		if seg.IsSYNACK() {
+			if !*synAck {
+				continue
+			}
+			kind = "SYN-ACK"
+		} else {
+			syns++
+			if *expect != "" && !r.Is(*expect) {
+				failed++
+			}
+		}
+
+		diffs := make([]string, 0, len(r.Mismatches))
+		for _, m := range r.Mismatches {
+			diffs = append(diffs, fmt.Sprintf("%s(%s!=%s)", m.Field, m.Actual, m.Expected))
+		}
+
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%d\t%s\t%s\t%s\t%d\t%s\n",
+			kind, seg.SrcAddrPort(), seg.DstAddrPort(), seg.TTL, seg.Window, seg.OptionLayout,
+			r.OS(), r.Quality, r.Distance, strings.Join(diffs, " "))
+	}
+	tw.Flush()
+
+	if *expect == "" {
+		return 0
+	}
+	if syns == 0 {
+		logging.Errorf("в %s нет SYN-пакетов", fs.Arg(0))
+		return 1
+	}
+	if failed > 0 {
+		logging.Errorf("%d из %d SYN не распознаны как %q", failed, syns, *expect)
+		return 1
+	}
+	logging.Infof("все %d SYN распознаны как %q", syns, *expect)
+	return 0
+}
+
+// runAnalyzeDiff сравнивает распределения полей SYN двух захватов и
+// возвращает 1, если они различаются.
+func runAnalyzeDiff(args []string) int {
+	fs := flag.NewFlagSet("analyze diff", flag.ExitOnError)
+	dbFile := fs.String("p0f", "configs/p0f.fp", "p0f v3 fingerprint database, used by -group profile")
+	group := fs.String("group", analyzer.GroupAll, "Group SYNs by all, source or profile before comparing")
+	dst := fs.String("dst", "", "Only SYNs to these comma-separated addresses or CIDRs")
+	dport := fs.String("dport", "", "Only SYNs to these comma-separated ports or ranges, e.g. 80,8000-8100")
+	tolerance := fs.Float64("tolerance", 0.1, "Distribution distance (0..1) above which a field is reported as different")
+	asJSON := fs.Bool("json", false, "Print the report as JSON")
+	all := fs.Bool("all", false, "Also print fields that do not differ")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s analyze diff [flags] a.pcap b.pcap\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return 2
+	}
+
+	opts := analyzer.DiffOptions{GroupBy: *group, Tolerance: *tolerance}
+	if *group == analyzer.GroupProfile {
+		db, err := p0f.Load(*dbFile)
+		if err != nil {
+			logging.Errorf("не удалось загрузить базу p0f: %v", err)
+			return 1
+		}
+		opts.DB = db
+	}
+
+	// Фильтр по назначению - то же условие, что dst и ports в правилах
+	// выбора профиля.
+	var rule policy.Rule
+	for _, s := range splitList(*dst) {
+		p, err := policy.ParsePrefix(s)
+		if err != nil {
+			logging.Errorf("некорректный адрес в -dst: %v", err)
+			return 2
+		}
+		rule.Dst = append(rule.Dst, p)
+	}
+	for _, s := range splitList(*dport) {
+		r, err := policy.ParsePortRange(s)
+		if err != nil {
+			logging.Errorf("некорректный порт в -dport: %v", err)
+			return 2
+		}
+		rule.Ports = append(rule.Ports, r)
+	}
+	if len(rule.Dst) > 0 || len(rule.Ports) > 0 {
+		opts.Filter = func(seg *analyzer.TCPSegment) bool {
+			return rule.Match(policy.Request{Addr: seg.Dst, Port: int(seg.DstPort)})
+		}
+	}
+
+	report, err := analyzer.DiffCaptures(fs.Arg(0), fs.Arg(1), opts)
+	if err != nil {
+		logging.Errorf("не удалось сравнить захваты: %v", err)
+		return 1
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			logging.Errorf("ошибка вывода отчета: %v", err)
+			return 1
+		}
+	} else {
+		printDiffReport(report, *all)
+	}
+
+	if report.Differs() {
+		return 1
+	}
+	return 0
+}
+
+func printDiffReport(report *analyzer.DiffReport, all bool) {
+	fmt.Printf("a: %s\nb: %s\n", report.A, report.B)
+	if len(report.Groups) == 0 {
+		fmt.Println("\nв захватах нет подходящих SYN")
+		return
+	}
+
+	for _, g := range report.Groups {
+		fmt.Printf("\nгруппа %s: SYN в a - %d, в b - %d\n", g.Group, g.SYNsA, g.SYNsB)
+		// У группы из одного захвата сравнивать нечего, поэтому выводятся
+		// все ее поля.
+		show := all
+		switch {
+		case g.SYNsA == 0:
+			fmt.Println("  есть только в b")
+			show = true
+		case g.SYNsB == 0:
+			fmt.Println("  есть только в a")
+			show = true
+		case !g.Differs() && !all:
+			fmt.Println("  различий нет")
+			continue
+		}
+
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "  FIELD\tDIST\tA\tB\t")
+		for _, f := range g.Fields {
+			if !f.Differs && !show {
+				continue
+			}
+			mark := ""
+			if f.Differs {
+				mark = "*"
+			}
+			fmt.Fprintf(tw, "  %s\t%.2f\t%s\t%s\t%s\n", f.Field, f.Distance,
+				formatDistribution(f.A), formatDistribution(f.B), mark)
+		}
+		tw.Flush()
+	}
+}
+
+// formatDistribution выводит самые частые значения с долями, например
+// "8192 75%, 65535 25%".
+func formatDistribution(d analyzer.Distribution) string {
+	values := d.Values()
+	if len(values) == 0 {
+		return "-"
+	}
+	parts := make([]string, 0, diffShownValues+1)
+	for i, v := range values {
+		if i == diffShownValues {
+			parts = append(parts, fmt.Sprintf("+%d", len(values)-i))
+			break
+		}
+		parts = append(parts, fmt.Sprintf("%s %.0f%%", v, d.Share(v)*100))
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+
+	"custom-tcp-fingerprint/internal/journal"
+	"custom-tcp-fingerprint/internal/logging"
+	"custom-tcp-fingerprint/internal/netns"
+	"custom-tcp-fingerprint/internal/network"
+	"custom-tcp-fingerprint/internal/rtnl"
+	"custom-tcp-fingerprint/internal/sysctl"
+)
+
+// Виды шагов отката в журнале.
+const (
+	stepLink     = "link"
+	stepFirewall = "firewall"
+	stepRouting  = "routing"
+	stepSysctl   = "sysctl"
+	stepNetns    = "netns"
+	stepUplink   = "uplink"
+	stepRedirect = "redirect"
+)
+
+// undoStep выполняет шаг в namespace из аргумента netns, если он задан.
+// Если namespace уже удален, вместе с ним исчезло и все, что в нем было.
+func undoStep(step journal.Step) error {
+	name := step.Args["netns"]
+	if name == "" {
+		return undoLocalStep(step)
+	}
+	if !netns.Exists(name) {
+		return nil
+	}
+	return netns.Do(name, func() error {
+		return undoLocalStep(step)
+	})
+}
+
+func undoLocalStep(step journal.Step) error {
+	a := step.Args
+	switch step.Kind {
+	case stepLink:
+		return rtnl.DeleteLink(a["name"])
+	case stepFirewall:
+		backend, err := network.NewRuleBackend(a["backend"])
+		if err != nil {
+			return err
+		}
+		spec, err := parseRuleArgs(a)
+		if err != nil {
+			return err
+		}
+		return backend.Cleanup(spec)
+	case stepRouting:
+		return network.CleanupRouting(a["tun"], splitList(a["target"]))
+	case stepSysctl:
+		return sysctl.Snapshot{{Key: a["key"], Value: a["value"]}}.Restore()
+	case stepNetns:
+		return netns.Delete(a["name"])
+	case stepUplink:
+		backend, err := network.NewRuleBackend(a["backend"])
+		if err != nil {
+			return err
+		}
+		spec, err := parseUplinkArgs(a)
+		if err != nil {
+			return err
+		}
+		return backend.CleanupUplink(spec)
+	case stepRedirect:
+		backend, err := network.NewRuleBackend(a["backend"])
+		if err != nil {
+			return err
+		}
+		spec, err := parseRedirectArgs(a)
+		if err != nil {
+			return err
+		}
+		return backend.CleanupRedirect(spec)
+	}
+	return fmt.Errorf("неизвестный шаг журнала: %s", step.Kind)
+}
+
+// ruleArgs и parseRuleArgs переводят RuleSpec в аргументы шага журнала и
+// обратно. Списки хранятся через запятую, поэтому журналы с одной целью и
+// одним портом читаются так же.
+func ruleArgs(backend string, spec network.RuleSpec) map[string]string {
+	ports := make([]string, len(spec.LocalPorts))
+	for i, port := range spec.LocalPorts {
+		ports[i] = strconv.Itoa(port)
+	}
+	snat := make([]string, len(spec.SNAT))
+	for i, n := range spec.SNAT {
+		snat[i] = n.Stack.String() + "=" + n.Source.String()
+	}
+	return map[string]string{
+		"backend": backend,
+		"tun":     spec.TunName,
+		"target":  strings.Join(spec.TargetHosts, ","),
+		"lport":   strings.Join(ports, ","),
+		"snat":    strings.Join(snat, ","),
+	}
+}
+
+func parseRuleArgs(a map[string]string) (network.RuleSpec, error) {
+	spec := network.RuleSpec{TunName: a["tun"], TargetHosts: splitList(a["target"])}
+	for _, v := range splitList(a["lport"]) {
+		port, err := strconv.Atoi(v)
+		if err != nil {
+			return spec, fmt.Errorf("некорректный порт %q", v)
+		}
+		spec.LocalPorts = append(spec.LocalPorts, port)
+	}
+	for _, v := range splitList(a["snat"]) {
+		stackAddr, source, _ := strings.Cut(v, "=")
+		n := network.SNAT{}
+		var err error
+		if n.Stack, err = netip.ParseAddr(stackAddr); err != nil {
+			return spec, err
+		}
+		if n.Source, err = netip.ParseAddr(source); err != nil {
+			return spec, err
+		}
+		spec.SNAT = append(spec.SNAT, n)
+	}
+	return spec, nil
+}
+
+// forwardingSysctls - параметры пересылки, которые меняют бэкенды правил;
+// их исходные значения сохраняются в журнале.
+var forwardingSysctls = []string{"net.ipv4.ip_forward", "net.ipv6.conf.all.forwarding"}
+
+// uplinkArgs и parseUplinkArgs переводят UplinkSpec в аргументы шага
+// журнала и обратно. Журналы прежних версий хранят одну подсеть в "subnet".
+func uplinkArgs(backend string, spec network.UplinkSpec) map[string]string {
+	subnets := make([]string, len(spec.Subnets))
+	for i, subnet := range spec.Subnets {
+		subnets[i] = subnet.String()
+	}
+	return map[string]string{
+		"backend": backend,
+		"iface":   spec.Iface,
+		"subnets": strings.Join(subnets, ","),
+	}
+}
+
+func parseUplinkArgs(a map[string]string) (network.UplinkSpec, error) {
+	spec := network.UplinkSpec{Iface: a["iface"]}
+	list := splitList(a["subnets"])
+	if subnet := a["subnet"]; subnet != "" {
+		list = append(list, subnet)
+	}
+	for _, s := range list {
+		subnet, err := netip.ParsePrefix(s)
+		if err != nil {
+			return spec, err
+		}
+		spec.Subnets = append(spec.Subnets, subnet)
+	}
+	return spec, nil
+}
+
+// redirectArgs и parseRedirectArgs переводят RedirectSpec в аргументы шага
+// журнала и обратно; списки хранятся через запятую.
+func redirectArgs(backend string, spec network.RedirectSpec) map[string]string {
+	uids := make([]string, len(spec.UIDs))
+	for i, uid := range spec.UIDs {
+		uids[i] = strconv.FormatUint(uint64(uid), 10)
+	}
+	sources := make([]string, len(spec.Sources))
+	for i, src := range spec.Sources {
+		sources[i] = src.String()
+	}
+	return map[string]string{
+		"backend": backend,
+		"tun":     spec.TunName,
+		"lport":   strconv.Itoa(spec.LocalPort),
+		"uids":    strings.Join(uids, ","),
+		"cgroups": strings.Join(spec.Cgroups, ","),
+		"sources": strings.Join(sources, ","),
+	}
+}
+
+func parseRedirectArgs(a map[string]string) (network.RedirectSpec, error) {
+	spec := network.RedirectSpec{TunName: a["tun"], Cgroups: splitList(a["cgroups"])}
+	spec.LocalPort, _ = strconv.Atoi(a["lport"])
+	for _, v := range splitList(a["uids"]) {
+		uid, err := strconv.ParseUint(v, 10, 32)
+		if err != nil {
+			return spec, fmt.Errorf("некорректный uid %q: %w", v, err)
+		}
+		spec.UIDs = append(spec.UIDs, uint32(uid))
+	}
+	for _, v := range splitList(a["sources"]) {
+		src, err := netip.ParsePrefix(v)
+		if err != nil {
+			return spec, err
+		}
+		spec.Sources = append(spec.Sources, src)
+	}
+	return spec, nil
+}
+
+func splitList(s string) []string {
+	var out []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// rollback откатывает журнал и только логирует ошибки: вызывается на пути
+// завершения, где сделать что-то еще уже нельзя.
+func rollback(j *journal.Journal) {
+	logging.Infof("откат изменений из журнала %s", j.Path())
+	if err := j.Rollback(undoStep); err != nil {
+		logging.Errorf("ошибка при откате изменений (повторите tcpcustom cleanup): %v", err)
+	}
+}
+
+func runCleanup(args []string) int {
+	fs := flag.NewFlagSet("cleanup", flag.ExitOnError)
+	dir := fs.String("dir", journal.DefaultDir, "Journal directory")
+	force := fs.Bool("force", false, "Also roll back journals of processes that are still running")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s cleanup [flags]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	journals, err := journal.List(*dir)
+	if err != nil {
+		logging.Warnf("предупреждение: %v", err)
+	}
+	if len(journals) == 0 {
+		logging.Infof("в %s нет журналов, откатывать нечего", *dir)
+		return 0
+	}
+
+	code := 0
+	for _, j := range journals {
+		if j.Alive() && !*force {
+			logging.Warnf("пропущен журнал %s: процесс %d еще работает (используйте -force)", j.Path(), j.PID)
+			continue
+		}
+
+		logging.Infof("откат журнала %s: %d шагов от %s", j.Path(), len(j.Steps), j.Started.Format("2006-01-02 15:04:05"))
+		for i := len(j.Steps) - 1; i >= 0; i-- {
+			logging.Infof("  %s", j.Steps[i])
+		}
+		if err := j.Rollback(undoStep); err != nil {
+			logging.Errorf("не удалось откатить журнал %s: %v", j.Path(), err)
+			code = 1
+		}
+	}
+	return code
+}
@@ -1,18 +1,30 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
+	"math/rand/v2"
+	"net"
+	"net/netip"
 	"os"
 	"os/signal"
-	"path/filepath"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
 	"custom-tcp-fingerprint/internal/analyzer"
+	"custom-tcp-fingerprint/internal/config"
+	"custom-tcp-fingerprint/internal/journal"
+	"custom-tcp-fingerprint/internal/logging"
+	"custom-tcp-fingerprint/internal/netns"
 	"custom-tcp-fingerprint/internal/network"
+	"custom-tcp-fingerprint/internal/policy"
+	"custom-tcp-fingerprint/internal/proxy"
 	"custom-tcp-fingerprint/internal/stack"
+	"custom-tcp-fingerprint/internal/sysctl"
 )
 
 var (
@@ -21,100 +33,669 @@ var (
 	tunName     = flag.String("tun", "tun0", "TUN interface name")
 	localPort   = flag.Int("lport", 8080, "Local port to listen on")
 	captureFile = flag.String("capture", "", "Capture traffic to file")
-	windowSize  = flag.Int("window", 8192, "TCP Window Size")
-	ttl         = flag.Int("ttl", 64, "IP Time to Live (TTL)")
+	captureFilt = flag.String("capture-filter", "", "pcap filter expression for the capture, e.g. \"tcp port 80\"")
+	handshakes  = flag.Bool("log-handshakes", false, "Log every TCP handshake seen on the TUN interface with its RTT and SYN fields")
+	windowSize  = flag.Int("window", 0, "TCP Window Size (0 - profile default)")
+	ttl         = flag.Int("ttl", 0, "IP Time to Live (TTL) (0 - profile default)")
+	hopLimit    = flag.Int("hop-limit", 0, "IPv6 Hop Limit (0 - profile default, same as TTL)")
+	flowLabel   = flag.String("flow-label", "", "IPv6 flow label policy: stack, zero or random (empty - profile default)")
 	mtu         = flag.Int("mtu", 1500, "Maximum Transmission Unit (MTU)")
-	fingerprint = flag.String("fp", "windows", "TCP fingerprint to imitate (windows, macos, linux)")
+	fingerprint = flag.String("fp", "windows", "TCP fingerprint to imitate: a profile name (see profile list) or a p0f label")
+	p0fFile     = flag.String("p0f", "", "p0f v3 fingerprint database (p0f.fp) with extra profiles")
+	profileFile = flag.String("profile-file", "", "Comma-separated profile files (e.g. from profile learn) usable by name in -fp")
+	profileDir  = flag.String("profile-dir", "", "Directory of YAML/JSON profile files usable by name in -fp")
+	firewall    = flag.String("firewall", network.BackendNftables, "Firewall rule backend (nftables, iptables)")
+	netnsName   = flag.String("netns", "", "Run TUN, rules and routes in this network namespace (created if missing)")
+	configFile  = flag.String("config", "", "YAML config file (explicitly set flags override its values)")
+	proxyMode   = flag.String("mode", "forward", "Proxy mode: forward to -host:-port, socks5, http or transparent")
+	proxyAuth   = flag.String("proxy-auth", "", "SOCKS5/HTTP proxy credentials as user:password")
+	redirUIDs   = flag.String("redirect-uids", "", "Transparent mode: comma-separated UIDs whose TCP connections are intercepted")
+	redirCgroup = flag.String("redirect-cgroups", "", "Transparent mode: comma-separated cgroup v2 paths (relative to /sys/fs/cgroup) to intercept")
+	redirSrc    = flag.String("redirect-sources", "", "Transparent mode: comma-separated source CIDRs of forwarded traffic to intercept")
+	rotate      = flag.String("rotate", "", "Rotate among comma-separated profiles with optional weights, e.g. windows:3,linux")
+	rotateMode  = flag.String("rotate-mode", "connection", "Rotation granularity: connection, window or destination")
+	rotateEvery = flag.Duration("rotate-interval", 0, "Rotation window length for -rotate-mode window")
+	seed        = flag.Uint64("seed", 0, "Seed for profile rotation and jitter (0 - random, logged at start)")
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "analyze":
+			os.Exit(runAnalyze(os.Args[2:]))
+		case "profile":
+			os.Exit(runProfile(os.Args[2:]))
+		case "verify":
+			os.Exit(runVerify(os.Args[2:]))
+		case "cleanup":
+			os.Exit(runCleanup(os.Args[2:]))
+		}
+	}
+
 	flag.Parse()
 
-	log.Println("запуск инструмента кастомизации tcp-отпечатка")
-	log.Printf("целевой хост: %s:%d", *targetHost, *targetPort)
+	cfg, err := loadConfig()
+	if err != nil {
+		log.Fatalf("ошибка конфигурации: %v", err)
+	}
+
+	closeLog, err := logging.Setup(cfg.Logging.Level, cfg.Logging.File)
+	if err != nil {
+		log.Fatalf("не удалось настроить логирование: %v", err)
+	}
+	defer closeLog()
+
+	tunCfg, target, lport := cfg.Network.Tun, cfg.Network.Target, cfg.Network.Local.Port
+
+	logging.Infof("запуск инструмента кастомизации tcp-отпечатка")
+	mode := cfg.Proxy.Mode
+	if mode != "forward" {
+		logging.Infof("режим %s: цель соединения выбирает клиент", mode)
+	} else if len(cfg.Network.Mappings) == 0 {
+		logging.Infof("целевой хост: %s:%d", target.Host, target.Port)
+	}
 
 	if os.Geteuid() != 0 {
 		log.Fatal("эта программа должна запускатся с правами суперпользователя (sudo)")
 	}
 
-	tun, err := network.CreateTunInterface(*tunName, *mtu)
+	if cfg.Fingerprint.P0fFile != "" {
+		if err := stack.LoadP0fProfiles(cfg.Fingerprint.P0fFile); err != nil {
+			log.Fatalf("не удалось загрузить базу p0f: %v", err)
+		}
+		logging.Infof("загружена база p0f %s: %d профилей", cfg.Fingerprint.P0fFile, len(stack.P0fProfileLabels()))
+	}
+	if err := loadProfiles(cfg.Fingerprint.ProfileDir, cfg.Fingerprint.ProfileFiles); err != nil {
+		log.Fatalf("не удалось загрузить профиль: %v", err)
+	}
+
+	opts, err := fingerprintOptions(cfg.Fingerprint, tunCfg.MTU)
 	if err != nil {
-		log.Fatalf("не удалось создать tun-интерфейс: %v", err)
+		log.Fatalf("не удалось получить tcp опции: %v", err)
+	}
+	selector, err := profileSelector(cfg.Fingerprint, opts, tunCfg.MTU)
+	if err != nil {
+		log.Fatalf("ошибка правил выбора профиля: %v", err)
 	}
-	defer tun.Close()
-	log.Printf("создан tun-интерфейс: %s", *tunName)
 
-	if err := network.SetupIptablesRules(*tunName, *targetHost, *localPort); err != nil {
-		log.Fatalf("не удалось настроить правила iptables: %v", err)
+	// В режимах socks5 и http правила и маршруты охватывают любой адрес
+	// назначения, что в network обозначается пустым списком целей.
+	rules := network.RuleSpec{TunName: tunCfg.Name, LocalPorts: []int{lport}}
+	var mappings []stack.Mapping
+	if mode == "forward" {
+		mappings, rules, err = forwardMappings(cfg, tunCfg.Name)
+		if err != nil {
+			log.Fatalf("ошибка конфигурации пересылок: %v", err)
+		}
 	}
-	log.Println("правила iptables настроены успешно")
 
-	if err := network.SetupRouting(*tunName, *targetHost); err != nil {
-		log.Fatalf("не удалось настроить маршрутизацию: %v", err)
+	firewall, err := network.NewRuleBackend(cfg.Network.Firewall)
+	if err != nil {
+		log.Fatalf("ошибка конфигурации: %v", err)
 	}
-	log.Println("маршрутизация настроена успешно")
 
-	if *captureFile != "" {
-		if dir := filepath.Dir(*captureFile); dir != "" {
-			os.MkdirAll(dir, 0755)
+	// Каждый шаг отката пишется в журнал до соответствующего изменения:
+	// при ошибке запуска все откатывается, а после kill -9 журнал
+	// воспроизводит команда tcpcustom cleanup.
+	j, err := journal.Create(journal.DefaultDir)
+	if err != nil {
+		log.Fatalf("не удалось создать журнал изменений: %v", err)
+	}
+	fatalf := func(format string, args ...interface{}) {
+		logging.Errorf(format, args...)
+		rollback(j)
+		os.Exit(1)
+	}
+	record := func(kind string, args map[string]string) {
+		if err := j.Record(kind, args); err != nil {
+			fatalf("не удалось записать журнал изменений: %v", err)
 		}
+	}
 
-		go func() {
-			if err := analyzer.CaptureTraffic(*tunName, *captureFile); err != nil {
-				log.Printf("ошибка при захвате трафика: %v", err)
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+
+	// В режиме -netns tun, правила, маршруты и sysctl живут в отдельном
+	// namespace, а прокси слушает на хосте: отпечаток меняется только у
+	// нашего трафика.
+	ns := cfg.Network.Netns
+	inNetns := func(fn func() error) error {
+		return netns.Do(ns, fn)
+	}
+	withNetns := func(args map[string]string) map[string]string {
+		if ns != "" {
+			args["netns"] = ns
+		}
+		return args
+	}
+
+	if ns != "" {
+		if netns.Exists(ns) {
+			logging.Infof("используется существующий namespace %s", ns)
+		} else {
+			record(stepNetns, map[string]string{"name": ns})
+			if err := netns.Create(ns); err != nil {
+				fatalf("не удалось создать namespace: %v", err)
 			}
-		}()
-		log.Printf("запущен захват трафика в фаил: %s", *captureFile)
+			logging.Infof("создан namespace %s", ns)
+		}
+
+		link := network.NewNetnsLink(ns)
+		record(stepLink, map[string]string{"name": link.HostVeth})
+		if err := network.SetupNetnsLink(link); err != nil {
+			fatalf("не удалось подключить namespace к хосту: %v", err)
+		}
+
+		snapshot, err := sysctl.Take(forwardingSysctls...)
+		if err != nil {
+			fatalf("не удалось сохранить настройки sysctl: %v", err)
+		}
+		for _, v := range snapshot {
+			record(stepSysctl, map[string]string{"key": v.Key, "value": v.Value})
+		}
+		uplink := network.UplinkSpec{Iface: link.HostVeth, Subnets: link.Subnets()}
+		record(stepUplink, uplinkArgs(firewall.Name(), uplink))
+		if err := firewall.SetupUplink(uplink); err != nil {
+			fatalf("не удалось настроить nat для namespace: %v", err)
+		}
 	}
 
-	s, err := stack.NewGvisorStack(*tunName, *mtu)
+	// Шаг записывается после создания: интерфейс с тем же именем может
+	// принадлежать другому процессу, и откат не должен его удалить.
+	tun, err := network.CreateTunInterface(tunCfg.Name, tunCfg.MTU)
 	if err != nil {
-		log.Fatalf("не удалось создать сетевой стек: %v", err)
+		fatalf("не удалось создать tun-интерфейс: %v", err)
 	}
-	defer s.Close()
+	record(stepLink, map[string]string{"name": tunCfg.Name})
+	logging.Infof("создан tun-интерфейс: %s", tunCfg.Name)
 
-	beforeSettings := stack.GetCurrentFingerprint()
-	log.Printf("текущие настройки tcp до изменений: %+v", beforeSettings)
+	if ns != "" {
+		record(stepLink, withNetns(map[string]string{"name": tunCfg.Name}))
+		if err := network.MoveTunToNetns(tunCfg.Name, ns, tunCfg.MTU); err != nil {
+			fatalf("не удалось перенести tun-интерфейс: %v", err)
+		}
+		logging.Infof("tun-интерфейс %s перенесен в namespace %s", tunCfg.Name, ns)
+	}
 
-	if err := stack.ConfigureTCPFingerprint(s, *fingerprint, *windowSize, *ttl); err != nil {
-		log.Fatalf("не удалось настроить tcp-отпечаток: %v", err)
+	// Исходные значения sysctl сохраняются в журнал до правил, которые их
+	// меняют, и после настройки сравниваются с действующими.
+	var beforeSettings stack.Fingerprint
+	var snapshot sysctl.Snapshot
+	err = inNetns(func() error {
+		beforeSettings = stack.GetCurrentFingerprint(nil, forwardingSysctls...)
+		snapshot, err = sysctl.Take(forwardingSysctls...)
+		return err
+	})
+	if err != nil {
+		fatalf("не удалось сохранить настройки sysctl: %v", err)
+	}
+	for _, v := range snapshot {
+		record(stepSysctl, withNetns(map[string]string{"key": v.Key, "value": v.Value}))
 	}
-	log.Printf("настроен tcp-отпечаток для имитации ос: %s", *fingerprint)
 
-	afterSettings := stack.GetCurrentFingerprint()
-	log.Printf("настройки tcp после изминений: %+v", afterSettings)
+	record(stepFirewall, withNetns(ruleArgs(firewall.Name(), rules)))
+	if err := inNetns(func() error { return firewall.Setup(rules) }); err != nil {
+		fatalf("не удалось настроить правила %s: %v", firewall.Name(), err)
+	}
+	logging.Infof("правила %s настроены успешно", firewall.Name())
 
-	if err := s.StartNetworking(*localPort, *targetHost, *targetPort); err != nil {
-		log.Fatalf("не удалось запустить сетевой стек: %v", err)
+	record(stepRouting, withNetns(map[string]string{"tun": tunCfg.Name, "target": strings.Join(rules.TargetHosts, ",")}))
+	err = inNetns(func() error { return network.SetupRouting(tunCfg.Name, rules.TargetHosts) })
+	if err != nil {
+		fatalf("не удалось настроить маршрутизацию: %v", err)
 	}
-	log.Printf("запущен прокси на локальном порту %d", *localPort)
+	logging.Infof("маршрутизация настроена успешно")
 
-	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	l2tunnel := network.L2Tunnel{
+		Type:     cfg.Bonus.L2Tunnel.Type,
+		LocalIP:  cfg.Bonus.L2Tunnel.LocalIP,
+		RemoteIP: cfg.Bonus.L2Tunnel.RemoteIP,
+		ID:       cfg.Bonus.L2Tunnel.ID,
+	}
+	if l2tunnel.Type != "" {
+		record(stepLink, map[string]string{"name": l2tunnel.Name()})
+		if err := network.SetupL2Tunnel(l2tunnel); err != nil {
+			fatalf("не удалось создать l2-туннель: %v", err)
+		}
+	}
+
+	var capture *analyzer.Capture
+	if c := cfg.Capture; c.Enabled {
+		err := inNetns(func() (err error) {
+			capture, err = analyzer.StartCapture(tunCfg.Name, analyzer.CaptureOptions{
+				File:       c.File,
+				Duration:   time.Duration(c.Duration) * time.Second,
+				MaxPackets: c.MaxPackets,
+				RotateSize: int64(c.RotateSizeMB) << 20,
+				Filter:     c.Filter,
+			})
+			return err
+		})
+		if err != nil {
+			logging.Errorf("ошибка при захвате трафика: %v", err)
+		} else {
+			logging.Infof("запущен захват трафика в фаил: %s", c.File)
+		}
+	}
+
+	handshakeCtx, stopHandshakes := context.WithCancel(context.Background())
+	defer stopHandshakes()
+	if c := cfg.Capture; c.Handshakes {
+		var events <-chan analyzer.Handshake
+		err := inNetns(func() (err error) {
+			events, err = analyzer.CaptureHandshakes(handshakeCtx, tunCfg.Name, c.Filter)
+			return err
+		})
+		if err != nil {
+			logging.Errorf("ошибка при захвате рукопожатий: %v", err)
+		} else {
+			go logHandshakes(events)
+		}
+	}
+
+	s, err := stack.NewGvisorStack(tunCfg.Name, tun.Fd(), tunCfg.MTU)
+	if err != nil {
+		fatalf("не удалось создать сетевой стек: %v", err)
+	}
+	for _, n := range rules.SNAT {
+		if err := s.AddAddress(n.Stack); err != nil {
+			fatalf("не удалось добавить адрес сетевому стеку: %v", err)
+		}
+	}
+
+	if err := stack.ConfigureTCPOptions(s, opts); err != nil {
+		fatalf("не удалось настроить tcp-отпечаток: %v", err)
+	}
+	logging.Infof("настроен tcp-отпечаток для имитации ос: %s", cfg.Fingerprint.Type)
+	if selector != nil {
+		s.SetProfileSelector(selector)
+	}
+
+	var afterSettings stack.Fingerprint
+	inNetns(func() error {
+		afterSettings = stack.GetCurrentFingerprint(s, forwardingSysctls...)
+		return nil
+	})
+	logging.Infof("действующий tcp-отпечаток: %s", afterSettings)
+	if diff := stack.DiffFingerprint(stack.ProfileFingerprint(opts), afterSettings); len(diff) > 0 {
+		logging.Warnf("предупреждение: стек не совпадает с профилем %s: %s", opts.OSType, strings.Join(diff, ", "))
+	}
+	if diff := stack.DiffFingerprint(beforeSettings, afterSettings); len(diff) > 0 {
+		logging.Infof("глобальные настройки sysctl изменены: %s", strings.Join(diff, ", "))
+	} else {
+		logging.Infof("глобальные настройки sysctl не изменились")
+	}
+
+	var proxyListener net.Listener
+	var srv interface{ Serve(net.Listener) error }
+	switch mode {
+	case "socks5":
+		srv = &proxy.SOCKS5Server{Dialer: s, Users: cfg.Proxy.Users}
+	case "http":
+		srv = &proxy.HTTPServer{Dialer: s, Users: cfg.Proxy.Users}
+	case "transparent":
+		srv = &proxy.TransparentServer{Dialer: s}
+	}
+	if srv != nil {
+		proxyListener, err = net.Listen("tcp", fmt.Sprintf(":%d", lport))
+		if err != nil {
+			fatalf("не удалось запустить слушающий сокет: %v", err)
+		}
+		go func() {
+			if err := srv.Serve(proxyListener); err != nil {
+				logging.Errorf("%s: сервер остановлен: %v", mode, err)
+			}
+		}()
+		logging.Infof("запущен %s-прокси на локальном порту %d (аутентификация: %t)", mode, lport, len(cfg.Proxy.Users) > 0)
+	} else {
+		if err := s.StartMappings(mappings); err != nil {
+			fatalf("не удалось запустить сетевой стек: %v", err)
+		}
+		logging.Infof("запущено пересылок: %d", len(mappings))
+	}
+
+	// Правила перехвата ставятся на хосте, где работают перехватываемые
+	// процессы, и только после того, как прокси начал слушать.
+	if mode == "transparent" {
+		redirect := redirectSpec(tunCfg.Name, lport, cfg.Proxy.Transparent)
+		record(stepRedirect, redirectArgs(firewall.Name(), redirect))
+		if err := firewall.SetupRedirect(redirect); err != nil {
+			fatalf("не удалось настроить перехват соединений: %v", err)
+		}
+	}
 
 	fmt.Printf("\n======================================================\n")
 	fmt.Printf("Сервис запущен и готов к использованию!\n")
-	fmt.Printf("Для проверки подключитесь к localhost:%d\n", *localPort)
-	fmt.Printf("Трафик будет перенаправлен на %s:%d с измененным TCP-отпечатком\n", *targetHost, *targetPort)
+	switch mode {
+	case "socks5":
+		fmt.Printf("SOCKS5-прокси: localhost:%d (например, curl --socks5-hostname localhost:%d)\n", lport, lport)
+		fmt.Printf("Исходящие соединения получат измененный TCP-отпечаток\n")
+	case "http":
+		fmt.Printf("HTTP-прокси: http://localhost:%d (например, HTTPS_PROXY=http://localhost:%d)\n", lport, lport)
+		fmt.Printf("Исходящие соединения получат измененный TCP-отпечаток\n")
+	case "transparent":
+		fmt.Printf("Прозрачный режим: соединения выбранных процессов и подсетей перехватываются на порт %d\n", lport)
+		fmt.Printf("Исходящие соединения получат измененный TCP-отпечаток без настройки приложений\n")
+	default:
+		for _, m := range mappings {
+			fmt.Printf("%s -> %s\n", m.Listen, net.JoinHostPort(m.TargetHost, strconv.Itoa(m.TargetPort)))
+		}
+		fmt.Printf("Трафик будет перенаправлен с измененным TCP-отпечатком\n")
+	}
 	fmt.Printf("Нажмите Ctrl+C для завершения работы\n")
 	fmt.Printf("======================================================\n\n")
 
 	<-sigCh
-	log.Println("завершение работы...")
+	logging.Infof("завершение работы...")
 
 	time.Sleep(500 * time.Millisecond)
 
-	if err := network.CleanupIptables(*tunName, *targetHost, *localPort); err != nil {
-		log.Printf("ошибка при очистке правил iptables: %v", err)
-	} else {
-		log.Println("правила iptables очищены")
+	if proxyListener != nil {
+		proxyListener.Close()
 	}
-
-	if err := network.CleanupRouting(*tunName, *targetHost); err != nil {
-		log.Printf("ошыбка при очистке маршрутизации: %v", err)
-	} else {
-		log.Println("маршрутизация очищена")
+	stopHandshakes()
+	s.Close()
+	if capture != nil {
+		if err := capture.Stop(); err != nil {
+			logging.Errorf("ошибка при захвате трафика: %v", err)
+		}
+	}
+	if err := tun.Close(); err != nil {
+		logging.Errorf("ошибка при закрытии tun-интерфейса: %v", err)
 	}
+	rollback(j)
 
 	fmt.Println("Все ресурсы освобождены, программа завершена")
 }
+
+// logHandshakes пишет в лог рукопожатия из events до закрытия канала.
+func logHandshakes(events <-chan analyzer.Handshake) {
+	for h := range events {
+		if h.Complete() {
+			logging.Infof("рукопожатие %s ack=%s", h, h.ACKDelay)
+		} else {
+			logging.Warnf("предупреждение: рукопожатие %s", h)
+		}
+	}
+}
+
+// loadConfig читает -config (если задан) и накладывает поверх явно
+// указанные флаги.
+func loadConfig() (*config.Config, error) {
+	cfg := config.Default()
+	if *configFile != "" {
+		var err error
+		if cfg, err = config.Load(*configFile); err != nil {
+			return nil, err
+		}
+		logging.Infof("загружена конфигурация из %s", *configFile)
+	}
+
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "host":
+			cfg.Network.Target.Host = *targetHost
+		case "port":
+			cfg.Network.Target.Port = *targetPort
+		case "tun":
+			cfg.Network.Tun.Name = *tunName
+		case "mtu":
+			cfg.Network.Tun.MTU = *mtu
+		case "lport":
+			cfg.Network.Local.Port = *localPort
+		case "firewall":
+			cfg.Network.Firewall = *firewall
+		case "netns":
+			cfg.Network.Netns = *netnsName
+		case "capture":
+			cfg.Capture.Enabled = *captureFile != ""
+			cfg.Capture.File = *captureFile
+		case "capture-filter":
+			cfg.Capture.Filter = *captureFilt
+		case "log-handshakes":
+			cfg.Capture.Handshakes = *handshakes
+		case "window":
+			cfg.Fingerprint.Parameters.WindowSize = *windowSize
+		case "ttl":
+			cfg.Fingerprint.Parameters.TTL = *ttl
+		case "hop-limit":
+			cfg.Fingerprint.Parameters.HopLimit = *hopLimit
+		case "flow-label":
+			cfg.Fingerprint.Parameters.FlowLabel = *flowLabel
+		case "fp":
+			cfg.Fingerprint.Type = *fingerprint
+		case "p0f":
+			cfg.Fingerprint.P0fFile = *p0fFile
+		case "profile-file":
+			cfg.Fingerprint.ProfileFiles = splitList(*profileFile)
+		case "profile-dir":
+			cfg.Fingerprint.ProfileDir = *profileDir
+		case "mode":
+			cfg.Proxy.Mode = *proxyMode
+		case "redirect-uids":
+			cfg.Proxy.Transparent.UIDs = nil
+			for _, v := range splitList(*redirUIDs) {
+				// Нечисловой uid превращается в -1 и не проходит Validate.
+				uid, err := strconv.Atoi(v)
+				if err != nil {
+					uid = -1
+				}
+				cfg.Proxy.Transparent.UIDs = append(cfg.Proxy.Transparent.UIDs, uid)
+			}
+		case "redirect-cgroups":
+			cfg.Proxy.Transparent.Cgroups = splitList(*redirCgroup)
+		case "redirect-sources":
+			cfg.Proxy.Transparent.Sources = splitList(*redirSrc)
+		case "rotate":
+			cfg.Fingerprint.Rotation.Profiles = nil
+			for _, v := range splitList(*rotate) {
+				// Нечисловой вес превращается в -1 и не проходит Validate.
+				name, weight, hasWeight := strings.Cut(v, ":")
+				w := 1
+				if hasWeight {
+					var err error
+					if w, err = strconv.Atoi(weight); err != nil {
+						w = -1
+					}
+				}
+				cfg.Fingerprint.Rotation.Profiles = append(cfg.Fingerprint.Rotation.Profiles,
+					config.WeightedProfileConfig{Profile: name, Weight: w})
+			}
+		case "rotate-mode":
+			cfg.Fingerprint.Rotation.Mode = *rotateMode
+		case "rotate-interval":
+			cfg.Fingerprint.Rotation.Interval = *rotateEvery
+		case "seed":
+			cfg.Fingerprint.Rotation.Seed = *seed
+		case "proxy-auth":
+			// Строка без двоеточия дает пустой пароль, и Validate ее отклонит.
+			user, pass, _ := strings.Cut(*proxyAuth, ":")
+			cfg.Proxy.Users = map[string]string{user: pass}
+		}
+	})
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func fingerprintOptions(fp config.FingerprintConfig, mtu int) (*stack.TCPOptions, error) {
+	p := fp.Parameters
+	opts, err := stack.GetTCPOptions(fp.Type, p.WindowSize, p.TTL)
+	if err != nil {
+		return nil, err
+	}
+
+	if p.MSS > 0 {
+		opts.MSS = uint16(p.MSS)
+	}
+	if p.TimestampsEnabled != nil {
+		opts.SetOptionEnabled(stack.OptionTS, *p.TimestampsEnabled)
+	}
+	if p.WindowScaleEnabled != nil {
+		opts.SetOptionEnabled(stack.OptionWS, *p.WindowScaleEnabled)
+	}
+	if p.WindowScaleValue != nil {
+		opts.WindowScaleValue = uint8(*p.WindowScaleValue)
+	}
+	if p.HopLimit > 0 {
+		opts.HopLimit = uint8(p.HopLimit)
+	}
+	if p.FlowLabel != "" {
+		opts.FlowLabel, err = stack.ParseFlowLabelMode(p.FlowLabel)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := opts.Validate(mtu); err != nil {
+		return nil, fmt.Errorf("профиль %s: %w", fp.Type, err)
+	}
+	return opts, nil
+}
+
+// profileSelector строит выбор профиля по fingerprint.rules и
+// fingerprint.rotation. Профиль fingerprint.type берется с
+// fingerprint.parameters (opts), остальные - без переопределений. Если
+// отклонения полей не заданы, для fingerprint.type остается профиль стека.
+func profileSelector(fp config.FingerprintConfig, opts *stack.TCPOptions, mtu int) (stack.ProfileSelector, error) {
+	rot := fp.Rotation
+	if len(fp.Rules) == 0 && !rot.Enabled() {
+		return nil, nil
+	}
+	pol := &policy.Policy{Default: fp.Type}
+	for i, r := range fp.Rules {
+		rule, err := r.Rule()
+		if err != nil {
+			return nil, fmt.Errorf("правило %d: %w", i+1, err)
+		}
+		pol.Rules = append(pol.Rules, rule)
+	}
+	if len(pol.Rules) > 0 {
+		logging.Infof("профиль соединений выбирается по %d правилам", len(pol.Rules))
+	}
+
+	jitter := stack.Jitter{MaxHops: rot.Jitter.MaxHops}
+	if wm := rot.Jitter.WindowMSS; len(wm) == 2 {
+		jitter.WindowMSSMin, jitter.WindowMSSMax = wm[0], wm[1]
+	}
+	if rot.Enabled() {
+		weighted := []policy.Weighted{{Profile: fp.Type, Weight: 1}}
+		if len(rot.Profiles) > 0 {
+			weighted = weighted[:0]
+			for _, w := range rot.Profiles {
+				weighted = append(weighted, policy.Weighted{Profile: w.Profile, Weight: w.Weight})
+			}
+		}
+		mode, err := policy.ParseRotationMode(rot.Mode)
+		if err != nil {
+			return nil, err
+		}
+		seed := rot.Seed
+		if seed == 0 {
+			seed = rand.Uint64()
+		}
+		if pol.Rotation, err = policy.NewRotation(mode, rot.Interval, weighted, seed); err != nil {
+			return nil, err
+		}
+		logging.Infof("ротация профилей %v в режиме %s, seed %d", weighted, mode, seed)
+	}
+
+	profiles := map[string]*stack.TCPOptions{fp.Type: opts}
+	for _, name := range pol.Profiles() {
+		if profiles[name] != nil {
+			continue
+		}
+		p, err := stack.GetTCPOptions(name, 0, 0)
+		if err != nil {
+			return nil, err
+		}
+		if err := p.Validate(mtu); err != nil {
+			return nil, fmt.Errorf("профиль %s: %w", name, err)
+		}
+		profiles[name] = p
+	}
+
+	return func(req policy.Request) *stack.TCPOptions {
+		choice := pol.Select(req)
+		p := profiles[choice.Profile]
+		if choice.Rand != nil && jitter.Enabled() {
+			p = jitter.Apply(p, choice.Rand)
+		} else if choice.Profile == fp.Type {
+			p = nil
+		}
+		if p != nil {
+			logging.Infof("соединение с %s (%s) порт %d: профиль %s, окно %s, ttl %d",
+				req.Host, req.Addr, req.Port, choice.Profile, p.Window, p.TTL)
+		} else {
+			logging.Infof("соединение с %s (%s) порт %d: профиль %s", req.Host, req.Addr, req.Port, choice.Profile)
+		}
+		return p
+	}, nil
+}
+
+// forwardMappings строит пересылки режима forward и правила для них. Без
+// network.mappings пересылка одна: с local.port на network.target. Цели
+// разрешаются заранее, чтобы правила, маршруты и стек использовали один и
+// тот же адрес.
+func forwardMappings(cfg *config.Config, tunName string) ([]stack.Mapping, network.RuleSpec, error) {
+	rules := network.RuleSpec{TunName: tunName}
+	entries := cfg.Network.Mappings
+	if len(entries) == 0 {
+		entries = []config.MappingConfig{{
+			Listen: fmt.Sprintf(":%d", cfg.Network.Local.Port),
+			Target: net.JoinHostPort(cfg.Network.Target.Host, strconv.Itoa(cfg.Network.Target.Port)),
+		}}
+	}
+
+	var mappings []stack.Mapping
+	for i, e := range entries {
+		_, listenPort, _ := net.SplitHostPort(e.Listen)
+		host, portStr, _ := net.SplitHostPort(e.Target)
+		lport, _ := strconv.Atoi(listenPort)
+		port, _ := strconv.Atoi(portStr)
+
+		m := stack.Mapping{Listen: e.Listen, TargetPort: port}
+		var source netip.Addr
+		if e.Source != "" {
+			source = netip.MustParseAddr(e.Source)
+		}
+		target, err := network.ResolveTargetFamily(host, source)
+		if err != nil {
+			return nil, rules, fmt.Errorf("пересылка %s: %w", e.Listen, err)
+		}
+		m.TargetHost = target.String()
+
+		if e.Fingerprint != "" {
+			m.Dial.TCP, err = stack.GetTCPOptions(e.Fingerprint, 0, 0)
+			if err == nil {
+				err = m.Dial.TCP.Validate(cfg.Network.Tun.MTU)
+			}
+			if err != nil {
+				return nil, rules, fmt.Errorf("пересылка %s: %w", e.Listen, err)
+			}
+		}
+		if source.IsValid() {
+			m.Dial.Source = network.SourceStackAddr(len(rules.SNAT), source.Is6())
+			rules.SNAT = append(rules.SNAT, network.SNAT{Stack: m.Dial.Source, Source: source})
+		}
+
+		logging.Infof("пересылка %d: %s -> %s (%s)", i+1, e.Listen, net.JoinHostPort(host, portStr), m.TargetHost)
+		mappings = append(mappings, m)
+		rules.TargetHosts = append(rules.TargetHosts, m.TargetHost)
+		rules.LocalPorts = append(rules.LocalPorts, lport)
+	}
+	return mappings, rules, nil
+}
+
+// redirectSpec собирает правила перехвата из уже проверенной конфигурации.
+func redirectSpec(tun string, lport int, tp config.TransparentConfig) network.RedirectSpec {
+	spec := network.RedirectSpec{TunName: tun, LocalPort: lport, Cgroups: tp.Cgroups}
+	for _, uid := range tp.UIDs {
+		spec.UIDs = append(spec.UIDs, uint32(uid))
+	}
+	for _, src := range tp.Sources {
+		spec.Sources = append(spec.Sources, netip.MustParsePrefix(src))
+	}
+	return spec
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"custom-tcp-fingerprint/internal/analyzer"
+	"custom-tcp-fingerprint/internal/logging"
+	"custom-tcp-fingerprint/internal/stack"
+)
+
+func runProfile(args []string) int {
+	if len(args) > 0 {
+		switch args[0] {
+		case "list":
+			return runProfileList(args[1:])
+		case "show":
+			return runProfileShow(args[1:])
+		case "learn":
+			return runProfileLearn(args[1:])
+		}
+	}
+	fmt.Fprintf(os.Stderr, "Usage: %s profile list|show|learn [flags]\n", os.Args[0])
+	return 2
+}
+
+// loadProfiles дополняет встроенные профили каталогом dir и файлами files;
+// одноименный профиль из более позднего источника заменяет прежний.
+func loadProfiles(dir string, files []string) error {
+	if dir != "" {
+		names, err := stack.LoadProfileDir(dir)
+		if err != nil {
+			return err
+		}
+		logging.Infof("загружено %d профилей из %s", len(names), dir)
+	}
+	for _, path := range files {
+		p, err := stack.LoadProfileFile(path)
+		if err != nil {
+			return err
+		}
+		logging.Infof("загружен профиль %s из %s", p.Name, path)
+	}
+	return nil
+}
+
+// profileSourceFlags добавляет флаги источников профилей и возвращает
+// функцию, которая их загружает.
+func profileSourceFlags(fs *flag.FlagSet) func() error {
+	dir := fs.String("profile-dir", "", "Directory of YAML/JSON profile files")
+	files := fs.String("profile-file", "", "Comma-separated profile files")
+	return func() error {
+		return loadProfiles(*dir, splitList(*files))
+	}
+}
+
+func runProfileList(args []string) int {
+	fs := flag.NewFlagSet("profile list", flag.ExitOnError)
+	load := profileSourceFlags(fs)
+	dbFile := fs.String("p0f", "", "Also list labels of this p0f v3 database")
+	fs.Parse(args)
+
+	if err := load(); err != nil {
+		logging.Errorf("не удалось загрузить профиль: %v", err)
+		return 1
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tEXTENDS\tTTL\tWIN\tRCVBUF\tMSS\tWS\tOPTIONS\tSOURCE")
+	for _, name := range stack.DefaultRegistry.Names() {
+		p, err := stack.DefaultRegistry.Resolve(name)
+		if err != nil {
+			logging.Errorf("ошибка профиля %s: %v", name, err)
+			return 1
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\t%d\t%d\t%s\t%s\n", p.Name, dashIfEmpty(p.Extends),
+			p.TTL, p.Window, dashIfZero(p.ReceiveBuffer), p.MSS, p.WindowScale, p.Options, stack.DefaultRegistry.Source(name))
+	}
+
+	if *dbFile != "" {
+		if err := stack.LoadP0fProfiles(*dbFile); err != nil {
+			logging.Errorf("не удалось загрузить базу p0f: %v", err)
+			return 1
+		}
+		for _, label := range stack.P0fProfileLabels() {
+			opts, err := stack.GetTCPOptions(label, 0, 0)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(tw, "%s\t-\t%d\t%s\t%s\t%d\t%d\t%s\t%s\n", label,
+				opts.TTL, opts.Window, dashIfZero(opts.ReceiveBuffer), opts.MSS, opts.WindowScaleValue, opts.Layout(), *dbFile)
+		}
+	}
+	tw.Flush()
+	return 0
+}
+
+// runProfileShow печатает профиль с учетом extends в формате файла
+// профиля.
+func runProfileShow(args []string) int {
+	fs := flag.NewFlagSet("profile show", flag.ExitOnError)
+	load := profileSourceFlags(fs)
+	asJSON := fs.Bool("json", false, "Print the profile as JSON")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s profile show [flags] name\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	if err := load(); err != nil {
+		logging.Errorf("не удалось загрузить профиль: %v", err)
+		return 1
+	}
+
+	p, err := stack.DefaultRegistry.Resolve(fs.Arg(0))
+	if err == nil {
+		_, err = p.TCPOptions()
+	}
+	if err != nil {
+		logging.Errorf("ошибка профиля: %v", err)
+		return 1
+	}
+
+	var data []byte
+	if *asJSON {
+		data, err = json.MarshalIndent(p, "", "  ")
+		data = append(data, '\n')
+	} else {
+		data, err = p.Marshal()
+	}
+	if err != nil {
+		logging.Errorf("ошибка вывода профиля: %v", err)
+		return 1
+	}
+	os.Stdout.Write(data)
+	return 0
+}
+
+func dashIfEmpty(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func dashIfZero(n int) string {
+	if n == 0 {
+		return "-"
+	}
+	return strconv.Itoa(n)
+}
+
+// runProfileLearn выводит профиль из захвата настоящей ОС и пишет его в
+// формате, который читает реестр профилей.
+func runProfileLearn(args []string) int {
+	fs := flag.NewFlagSet("profile learn", flag.ExitOnError)
+	output := fs.String("o", "", "Write the profile to this file instead of stdout")
+	name := fs.String("name", "", "Profile name (default - output file name without extension)")
+	source := fs.String("src", "", "Address of the host to learn (default - the source of most SYNs)")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s profile learn [flags] ref.pcap\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	opts := analyzer.LearnOptions{Name: *name}
+	if opts.Name == "" && *output != "" {
+		opts.Name = strings.TrimSuffix(filepath.Base(*output), filepath.Ext(*output))
+	}
+	if opts.Name == "" {
+		opts.Name = "learned"
+	}
+	if *source != "" {
+		addr, err := netip.ParseAddr(*source)
+		if err != nil {
+			logging.Errorf("некорректный адрес в -src: %v", err)
+			return 2
+		}
+		opts.Source = addr
+	}
+
+	p, err := analyzer.LearnProfile(fs.Arg(0), opts)
+	if err != nil {
+		logging.Errorf("не удалось вывести профиль: %v", err)
+		return 1
+	}
+	data, err := p.Marshal()
+	if err != nil {
+		logging.Errorf("не удалось сохранить профиль: %v", err)
+		return 1
+	}
+
+	if *output == "" {
+		os.Stdout.Write(data)
+		return 0
+	}
+	if err := os.WriteFile(*output, data, 0o644); err != nil {
+		logging.Errorf("не удалось сохранить профиль: %v", err)
+		return 1
+	}
+	logging.Infof("профиль %s по %d SYN от %s записан в %s", p.Name, p.Observed.SYNs, p.Observed.Source, *output)
+	return 0
+}
@@ -0,0 +1,433 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"syscall"
+	"text/tabwriter"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+
+	"custom-tcp-fingerprint/internal/analyzer"
+	"custom-tcp-fingerprint/internal/journal"
+	"custom-tcp-fingerprint/internal/logging"
+	"custom-tcp-fingerprint/internal/netns"
+	"custom-tcp-fingerprint/internal/network"
+	"custom-tcp-fingerprint/internal/rtnl"
+	"custom-tcp-fingerprint/internal/stack"
+)
+
+var (
+	verifyHostAddr  = netip.MustParseAddr("10.200.0.1")
+	verifySinkAddr  = netip.MustParseAddr("10.200.0.2")
+	verifyHostAddr6 = netip.MustParseAddr("fd00:200::1")
+	verifySinkAddr6 = netip.MustParseAddr("fd00:200::2")
+)
+
+const verifySinkPort = 9
+
+func runVerify(args []string) int {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	fp := fs.String("fp", "windows", "TCP fingerprint to verify: a profile name (see profile list) or a p0f label")
+	window := fs.Int("window", 0, "TCP Window Size (0 - profile default)")
+	ttlValue := fs.Int("ttl", 0, "IP Time to Live (TTL) (0 - profile default)")
+	dbFile := fs.String("p0f", "", "p0f v3 fingerprint database (p0f.fp) with extra profiles")
+	profileFiles := fs.String("profile-file", "", "Comma-separated profile files usable by name in -fp")
+	profileDir := fs.String("profile-dir", "", "Directory of YAML/JSON profile files usable by name in -fp")
+	tunIface := fs.String("tun", "tcv0", "TUN interface name")
+	mtuValue := fs.Int("mtu", 1500, "Maximum Transmission Unit (MTU)")
+	lport := fs.Int("lport", 18080, "Local proxy port")
+	firewallName := fs.String("firewall", network.BackendNftables, "Firewall rule backend (nftables, iptables)")
+	timeout := fs.Duration("timeout", 10*time.Second, "Time to wait for the SYN to arrive")
+	useIPv6 := fs.Bool("ipv6", false, "Verify the IPv6 SYN instead of the IPv4 one")
+	fs.Parse(args)
+
+	sinkAddr := verifySinkAddr.String()
+	if *useIPv6 {
+		sinkAddr = verifySinkAddr6.String()
+	}
+
+	if os.Geteuid() != 0 {
+		logging.Errorf("эта программа должна запускатся с правами суперпользователя (sudo)")
+		return 1
+	}
+
+	if *dbFile != "" {
+		if err := stack.LoadP0fProfiles(*dbFile); err != nil {
+			logging.Errorf("не удалось загрузить базу p0f: %v", err)
+			return 1
+		}
+	}
+	if err := loadProfiles(*profileDir, splitList(*profileFiles)); err != nil {
+		logging.Errorf("не удалось загрузить профиль: %v", err)
+		return 1
+	}
+
+	opts, err := stack.GetTCPOptions(*fp, *window, *ttlValue)
+	if err == nil {
+		err = opts.Validate(*mtuValue)
+	}
+	if err != nil {
+		logging.Errorf("не удалось получить tcp опции: %v", err)
+		return 1
+	}
+
+	// Шаги отката пишутся в журнал, как в основном режиме: после kill -9
+	// namespace, veth и правила убирает tcpcustom cleanup.
+	j, err := journal.Create(journal.DefaultDir)
+	if err != nil {
+		logging.Errorf("не удалось создать журнал изменений: %v", err)
+		return 1
+	}
+	defer rollback(j)
+
+	sink, err := newVerifySink(j, *useIPv6)
+	if err != nil {
+		logging.Errorf("не удалось запустить приемник: %v", err)
+		return 1
+	}
+	defer sink.Close()
+
+	tun, err := network.CreateTunInterface(*tunIface, *mtuValue)
+	if err != nil {
+		logging.Errorf("не удалось создать tun-интерфейс: %v", err)
+		return 1
+	}
+	defer tun.Close()
+	if err := j.Record(stepLink, map[string]string{"name": *tunIface}); err != nil {
+		logging.Errorf("не удалось записать журнал изменений: %v", err)
+		return 1
+	}
+
+	firewall, err := network.NewRuleBackend(*firewallName)
+	if err != nil {
+		logging.Errorf("ошибка: %v", err)
+		return 1
+	}
+	rules := network.RuleSpec{TunName: *tunIface, TargetHosts: []string{sinkAddr}, LocalPorts: []int{*lport}}
+	if err := j.Record(stepFirewall, ruleArgs(firewall.Name(), rules)); err != nil {
+		logging.Errorf("не удалось записать журнал изменений: %v", err)
+		return 1
+	}
+	if err := firewall.Setup(rules); err != nil {
+		logging.Errorf("не удалось настроить правила %s: %v", firewall.Name(), err)
+		return 1
+	}
+
+	if err := j.Record(stepRouting, map[string]string{"tun": *tunIface, "target": sinkAddr}); err != nil {
+		logging.Errorf("не удалось записать журнал изменений: %v", err)
+		return 1
+	}
+	if err := network.SetupRouting(*tunIface, rules.TargetHosts); err != nil {
+		logging.Errorf("не удалось настроить маршрутизацию: %v", err)
+		return 1
+	}
+
+	s, err := stack.NewGvisorStack(*tunIface, tun.Fd(), *mtuValue)
+	if err != nil {
+		logging.Errorf("не удалось создать сетевой стек: %v", err)
+		return 1
+	}
+	defer s.Close()
+
+	if err := stack.ConfigureTCPFingerprint(s, *fp, *window, *ttlValue); err != nil {
+		logging.Errorf("не удалось настроить tcp-отпечаток: %v", err)
+		return 1
+	}
+
+	if err := s.StartNetworking(*lport, sinkAddr, verifySinkPort); err != nil {
+		logging.Errorf("не удалось запустить сетевой стек: %v", err)
+		return 1
+	}
+
+	client, err := net.DialTimeout("tcp", fmt.Sprintf("127.0.0.1:%d", *lport), *timeout)
+	if err != nil {
+		logging.Errorf("не удалось подключиться к прокси: %v", err)
+		return 1
+	}
+	defer client.Close()
+	client.Write([]byte("tcpcustom verify\n"))
+
+	syn, err := sink.WaitSYN(*timeout)
+	if err != nil {
+		logging.Errorf("SYN не получен: %v", err)
+		return 1
+	}
+
+	seg, ok := analyzer.DecodeIP(syn)
+	if !ok {
+		logging.Errorf("не удалось разобрать полученный SYN: %x", syn)
+		return 1
+	}
+
+	rows := compareSYN(opts, seg)
+	failed := printVerifyTable(os.Stdout, rows)
+	if failed > 0 {
+		logging.Errorf("отпечаток %s не совпал: %d полей отличаются", opts.OSType, failed)
+		return 1
+	}
+
+	logging.Infof("отпечаток %s совпал по всем полям", opts.OSType)
+	return 0
+}
+
+type verifyRow struct {
+	field    string
+	expected string
+	actual   string
+	ok       bool
+}
+
+func compareSYN(opts *stack.TCPOptions, seg *analyzer.TCPSegment) []verifyRow {
+	var rows []verifyRow
+	add := func(field, expected, actual string) {
+		rows = append(rows, verifyRow{field: field, expected: expected, actual: actual, ok: expected == actual})
+	}
+
+	layout := opts.Layout()
+
+	ipv6 := seg.IPVersion == 6
+	if ipv6 {
+		add("hop limit", strconv.Itoa(int(opts.IPv6HopLimit())), strconv.Itoa(int(seg.TTL)))
+	} else {
+		add("ttl", strconv.Itoa(int(opts.TTL)), strconv.Itoa(int(seg.TTL)))
+	}
+	add("window", strconv.Itoa(int(opts.SYNWindow(ipv6))), strconv.Itoa(int(seg.Window)))
+
+	expectedMSS := "-"
+	if layout.Has(stack.OptionMSS) {
+		expectedMSS = strconv.Itoa(int(opts.MSS))
+		if ipv6 {
+			expectedMSS = strconv.Itoa(int(opts.IPv6MSS()))
+		}
+	}
+	add("mss", expectedMSS, optionalInt(seg.MSS))
+
+	expectedScale := "-"
+	if layout.Has(stack.OptionWS) {
+		expectedScale = strconv.Itoa(int(opts.WindowScaleValue))
+	}
+	add("wscale", expectedScale, optionalInt(seg.WindowScale))
+
+	add("options", layout.String(), seg.OptionLayout)
+
+	// В ipv6 нет DF и ip id, вместо них сравнивается flow label.
+	if ipv6 {
+		actualLabel := "0"
+		if seg.FlowLabel != 0 {
+			actualLabel = "!=0"
+		}
+		switch opts.FlowLabel {
+		case stack.FlowLabelZero:
+			add("flow label", "0", actualLabel)
+		case stack.FlowLabelRandom:
+			add("flow label", "!=0", actualLabel)
+		}
+		return rows
+	}
+
+	add("df", strconv.FormatBool(opts.DontFragment), strconv.FormatBool(seg.DF))
+
+	actualID := "0"
+	if seg.IPID != 0 {
+		actualID = "!=0"
+	}
+	switch opts.IPID {
+	case stack.IPIDZero:
+		add("ip id", "0", actualID)
+	case stack.IPIDIncrement, stack.IPIDRandom:
+		add("ip id", "!=0", actualID)
+	}
+
+	return rows
+}
+
+func optionalInt(v int) string {
+	if v < 0 {
+		return "-"
+	}
+	return strconv.Itoa(v)
+}
+
+func printVerifyTable(w io.Writer, rows []verifyRow) int {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "FIELD\tEXPECTED\tACTUAL\tRESULT")
+
+	failed := 0
+	for _, row := range rows {
+		result := "OK"
+		if !row.ok {
+			result = "MISMATCH"
+			failed++
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", row.field, row.expected, row.actual, result)
+	}
+	tw.Flush()
+	return failed
+}
+
+// verifySink - tcp-приемник в отдельном network namespace, соединенном с
+// хостом парой veth. Ядро сохраняет SYN каждого входящего соединения
+// (TCP_SAVE_SYN), поэтому захват трафика не нужен.
+type verifySink struct {
+	netns    string
+	listener net.Listener
+	syns     chan []byte
+}
+
+// newVerifySink создает namespace приемника и пару veth. Шаги отката
+// пишутся в журнал до изменений, чтобы tcpcustom cleanup убрал их после
+// kill -9; veth со стороны namespace удаляется вместе с ним.
+func newVerifySink(j *journal.Journal, ipv6 bool) (*verifySink, error) {
+	pid := os.Getpid()
+	sink := &verifySink{
+		netns: fmt.Sprintf("tcpcustom-verify-%d", pid),
+		syns:  make(chan []byte, 1),
+	}
+	hostVeth := fmt.Sprintf("tcvh%d", pid)
+	sinkVeth := fmt.Sprintf("tcvs%d", pid)
+
+	if err := j.Record(stepNetns, map[string]string{"name": sink.netns}); err != nil {
+		return nil, err
+	}
+	if err := netns.Create(sink.netns); err != nil {
+		return nil, err
+	}
+	ns, err := netns.Open(sink.netns)
+	if err != nil {
+		return nil, err
+	}
+	defer ns.Close()
+
+	if err := j.Record(stepLink, map[string]string{"name": hostVeth}); err != nil {
+		return nil, err
+	}
+	if err := rtnl.EnsureVeth(hostVeth, sinkVeth, int(ns.Fd())); err != nil {
+		return nil, fmt.Errorf("не удалось создать пару veth: %w", err)
+	}
+
+	hostAddrs := []netip.Prefix{netip.PrefixFrom(verifyHostAddr, 30)}
+	sinkAddrs := []netip.Prefix{netip.PrefixFrom(verifySinkAddr, 30)}
+	routes := []rtnl.Route{{Dst: netip.PrefixFrom(netip.IPv4Unspecified(), 0), Gateway: verifyHostAddr, Dev: sinkVeth}}
+	sinkAddr := verifySinkAddr
+	if ipv6 {
+		sinkAddr = verifySinkAddr6
+		hostAddrs = append(hostAddrs, netip.PrefixFrom(verifyHostAddr6, 64))
+		sinkAddrs = append(sinkAddrs, netip.PrefixFrom(verifySinkAddr6, 64))
+		routes = append(routes, rtnl.Route{Dst: netip.PrefixFrom(netip.IPv6Unspecified(), 0), Gateway: verifyHostAddr6, Dev: sinkVeth})
+	}
+	for _, prefix := range hostAddrs {
+		if err := rtnl.EnsureAddr(hostVeth, prefix); err != nil {
+			return nil, err
+		}
+	}
+
+	err = netns.Do(sink.netns, func() error {
+		if err := rtnl.EnsureLinkUp("lo", 0); err != nil {
+			return err
+		}
+		if err := rtnl.EnsureLinkUp(sinkVeth, 0); err != nil {
+			return err
+		}
+		for _, prefix := range sinkAddrs {
+			if err := rtnl.EnsureAddr(sinkVeth, prefix); err != nil {
+				return err
+			}
+		}
+		for _, route := range routes {
+			if err := rtnl.EnsureRoute(route); err != nil {
+				return err
+			}
+		}
+
+		// Сокет остается в namespace, в котором создан.
+		lc := net.ListenConfig{Control: func(network, address string, c syscall.RawConn) error {
+			var serr error
+			if err := c.Control(func(fd uintptr) {
+				serr = unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_SAVE_SYN, 1)
+			}); err != nil {
+				return err
+			}
+			return serr
+		}}
+		l, err := lc.Listen(context.Background(), "tcp", netip.AddrPortFrom(sinkAddr, verifySinkPort).String())
+		sink.listener = l
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("не удалось настроить namespace %s: %w", sink.netns, err)
+	}
+	logging.Infof("приемник запущен в namespace %s на %s", sink.netns, sink.listener.Addr())
+
+	go sink.serve()
+	return sink, nil
+}
+
+func (v *verifySink) serve() {
+	for {
+		conn, err := v.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		syn, err := savedSYN(conn.(*net.TCPConn))
+		if err != nil {
+			logging.Errorf("не удалось получить сохраненный SYN: %v", err)
+		} else {
+			select {
+			case v.syns <- syn:
+			default:
+			}
+		}
+
+		go func() {
+			io.Copy(io.Discard, conn)
+			conn.Close()
+		}()
+	}
+}
+
+func (v *verifySink) WaitSYN(timeout time.Duration) ([]byte, error) {
+	select {
+	case syn := <-v.syns:
+		return syn, nil
+	case <-time.After(timeout):
+		return nil, errors.New("истекло время ожидания")
+	}
+}
+
+// Close закрывает сокет приемника; namespace и veth удаляет откат журнала.
+func (v *verifySink) Close() {
+	v.listener.Close()
+}
+
+func savedSYN(conn *net.TCPConn) ([]byte, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 512)
+	size := uint32(len(buf))
+	var errno syscall.Errno
+	err = raw.Control(func(fd uintptr) {
+		_, _, errno = unix.Syscall6(unix.SYS_GETSOCKOPT, fd, unix.IPPROTO_TCP, unix.TCP_SAVED_SYN,
+			uintptr(unsafe.Pointer(&buf[0])), uintptr(unsafe.Pointer(&size)), 0)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if errno != 0 {
+		return nil, errno
+	}
+	return buf[:size], nil
+}
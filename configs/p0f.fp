@@ -0,0 +1,58 @@
+;
+; Подборка SYN-сигнатур в формате p0f v3 (p0f.fp).
+; Используется флагом -p0f; полную базу можно взять из дистрибутива p0f.
+;
+; sig = ver:ittl:olen:mss:wsize,scale:olayout:quirks:pclass
+;
+
+[tcp:request]
+
+label = s:unix:Linux:3.11 and newer
+sig   = *:64:0:*:mss*20,10:mss,sok,ts,nop,ws:df,id+:0
+sig   = *:64:0:*:mss*20,7:mss,sok,ts,nop,ws:df,id+:0
+
+label = s:unix:Linux:3.1-3.10
+sig   = *:64:0:*:mss*10,4:mss,sok,ts,nop,ws:df,id+:0
+sig   = *:64:0:*:mss*10,7:mss,sok,ts,nop,ws:df,id+:0
+
+label = s:unix:Linux:2.6.x
+sig   = *:64:0:*:mss*4,6:mss,sok,ts,nop,ws:df,id+:0
+sig   = *:64:0:*:mss*4,7:mss,sok,ts,nop,ws:df,id+:0
+
+label = s:win:Windows:10 or 11
+sig   = *:128:0:*:64240,8:mss,nop,ws,nop,nop,sok:df,id+:0
+sig   = *:128:0:*:65535,8:mss,nop,ws,nop,nop,sok:df,id+:0
+
+label = s:win:Windows:7 or 8
+sig   = *:128:0:*:8192,8:mss,nop,ws,nop,nop,sok:df,id+:0
+sig   = *:128:0:*:8192,2:mss,nop,ws,nop,nop,sok:df,id+:0
+sig   = *:128:0:*:8192,0:mss,nop,nop,sok:df,id+:0
+sig   = *:128:0:*:8192,2:mss,nop,ws,sok,ts:df,id+:0
+
+label = s:win:Windows:XP
+sig   = *:128:0:*:16384,0:mss,nop,nop,sok:df,id+:0
+sig   = *:128:0:*:65535,0:mss,nop,nop,sok:df,id+:0
+
+label = s:unix:Mac OS X:10.x
+sig   = *:64:0:*:65535,1:mss,nop,ws,nop,nop,ts,sok,eol+1:df,id+:0
+sig   = *:64:0:*:65535,3:mss,nop,ws,nop,nop,ts,sok,eol+1:df,id+:0
+
+label = s:unix:Mac OS X:11 or newer
+sig   = *:64:0:*:65535,6:mss,nop,ws,nop,nop,ts,sok,eol+1:df,id+:0
+
+label = s:unix:FreeBSD:9.x or newer
+sig   = *:64:0:*:65535,6:mss,nop,ws,sok,ts:df,id+:0
+
+[tcp:response]
+
+label = s:unix:Linux:3.x
+sig   = *:64:0:*:mss*10,0:mss:df:0
+sig   = *:64:0:*:mss*10,0:mss,sok,ts:df:0
+sig   = *:64:0:*:mss*10,0:mss,nop,nop,sok:df:0
+sig   = *:64:0:*:mss*10,0:mss,nop,ws:df:0
+
+label = s:win:Windows:7 or 8
+sig   = *:128:0:*:8192,0:mss:df,id+:0
+sig   = *:128:0:*:8192,0:mss,sok,ts:df,id+:0
+sig   = *:128:0:*:8192,8:mss,nop,ws:df,id+:0
+sig   = *:128:0:*:8192,0:mss,nop,nop,sok:df,id+:0
@@ -1,11 +1,23 @@
 module custom-tcp-fingerprint
 
-go 1.23.1
+go 1.26.3
 
-require gvisor.dev/gvisor v0.0.0-20250411205413-9cc0e9f85e6f
+require (
+	github.com/google/nftables v0.3.0
+	github.com/vishvananda/netlink v1.3.1
+	golang.org/x/sys v0.43.0
+	gopkg.in/yaml.v3 v3.0.1
+	gvisor.dev/gvisor v0.0.0-20260527191743-a81fd9dd382e
+)
 
 require (
 	github.com/google/btree v1.1.2 // indirect
-	golang.org/x/sys v0.32.0 // indirect
-	golang.org/x/time v0.7.0 // indirect
+	github.com/google/go-cmp v0.7.0 // indirect
+	github.com/mdlayher/netlink v1.7.3-0.20250113171957-fbb4dce95f42 // indirect
+	github.com/mdlayher/socket v0.5.1 // indirect
+	github.com/vishvananda/netns v0.0.5 // indirect
+	golang.org/x/exp v0.0.0-20250711185948-6ae5c78190dc // indirect
+	golang.org/x/net v0.52.0 // indirect
+	golang.org/x/sync v0.20.0 // indirect
+	golang.org/x/time v0.15.0 // indirect
 )
@@ -0,0 +1,702 @@
+package analyzer
+
+import (
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// CompileFilter переводит выражение в синтаксисе фильтров pcap в программу
+// classic BPF для пакетов, начинающихся с IP-заголовка (LinkTypeRaw, как у
+// PacketSource). Поддерживается подмножество:
+//
+//	[ip|ip6|tcp|udp] [src|dst] host АДРЕС
+//	[ip|ip6|tcp|udp] [src|dst] net ПОДСЕТЬ
+//	[ip|ip6|tcp|udp] [src|dst] port N
+//	[ip|ip6|tcp|udp] [src|dst] portrange N-M
+//	ip|ip6|tcp|udp|icmp|icmp6, [ip|ip6] proto N|tcp|udp|icmp
+//	tcp[tcpflags] & (tcp-syn|tcp-ack) != 0, tcp[N], tcp[N:2], udp[N:4]
+//	and, or, not, &&, ||, !, скобки
+//
+// Заголовки расширения IPv6 не разбираются: транспортный заголовок
+// ожидается сразу после основного. Фрагменты IPv4, кроме первого, не
+// совпадают с условиями на порты и поля TCP/UDP. Пустое выражение
+// пропускает все пакеты. Совпавший пакет обрезается до snaplen байт.
+func CompileFilter(expr string, snaplen int) ([]unix.SockFilter, error) {
+	node := filterNode(filterTrue{})
+	if strings.TrimSpace(expr) != "" {
+		var err error
+		if node, err = parseFilter(expr); err != nil {
+			return nil, err
+		}
+	}
+
+	a := &bpfAsm{}
+	accept, reject := a.newLabel(), a.newLabel()
+	a.gen(node, accept, reject)
+	a.place(accept)
+	a.emit(unix.BPF_RET|unix.BPF_K, uint32(snaplen))
+	a.place(reject)
+	a.emit(unix.BPF_RET|unix.BPF_K, 0)
+	return a.assemble()
+}
+
+// filterNode - узел разобранного фильтра: filterAnd, filterOr, filterNot,
+// filterTrue или filterTest.
+type filterNode interface{}
+
+type filterAnd struct{ a, b filterNode }
+
+type filterOr struct{ a, b filterNode }
+
+type filterNot struct{ a filterNode }
+
+type filterTrue struct{}
+
+// filterTest загружает поле пакета, накладывает маску (0 - без маски) и
+// сравнивает с val.
+type filterTest struct {
+	load filterLoad
+	mask uint32
+	op   string
+	val  uint32
+}
+
+// filterLoad - поле размера size (unix.BPF_B, BPF_H или BPF_W) по смещению
+// off от начала IP-заголовка или, с v4Transport, от начала транспортного
+// заголовка IPv4, длина заголовка которого берется из IHL.
+type filterLoad struct {
+	size        uint16
+	off         uint32
+	v4Transport bool
+}
+
+const (
+	ipProtoICMP   = 1
+	ipProtoTCP    = 6
+	ipProtoUDP    = 17
+	ipProtoICMPv6 = 58
+
+	ipv6HeaderLen = 40
+	tcpFlagsOff   = 13
+)
+
+var tcpFlagNames = map[string]uint32{
+	"tcp-fin":  0x01,
+	"tcp-syn":  0x02,
+	"tcp-rst":  0x04,
+	"tcp-push": 0x08,
+	"tcp-ack":  0x10,
+	"tcp-urg":  0x20,
+	"tcp-ece":  0x40,
+	"tcp-cwr":  0x80,
+}
+
+var protoNames = map[string]uint32{
+	"icmp":   ipProtoICMP,
+	"tcp":    ipProtoTCP,
+	"udp":    ipProtoUDP,
+	"icmp6":  ipProtoICMPv6,
+	"icmpv6": ipProtoICMPv6,
+}
+
+func test(size uint16, off uint32, mask uint32, op string, val uint32) filterTest {
+	return filterTest{load: filterLoad{size: size, off: off}, mask: mask, op: op, val: val}
+}
+
+func and(nodes ...filterNode) filterNode {
+	n := nodes[0]
+	for _, m := range nodes[1:] {
+		n = filterAnd{n, m}
+	}
+	return n
+}
+
+func or(nodes ...filterNode) filterNode {
+	n := nodes[0]
+	for _, m := range nodes[1:] {
+		n = filterOr{n, m}
+	}
+	return n
+}
+
+var (
+	isIPv4 = test(unix.BPF_B, 0, 0xf0, "==", 0x40)
+	isIPv6 = test(unix.BPF_B, 0, 0xf0, "==", 0x60)
+	// notFragment отсекает фрагменты IPv4, кроме первого: в них нет
+	// транспортного заголовка.
+	notFragment = test(unix.BPF_H, 6, 0x1fff, "==", 0)
+)
+
+// family - семейства, к которым относится примитив.
+type family struct{ v4, v6 bool }
+
+func familyFor(proto string) family {
+	switch proto {
+	case "ip", "icmp":
+		return family{v4: true}
+	case "ip6", "icmp6":
+		return family{v6: true}
+	}
+	return family{v4: true, v6: true}
+}
+
+// ipProto проверяет номер протокола (next header для IPv6).
+func ipProto(fam family, protos ...uint32) filterNode {
+	var alts []filterNode
+	if fam.v4 {
+		var eq []filterNode
+		for _, p := range protos {
+			eq = append(eq, test(unix.BPF_B, 9, 0, "==", p))
+		}
+		alts = append(alts, and(isIPv4, or(eq...)))
+	}
+	if fam.v6 {
+		var eq []filterNode
+		for _, p := range protos {
+			eq = append(eq, test(unix.BPF_B, 6, 0, "==", p))
+		}
+		alts = append(alts, and(isIPv6, or(eq...)))
+	}
+	return or(alts...)
+}
+
+// transport строит условие на поля транспортного заголовка: fn получает
+// функцию загрузки поля по смещению от начала заголовка для нужного
+// семейства.
+func transport(fam family, protos []uint32, fn func(load func(size uint16, off uint32) filterLoad) filterNode) filterNode {
+	var alts []filterNode
+	if fam.v4 {
+		load := func(size uint16, off uint32) filterLoad {
+			return filterLoad{size: size, off: off, v4Transport: true}
+		}
+		alts = append(alts, and(ipProto(family{v4: true}, protos...), notFragment, fn(load)))
+	}
+	if fam.v6 {
+		load := func(size uint16, off uint32) filterLoad {
+			return filterLoad{size: size, off: ipv6HeaderLen + off}
+		}
+		alts = append(alts, and(ipProto(family{v6: true}, protos...), fn(load)))
+	}
+	return or(alts...)
+}
+
+func protoNode(proto string) filterNode {
+	switch proto {
+	case "ip":
+		return isIPv4
+	case "ip6":
+		return isIPv6
+	}
+	return ipProto(familyFor(proto), protoNames[proto])
+}
+
+// addrNode сравнивает адрес источника и/или назначения с префиксом.
+func addrNode(fam family, dir string, prefix netip.Prefix) (filterNode, error) {
+	addr := prefix.Addr()
+	if addr.Is4() && !fam.v4 || addr.Is6() && !fam.v6 {
+		return nil, fmt.Errorf("фильтр: адрес %s не подходит к протоколу", addr)
+	}
+
+	srcOff, dstOff, ver := uint32(12), uint32(16), isIPv4
+	if addr.Is6() {
+		srcOff, dstOff, ver = 8, 24, isIPv6
+	}
+	match := func(off uint32) filterNode {
+		b := addr.AsSlice()
+		bits := prefix.Bits()
+		var tests []filterNode
+		for i := 0; i < len(b); i += 4 {
+			word := uint32(b[i])<<24 | uint32(b[i+1])<<16 | uint32(b[i+2])<<8 | uint32(b[i+3])
+			wordBits := min(max(bits-i*8, 0), 32)
+			if wordBits == 0 {
+				break
+			}
+			// Префикс уже выровнен Masked, поэтому слово сравнивается с
+			// маской как есть; полное слово маски не требует.
+			var mask uint32
+			if wordBits < 32 {
+				mask = ^uint32(0) << (32 - wordBits)
+			}
+			tests = append(tests, test(unix.BPF_W, off+uint32(i), mask, "==", word))
+		}
+		if len(tests) == 0 {
+			return filterTrue{}
+		}
+		return and(tests...)
+	}
+
+	switch dir {
+	case "src":
+		return and(ver, match(srcOff)), nil
+	case "dst":
+		return and(ver, match(dstOff)), nil
+	}
+	return and(ver, or(match(srcOff), match(dstOff))), nil
+}
+
+func portNode(fam family, protos []uint32, dir string, from, to uint32) filterNode {
+	return transport(fam, protos, func(load func(uint16, uint32) filterLoad) filterNode {
+		match := func(off uint32) filterNode {
+			l := load(unix.BPF_H, off)
+			if from == to {
+				return filterTest{load: l, op: "==", val: from}
+			}
+			return and(filterTest{load: l, op: ">=", val: from}, filterTest{load: l, op: "<=", val: to})
+		}
+		switch dir {
+		case "src":
+			return match(0)
+		case "dst":
+			return match(2)
+		}
+		return or(match(0), match(2))
+	})
+}
+
+// bpfAsm собирает программу с символическими метками. Все переходы в BPF
+// идут только вперед, поэтому метка всегда ставится после переходов на
+// нее.
+type bpfAsm struct {
+	insns  []bpfInsn
+	labels []int
+}
+
+type bpfInsn struct {
+	code   uint16
+	jt, jf int
+	k      uint32
+}
+
+func (a *bpfAsm) newLabel() int {
+	a.labels = append(a.labels, -1)
+	return len(a.labels) - 1
+}
+
+func (a *bpfAsm) place(label int) {
+	a.labels[label] = len(a.insns)
+}
+
+func (a *bpfAsm) emit(code uint16, k uint32) {
+	a.insns = append(a.insns, bpfInsn{code: code, k: k, jt: -1, jf: -1})
+}
+
+func (a *bpfAsm) jump(code uint16, k uint32, jt, jf int) {
+	a.insns = append(a.insns, bpfInsn{code: code, k: k, jt: jt, jf: jf})
+}
+
+// gen выдает код, который переходит на tl, если узел истинен, и на fl
+// иначе; управление никогда не проваливается дальше.
+func (a *bpfAsm) gen(n filterNode, tl, fl int) {
+	switch n := n.(type) {
+	case filterTrue:
+		a.jump(unix.BPF_JMP|unix.BPF_JA, 0, tl, -1)
+	case filterAnd:
+		mid := a.newLabel()
+		a.gen(n.a, mid, fl)
+		a.place(mid)
+		a.gen(n.b, tl, fl)
+	case filterOr:
+		mid := a.newLabel()
+		a.gen(n.a, tl, mid)
+		a.place(mid)
+		a.gen(n.b, tl, fl)
+	case filterNot:
+		a.gen(n.a, fl, tl)
+	case filterTest:
+		if n.load.v4Transport {
+			a.emit(unix.BPF_LDX|unix.BPF_B|unix.BPF_MSH, 0)
+			a.emit(unix.BPF_LD|n.load.size|unix.BPF_IND, n.load.off)
+		} else {
+			a.emit(unix.BPF_LD|n.load.size|unix.BPF_ABS, n.load.off)
+		}
+		if n.mask != 0 {
+			a.emit(unix.BPF_ALU|unix.BPF_AND|unix.BPF_K, n.mask)
+		}
+		const jeq, jgt, jge = unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, unix.BPF_JMP | unix.BPF_JGT | unix.BPF_K, unix.BPF_JMP | unix.BPF_JGE | unix.BPF_K
+		switch n.op {
+		case "==":
+			a.jump(jeq, n.val, tl, fl)
+		case "!=":
+			a.jump(jeq, n.val, fl, tl)
+		case ">":
+			a.jump(jgt, n.val, tl, fl)
+		case ">=":
+			a.jump(jge, n.val, tl, fl)
+		case "<":
+			a.jump(jge, n.val, fl, tl)
+		case "<=":
+			a.jump(jgt, n.val, fl, tl)
+		}
+	}
+}
+
+func (a *bpfAsm) assemble() ([]unix.SockFilter, error) {
+	prog := make([]unix.SockFilter, len(a.insns))
+	for i, in := range a.insns {
+		f := unix.SockFilter{Code: in.code, K: in.k}
+		if in.code == unix.BPF_JMP|unix.BPF_JA {
+			f.K = uint32(a.labels[in.jt] - i - 1)
+		} else if in.jt >= 0 {
+			jt, jf := a.labels[in.jt]-i-1, a.labels[in.jf]-i-1
+			if jt > 255 || jf > 255 {
+				return nil, fmt.Errorf("фильтр: выражение слишком длинное для условного перехода BPF")
+			}
+			f.Jt, f.Jf = uint8(jt), uint8(jf)
+		}
+		prog[i] = f
+	}
+	if len(prog) > unix.BPF_MAXINSNS {
+		return nil, fmt.Errorf("фильтр: программа из %d инструкций длиннее допустимых %d", len(prog), unix.BPF_MAXINSNS)
+	}
+	return prog, nil
+}
+
+type filterParser struct {
+	toks []string
+	pos  int
+}
+
+func parseFilter(expr string) (filterNode, error) {
+	toks, err := tokenizeFilter(expr)
+	if err != nil {
+		return nil, err
+	}
+	p := &filterParser{toks: toks}
+	n, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.toks) {
+		return nil, fmt.Errorf("фильтр: лишний токен %q", p.toks[p.pos])
+	}
+	return n, nil
+}
+
+func tokenizeFilter(expr string) ([]string, error) {
+	var toks []string
+	for i := 0; i < len(expr); {
+		c := expr[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			i++
+		case strings.ContainsRune("()[]", rune(c)):
+			toks = append(toks, string(c))
+			i++
+		case strings.ContainsRune("&|!=<>", rune(c)):
+			if i+1 < len(expr) {
+				if two := expr[i : i+2]; two == "&&" || two == "||" || two == "!=" || two == "==" || two == ">=" || two == "<=" {
+					toks = append(toks, two)
+					i += 2
+					continue
+				}
+			}
+			toks = append(toks, string(c))
+			i++
+		case isFilterWordChar(c):
+			j := i
+			for j < len(expr) && isFilterWordChar(expr[j]) {
+				j++
+			}
+			toks = append(toks, strings.ToLower(expr[i:j]))
+			i = j
+		default:
+			return nil, fmt.Errorf("фильтр: неожиданный символ %q", c)
+		}
+	}
+	return toks, nil
+}
+
+func isFilterWordChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.IndexByte(".:/-_", c) >= 0
+}
+
+func (p *filterParser) peek() string {
+	if p.pos < len(p.toks) {
+		return p.toks[p.pos]
+	}
+	return ""
+}
+
+func (p *filterParser) next() string {
+	t := p.peek()
+	if t != "" {
+		p.pos++
+	}
+	return t
+}
+
+func (p *filterParser) expect(tok string) error {
+	if t := p.next(); t != tok {
+		return fmt.Errorf("фильтр: ожидалось %q, получено %q", tok, t)
+	}
+	return nil
+}
+
+func (p *filterParser) parseOr() (filterNode, error) {
+	n, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for t := p.peek(); t == "or" || t == "||"; t = p.peek() {
+		p.next()
+		m, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		n = filterOr{n, m}
+	}
+	return n, nil
+}
+
+func (p *filterParser) parseAnd() (filterNode, error) {
+	n, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for t := p.peek(); t == "and" || t == "&&"; t = p.peek() {
+		p.next()
+		m, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		n = filterAnd{n, m}
+	}
+	return n, nil
+}
+
+func (p *filterParser) parseUnary() (filterNode, error) {
+	switch p.peek() {
+	case "not", "!":
+		p.next()
+		n, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return filterNot{n}, nil
+	case "(":
+		p.next()
+		n, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		return n, p.expect(")")
+	case "":
+		return nil, fmt.Errorf("фильтр: неожиданный конец выражения")
+	}
+	return p.parsePrimitive()
+}
+
+func (p *filterParser) parsePrimitive() (filterNode, error) {
+	var proto, dir, kind string
+	switch t := p.peek(); t {
+	case "ip", "ip6", "tcp", "udp", "icmp", "icmp6":
+		proto = p.next()
+		if p.peek() == "[" {
+			return p.parseAccessor(proto)
+		}
+	}
+	if t := p.peek(); t == "src" || t == "dst" {
+		dir = p.next()
+	}
+	switch t := p.peek(); t {
+	case "host", "net", "port", "portrange", "proto":
+		kind = p.next()
+	}
+
+	if kind == "" && dir == "" {
+		if proto != "" {
+			return protoNode(proto), nil
+		}
+		// Голый адрес означает host, как в tcpdump.
+		if _, err := netip.ParseAddr(p.peek()); err != nil {
+			return nil, fmt.Errorf("фильтр: неизвестный примитив %q", p.peek())
+		}
+		kind = "host"
+	}
+	if kind == "" {
+		kind = "host"
+	}
+
+	value := p.next()
+	if value == "" {
+		return nil, fmt.Errorf("фильтр: у %s нет значения", kind)
+	}
+	fam := familyFor(proto)
+
+	switch kind {
+	case "host", "net":
+		prefix, err := parseFilterPrefix(value, kind == "host")
+		if err != nil {
+			return nil, err
+		}
+		n, err := addrNode(fam, dir, prefix)
+		if err != nil {
+			return nil, err
+		}
+		if proto == "tcp" || proto == "udp" || proto == "icmp" || proto == "icmp6" {
+			n = and(protoNode(proto), n)
+		}
+		return n, nil
+
+	case "port", "portrange":
+		from, to, err := parseFilterPorts(value, kind == "portrange")
+		if err != nil {
+			return nil, err
+		}
+		protos := []uint32{ipProtoTCP, ipProtoUDP}
+		switch proto {
+		case "tcp", "udp":
+			protos = []uint32{protoNames[proto]}
+		case "icmp", "icmp6":
+			return nil, fmt.Errorf("фильтр: у %s нет портов", proto)
+		}
+		return portNode(fam, protos, dir, from, to), nil
+
+	case "proto":
+		if dir != "" {
+			return nil, fmt.Errorf("фильтр: proto не сочетается с %s", dir)
+		}
+		num, ok := protoNames[value]
+		if !ok {
+			n, err := strconv.ParseUint(value, 0, 8)
+			if err != nil {
+				return nil, fmt.Errorf("фильтр: неизвестный протокол %q", value)
+			}
+			num = uint32(n)
+		}
+		return ipProto(fam, num), nil
+	}
+	return nil, fmt.Errorf("фильтр: неизвестный примитив %q", kind)
+}
+
+// parseAccessor разбирает tcp[ИНДЕКС[:РАЗМЕР]] [& МАСКА] ОП ЗНАЧЕНИЕ.
+func (p *filterParser) parseAccessor(proto string) (filterNode, error) {
+	if proto != "tcp" && proto != "udp" {
+		return nil, fmt.Errorf("фильтр: доступ к полям поддерживается только для tcp и udp")
+	}
+	p.next()
+	index := p.next()
+	size := uint16(unix.BPF_B)
+	if idx, sz, ok := strings.Cut(index, ":"); ok {
+		index = idx
+		switch sz {
+		case "1":
+		case "2":
+			size = unix.BPF_H
+		case "4":
+			size = unix.BPF_W
+		default:
+			return nil, fmt.Errorf("фильтр: размер поля должен быть 1, 2 или 4, получено %q", sz)
+		}
+	}
+	var off uint32
+	if index == "tcpflags" && proto == "tcp" {
+		off = tcpFlagsOff
+	} else {
+		n, err := strconv.ParseUint(index, 0, 16)
+		if err != nil {
+			return nil, fmt.Errorf("фильтр: некорректное смещение %q", index)
+		}
+		off = uint32(n)
+	}
+	if err := p.expect("]"); err != nil {
+		return nil, err
+	}
+
+	var mask uint32
+	if p.peek() == "&" {
+		p.next()
+		m, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		if m == 0 {
+			// Маска 0 обнуляет поле, и сравнение не зависит от пакета.
+			return nil, fmt.Errorf("фильтр: нулевая маска")
+		}
+		mask = m
+	}
+
+	op := p.next()
+	switch op {
+	case "=":
+		op = "=="
+	case "==", "!=", ">", ">=", "<", "<=":
+	default:
+		return nil, fmt.Errorf("фильтр: ожидалось сравнение, получено %q", op)
+	}
+	val, err := p.parseValue()
+	if err != nil {
+		return nil, err
+	}
+
+	return transport(family{v4: true, v6: true}, []uint32{protoNames[proto]}, func(load func(uint16, uint32) filterLoad) filterNode {
+		return filterTest{load: load(size, off), mask: mask, op: op, val: val}
+	}), nil
+}
+
+// parseValue разбирает число или имя флага TCP, возможно объединенные
+// через | и взятые в скобки.
+func (p *filterParser) parseValue() (uint32, error) {
+	if p.peek() == "(" {
+		p.next()
+		v, err := p.parseValue()
+		if err != nil {
+			return 0, err
+		}
+		return v, p.expect(")")
+	}
+	var v uint32
+	for {
+		t := p.next()
+		if f, ok := tcpFlagNames[t]; ok {
+			v |= f
+		} else if n, err := strconv.ParseUint(t, 0, 32); err == nil {
+			v |= uint32(n)
+		} else {
+			return 0, fmt.Errorf("фильтр: ожидалось число или флаг tcp, получено %q", t)
+		}
+		if p.peek() != "|" {
+			return v, nil
+		}
+		p.next()
+	}
+}
+
+// parseFilterPrefix разбирает адрес или подсеть; адрес без длины префикса
+// сравнивается целиком.
+func parseFilterPrefix(s string, host bool) (netip.Prefix, error) {
+	if !host && strings.Contains(s, "/") {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("фильтр: некорректная подсеть %q", s)
+		}
+		return prefix.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("фильтр: некорректный адрес %q", s)
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+func parseFilterPorts(s string, isRange bool) (uint32, uint32, error) {
+	from, to := s, s
+	if isRange {
+		var ok bool
+		if from, to, ok = strings.Cut(s, "-"); !ok {
+			return 0, 0, fmt.Errorf("фильтр: ожидался диапазон портов N-M, получено %q", s)
+		}
+	}
+	a, err1 := strconv.ParseUint(from, 10, 16)
+	b, err2 := strconv.ParseUint(to, 10, 16)
+	if err1 != nil || err2 != nil || a > b {
+		return 0, 0, fmt.Errorf("фильтр: некорректный порт %q", s)
+	}
+	return uint32(a), uint32(b), nil
+}
@@ -0,0 +1,243 @@
+package analyzer
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// runBPF выполняет программу classic BPF над пакетом так же, как ядро:
+// чтение за концом пакета отбрасывает его. Поддерживаются только
+// инструкции, которые выдает CompileFilter.
+func runBPF(t *testing.T, prog []unix.SockFilter, pkt []byte) uint32 {
+	t.Helper()
+	load := func(size uint16, off uint32) (uint32, bool) {
+		n := map[uint16]uint32{unix.BPF_B: 1, unix.BPF_H: 2, unix.BPF_W: 4}[size]
+		if uint64(off)+uint64(n) > uint64(len(pkt)) {
+			return 0, false
+		}
+		var v uint32
+		for _, b := range pkt[off : off+n] {
+			v = v<<8 | uint32(b)
+		}
+		return v, true
+	}
+
+	var a, x uint32
+	for pc := 0; pc < len(prog); pc++ {
+		in := prog[pc]
+		size := in.Code & 0x18
+		switch {
+		case in.Code == unix.BPF_RET|unix.BPF_K:
+			return in.K
+		case in.Code == unix.BPF_LD|size|unix.BPF_ABS:
+			v, ok := load(size, in.K)
+			if !ok {
+				return 0
+			}
+			a = v
+		case in.Code == unix.BPF_LD|size|unix.BPF_IND:
+			v, ok := load(size, x+in.K)
+			if !ok {
+				return 0
+			}
+			a = v
+		case in.Code == unix.BPF_LDX|unix.BPF_B|unix.BPF_MSH:
+			v, ok := load(unix.BPF_B, in.K)
+			if !ok {
+				return 0
+			}
+			x = 4 * (v & 0xf)
+		case in.Code == unix.BPF_ALU|unix.BPF_AND|unix.BPF_K:
+			a &= in.K
+		case in.Code == unix.BPF_JMP|unix.BPF_JA:
+			pc += int(in.K)
+		case in.Code&0x07 == unix.BPF_JMP:
+			var cond bool
+			switch in.Code {
+			case unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K:
+				cond = a == in.K
+			case unix.BPF_JMP | unix.BPF_JGT | unix.BPF_K:
+				cond = a > in.K
+			case unix.BPF_JMP | unix.BPF_JGE | unix.BPF_K:
+				cond = a >= in.K
+			default:
+				t.Fatalf("инструкция %d: неизвестный переход %#x", pc, in.Code)
+			}
+			if cond {
+				pc += int(in.Jt)
+			} else {
+				pc += int(in.Jf)
+			}
+		default:
+			t.Fatalf("инструкция %d: неизвестный код %#x", pc, in.Code)
+		}
+	}
+	t.Fatalf("программа закончилась без ret")
+	return 0
+}
+
+// filterPackets - набор пакетов для проверки фильтров; ключ - короткое имя
+// для таблицы ожидаемых совпадений.
+func filterPackets() map[string][]byte {
+	synAck := linuxSYN()
+	synAck.src, synAck.dst, synAck.sport, synAck.dport = synAck.dst, synAck.src, 443, 40000
+	synAck.seq, synAck.ack, synAck.flags = 7, 1001, tcpFlagSYN|tcpFlagACK
+
+	withOptions := linuxSYN()
+	withOptions.sport, withOptions.dport = 40001, 8080
+	withOptions.ipOptions = []byte{1, 1, 1, 1}
+
+	// Не первый фрагмент: транспортного заголовка в нем нет.
+	fragment := linuxSYN().bytes()
+	fragment[7] = 1
+
+	v6 := linuxSYN()
+	v6.src, v6.dst = "2001:db8::1", "2001:db8:1::2"
+
+	return map[string][]byte{
+		"A": linuxSYN().bytes(),
+		"B": synAck.bytes(),
+		"C": withOptions.bytes(),
+		"D": fragment,
+		"E": testPacket{src: "10.0.0.1", dst: "10.0.0.53", ttl: 64, proto: 17, sport: 5353, dport: 53}.bytes(),
+		"F": testPacket{src: "10.0.0.1", dst: "10.0.0.2", ttl: 64, proto: 1}.bytes(),
+		"G": v6.bytes(),
+		"H": testPacket{src: "2001:db8::1", dst: "2001:db8:1::53", ttl: 64, proto: 17, sport: 5353, dport: 53}.bytes(),
+	}
+}
+
+func TestCompileFilter(t *testing.T) {
+	pkts := filterPackets()
+	tests := []struct {
+		expr string
+		want string
+	}{
+		{"", "ABCDEFGH"},
+		{"ip", "ABCDEF"},
+		{"ip6", "GH"},
+		{"tcp", "ABCDG"},
+		{"udp", "EH"},
+		{"icmp", "F"},
+		{"proto 17", "EH"},
+		{"ip proto udp", "E"},
+		{"ip6 proto 6", "G"},
+
+		{"host 192.0.2.10", "ABCD"},
+		{"src host 192.0.2.10", "ACD"},
+		{"dst 198.51.100.1", "ACD"},
+		{"198.51.100.1", "ABCD"},
+		{"tcp host 10.0.0.1", ""},
+		{"net 10.0.0.0/24", "EF"},
+		{"src net 10.1.2.3/8", "EF"},
+		{"dst net 10.0.0.32/27", "E"},
+		{"net 0.0.0.0/0", "ABCDEF"},
+		{"host 2001:db8::1", "GH"},
+		{"ip6 dst host 2001:db8:1::53", "H"},
+		{"net 2001:db8:1::/48", "GH"},
+		{"src net 2001:db8:1::/48", ""},
+
+		{"port 443", "ABG"},
+		{"dst port 443", "AG"},
+		{"src port 443", "B"},
+		{"tcp port 8080", "C"},
+		{"port 53", "EH"},
+		{"tcp port 53", ""},
+		{"portrange 1-1024", "ABEGH"},
+		{"udp src portrange 5000-6000", "EH"},
+
+		{"tcp[tcpflags] & tcp-syn != 0", "ABCG"},
+		{"tcp[tcpflags] & (tcp-syn|tcp-ack) == tcp-syn", "ACG"},
+		{"tcp[tcpflags] == tcp-syn|tcp-ack", "B"},
+		{"tcp[13] & 0x12 = 0x12", "B"},
+		{"tcp[2:2] >= 8080", "BC"},
+		{"tcp[2:2] > 8080", "B"},
+		{"tcp[2:2] <= 443", "AG"},
+		{"tcp[2:2] < 443", ""},
+		{"tcp[4:4] = 1000", "ACG"},
+		{"udp[2:2] = 53", "EH"},
+
+		{"tcp and not port 443", "CD"},
+		{"ip6 or udp", "EGH"},
+		{"tcp && (src port 443 || dst port 8080)", "BC"},
+		{"!ip", "GH"},
+		{"not (tcp or udp)", "F"},
+		{"not not icmp", "F"},
+		{"host 192.0.2.10 and port 443 and tcp[tcpflags] & tcp-ack = 0", "A"},
+		{"TCP AND DST PORT 443", "AG"},
+	}
+	for _, tt := range tests {
+		prog, err := CompileFilter(tt.expr, 96)
+		if err != nil {
+			t.Errorf("%q: %v", tt.expr, err)
+			continue
+		}
+		var got strings.Builder
+		for _, name := range "ABCDEFGH" {
+			switch n := runBPF(t, prog, pkts[string(name)]); n {
+			case 96:
+				got.WriteRune(name)
+			case 0:
+			default:
+				t.Errorf("%q: пакет %c обрезан до %d байт", tt.expr, name, n)
+			}
+		}
+		if got.String() != tt.want {
+			t.Errorf("%q: совпали %q, ожидалось %q", tt.expr, got.String(), tt.want)
+		}
+	}
+}
+
+func TestCompileFilterShortPacket(t *testing.T) {
+	prog, err := CompileFilter("tcp port 443", 0xffff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkt := linuxSYN().bytes()
+	for _, n := range []int{0, 1, 10, 20, 21} {
+		if runBPF(t, prog, pkt[:n]) != 0 {
+			t.Errorf("пакет из %d байт прошел фильтр", n)
+		}
+	}
+	if runBPF(t, prog, pkt[:24]) == 0 {
+		t.Errorf("заголовок с портами не прошел фильтр")
+	}
+}
+
+func TestCompileFilterErrors(t *testing.T) {
+	for _, expr := range []string{
+		"host",
+		"host 300.1.1.1",
+		"host 10.0.0.0/8",
+		"net 10.0.0.0/33",
+		"port 70000",
+		"port http",
+		"portrange 10",
+		"portrange 20-10",
+		"icmp port 1",
+		"ip host 2001:db8::1",
+		"ip6 net 10.0.0.0/8",
+		"src proto 6",
+		"proto foo",
+		"foo",
+		"tcp and",
+		"tcp or or udp",
+		"(tcp",
+		"tcp)",
+		"tcp udp",
+		"ip[0] = 4",
+		"tcp[13",
+		"tcp[13:3] = 1",
+		"tcp[x] = 1",
+		"tcp[13] & 0 = 0",
+		"tcp[13] ~ 1",
+		"tcp[13] = tcp-bogus",
+		"tcp[13] = (1",
+		"tcp $ udp",
+	} {
+		if _, err := CompileFilter(expr, 0); err == nil {
+			t.Errorf("%q: ошибки нет", expr)
+		}
+	}
+}
@@ -1,118 +1,218 @@
 package analyzer
 
 import (
+	"errors"
 	"fmt"
-	"log"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"strings"
+	"sync"
 	"time"
+
+	"custom-tcp-fingerprint/internal/logging"
 )
 
-func CaptureTraffic(interfaceName, outputFile string) error {
-	time.Sleep(2 * time.Second)
+// CaptureOptions ограничивают захват. Нулевые значения снимают
+// соответствующее ограничение.
+type CaptureOptions struct {
+	// File - путь к файлу pcapng; при ротации следующие файлы получают
+	// номер перед расширением: traffic.pcapng, traffic.1.pcapng, ...
+	File       string
+	Duration   time.Duration
+	MaxPackets int
+	// RotateSize - размер файла в байтах, после которого начинается
+	// следующий.
+	RotateSize int64
+	// Filter - выражение фильтра pcap (см. CompileFilter).
+	Filter string
+}
+
+// HandshakeFilter отбирает сегменты TCP с флагом SYN или ACK.
+const HandshakeFilter = "tcp[tcpflags] & (tcp-syn|tcp-ack) != 0"
+
+// Capture пишет пакеты интерфейса в pcapng в отдельной горутине до
+// истечения ограничений или вызова Stop.
+type Capture struct {
+	opts CaptureOptions
+	src  *PacketSource
+
+	file    *os.File
+	writer  *PcapngWriter
+	fileNum int
+	packets int
+
+	stopOnce sync.Once
+	done     chan struct{}
+	err      error
+}
 
-	dir := filepath.Dir(outputFile)
-	if dir != "" {
+// StartCapture открывает сокет на интерфейсе (в текущем network namespace)
+// и первый файл захвата, после чего возвращается сразу.
+func StartCapture(interfaceName string, opts CaptureOptions) (*Capture, error) {
+	if dir := filepath.Dir(opts.File); dir != "" {
 		os.MkdirAll(dir, 0755)
 	}
 
-	cmd := exec.Command("ip", "link", "show", interfaceName)
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("interface %s does not exist: %w", interfaceName, err)
+	src, err := OpenPacketSource(interfaceName, opts.Filter)
+	if err != nil {
+		return nil, err
+	}
+	c := &Capture{opts: opts, src: src, done: make(chan struct{})}
+	if err := c.openFile(); err != nil {
+		src.Close()
+		return nil, err
 	}
 
-	args := []string{
-		"-i", interfaceName,
-		"-w", outputFile,
-		"-v",
-		"tcp",
+	logging.Infof("начинаем захват трафика на интерфейсе %s, сохраняем в %s", interfaceName, opts.File)
+	if opts.Duration > 0 {
+		time.AfterFunc(opts.Duration, func() {
+			select {
+			case <-c.done:
+			default:
+				logging.Infof("останавливаем захват после %s", opts.Duration)
+				c.Stop()
+			}
+		})
 	}
+	go c.run()
+	return c, nil
+}
 
-	log.Printf("начинаем захват трафика на интерфейсе %s, сохраняем в %s", interfaceName, outputFile)
+// Stop прерывает захват, дописывает буфер и закрывает файл. Повторные
+// вызовы только ждут завершения и возвращают ту же ошибку.
+func (c *Capture) Stop() error {
+	c.stopOnce.Do(func() {
+		c.src.Close()
+	})
+	return c.Wait()
+}
 
-	cmd = exec.Command("tcpdump", args...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+// Wait ждет завершения захвата по ограничениям или Stop.
+func (c *Capture) Wait() error {
+	<-c.done
+	return c.err
+}
 
-	if err := cmd.Start(); err != nil {
-		return fmt.Errorf("failed to start tcpdump: %w", err)
-	}
+// Done закрывается, когда захват завершен и файл закрыт.
+func (c *Capture) Done() <-chan struct{} {
+	return c.done
+}
 
-	pid := cmd.Process.Pid
-	log.Printf("tcpdump запущен с пид %d", pid)
+// Packets возвращает число записанных пакетов; после Done значение
+// окончательное.
+func (c *Capture) Packets() int {
+	<-c.done
+	return c.packets
+}
 
-	go func() {
-		if err := cmd.Wait(); err != nil {
-			log.Printf("tcpdump завершился с ошыбкой: %v", err)
-		} else {
-			log.Printf("tcpdump завершился успешно")
+func (c *Capture) run() {
+	defer close(c.done)
+	defer func() {
+		if err := c.closeFile(); err != nil && c.err == nil {
+			c.err = err
 		}
+		logging.Infof("захват завершен: %d пакетов", c.packets)
 	}()
 
-	return nil
+	for {
+		pkt, err := c.src.ReadPacket()
+		if err != nil {
+			if !errors.Is(err, os.ErrClosed) {
+				c.err = err
+				c.src.Close()
+			}
+			return
+		}
+		if c.opts.RotateSize > 0 && c.writer.Size() >= c.opts.RotateSize {
+			if err := c.rotate(); err != nil {
+				c.err = err
+				c.src.Close()
+				return
+			}
+		}
+		if err := c.writer.WritePacket(0, pkt.Timestamp, pkt.Data, pkt.OrigLen); err != nil {
+			c.err = err
+			c.src.Close()
+			return
+		}
+		c.packets++
+		if c.opts.MaxPackets > 0 && c.packets >= c.opts.MaxPackets {
+			logging.Infof("останавливаем захват после %d пакетов", c.packets)
+			c.src.Close()
+			return
+		}
+	}
 }
 
-func CaptureTCPHandshake(interfaceName, outputFile string, durationSeconds int) error {
-	args := []string{
-		"-i", interfaceName,
-		"-w", outputFile,
-		"-v",
-		"tcp[tcpflags] & (tcp-syn|tcp-ack) != 0",
-		"-c", "10",
+func (c *Capture) openFile() error {
+	name := rotatedName(c.opts.File, c.fileNum)
+	f, err := os.Create(name)
+	if err != nil {
+		return fmt.Errorf("failed to create capture file: %w", err)
 	}
-
-	log.Printf("начинаем захват tcp-хендшейка на интерфейсе %s, сохраняем в %s", interfaceName, outputFile)
-
-	cmd := exec.Command("tcpdump", args...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-
-	if err := cmd.Start(); err != nil {
-		return fmt.Errorf("failed to start tcpdump for handshake: %w", err)
+	w, err := NewPcapngWriter(f)
+	if err == nil {
+		_, err = w.AddInterface(c.src.Interface(), c.src.LinkType(), maxPacketSize)
 	}
-
-	timer := time.AfterFunc(time.Duration(durationSeconds)*time.Second, func() {
-		if cmd.Process != nil {
-			log.Printf("останавливаем tcpdump после %d секунд", durationSeconds)
-			cmd.Process.Signal(os.Interrupt)
-		}
-	})
-	defer timer.Stop()
-
-	if err := cmd.Wait(); err != nil {
-		if cmd.ProcessState.ExitCode() == 1 {
-			log.Printf("захват tcp-хендшейка завершен (таймаут)")
-			return nil
-		}
-		return fmt.Errorf("tcpdump handshake capture failed: %w", err)
+	if err != nil {
+		f.Close()
+		return err
 	}
-
-	log.Printf("захват tcp-хендшейка завершен успешно")
+	c.file, c.writer = f, w
 	return nil
 }
 
-func AnalyzePcapFile(pcapFile string) (string, error) {
-	if _, err := os.Stat(pcapFile); os.IsNotExist(err) {
-		return "", fmt.Errorf("pcap file does not exist: %s", pcapFile)
+// closeFile дописывает и закрывает текущий файл. Если ротация не открыла
+// следующий, файла нет, и закрытие в конце run ничего не делает.
+func (c *Capture) closeFile() error {
+	if c.file == nil {
+		return nil
 	}
+	err := c.writer.Flush()
+	if cerr := c.file.Close(); err == nil {
+		err = cerr
+	}
+	c.file, c.writer = nil, nil
+	return err
+}
+
+func (c *Capture) rotate() error {
+	if err := c.closeFile(); err != nil {
+		return err
+	}
+	c.fileNum++
+	logging.Infof("захват продолжается в %s", rotatedName(c.opts.File, c.fileNum))
+	return c.openFile()
+}
 
-	args := []string{
-		"-r", pcapFile,
-		"-Y", "tcp.flags.syn==1 && tcp.flags.ack==0",
-		"-T", "fields",
-		"-e", "ip.src",
-		"-e", "ip.dst",
-		"-e", "tcp.window_size",
-		"-e", "ip.ttl",
-		"-e", "tcp.options",
+// rotatedName вставляет номер файла перед расширением; нулевой номер
+// оставляет имя как есть.
+func rotatedName(path string, n int) string {
+	if n == 0 {
+		return path
 	}
+	ext := filepath.Ext(path)
+	return fmt.Sprintf("%s.%d%s", strings.TrimSuffix(path, ext), n, ext)
+}
 
-	cmd := exec.Command("tshark", args...)
-	output, err := cmd.CombinedOutput()
+// CaptureTCPHandshake пишет в outputFile до 10 сегментов с SYN или ACK и
+// ждет их или истечения durationSeconds.
+func CaptureTCPHandshake(interfaceName, outputFile string, durationSeconds int) error {
+	logging.Infof("начинаем захват tcp-хендшейка на интерфейсе %s, сохраняем в %s", interfaceName, outputFile)
+
+	c, err := StartCapture(interfaceName, CaptureOptions{
+		File:       outputFile,
+		Duration:   time.Duration(durationSeconds) * time.Second,
+		MaxPackets: 10,
+		Filter:     HandshakeFilter,
+	})
 	if err != nil {
-		return "", fmt.Errorf("failed to analyze pcap file: %w, output: %s", err, string(output))
+		return fmt.Errorf("failed to start handshake capture: %w", err)
+	}
+	if err := c.Wait(); err != nil {
+		return fmt.Errorf("handshake capture failed: %w", err)
 	}
 
-	return string(output), nil
+	logging.Infof("захват tcp-хендшейка завершен успешно")
+	return nil
 }
@@ -0,0 +1,149 @@
+package analyzer
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const captureTestPort = 47999
+
+// startLoopbackCapture захватывает udp на порт captureTestPort на lo и
+// шлет туда пакеты, пока захват не завершится. Без прав на сокет
+// AF_PACKET тест пропускается.
+func startLoopbackCapture(t *testing.T, opts CaptureOptions) *Capture {
+	t.Helper()
+	opts.Filter = fmt.Sprintf("udp and dst port %d", captureTestPort)
+	c, err := StartCapture("lo", opts)
+	if err != nil {
+		if os.IsPermission(err) || strings.Contains(err.Error(), "operation not permitted") {
+			t.Skipf("нет прав на захват: %v", err)
+		}
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Stop() })
+
+	conn, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: captureTestPort})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		defer conn.Close()
+		payload := make([]byte, 300)
+		for {
+			select {
+			case <-c.Done():
+				return
+			case <-time.After(time.Millisecond):
+				conn.Write(payload)
+			}
+		}
+	}()
+	return c
+}
+
+func waitCapture(t *testing.T, c *Capture) error {
+	t.Helper()
+	select {
+	case <-c.Done():
+		return c.Wait()
+	case <-time.After(10 * time.Second):
+		t.Fatal("захват не завершился")
+		return nil
+	}
+}
+
+// udpDstPort возвращает порт назначения пакета udp ipv4.
+func udpDstPort(data []byte) (uint16, bool) {
+	if len(data) < 20 || data[0]>>4 != 4 || data[9] != 17 {
+		return 0, false
+	}
+	ihl := int(data[0]&0x0f) * 4
+	if len(data) < ihl+4 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint16(data[ihl+2:]), true
+}
+
+func readCaptureFile(t *testing.T, path string) []*Packet {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkts, err := readAll(t, data)
+	if err != nil {
+		t.Fatalf("%s: %v", path, err)
+	}
+	return pkts
+}
+
+func TestCaptureRotateSize(t *testing.T) {
+	const rotateSize = 2000
+	file := filepath.Join(t.TempDir(), "traffic.pcapng")
+	c := startLoopbackCapture(t, CaptureOptions{File: file, RotateSize: rotateSize, MaxPackets: 20})
+	if err := waitCapture(t, c); err != nil {
+		t.Fatal(err)
+	}
+	if c.Packets() != 20 {
+		t.Errorf("%d пакетов, ожидалось 20", c.Packets())
+	}
+
+	total := 0
+	for n := 0; ; n++ {
+		name := rotatedName(file, n)
+		info, err := os.Stat(name)
+		if os.IsNotExist(err) {
+			if n < 2 {
+				t.Fatalf("файлов %d, ожидалась ротация", n)
+			}
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		pkts := readCaptureFile(t, name)
+		if len(pkts) == 0 {
+			t.Errorf("%s: пустой файл", name)
+		}
+		total += len(pkts)
+		// Следующий файл начинается, только когда текущий достиг предела.
+		if _, err := os.Stat(rotatedName(file, n+1)); err == nil && info.Size() < rotateSize {
+			t.Errorf("%s: %d байт, ротация раньше %d", name, info.Size(), rotateSize)
+		}
+		for _, pkt := range pkts {
+			if port, ok := udpDstPort(pkt.Data); !ok || port != captureTestPort {
+				t.Errorf("%s: чужой пакет %x", name, pkt.Data)
+			}
+		}
+	}
+	if total != 20 {
+		t.Errorf("во всех файлах %d пакетов, ожидалось 20", total)
+	}
+}
+
+func TestCaptureRotateError(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "traffic.pcapng")
+	// Второй файл не создать: на его месте каталог.
+	if err := os.Mkdir(rotatedName(file, 1), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	c := startLoopbackCapture(t, CaptureOptions{File: file, RotateSize: 1000})
+	err := waitCapture(t, c)
+	if err == nil || !strings.Contains(err.Error(), "failed to create capture file") {
+		t.Errorf("ошибка %v, ожидалась ошибка создания второго файла", err)
+	}
+	if c.file != nil {
+		t.Error("файл не сброшен после закрытия")
+	}
+	// Первый файл закрыт один раз и дописан целиком.
+	if pkts := readCaptureFile(t, file); len(pkts) != c.Packets() || len(pkts) == 0 {
+		t.Errorf("в первом файле %d пакетов, записано %d", len(pkts), c.Packets())
+	}
+}
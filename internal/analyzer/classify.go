@@ -0,0 +1,258 @@
+package analyzer
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"custom-tcp-fingerprint/internal/p0f"
+)
+
+// maxTTLDistance - наибольшее число хопов между отправителем и точкой
+// захвата, при котором ttl еще считается совпавшим (как MAX_DIST в p0f).
+const maxTTLDistance = 35
+
+type MatchQuality int
+
+const (
+	MatchNone MatchQuality = iota
+	MatchPartial
+	MatchFuzzy
+	MatchExact
+)
+
+func (q MatchQuality) String() string {
+	switch q {
+	case MatchExact:
+		return "exact"
+	case MatchFuzzy:
+		return "fuzzy"
+	case MatchPartial:
+		return "partial"
+	}
+	return "none"
+}
+
+type FieldMismatch struct {
+	Field    string
+	Expected string
+	Actual   string
+}
+
+func (m FieldMismatch) String() string {
+	return fmt.Sprintf("%s: ожидалось %s, получено %s", m.Field, m.Expected, m.Actual)
+}
+
+type Classification struct {
+	Segment    *TCPSegment
+	Signature  *p0f.Signature
+	Quality    MatchQuality
+	Distance   int
+	Mismatches []FieldMismatch
+}
+
+func (c *Classification) OS() string {
+	if c.Signature == nil {
+		return "???"
+	}
+	return c.Signature.Label.OS()
+}
+
+// Is сообщает, что пакет распознан как ОС name хотя бы с нечетким совпадением.
+func (c *Classification) Is(name string) bool {
+	return c.Signature != nil && c.Quality >= MatchFuzzy && c.Signature.Label.Matches(name)
+}
+
+// AnalyzePcapFile читает pcap или pcapng и возвращает все SYN и SYN-ACK.
+func AnalyzePcapFile(pcapFile string) ([]*TCPSegment, error) {
+	r, f, err := OpenPcapFile(pcapFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var segments []*TCPSegment
+	for {
+		pkt, err := r.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("ошибка чтения %s: %w", pcapFile, err)
+		}
+
+		seg, ok := DecodeTCP(pkt)
+		if !ok || !(seg.IsSYN() || seg.IsSYNACK()) {
+			continue
+		}
+		segments = append(segments, seg)
+	}
+
+	return segments, nil
+}
+
+func ClassifyPcapFile(pcapFile string, db *p0f.Database) ([]*Classification, error) {
+	segments, err := AnalyzePcapFile(pcapFile)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]*Classification, 0, len(segments))
+	for _, seg := range segments {
+		results = append(results, Classify(seg, db))
+	}
+	return results, nil
+}
+
+// Classify сравнивает SYN с [tcp:request], а SYN-ACK с [tcp:response] и
+// возвращает сигнатуру с наименьшим числом расхождений. Расхождения только
+// в ttl и quirks дают нечеткое совпадение, в остальных полях - частичное.
+func Classify(seg *TCPSegment, db *p0f.Database) *Classification {
+	result := &Classification{Segment: seg, Quality: MatchNone}
+	if db == nil {
+		return result
+	}
+
+	sigs := db.Requests
+	if seg.IsSYNACK() {
+		sigs = db.Responses
+	}
+
+	bestScore := -1
+	for _, sig := range sigs {
+		mismatches, distance := compareSignature(seg, sig)
+
+		score := 0
+		for _, m := range mismatches {
+			if isSoftField(m.Field) {
+				score++
+			} else {
+				score += 10
+			}
+		}
+		if sig.Label.Generic {
+			score++
+		}
+
+		if bestScore >= 0 && score >= bestScore {
+			continue
+		}
+		bestScore = score
+		result.Signature = sig
+		result.Distance = distance
+		result.Mismatches = mismatches
+	}
+
+	if result.Signature == nil {
+		return result
+	}
+
+	result.Quality = MatchExact
+	for _, m := range result.Mismatches {
+		if !isSoftField(m.Field) {
+			result.Quality = MatchPartial
+			break
+		}
+		result.Quality = MatchFuzzy
+	}
+	return result
+}
+
+func isSoftField(field string) bool {
+	return field == "ttl" || field == "quirks"
+}
+
+func compareSignature(seg *TCPSegment, sig *p0f.Signature) ([]FieldMismatch, int) {
+	var mismatches []FieldMismatch
+	add := func(field, expected, actual string) {
+		mismatches = append(mismatches, FieldMismatch{Field: field, Expected: expected, Actual: actual})
+	}
+
+	if sig.Version > 0 && sig.Version != seg.IPVersion {
+		add("ver", strconv.Itoa(sig.Version), strconv.Itoa(seg.IPVersion))
+	}
+
+	distance := sig.ITTL - int(seg.TTL)
+	if distance < 0 || distance > maxTTLDistance {
+		add("ttl", strconv.Itoa(sig.ITTL), strconv.Itoa(int(seg.TTL)))
+	}
+
+	if sig.OptLen != seg.IPOptionsLen {
+		add("olen", strconv.Itoa(sig.OptLen), strconv.Itoa(seg.IPOptionsLen))
+	}
+
+	if sig.MSS >= 0 && sig.MSS != seg.MSS {
+		add("mss", strconv.Itoa(sig.MSS), strconv.Itoa(seg.MSS))
+	}
+
+	if !windowMatches(sig.Window, seg) {
+		add("wsize", sig.Window.String(), strconv.Itoa(int(seg.Window)))
+	}
+
+	scale := seg.WindowScale
+	if scale < 0 {
+		scale = 0
+	}
+	if sig.Scale >= 0 && sig.Scale != scale {
+		add("scale", strconv.Itoa(sig.Scale), strconv.Itoa(scale))
+	}
+
+	if sig.OptionLayout != seg.OptionLayout {
+		add("olayout", sig.OptionLayout, seg.OptionLayout)
+	}
+
+	if !sameQuirks(sig.Quirks, seg.Quirks) {
+		add("quirks", strings.Join(sig.Quirks, ","), strings.Join(seg.Quirks, ","))
+	}
+
+	switch sig.PayloadClass {
+	case "0":
+		if seg.PayloadLen != 0 {
+			add("pclass", "0", "+")
+		}
+	case "+":
+		if seg.PayloadLen == 0 {
+			add("pclass", "+", "0")
+		}
+	}
+
+	return mismatches, distance
+}
+
+func windowMatches(w p0f.Window, seg *TCPSegment) bool {
+	win := int(seg.Window)
+	switch w.Kind {
+	case p0f.WindowFixed:
+		return win == w.Value
+	case p0f.WindowMSS:
+		return seg.MSS > 0 && win == seg.MSS*w.Value
+	case p0f.WindowMTU:
+		mtu := seg.MSS + 40
+		if seg.IPVersion == 6 {
+			mtu = seg.MSS + 60
+		}
+		return seg.MSS > 0 && win == mtu*w.Value
+	case p0f.WindowMod:
+		return w.Value > 0 && win%w.Value == 0
+	}
+	return true
+}
+
+func sameQuirks(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	x := append([]string(nil), a...)
+	y := append([]string(nil), b...)
+	sort.Strings(x)
+	sort.Strings(y)
+	for i := range x {
+		if x[i] != y[i] {
+			return false
+		}
+	}
+	return true
+}
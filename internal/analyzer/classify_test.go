@@ -0,0 +1,127 @@
+package analyzer
+
+import (
+	"strings"
+	"testing"
+
+	"custom-tcp-fingerprint/internal/p0f"
+)
+
+const testP0fDB = `
+[tcp:request]
+label = g:unix:Linux:2.2.x-3.x
+sig   = *:64:0:*:*,*:mss,sok,ts,nop,ws:df,id+:0
+
+label = s:unix:Linux:3.11 and newer
+sig   = *:64:0:*:mss*20,7:mss,sok,ts,nop,ws:df,id+:0
+
+label = s:win:Windows:7 or 8
+sig   = *:128:0:*:8192,8:mss,nop,ws,nop,nop,sok:df,id+:0
+
+[tcp:response]
+label = s:unix:Linux:3.x
+sig   = *:64:0:*:mss*10,0:mss:df:0
+`
+
+func testDB(t *testing.T) *p0f.Database {
+	t.Helper()
+	db, err := p0f.Parse(strings.NewReader(testP0fDB))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestClassify(t *testing.T) {
+	db := testDB(t)
+	tests := []struct {
+		name     string
+		modify   func(p *testPacket)
+		quality  MatchQuality
+		os       string
+		fields   []string
+		distance int
+	}{
+		{"linux", func(p *testPacket) {}, MatchExact, "Linux", nil, 0},
+		{"linux через 4 хопа", func(p *testPacket) { p.ttl = 60 }, MatchExact, "Linux", nil, 4},
+		{"windows", func(p *testPacket) {
+			p.ttl, p.window, p.tcpOptions = 121, 8192, windowsSYNOptions
+		}, MatchExact, "Windows", nil, 7},
+		{"ttl больше начального", func(p *testPacket) { p.ttl = 100 }, MatchFuzzy, "Linux", []string{"ttl"}, -36},
+		{"лишний quirk", func(p *testPacket) { p.flags |= tcpFlagPSH }, MatchFuzzy, "Linux", []string{"quirks"}, 0},
+		{"без df", func(p *testPacket) { p.df = false }, MatchFuzzy, "Linux", []string{"quirks"}, 0},
+		{"ttl и quirks", func(p *testPacket) { p.ttl, p.id = 20, 0 }, MatchFuzzy, "Linux", []string{"ttl", "quirks"}, 44},
+		// Окно не кратно mss: подходит только обобщенная сигнатура.
+		{"окно вне сигнатуры", func(p *testPacket) { p.window = 29201 }, MatchExact, "Linux", nil, 0},
+		{"масштаб окна", func(p *testPacket) {
+			p.ttl, p.window, p.tcpOptions = 128, 8192, []byte{2, 4, 0x05, 0xb4, 1, 3, 3, 2, 1, 1, 4, 2}
+		}, MatchPartial, "Windows", []string{"scale"}, 0},
+		{"полезная нагрузка", func(p *testPacket) { p.payload = []byte("GET") }, MatchPartial, "Linux", []string{"pclass"}, 0},
+	}
+	for _, tt := range tests {
+		p := linuxSYN()
+		tt.modify(&p)
+		seg, ok := DecodeIP(p.bytes())
+		if !ok {
+			t.Fatalf("%s: пакет не разобран", tt.name)
+		}
+		c := Classify(seg, db)
+		if c.Quality != tt.quality || !c.Signature.Label.Matches(tt.os) || c.Distance != tt.distance {
+			t.Errorf("%s: %s %s, расстояние %d; ожидалось %s %s, %d (%v)",
+				tt.name, c.Quality, c.OS(), c.Distance, tt.quality, tt.os, tt.distance, c.Mismatches)
+			continue
+		}
+		var fields []string
+		for _, m := range c.Mismatches {
+			fields = append(fields, m.Field)
+		}
+		if strings.Join(fields, ",") != strings.Join(tt.fields, ",") {
+			t.Errorf("%s: расхождения %v, ожидалось %v", tt.name, fields, tt.fields)
+		}
+	}
+}
+
+func TestClassifyPrefersSpecific(t *testing.T) {
+	seg, _ := DecodeIP(linuxSYN().bytes())
+	c := Classify(seg, testDB(t))
+	if c.Signature.Label.Generic || !strings.Contains(c.Signature.Label.String(), "3.11") {
+		t.Fatalf("выбрана %s, ожидалась точная сигнатура Linux 3.11", c.Signature.Label)
+	}
+	if !c.Is("linux") || c.Is("windows") {
+		t.Fatalf("Is: неверное сравнение метки %s", c.Signature.Label)
+	}
+}
+
+func TestClassifySYNACK(t *testing.T) {
+	db := testDB(t)
+	p := testPacket{
+		src: "198.51.100.1", dst: "192.0.2.10", ttl: 57, df: true,
+		sport: 443, dport: 40000, seq: 7, ack: 1001, flags: tcpFlagSYN | tcpFlagACK,
+		window: 14600, tcpOptions: []byte{2, 4, 0x05, 0xb4},
+	}
+	seg, _ := DecodeIP(p.bytes())
+	if c := Classify(seg, db); c.Quality != MatchExact || c.Signature != db.Responses[0] {
+		t.Fatalf("SYN-ACK: %s %s (%v)", c.Quality, c.OS(), c.Mismatches)
+	}
+
+	if c := Classify(seg, nil); c.Quality != MatchNone || c.OS() != "???" {
+		t.Fatalf("без базы: %s %s", c.Quality, c.OS())
+	}
+}
+
+func TestSameQuirks(t *testing.T) {
+	tests := []struct {
+		a, b []string
+		want bool
+	}{
+		{nil, nil, true},
+		{[]string{"df", "id+"}, []string{"id+", "df"}, true},
+		{[]string{"df"}, []string{"df", "id+"}, false},
+		{[]string{"df", "df"}, []string{"df", "id+"}, false},
+	}
+	for _, tt := range tests {
+		if got := sameQuirks(tt.a, tt.b); got != tt.want {
+			t.Errorf("sameQuirks(%v, %v) = %v", tt.a, tt.b, got)
+		}
+	}
+}
@@ -0,0 +1,352 @@
+package analyzer
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+const (
+	tcpFlagFIN = 0x01
+	tcpFlagSYN = 0x02
+	tcpFlagRST = 0x04
+	tcpFlagPSH = 0x08
+	tcpFlagACK = 0x10
+	tcpFlagURG = 0x20
+	tcpFlagECE = 0x40
+	tcpFlagCWR = 0x80
+
+	etherTypeIPv4 = 0x0800
+	etherTypeIPv6 = 0x86dd
+	etherTypeVLAN = 0x8100
+	etherTypeQinQ = 0x88a8
+)
+
+// TCPSegment - разобранные заголовки ip и tcp одного пакета вместе с
+// раскладкой опций и особенностями (quirks) в нотации p0f.
+type TCPSegment struct {
+	Timestamp time.Time
+
+	IPVersion    int
+	Src          netip.Addr
+	Dst          netip.Addr
+	TTL          uint8
+	TOS          uint8
+	IPID         uint16
+	DF           bool
+	IPOptionsLen int
+	FlowLabel    uint32
+
+	SrcPort uint16
+	DstPort uint16
+	Seq     uint32
+	Ack     uint32
+	Flags   uint8
+	Window  uint16
+	Urgent  uint16
+
+	MSS           int
+	WindowScale   int
+	SACKPermitted bool
+	HasTimestamps bool
+	TSVal         uint32
+	TSEcr         uint32
+
+	OptionLayout string
+	Quirks       []string
+	PayloadLen   int
+}
+
+func (s *TCPSegment) IsSYN() bool {
+	return s.Flags&(tcpFlagSYN|tcpFlagACK) == tcpFlagSYN
+}
+
+func (s *TCPSegment) IsSYNACK() bool {
+	return s.Flags&(tcpFlagSYN|tcpFlagACK) == tcpFlagSYN|tcpFlagACK
+}
+
+func (s *TCPSegment) HasQuirk(quirk string) bool {
+	for _, q := range s.Quirks {
+		if q == quirk {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *TCPSegment) SrcAddrPort() netip.AddrPort {
+	return netip.AddrPortFrom(s.Src, s.SrcPort)
+}
+
+func (s *TCPSegment) DstAddrPort() netip.AddrPort {
+	return netip.AddrPortFrom(s.Dst, s.DstPort)
+}
+
+func (s *TCPSegment) String() string {
+	return fmt.Sprintf("%s -> %s ttl=%d win=%d mss=%d ws=%d olayout=%s quirks=%s",
+		s.SrcAddrPort(), s.DstAddrPort(), s.TTL, s.Window, s.MSS, s.WindowScale,
+		s.OptionLayout, strings.Join(s.Quirks, ","))
+}
+
+// DecodeTCP снимает канальный уровень и разбирает ip/tcp. Второе значение
+// false, если пакет не tcp или обрезан.
+func DecodeTCP(p *Packet) (*TCPSegment, bool) {
+	ipData, ok := stripLinkLayer(p.LinkType, p.Data)
+	if !ok {
+		return nil, false
+	}
+
+	seg, ok := DecodeIP(ipData)
+	if !ok {
+		return nil, false
+	}
+	seg.Timestamp = p.Timestamp
+	return seg, true
+}
+
+func stripLinkLayer(linkType LinkType, data []byte) ([]byte, bool) {
+	switch linkType {
+	case LinkTypeRaw, LinkTypeIPv4, LinkTypeIPv6:
+		return data, true
+
+	case LinkTypeNull:
+		if len(data) < 4 {
+			return nil, false
+		}
+		return data[4:], true
+
+	case LinkTypeEthernet:
+		if len(data) < 14 {
+			return nil, false
+		}
+		etherType := binary.BigEndian.Uint16(data[12:14])
+		data = data[14:]
+		for etherType == etherTypeVLAN || etherType == etherTypeQinQ {
+			if len(data) < 4 {
+				return nil, false
+			}
+			etherType = binary.BigEndian.Uint16(data[2:4])
+			data = data[4:]
+		}
+		return data, etherType == etherTypeIPv4 || etherType == etherTypeIPv6
+
+	case LinkTypeLinuxSLL:
+		if len(data) < 16 {
+			return nil, false
+		}
+		proto := binary.BigEndian.Uint16(data[14:16])
+		return data[16:], proto == etherTypeIPv4 || proto == etherTypeIPv6
+
+	case LinkTypeLinuxSLL2:
+		if len(data) < 20 {
+			return nil, false
+		}
+		proto := binary.BigEndian.Uint16(data[0:2])
+		return data[20:], proto == etherTypeIPv4 || proto == etherTypeIPv6
+	}
+
+	return nil, false
+}
+
+// DecodeIP разбирает пакет, начинающийся с ip-заголовка.
+func DecodeIP(data []byte) (*TCPSegment, bool) {
+	if len(data) < 1 {
+		return nil, false
+	}
+
+	seg := &TCPSegment{MSS: -1, WindowScale: -1}
+	var payload []byte
+
+	switch data[0] >> 4 {
+	case 4:
+		if len(data) < 20 {
+			return nil, false
+		}
+		ihl := int(data[0]&0x0f) * 4
+		totalLen := int(binary.BigEndian.Uint16(data[2:4]))
+		if ihl < 20 || len(data) < ihl || data[9] != 6 {
+			return nil, false
+		}
+		if totalLen < ihl || totalLen > len(data) {
+			totalLen = len(data)
+		}
+
+		flags := data[6] >> 5
+		seg.IPVersion = 4
+		seg.TOS = data[1]
+		seg.IPID = binary.BigEndian.Uint16(data[4:6])
+		seg.DF = flags&0x2 != 0
+		seg.TTL = data[8]
+		seg.IPOptionsLen = ihl - 20
+		seg.Src = netip.AddrFrom4([4]byte(data[12:16]))
+		seg.Dst = netip.AddrFrom4([4]byte(data[16:20]))
+
+		if seg.DF {
+			seg.Quirks = append(seg.Quirks, "df")
+			if seg.IPID != 0 {
+				seg.Quirks = append(seg.Quirks, "id+")
+			}
+		} else if seg.IPID == 0 {
+			seg.Quirks = append(seg.Quirks, "id-")
+		}
+		if seg.TOS&0x03 != 0 {
+			seg.Quirks = append(seg.Quirks, "ecn")
+		}
+		if flags&0x4 != 0 {
+			seg.Quirks = append(seg.Quirks, "0+")
+		}
+		payload = data[ihl:totalLen]
+
+	case 6:
+		if len(data) < 40 || data[6] != 6 {
+			return nil, false
+		}
+		vtf := binary.BigEndian.Uint32(data[0:4])
+		seg.IPVersion = 6
+		seg.TOS = uint8(vtf >> 20)
+		seg.FlowLabel = vtf & 0xfffff
+		seg.TTL = data[7]
+		seg.Src = netip.AddrFrom16([16]byte(data[8:24]))
+		seg.Dst = netip.AddrFrom16([16]byte(data[24:40]))
+
+		if seg.TOS&0x03 != 0 {
+			seg.Quirks = append(seg.Quirks, "ecn")
+		}
+		if seg.FlowLabel != 0 {
+			seg.Quirks = append(seg.Quirks, "flow")
+		}
+		end := 40 + int(binary.BigEndian.Uint16(data[4:6]))
+		if end > len(data) {
+			end = len(data)
+		}
+		payload = data[40:end]
+
+	default:
+		return nil, false
+	}
+
+	if !decodeTCP(seg, payload) {
+		return nil, false
+	}
+	return seg, true
+}
+
+func decodeTCP(seg *TCPSegment, data []byte) bool {
+	if len(data) < 20 {
+		return false
+	}
+	dataOffset := int(data[12]>>4) * 4
+	if dataOffset < 20 || dataOffset > len(data) {
+		return false
+	}
+
+	seg.SrcPort = binary.BigEndian.Uint16(data[0:2])
+	seg.DstPort = binary.BigEndian.Uint16(data[2:4])
+	seg.Seq = binary.BigEndian.Uint32(data[4:8])
+	seg.Ack = binary.BigEndian.Uint32(data[8:12])
+	seg.Flags = data[13]
+	seg.Window = binary.BigEndian.Uint16(data[14:16])
+	seg.Urgent = binary.BigEndian.Uint16(data[18:20])
+	seg.PayloadLen = len(data) - dataOffset
+
+	if seg.Flags&(tcpFlagECE|tcpFlagCWR) != 0 || data[12]&0x0f != 0 {
+		seg.addQuirk("ecn")
+	}
+	if seg.Seq == 0 {
+		seg.addQuirk("seq-")
+	}
+	if seg.Flags&tcpFlagACK != 0 {
+		if seg.Ack == 0 {
+			seg.addQuirk("ack-")
+		}
+	} else if seg.Ack != 0 && seg.Flags&tcpFlagRST == 0 {
+		seg.addQuirk("ack+")
+	}
+	if seg.Flags&tcpFlagURG != 0 {
+		seg.addQuirk("urgf+")
+	} else if seg.Urgent != 0 {
+		seg.addQuirk("uptr+")
+	}
+	if seg.Flags&tcpFlagPSH != 0 {
+		seg.addQuirk("pushf+")
+	}
+
+	decodeTCPOptions(seg, data[20:dataOffset])
+	return true
+}
+
+func (s *TCPSegment) addQuirk(quirk string) {
+	if !s.HasQuirk(quirk) {
+		s.Quirks = append(s.Quirks, quirk)
+	}
+}
+
+func decodeTCPOptions(seg *TCPSegment, opts []byte) {
+	var layout []string
+
+	for i := 0; i < len(opts); {
+		kind := opts[i]
+		switch kind {
+		case 0:
+			rest := opts[i+1:]
+			layout = append(layout, fmt.Sprintf("eol+%d", len(rest)))
+			for _, b := range rest {
+				if b != 0 {
+					seg.addQuirk("opt+")
+					break
+				}
+			}
+			seg.OptionLayout = strings.Join(layout, ",")
+			return
+		case 1:
+			layout = append(layout, "nop")
+			i++
+			continue
+		}
+
+		if i+1 >= len(opts) || opts[i+1] < 2 || i+int(opts[i+1]) > len(opts) {
+			seg.addQuirk("bad")
+			break
+		}
+		length := int(opts[i+1])
+		body := opts[i+2 : i+length]
+
+		switch {
+		case kind == 2 && length == 4:
+			layout = append(layout, "mss")
+			seg.MSS = int(binary.BigEndian.Uint16(body))
+		case kind == 3 && length == 3:
+			layout = append(layout, "ws")
+			seg.WindowScale = int(body[0])
+			if seg.WindowScale > 14 {
+				seg.addQuirk("exws")
+			}
+		case kind == 4 && length == 2:
+			layout = append(layout, "sok")
+			seg.SACKPermitted = true
+		case kind == 5:
+			layout = append(layout, "sack")
+		case kind == 8 && length == 10:
+			layout = append(layout, "ts")
+			seg.HasTimestamps = true
+			seg.TSVal = binary.BigEndian.Uint32(body[0:4])
+			seg.TSEcr = binary.BigEndian.Uint32(body[4:8])
+			if seg.TSVal == 0 {
+				seg.addQuirk("ts1-")
+			}
+			if seg.TSEcr != 0 && seg.Flags&tcpFlagACK == 0 {
+				seg.addQuirk("ts2+")
+			}
+		case kind == 2 || kind == 3 || kind == 4 || kind == 8:
+			seg.addQuirk("bad")
+			layout = append(layout, fmt.Sprintf("?%d", kind))
+		default:
+			layout = append(layout, fmt.Sprintf("?%d", kind))
+		}
+		i += length
+	}
+
+	seg.OptionLayout = strings.Join(layout, ",")
+}
@@ -0,0 +1,263 @@
+package analyzer
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"slices"
+	"testing"
+)
+
+// testPacket описывает пакет ip/tcp для тестов; bytes собирает его без
+// канального заголовка. Контрольные суммы не считаются: разбор их не
+// проверяет.
+type testPacket struct {
+	src, dst   string
+	ttl        uint8
+	id         uint16
+	df, mf     bool
+	reserved   bool
+	tos        uint8
+	flowLabel  uint32
+	ipOptions  []byte
+	proto      uint8
+	sport      uint16
+	dport      uint16
+	seq, ack   uint32
+	flags      uint8
+	window     uint16
+	urgent     uint16
+	tcpOptions []byte
+	payload    []byte
+}
+
+func (p testPacket) bytes() []byte {
+	tcp := make([]byte, 20, 20+len(p.tcpOptions)+len(p.payload))
+	binary.BigEndian.PutUint16(tcp[0:2], p.sport)
+	binary.BigEndian.PutUint16(tcp[2:4], p.dport)
+	binary.BigEndian.PutUint32(tcp[4:8], p.seq)
+	binary.BigEndian.PutUint32(tcp[8:12], p.ack)
+	tcp[12] = byte((20+len(p.tcpOptions))/4) << 4
+	tcp[13] = p.flags
+	binary.BigEndian.PutUint16(tcp[14:16], p.window)
+	binary.BigEndian.PutUint16(tcp[18:20], p.urgent)
+	tcp = append(tcp, p.tcpOptions...)
+	tcp = append(tcp, p.payload...)
+
+	proto := p.proto
+	if proto == 0 {
+		proto = 6
+	}
+	src, dst := netip.MustParseAddr(p.src), netip.MustParseAddr(p.dst)
+	if src.Is6() {
+		ip := make([]byte, 40, 40+len(tcp))
+		binary.BigEndian.PutUint32(ip[0:4], 6<<28|uint32(p.tos)<<20|p.flowLabel)
+		binary.BigEndian.PutUint16(ip[4:6], uint16(len(tcp)))
+		ip[6] = proto
+		ip[7] = p.ttl
+		copy(ip[8:24], src.AsSlice())
+		copy(ip[24:40], dst.AsSlice())
+		return append(ip, tcp...)
+	}
+
+	ihl := 20 + len(p.ipOptions)
+	ip := make([]byte, 20, ihl+len(tcp))
+	ip[0] = 4<<4 | byte(ihl/4)
+	ip[1] = p.tos
+	binary.BigEndian.PutUint16(ip[2:4], uint16(ihl+len(tcp)))
+	binary.BigEndian.PutUint16(ip[4:6], p.id)
+	var flags byte
+	if p.reserved {
+		flags |= 0x80
+	}
+	if p.df {
+		flags |= 0x40
+	}
+	if p.mf {
+		flags |= 0x20
+	}
+	ip[6] = flags
+	ip[8] = p.ttl
+	ip[9] = proto
+	copy(ip[12:16], src.AsSlice())
+	copy(ip[16:20], dst.AsSlice())
+	ip = append(ip, p.ipOptions...)
+	return append(ip, tcp...)
+}
+
+// Опции SYN настоящих ОС, байт в байт.
+var (
+	linuxSYNOptions = []byte{
+		2, 4, 0x05, 0xb4, // mss 1460
+		4, 2, // sok
+		8, 10, 0, 0, 0x12, 0x34, 0, 0, 0, 0, // ts
+		1,       // nop
+		3, 3, 7, // ws 7
+	}
+	windowsSYNOptions = []byte{
+		2, 4, 0x05, 0xb4,
+		1,
+		3, 3, 8,
+		1, 1,
+		4, 2,
+	}
+)
+
+func linuxSYN() testPacket {
+	return testPacket{
+		src: "192.0.2.10", dst: "198.51.100.1", ttl: 64, id: 0x1234, df: true,
+		sport: 40000, dport: 443, seq: 1000, flags: tcpFlagSYN, window: 29200,
+		tcpOptions: linuxSYNOptions,
+	}
+}
+
+func TestStripLinkLayer(t *testing.T) {
+	ip := linuxSYN().bytes()
+	ether := func(types ...uint16) []byte {
+		b := make([]byte, 12)
+		for i, typ := range types {
+			if i > 0 {
+				b = append(b, 0, 1) // tci
+			}
+			b = binary.BigEndian.AppendUint16(b, typ)
+		}
+		return append(b, ip...)
+	}
+	sll := append(make([]byte, 14), 0x08, 0x00)
+	sll2 := append([]byte{0x08, 0x00}, make([]byte, 18)...)
+
+	tests := []struct {
+		name     string
+		linkType LinkType
+		data     []byte
+		ok       bool
+	}{
+		{"raw", LinkTypeRaw, ip, true},
+		{"ipv4", LinkTypeIPv4, ip, true},
+		{"null", LinkTypeNull, append([]byte{2, 0, 0, 0}, ip...), true},
+		{"ethernet", LinkTypeEthernet, ether(etherTypeIPv4), true},
+		{"vlan", LinkTypeEthernet, ether(etherTypeVLAN, etherTypeIPv4), true},
+		{"qinq", LinkTypeEthernet, ether(etherTypeQinQ, etherTypeVLAN, etherTypeIPv4), true},
+		{"arp", LinkTypeEthernet, ether(0x0806), false},
+		{"обрезанный vlan", LinkTypeEthernet, ether(etherTypeVLAN)[:14], false},
+		{"sll", LinkTypeLinuxSLL, append(sll, ip...), true},
+		{"sll2", LinkTypeLinuxSLL2, append(sll2, ip...), true},
+		{"короткий sll2", LinkTypeLinuxSLL2, sll2[:10], false},
+		{"неизвестный тип", LinkType(147), ip, false},
+	}
+	for _, tt := range tests {
+		seg, ok := DecodeTCP(&Packet{LinkType: tt.linkType, Data: tt.data})
+		if ok != tt.ok {
+			t.Errorf("%s: ok = %v, ожидалось %v", tt.name, ok, tt.ok)
+			continue
+		}
+		if ok && (seg.SrcPort != 40000 || seg.Window != 29200) {
+			t.Errorf("%s: разобрано %s", tt.name, seg)
+		}
+	}
+}
+
+func TestDecodeSYN(t *testing.T) {
+	seg, ok := DecodeIP(linuxSYN().bytes())
+	if !ok {
+		t.Fatal("SYN не разобран")
+	}
+	if seg.IPVersion != 4 || seg.Src != netip.MustParseAddr("192.0.2.10") || seg.DstPort != 443 ||
+		seg.TTL != 64 || seg.IPID != 0x1234 || !seg.DF || !seg.IsSYN() || seg.IsSYNACK() {
+		t.Errorf("заголовки разобраны неверно: %+v", seg)
+	}
+	if seg.OptionLayout != "mss,sok,ts,nop,ws" || seg.MSS != 1460 || seg.WindowScale != 7 ||
+		!seg.SACKPermitted || !seg.HasTimestamps || seg.TSVal != 0x1234 || seg.TSEcr != 0 {
+		t.Errorf("опции разобраны неверно: %+v", seg)
+	}
+	if want := []string{"df", "id+"}; !slices.Equal(seg.Quirks, want) {
+		t.Errorf("quirks = %v, ожидалось %v", seg.Quirks, want)
+	}
+
+	v6 := linuxSYN()
+	v6.src, v6.dst, v6.flowLabel = "2001:db8::1", "2001:db8::2", 0xabcde
+	seg, ok = DecodeIP(v6.bytes())
+	if !ok || seg.IPVersion != 6 || seg.FlowLabel != 0xabcde || seg.TTL != 64 || seg.OptionLayout != "mss,sok,ts,nop,ws" {
+		t.Errorf("ipv6 SYN разобран неверно: %+v", seg)
+	}
+}
+
+func TestDecodeRejects(t *testing.T) {
+	udp := linuxSYN()
+	udp.proto = 17
+	short := linuxSYN().bytes()
+	badOffset := linuxSYN().bytes()
+	badOffset[20+12] = 15 << 4
+
+	for name, data := range map[string][]byte{
+		"пусто":             nil,
+		"udp":               udp.bytes(),
+		"версия 5":          append([]byte{0x50}, short[1:]...),
+		"обрезанный ip":     short[:19],
+		"обрезанный tcp":    short[:30],
+		"data offset > len": badOffset,
+	} {
+		if seg, ok := DecodeIP(data); ok {
+			t.Errorf("%s: разобрано %s", name, seg)
+		}
+	}
+}
+
+func TestDecodeQuirks(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(p *testPacket)
+		layout string
+		quirks []string
+	}{
+		{"без df с id", func(p *testPacket) { p.df = false }, "mss,sok,ts,nop,ws", nil},
+		{"без df и id", func(p *testPacket) { p.df, p.id = false, 0 }, "mss,sok,ts,nop,ws", []string{"id-"}},
+		{"df с нулевым id", func(p *testPacket) { p.id = 0 }, "mss,sok,ts,nop,ws", []string{"df"}},
+		{"ecn в tos", func(p *testPacket) { p.tos = 0x02 }, "mss,sok,ts,nop,ws", []string{"df", "id+", "ecn"}},
+		{"ecn во флагах", func(p *testPacket) { p.flags |= tcpFlagECE | tcpFlagCWR }, "mss,sok,ts,nop,ws", []string{"df", "id+", "ecn"}},
+		{"зарезервированный бит", func(p *testPacket) { p.reserved = true }, "mss,sok,ts,nop,ws", []string{"df", "id+", "0+"}},
+		{"нулевой seq", func(p *testPacket) { p.seq = 0 }, "mss,sok,ts,nop,ws", []string{"df", "id+", "seq-"}},
+		{"ack без флага", func(p *testPacket) { p.ack = 5 }, "mss,sok,ts,nop,ws", []string{"df", "id+", "ack+"}},
+		{"флаг ack без номера", func(p *testPacket) { p.flags |= tcpFlagACK }, "mss,sok,ts,nop,ws", []string{"df", "id+", "ack-"}},
+		{"указатель urg", func(p *testPacket) { p.urgent = 1 }, "mss,sok,ts,nop,ws", []string{"df", "id+", "uptr+"}},
+		{"флаг urg", func(p *testPacket) { p.flags |= tcpFlagURG }, "mss,sok,ts,nop,ws", []string{"df", "id+", "urgf+"}},
+		{"флаг push", func(p *testPacket) { p.flags |= tcpFlagPSH }, "mss,sok,ts,nop,ws", []string{"df", "id+", "pushf+"}},
+		{"нулевой tsval", func(p *testPacket) {
+			p.tcpOptions = []byte{8, 10, 0, 0, 0, 0, 0, 0, 0, 0, 1, 1}
+		}, "ts,nop,nop", []string{"df", "id+", "ts1-"}},
+		{"tsecr в SYN", func(p *testPacket) {
+			p.tcpOptions = []byte{8, 10, 0, 0, 0, 1, 0, 0, 0, 9, 1, 1}
+		}, "ts,nop,nop", []string{"df", "id+", "ts2+"}},
+		{"данные после eol", func(p *testPacket) {
+			p.tcpOptions = []byte{2, 4, 5, 0xb4, 0, 0, 1, 0}
+		}, "mss,eol+3", []string{"df", "id+", "opt+"}},
+		{"нули после eol", func(p *testPacket) {
+			p.tcpOptions = []byte{2, 4, 5, 0xb4, 0, 0, 0, 0}
+		}, "mss,eol+3", []string{"df", "id+"}},
+		{"ws больше 14", func(p *testPacket) { p.tcpOptions = []byte{3, 3, 15, 1} }, "ws,nop", []string{"df", "id+", "exws"}},
+		{"mss неверной длины", func(p *testPacket) { p.tcpOptions = []byte{2, 3, 5, 1} }, "?2,nop", []string{"df", "id+", "bad"}},
+		{"опция за концом", func(p *testPacket) { p.tcpOptions = []byte{1, 1, 2, 8} }, "nop,nop", []string{"df", "id+", "bad"}},
+		{"неизвестная опция", func(p *testPacket) { p.tcpOptions = []byte{30, 4, 0, 0} }, "?30", []string{"df", "id+"}},
+	}
+	for _, tt := range tests {
+		p := linuxSYN()
+		tt.modify(&p)
+		seg, ok := DecodeIP(p.bytes())
+		if !ok {
+			t.Errorf("%s: пакет не разобран", tt.name)
+			continue
+		}
+		if seg.OptionLayout != tt.layout {
+			t.Errorf("%s: раскладка %q, ожидалась %q", tt.name, seg.OptionLayout, tt.layout)
+		}
+		if !sameQuirks(seg.Quirks, tt.quirks) {
+			t.Errorf("%s: quirks %v, ожидалось %v", tt.name, seg.Quirks, tt.quirks)
+		}
+	}
+
+	v6 := linuxSYN()
+	v6.src, v6.dst, v6.flowLabel, v6.tos = "2001:db8::1", "2001:db8::2", 1, 0x01
+	seg, _ := DecodeIP(v6.bytes())
+	if want := []string{"ecn", "flow"}; !sameQuirks(seg.Quirks, want) {
+		t.Errorf("ipv6: quirks %v, ожидалось %v", seg.Quirks, want)
+	}
+}
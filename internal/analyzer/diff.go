@@ -0,0 +1,287 @@
+package analyzer
+
+import (
+	"fmt"
+	"net/netip"
+	"sort"
+	"strconv"
+
+	"custom-tcp-fingerprint/internal/p0f"
+)
+
+// DiffFields - поля SYN, распределения которых сравнивает DiffCaptures, в
+// порядке вывода.
+var DiffFields = []string{"ttl", "window", "mss", "wscale", "olayout", "ipid", "df", "ecn"}
+
+// Способы группировки SYN в DiffCaptures.
+const (
+	GroupAll     = "all"
+	GroupSource  = "source"
+	GroupProfile = "profile"
+)
+
+// ipidIncrementMax - наибольший прирост ip id между соседними SYN одного
+// источника, который еще считается последовательным счетчиком.
+const ipidIncrementMax = 1024
+
+type DiffOptions struct {
+	// GroupBy - GroupAll (по умолчанию), GroupSource (адрес источника) или
+	// GroupProfile (ОС по базе DB). Сравниваются группы с одинаковым ключом.
+	GroupBy string
+	DB      *p0f.Database
+	// Filter отбирает SYN; nil - все.
+	Filter func(*TCPSegment) bool
+	// Tolerance - расстояние между распределениями, начиная с которого поле
+	// считается отличающимся.
+	Tolerance float64
+}
+
+// Distribution - число SYN с каждым значением поля.
+type Distribution map[string]int
+
+// Share возвращает долю SYN со значением value.
+func (d Distribution) Share(value string) float64 {
+	total := 0
+	for _, n := range d {
+		total += n
+	}
+	if total == 0 {
+		return 0
+	}
+	return float64(d[value]) / float64(total)
+}
+
+// Values возвращает значения по убыванию числа SYN.
+func (d Distribution) Values() []string {
+	values := make([]string, 0, len(d))
+	for v := range d {
+		values = append(values, v)
+	}
+	sort.Slice(values, func(i, j int) bool {
+		if d[values[i]] != d[values[j]] {
+			return d[values[i]] > d[values[j]]
+		}
+		return values[i] < values[j]
+	})
+	return values
+}
+
+// FieldDiff - распределения одного поля в двух захватах. Distance - полное
+// вариационное расстояние: 0 у одинаковых долей, 1 у непересекающихся
+// значений.
+type FieldDiff struct {
+	Field    string       `json:"field"`
+	A        Distribution `json:"a"`
+	B        Distribution `json:"b"`
+	Distance float64      `json:"distance"`
+	Differs  bool         `json:"differs"`
+}
+
+type GroupDiff struct {
+	Group  string      `json:"group"`
+	SYNsA  int         `json:"syns_a"`
+	SYNsB  int         `json:"syns_b"`
+	Fields []FieldDiff `json:"fields"`
+}
+
+// Differs сообщает, что группа есть только в одном захвате или хотя бы одно
+// поле отличается.
+func (g *GroupDiff) Differs() bool {
+	if g.SYNsA == 0 || g.SYNsB == 0 {
+		return true
+	}
+	for _, f := range g.Fields {
+		if f.Differs {
+			return true
+		}
+	}
+	return false
+}
+
+type DiffReport struct {
+	A      string      `json:"a"`
+	B      string      `json:"b"`
+	Groups []GroupDiff `json:"groups"`
+}
+
+func (r *DiffReport) Differs() bool {
+	for i := range r.Groups {
+		if r.Groups[i].Differs() {
+			return true
+		}
+	}
+	return false
+}
+
+// DiffCaptures сравнивает SYN двух файлов pcap или pcapng: для каждой
+// группы строит распределения полей DiffFields и отмечает поля, расстояние
+// между распределениями которых больше opts.Tolerance.
+func DiffCaptures(fileA, fileB string, opts DiffOptions) (*DiffReport, error) {
+	switch opts.GroupBy {
+	case "":
+		opts.GroupBy = GroupAll
+	case GroupAll, GroupSource:
+	case GroupProfile:
+		if opts.DB == nil {
+			return nil, fmt.Errorf("для группировки по профилю нужна база p0f")
+		}
+	default:
+		return nil, fmt.Errorf("неизвестная группировка %q: ожидалось all, source или profile", opts.GroupBy)
+	}
+
+	groupsA, err := synDistributions(fileA, opts)
+	if err != nil {
+		return nil, err
+	}
+	groupsB, err := synDistributions(fileB, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, 0, len(groupsA)+len(groupsB))
+	for k := range groupsA {
+		keys = append(keys, k)
+	}
+	for k := range groupsB {
+		if _, ok := groupsA[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	report := &DiffReport{A: fileA, B: fileB, Groups: []GroupDiff{}}
+	for _, k := range keys {
+		a, b := groupsA[k], groupsB[k]
+		g := GroupDiff{Group: k}
+		if a != nil {
+			g.SYNsA = a.syns
+		}
+		if b != nil {
+			g.SYNsB = b.syns
+		}
+		for _, field := range DiffFields {
+			f := FieldDiff{Field: field, A: Distribution{}, B: Distribution{}}
+			if a != nil {
+				f.A = a.fields[field]
+			}
+			if b != nil {
+				f.B = b.fields[field]
+			}
+			f.Distance = distributionDistance(f.A, f.B)
+			f.Differs = f.Distance > opts.Tolerance
+			g.Fields = append(g.Fields, f)
+		}
+		report.Groups = append(report.Groups, g)
+	}
+	return report, nil
+}
+
+type synGroup struct {
+	syns   int
+	fields map[string]Distribution
+}
+
+func synDistributions(file string, opts DiffOptions) (map[string]*synGroup, error) {
+	segments, err := AnalyzePcapFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	groups := make(map[string]*synGroup)
+	lastIPID := make(map[netip.Addr]uint16)
+	for _, seg := range segments {
+		if !seg.IsSYN() || (opts.Filter != nil && !opts.Filter(seg)) {
+			continue
+		}
+
+		key := "*"
+		switch opts.GroupBy {
+		case GroupSource:
+			key = seg.Src.String()
+		case GroupProfile:
+			if c := Classify(seg, opts.DB); c.Quality >= MatchFuzzy {
+				key = c.OS()
+			} else {
+				key = "???"
+			}
+		}
+		g := groups[key]
+		if g == nil {
+			g = &synGroup{fields: make(map[string]Distribution)}
+			for _, field := range DiffFields {
+				g.fields[field] = Distribution{}
+			}
+			groups[key] = g
+		}
+		g.syns++
+
+		add := func(field, value string) {
+			g.fields[field][value]++
+		}
+		add("ttl", strconv.Itoa(int(seg.TTL)))
+		add("window", strconv.Itoa(int(seg.Window)))
+		add("mss", optionalInt(seg.MSS))
+		add("wscale", optionalInt(seg.WindowScale))
+		add("olayout", seg.OptionLayout)
+		add("ecn", onOff(seg.HasQuirk("ecn")))
+		if seg.IPVersion == 6 {
+			add("df", "-")
+			add("ipid", "-")
+			continue
+		}
+		add("df", onOff(seg.DF))
+
+		// Поведение ip id видно только по нескольким SYN одного источника,
+		// поэтому первый ненулевой id не учитывается.
+		prev, seen := lastIPID[seg.Src]
+		lastIPID[seg.Src] = seg.IPID
+		switch {
+		case seg.IPID == 0:
+			add("ipid", "zero")
+		case !seen:
+		case seg.IPID-prev > 0 && seg.IPID-prev <= ipidIncrementMax:
+			add("ipid", "inc")
+		default:
+			add("ipid", "random")
+		}
+	}
+	return groups, nil
+}
+
+// distributionDistance - половина суммы модулей разностей долей. Пустое
+// распределение означает, что данных нет, и ни с чем не различается.
+func distributionDistance(a, b Distribution) float64 {
+	if len(a) == 0 || len(b) == 0 {
+		return 0
+	}
+	values := make(map[string]bool)
+	for v := range a {
+		values[v] = true
+	}
+	for v := range b {
+		values[v] = true
+	}
+	sum := 0.0
+	for v := range values {
+		d := a.Share(v) - b.Share(v)
+		if d < 0 {
+			d = -d
+		}
+		sum += d
+	}
+	return sum / 2
+}
+
+func optionalInt(v int) string {
+	if v < 0 {
+		return "-"
+	}
+	return strconv.Itoa(v)
+}
+
+func onOff(b bool) string {
+	if b {
+		return "on"
+	}
+	return "off"
+}
@@ -0,0 +1,217 @@
+package analyzer
+
+import (
+	"maps"
+	"math"
+	"slices"
+	"testing"
+	"time"
+)
+
+// synCapture записывает SYN с интервалом 10 мс.
+func synCapture(t *testing.T, syns ...testPacket) string {
+	t.Helper()
+	packets := make([]capturedPacket, len(syns))
+	for i, p := range syns {
+		packets[i] = capturedPacket{at: time.Duration(i) * 10 * time.Millisecond, pkt: p}
+	}
+	return writeCapture(t, packets...)
+}
+
+// linuxSYNs - SYN linux с адреса 192.0.2.10 с заданными ip id, по одному
+// на соединение.
+func linuxSYNs(ids ...uint16) []testPacket {
+	syns := make([]testPacket, len(ids))
+	for i, id := range ids {
+		p := linuxSYN()
+		p.sport += uint16(i)
+		p.seq += uint32(i) * 100000
+		p.id = id
+		syns[i] = p
+	}
+	return syns
+}
+
+func windowsSYNs(n int) []testPacket {
+	syns := make([]testPacket, n)
+	for i := range syns {
+		syns[i] = testPacket{
+			src: "192.0.2.20", dst: "198.51.100.1", ttl: 128, df: true,
+			sport: 50000 + uint16(i), dport: 443, seq: 7000 + uint32(i), flags: tcpFlagSYN, window: 64240,
+			tcpOptions: windowsSYNOptions,
+		}
+	}
+	return syns
+}
+
+func ipv6SYN() testPacket {
+	p := linuxSYN()
+	p.src, p.dst = "2001:db8::30", "2001:db8::1"
+	p.flowLabel = 0x12345
+	return p
+}
+
+// diffCaptures записывает два захвата: в обоих linux и windows, но в b
+// ip id linux случаен и есть еще SYN по ipv6 с третьего адреса.
+func diffCaptures(t *testing.T) (string, string) {
+	t.Helper()
+	// 0xfffe, 0xffff, 0x0003: счетчик с переходом через ноль.
+	a := synCapture(t, append(linuxSYNs(0xfffe, 0xffff, 0x0003), windowsSYNs(3)...)...)
+	// 0x1234 -> 0x9000 -> 0x2000: скачки больше ipidIncrementMax в обе
+	// стороны.
+	b := synCapture(t, append(append(linuxSYNs(0x1234, 0x9000, 0x2000), windowsSYNs(3)...), ipv6SYN())...)
+	return a, b
+}
+
+func TestSYNDistributions(t *testing.T) {
+	a, b := diffCaptures(t)
+	tests := []struct {
+		file   string
+		source string
+		field  string
+		want   Distribution
+	}{
+		// Первый ненулевой id источника не учитывается.
+		{a, "192.0.2.10", "ipid", Distribution{"inc": 2}},
+		{a, "192.0.2.20", "ipid", Distribution{"zero": 3}},
+		{b, "192.0.2.10", "ipid", Distribution{"random": 2}},
+		{a, "192.0.2.10", "ttl", Distribution{"64": 3}},
+		{a, "192.0.2.10", "window", Distribution{"29200": 3}},
+		{a, "192.0.2.10", "mss", Distribution{"1460": 3}},
+		{a, "192.0.2.10", "olayout", Distribution{"mss,sok,ts,nop,ws": 3}},
+		{a, "192.0.2.20", "wscale", Distribution{"8": 3}},
+		{a, "192.0.2.20", "df", Distribution{"on": 3}},
+		{a, "192.0.2.20", "ecn", Distribution{"off": 3}},
+		{b, "2001:db8::30", "ipid", Distribution{"-": 1}},
+		{b, "2001:db8::30", "df", Distribution{"-": 1}},
+	}
+	for _, tt := range tests {
+		groups, err := synDistributions(tt.file, DiffOptions{GroupBy: GroupSource})
+		if err != nil {
+			t.Fatal(err)
+		}
+		g := groups[tt.source]
+		if g == nil {
+			t.Errorf("%s: нет группы %s", tt.file, tt.source)
+			continue
+		}
+		if got := g.fields[tt.field]; !maps.Equal(got, tt.want) {
+			t.Errorf("%s %s: %v, ожидалось %v", tt.source, tt.field, got, tt.want)
+		}
+	}
+}
+
+func TestDiffCapturesBySource(t *testing.T) {
+	a, b := diffCaptures(t)
+	report, err := DiffCaptures(a, b, DiffOptions{GroupBy: GroupSource, Tolerance: 0.1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Differs() {
+		t.Error("захваты не различаются")
+	}
+
+	tests := []struct {
+		group   string
+		synsA   int
+		synsB   int
+		differs bool
+		fields  []string
+	}{
+		{"192.0.2.10", 3, 3, true, []string{"ipid"}},
+		{"192.0.2.20", 3, 3, false, nil},
+		// Группа есть только в b: она отличается, но поля без данных с
+		// одной стороны не отмечаются.
+		{"2001:db8::30", 0, 1, true, nil},
+	}
+	if len(report.Groups) != len(tests) {
+		t.Fatalf("%d групп, ожидалось %d: %+v", len(report.Groups), len(tests), report.Groups)
+	}
+	for i, tt := range tests {
+		g := report.Groups[i]
+		if g.Group != tt.group || g.SYNsA != tt.synsA || g.SYNsB != tt.synsB || g.Differs() != tt.differs {
+			t.Errorf("группа %+v, ожидалось %s с %d и %d SYN, различие %v", g, tt.group, tt.synsA, tt.synsB, tt.differs)
+		}
+		var differs []string
+		for _, f := range g.Fields {
+			if f.Differs {
+				differs = append(differs, f.Field)
+			}
+		}
+		if !slices.Equal(differs, tt.fields) {
+			t.Errorf("%s: отличаются %v, ожидалось %v", tt.group, differs, tt.fields)
+		}
+	}
+}
+
+func TestDiffCapturesTolerance(t *testing.T) {
+	a, b := diffCaptures(t)
+	ipv4 := func(seg *TCPSegment) bool { return seg.IPVersion == 4 }
+
+	// ipid: {inc 2, zero 3} против {random 2, zero 3} - расстояние 0.4.
+	tests := []struct {
+		tolerance float64
+		differs   bool
+	}{
+		{0, true},
+		{0.39, true},
+		{0.4, false},
+		{0.5, false},
+	}
+	for _, tt := range tests {
+		report, err := DiffCaptures(a, b, DiffOptions{Filter: ipv4, Tolerance: tt.tolerance})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(report.Groups) != 1 || report.Groups[0].Group != "*" {
+			t.Fatalf("группы %+v, ожидалась одна группа *", report.Groups)
+		}
+		for _, f := range report.Groups[0].Fields {
+			if f.Field != "ipid" {
+				if f.Distance != 0 || f.Differs {
+					t.Errorf("допуск %v: поле %s отличается: %+v", tt.tolerance, f.Field, f)
+				}
+				continue
+			}
+			if math.Abs(f.Distance-0.4) > 1e-9 || f.Differs != tt.differs {
+				t.Errorf("допуск %v: ipid %+v, ожидалось расстояние 0.4 и различие %v", tt.tolerance, f, tt.differs)
+			}
+		}
+		if report.Differs() != tt.differs {
+			t.Errorf("допуск %v: отчет различается: %v", tt.tolerance, report.Differs())
+		}
+	}
+}
+
+func TestDiffCapturesGroupErrors(t *testing.T) {
+	a, b := diffCaptures(t)
+	if _, err := DiffCaptures(a, b, DiffOptions{GroupBy: GroupProfile}); err == nil {
+		t.Error("группировка по профилю без базы: ошибки нет")
+	}
+	if _, err := DiffCaptures(a, b, DiffOptions{GroupBy: "port"}); err == nil {
+		t.Error("неизвестная группировка: ошибки нет")
+	}
+}
+
+func TestDistributionDistance(t *testing.T) {
+	tests := []struct {
+		a, b Distribution
+		want float64
+	}{
+		{Distribution{"64": 3}, Distribution{"64": 1}, 0},
+		{Distribution{"64": 3}, Distribution{"128": 2}, 1},
+		{Distribution{"64": 1, "128": 1}, Distribution{"64": 1}, 0.5},
+		{Distribution{"inc": 2, "zero": 3}, Distribution{"random": 2, "zero": 3}, 0.4},
+		// Без данных с одной стороны различия нет.
+		{Distribution{}, Distribution{"64": 1}, 0},
+		{nil, nil, 0},
+	}
+	for _, tt := range tests {
+		if got := distributionDistance(tt.a, tt.b); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("%v и %v: %v, ожидалось %v", tt.a, tt.b, got, tt.want)
+		}
+		if got := distributionDistance(tt.b, tt.a); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("%v и %v: %v, ожидалось %v", tt.b, tt.a, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package analyzer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"time"
+
+	"custom-tcp-fingerprint/internal/logging"
+)
+
+// pendingHandshakeTTL - сколько ждать SYN-ACK и ACK после SYN, прежде чем
+// выдать рукопожатие незавершенным. Покрывает две повторные отправки SYN
+// при начальном RTO в одну секунду.
+const pendingHandshakeTTL = 3 * time.Second
+
+// handshakeExpireInterval - как часто искать истекшие рукопожатия. Проверка
+// идет и по таймауту чтения, и после пакетов, поэтому на загруженном
+// интерфейсе она не откладывается.
+const handshakeExpireInterval = time.Second
+
+// Handshake - тройное рукопожатие TCP, собранное из захваченных пакетов.
+// Время измеряется в точке захвата.
+type Handshake struct {
+	Client netip.AddrPort
+	Server netip.AddrPort
+
+	SYN *TCPSegment
+	// SYNACK и ACK равны nil, если ответ не был замечен до истечения
+	// ожидания или сброса соединения.
+	SYNACK *TCPSegment
+	ACK    *TCPSegment
+
+	// RTT - время от SYN до SYN-ACK, ACKDelay - от SYN-ACK до ACK.
+	RTT      time.Duration
+	ACKDelay time.Duration
+
+	// Retransmits - число повторных SYN с тем же порядковым номером.
+	Retransmits int
+	// Reset - сервер ответил на SYN сегментом RST.
+	Reset bool
+}
+
+// Complete сообщает, замечены ли все три сегмента.
+func (h Handshake) Complete() bool {
+	return h.SYNACK != nil && h.ACK != nil
+}
+
+func (h Handshake) String() string {
+	state := "завершено"
+	switch {
+	case h.Reset:
+		state = "сброшено"
+	case h.SYNACK == nil:
+		state = "нет ответа"
+	case h.ACK == nil:
+		state = "нет ack"
+	}
+	return fmt.Sprintf("%s -> %s %s rtt=%s ttl=%d win=%d mss=%d ws=%d olayout=%s",
+		h.Client, h.Server, state, h.RTT,
+		h.SYN.TTL, h.SYN.Window, h.SYN.MSS, h.SYN.WindowScale, h.SYN.OptionLayout)
+}
+
+type handshakeKey struct {
+	client, server netip.AddrPort
+}
+
+// CaptureHandshakes захватывает пакеты интерфейса iface (в текущем network
+// namespace) и выдает в канал рукопожатия TCP по мере их завершения.
+// Рукопожатие без SYN-ACK или ACK выдается после истечения ожидания, со
+// сбросом - сразу после RST. filter дополнительно ограничивает пакеты
+// (синтаксис CompileFilter) и выполняется в ядре. Захват идет до отмены
+// ctx, после чего канал закрывается; незавершенные рукопожатия при этом
+// отбрасываются.
+func CaptureHandshakes(ctx context.Context, iface, filter string) (<-chan Handshake, error) {
+	expr := "tcp"
+	if filter != "" {
+		expr = "tcp and (" + filter + ")"
+	}
+	src, err := OpenPacketSource(iface, expr)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(chan Handshake)
+	go func() {
+		<-ctx.Done()
+		src.Close()
+	}()
+	go func() {
+		defer close(out)
+		t := &handshakeTracker{pending: make(map[handshakeKey]*Handshake)}
+		emit := func(h *Handshake) bool {
+			select {
+			case out <- *h:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+
+		for {
+			src.SetReadDeadline(time.Now().Add(handshakeExpireInterval))
+			pkt, err := src.ReadPacket()
+			if err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+				if !errors.Is(err, os.ErrClosed) {
+					logging.Errorf("ошибка захвата рукопожатий на %s: %v", iface, err)
+					src.Close()
+				}
+				return
+			}
+			if err == nil {
+				if seg, ok := DecodeTCP(pkt); ok {
+					if h := t.add(seg); h != nil && !emit(h) {
+						return
+					}
+				}
+			}
+			for _, h := range t.expireEvery(time.Now()) {
+				if !emit(h) {
+					return
+				}
+			}
+		}
+	}()
+	return out, nil
+}
+
+// handshakeTracker сопоставляет SYN, SYN-ACK и ACK по адресам и номерам
+// последовательности.
+type handshakeTracker struct {
+	pending    map[handshakeKey]*Handshake
+	lastExpire time.Time
+}
+
+// add учитывает сегмент и возвращает рукопожатие, если оно завершилось
+// или было сброшено.
+func (t *handshakeTracker) add(seg *TCPSegment) *Handshake {
+	switch {
+	case seg.IsSYN():
+		key := handshakeKey{seg.SrcAddrPort(), seg.DstAddrPort()}
+		if h, ok := t.pending[key]; ok && h.SYN.Seq == seg.Seq {
+			h.Retransmits++
+			return nil
+		}
+		t.pending[key] = &Handshake{Client: key.client, Server: key.server, SYN: seg}
+
+	case seg.IsSYNACK():
+		h, ok := t.pending[handshakeKey{seg.DstAddrPort(), seg.SrcAddrPort()}]
+		if ok && h.SYNACK == nil && seg.Ack == h.SYN.Seq+1 {
+			h.SYNACK = seg
+			h.RTT = seg.Timestamp.Sub(h.SYN.Timestamp)
+		}
+
+	case seg.Flags&tcpFlagRST != 0:
+		key := handshakeKey{seg.DstAddrPort(), seg.SrcAddrPort()}
+		if h, ok := t.pending[key]; ok && h.SYNACK == nil {
+			delete(t.pending, key)
+			h.Reset = true
+			h.RTT = seg.Timestamp.Sub(h.SYN.Timestamp)
+			return h
+		}
+
+	case seg.Flags&tcpFlagACK != 0:
+		key := handshakeKey{seg.SrcAddrPort(), seg.DstAddrPort()}
+		if h, ok := t.pending[key]; ok && h.SYNACK != nil && seg.Ack == h.SYNACK.Seq+1 {
+			delete(t.pending, key)
+			h.ACK = seg
+			h.ACKDelay = seg.Timestamp.Sub(h.SYNACK.Timestamp)
+			return h
+		}
+	}
+	return nil
+}
+
+// expire убирает рукопожатия, ожидающие дольше pendingHandshakeTTL.
+func (t *handshakeTracker) expire(now time.Time) []*Handshake {
+	var expired []*Handshake
+	for key, h := range t.pending {
+		if now.Sub(h.SYN.Timestamp) > pendingHandshakeTTL {
+			delete(t.pending, key)
+			expired = append(expired, h)
+		}
+	}
+	return expired
+}
+
+// expireEvery вызывает expire не чаще раза в handshakeExpireInterval.
+func (t *handshakeTracker) expireEvery(now time.Time) []*Handshake {
+	if now.Sub(t.lastExpire) < handshakeExpireInterval {
+		return nil
+	}
+	t.lastExpire = now
+	return t.expire(now)
+}
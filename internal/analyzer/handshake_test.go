@@ -0,0 +1,169 @@
+package analyzer
+
+import (
+	"testing"
+	"time"
+)
+
+var handshakeStart = time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+// handshakeSegment разбирает p так же, как захват, с временем at от
+// начала теста.
+func handshakeSegment(t *testing.T, p testPacket, at time.Duration) *TCPSegment {
+	t.Helper()
+	seg, ok := DecodeTCP(&Packet{Timestamp: handshakeStart.Add(at), LinkType: LinkTypeRaw, Data: p.bytes()})
+	if !ok {
+		t.Fatalf("не удалось разобрать %+v", p)
+	}
+	return seg
+}
+
+func synAckFor(syn testPacket, seq uint32) testPacket {
+	return testPacket{
+		src: syn.dst, dst: syn.src, ttl: 57, sport: syn.dport, dport: syn.sport,
+		seq: seq, ack: syn.seq + 1, flags: tcpFlagSYN | tcpFlagACK, window: 65535,
+	}
+}
+
+func ackFor(syn testPacket, serverSeq uint32) testPacket {
+	return testPacket{
+		src: syn.src, dst: syn.dst, ttl: 64, sport: syn.sport, dport: syn.dport,
+		seq: syn.seq + 1, ack: serverSeq + 1, flags: tcpFlagACK, window: 502,
+	}
+}
+
+func newHandshakeTracker() *handshakeTracker {
+	return &handshakeTracker{pending: make(map[handshakeKey]*Handshake)}
+}
+
+func TestHandshakeComplete(t *testing.T) {
+	tr := newHandshakeTracker()
+	syn := linuxSYN()
+
+	if h := tr.add(handshakeSegment(t, syn, 0)); h != nil {
+		t.Fatalf("рукопожатие выдано после SYN: %v", h)
+	}
+	// ACK до SYN-ACK и SYN-ACK с чужим номером не продвигают рукопожатие.
+	if h := tr.add(handshakeSegment(t, ackFor(syn, 7000), 5*time.Millisecond)); h != nil {
+		t.Fatalf("рукопожатие выдано по ACK без SYN-ACK")
+	}
+	wrong := synAckFor(syn, 7000)
+	wrong.ack++
+	tr.add(handshakeSegment(t, wrong, 10*time.Millisecond))
+
+	tr.add(handshakeSegment(t, synAckFor(syn, 7000), 30*time.Millisecond))
+	h := tr.add(handshakeSegment(t, ackFor(syn, 7000), 31*time.Millisecond))
+	if h == nil || !h.Complete() || h.Reset || h.Retransmits != 0 {
+		t.Fatalf("рукопожатие %+v, ожидалось завершенное", h)
+	}
+	if h.RTT != 30*time.Millisecond || h.ACKDelay != time.Millisecond {
+		t.Errorf("rtt %s, задержка ack %s", h.RTT, h.ACKDelay)
+	}
+	if h.Client.String() != "192.0.2.10:40000" || h.Server.String() != "198.51.100.1:443" {
+		t.Errorf("адреса %s -> %s", h.Client, h.Server)
+	}
+	if h.SYN.MSS != 1460 || h.SYNACK.TTL != 57 || h.ACK.Window != 502 {
+		t.Errorf("сегменты %v / %v / %v", h.SYN, h.SYNACK, h.ACK)
+	}
+	if len(tr.pending) != 0 {
+		t.Errorf("после завершения ожидают %d рукопожатий", len(tr.pending))
+	}
+}
+
+func TestHandshakeSYNRetransmit(t *testing.T) {
+	tr := newHandshakeTracker()
+	syn := linuxSYN()
+
+	tr.add(handshakeSegment(t, syn, 0))
+	tr.add(handshakeSegment(t, syn, time.Second))
+	tr.add(handshakeSegment(t, syn, 3*time.Second))
+	tr.add(handshakeSegment(t, synAckFor(syn, 1), 3*time.Second+20*time.Millisecond))
+	h := tr.add(handshakeSegment(t, ackFor(syn, 1), 3*time.Second+21*time.Millisecond))
+	if h == nil || h.Retransmits != 2 {
+		t.Fatalf("рукопожатие %+v, ожидалось 2 повтора", h)
+	}
+	// RTT считается от первого SYN: повторы не сбрасывают его время.
+	if h.RTT != 3*time.Second+20*time.Millisecond {
+		t.Errorf("rtt %s", h.RTT)
+	}
+
+	// SYN с другим номером с того же порта - новое соединение.
+	tr.add(handshakeSegment(t, syn, 10*time.Second))
+	next := syn
+	next.seq = 555
+	tr.add(handshakeSegment(t, next, 11*time.Second))
+	tr.add(handshakeSegment(t, synAckFor(next, 9), 11*time.Second+time.Millisecond))
+	h = tr.add(handshakeSegment(t, ackFor(next, 9), 11*time.Second+2*time.Millisecond))
+	if h == nil || h.Retransmits != 0 || h.SYN.Seq != 555 {
+		t.Fatalf("рукопожатие %+v, ожидалось новое без повторов", h)
+	}
+}
+
+func TestHandshakeReset(t *testing.T) {
+	tr := newHandshakeTracker()
+	syn := linuxSYN()
+	tr.add(handshakeSegment(t, syn, 0))
+
+	rst := synAckFor(syn, 0)
+	rst.flags = tcpFlagRST | tcpFlagACK
+	h := tr.add(handshakeSegment(t, rst, 2*time.Millisecond))
+	if h == nil || !h.Reset || h.SYNACK != nil || h.Complete() {
+		t.Fatalf("рукопожатие %+v, ожидался сброс", h)
+	}
+	if h.RTT != 2*time.Millisecond {
+		t.Errorf("rtt %s", h.RTT)
+	}
+	if len(tr.pending) != 0 {
+		t.Errorf("после сброса ожидают %d рукопожатий", len(tr.pending))
+	}
+
+	// RST после SYN-ACK рукопожатие не прерывает: оно завершится по ACK
+	// или истечет.
+	tr.add(handshakeSegment(t, syn, time.Second))
+	tr.add(handshakeSegment(t, synAckFor(syn, 3), time.Second+time.Millisecond))
+	if h := tr.add(handshakeSegment(t, rst, time.Second+2*time.Millisecond)); h != nil {
+		t.Fatalf("RST после SYN-ACK выдал рукопожатие %+v", h)
+	}
+}
+
+func TestHandshakeExpireUnderTraffic(t *testing.T) {
+	tr := newHandshakeTracker()
+	lost := linuxSYN()
+	lost.sport = 50000
+	tr.add(handshakeSegment(t, lost, 0))
+
+	// Каждые 10 мс приходит новый SYN без ответа: таймаут чтения при таком
+	// потоке не наступает, и истечение идет только после пакетов.
+	other := linuxSYN()
+	var lostAt time.Duration
+	checks := 0
+	for at := 10 * time.Millisecond; at <= 10*time.Second; at += 10 * time.Millisecond {
+		other.sport++
+		seg := handshakeSegment(t, other, at)
+		tr.add(seg)
+
+		last := tr.lastExpire
+		for _, h := range tr.expireEvery(seg.Timestamp) {
+			if h.SYNACK != nil || h.Reset {
+				t.Fatalf("истекло рукопожатие с ответом: %+v", h)
+			}
+			if h.Client.Port() == lost.sport {
+				lostAt = at
+			}
+		}
+		if tr.lastExpire != last {
+			checks++
+		}
+		// Ожидают не больше SYN за pendingHandshakeTTL и один интервал.
+		if limit := int((pendingHandshakeTTL+handshakeExpireInterval)/(10*time.Millisecond)) + 1; len(tr.pending) > limit {
+			t.Fatalf("%s: ожидают %d рукопожатий, больше %d", at, len(tr.pending), limit)
+		}
+	}
+
+	if lostAt <= pendingHandshakeTTL || lostAt > pendingHandshakeTTL+handshakeExpireInterval {
+		t.Errorf("SYN без ответа истек на %s, ожидалось в пределах интервала после %s", lostAt, pendingHandshakeTTL)
+	}
+	if checks > 11 {
+		t.Errorf("проверок истечения %d за 10 секунд, ожидалось не чаще раза в секунду", checks)
+	}
+}
@@ -0,0 +1,435 @@
+package analyzer
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/netip"
+	"slices"
+	"sort"
+	"time"
+
+	"custom-tcp-fingerprint/internal/stack"
+)
+
+// Начальные значения ttl, из которых выбирается ближайшее сверху к
+// наблюдаемому (как в p0f).
+var initialTTLs = []int{32, 64, 128, 255}
+
+// Типичные частоты часов TSval; измеренная частота округляется к одной из
+// них, если отличается не больше чем на timestampHzTolerance.
+var (
+	timestampRates       = []float64{1, 10, 100, 250, 1000, 1e6}
+	timestampHzTolerance = 0.15
+)
+
+// minTimestampSpan - наименьший интервал внутри соединения, по которому
+// измеряется частота TSval.
+const minTimestampSpan = 200 * time.Millisecond
+
+type LearnOptions struct {
+	// Name - имя профиля.
+	Name string
+	// Source - адрес изучаемого хоста; нулевой - источник с наибольшим
+	// числом SYN.
+	Source netip.Addr
+}
+
+// LearnProfile выводит профиль из SYN хоста в захвате: поля и раскладку
+// опций берет по самым частым значениям, начальный ttl - по наибольшему
+// наблюдаемому, режимы ip id и flow label - по последовательности SYN
+// разных соединений. Частота часов TSval, поведение ISN и паузы повторных
+// SYN записываются в Observed.
+func LearnProfile(file string, opts LearnOptions) (*stack.Profile, error) {
+	r, f, err := OpenPcapFile(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var segments []*TCPSegment
+	for {
+		pkt, err := r.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("ошибка чтения %s: %w", file, err)
+		}
+		if seg, ok := DecodeTCP(pkt); ok {
+			segments = append(segments, seg)
+		}
+	}
+
+	src := opts.Source
+	if !src.IsValid() {
+		src = busiestSYNSource(segments)
+		if !src.IsValid() {
+			return nil, fmt.Errorf("в %s нет SYN", file)
+		}
+	}
+
+	var own []*TCPSegment
+	for _, seg := range segments {
+		if seg.Src == src {
+			own = append(own, seg)
+		}
+	}
+	syns, retransmits := splitSYNAttempts(own)
+	if len(syns) == 0 {
+		return nil, fmt.Errorf("в %s нет SYN от %s", file, src)
+	}
+
+	p := &stack.Profile{
+		Name:     opts.Name,
+		Observed: &stack.ProfileObservations{Capture: file, Source: src.String(), SYNs: len(syns)},
+	}
+	learnSYNFields(p, syns)
+	p.ReceiveBuffer = learnReceiveBuffer(segments, syns, p.Window)
+	p.IPID = learnIPID(syns)
+	p.FlowLabel = learnFlowLabel(syns)
+
+	p.Observed.TimestampHz = learnTimestampHz(own)
+	p.Observed.ISN = learnISN(syns)
+	for _, d := range retransmits {
+		p.Observed.SYNRetransmits = append(p.Observed.SYNRetransmits, d.String())
+	}
+
+	if _, err := p.TCPOptions(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func busiestSYNSource(segments []*TCPSegment) netip.Addr {
+	counts := make(map[netip.Addr]int)
+	var best netip.Addr
+	for _, seg := range segments {
+		if !seg.IsSYN() {
+			continue
+		}
+		counts[seg.Src]++
+		if n := counts[seg.Src]; n > counts[best] || (n == counts[best] && seg.Src.Less(best)) {
+			best = seg.Src
+		}
+	}
+	return best
+}
+
+type synAttempt struct {
+	src, dst netip.AddrPort
+	seq      uint32
+}
+
+// splitSYNAttempts отделяет первые SYN соединений от повторных и
+// возвращает медианные паузы перед каждым повтором по номеру повтора.
+// Повторный SYN - с тем же адресом, портами и номером последовательности.
+func splitSYNAttempts(segments []*TCPSegment) ([]*TCPSegment, []time.Duration) {
+	var first []*TCPSegment
+	sent := make(map[synAttempt][]time.Time)
+	for _, seg := range segments {
+		if !seg.IsSYN() {
+			continue
+		}
+		key := synAttempt{seg.SrcAddrPort(), seg.DstAddrPort(), seg.Seq}
+		if _, ok := sent[key]; !ok {
+			first = append(first, seg)
+		}
+		sent[key] = append(sent[key], seg.Timestamp)
+	}
+
+	var gaps [][]time.Duration
+	for _, times := range sent {
+		for i := 1; i < len(times); i++ {
+			if len(gaps) < i {
+				gaps = append(gaps, nil)
+			}
+			gaps[i-1] = append(gaps[i-1], times[i].Sub(times[i-1]))
+		}
+	}
+	retransmits := make([]time.Duration, 0, len(gaps))
+	for _, g := range gaps {
+		slices.Sort(g)
+		retransmits = append(retransmits, g[len(g)/2].Round(time.Millisecond))
+	}
+	return first, retransmits
+}
+
+func learnSYNFields(p *stack.Profile, syns []*TCPSegment) {
+	windows, mss, scales := make(map[int]int), make(map[int]int), make(map[int]int)
+	layouts := make(map[string]int)
+	maxTTL, maxHopLimit := 0, 0
+	df, v4 := 0, 0
+	multiple, sameMultiple := 0, true
+
+	for _, seg := range syns {
+		segMSS := seg.MSS
+		if seg.IPVersion == 6 {
+			maxHopLimit = max(maxHopLimit, int(seg.TTL))
+			// MSS профиля задан для ipv4.
+			if segMSS > 0 {
+				segMSS += 20
+			}
+		} else {
+			maxTTL = max(maxTTL, int(seg.TTL))
+			v4++
+			if seg.DF {
+				df++
+			}
+		}
+
+		windows[int(seg.Window)]++
+		mss[max(segMSS, 0)]++
+		scales[max(seg.WindowScale, 0)]++
+		layouts[seg.OptionLayout]++
+
+		switch {
+		case seg.MSS <= 0 || int(seg.Window)%seg.MSS != 0:
+			sameMultiple = false
+		case multiple == 0:
+			multiple = int(seg.Window) / seg.MSS
+		case multiple != int(seg.Window)/seg.MSS:
+			sameMultiple = false
+		}
+	}
+
+	p.MSS = mostCommon(mss)
+	p.WindowScale = mostCommon(scales)
+	p.Options = mostCommon(layouts)
+	p.DF = v4 == 0 || df*2 > v4
+
+	p.Observed.TTL = max(maxTTL, maxHopLimit)
+	if maxTTL > 0 {
+		p.TTL = initialTTL(maxTTL)
+		if maxHopLimit > 0 && initialTTL(maxHopLimit) != p.TTL {
+			p.HopLimit = initialTTL(maxHopLimit)
+		}
+	} else {
+		p.TTL = initialTTL(maxHopLimit)
+	}
+	if sameMultiple && multiple > 0 {
+		p.Observed.WindowMSS = multiple
+	}
+	// Окно SYN не масштабируется: кратное MSS годится, только если при
+	// MSS профиля оно помещается в 16 бит.
+	if p.Observed.WindowMSS > 0 && p.Observed.WindowMSS*p.MSS <= 0xffff {
+		p.Window = stack.WindowPolicy{Kind: stack.WindowMSS, Value: p.Observed.WindowMSS}
+	} else {
+		p.Window = stack.FixedWindow(mostCommon(windows))
+	}
+}
+
+// learnReceiveBuffer измеряет окно приема после рукопожатия по первому ACK
+// хоста после SYN-ACK с учетом согласованного window scale. Буфер
+// возвращается, только если в большинстве соединений окно отличается от
+// окна SYN при согласованном MSS больше чем на единицу масштаба.
+func learnReceiveBuffer(segments, syns []*TCPSegment, window stack.WindowPolicy) int {
+	type conn struct {
+		syn, synack *TCPSegment
+	}
+	conns := make(map[handshakeKey]*conn, len(syns))
+	for _, seg := range syns {
+		conns[handshakeKey{seg.SrcAddrPort(), seg.DstAddrPort()}] = &conn{syn: seg}
+	}
+
+	windows := make(map[int]int)
+	same, measured := 0, 0
+	for _, seg := range segments {
+		if seg.IsSYNACK() {
+			c, ok := conns[handshakeKey{seg.DstAddrPort(), seg.SrcAddrPort()}]
+			if ok && c.synack == nil && seg.Ack == c.syn.Seq+1 {
+				c.synack = seg
+			}
+			continue
+		}
+		if seg.Flags&(tcpFlagSYN|tcpFlagRST) != 0 || seg.Flags&tcpFlagACK == 0 {
+			continue
+		}
+		key := handshakeKey{seg.SrcAddrPort(), seg.DstAddrPort()}
+		c, ok := conns[key]
+		if !ok || c.synack == nil {
+			continue
+		}
+		delete(conns, key)
+
+		wnd, scale := int(seg.Window), 0
+		if c.syn.WindowScale >= 0 && c.synack.WindowScale >= 0 {
+			scale = c.syn.WindowScale
+			wnd <<= scale
+		}
+		mss := c.syn.MSS
+		if peer := c.synack.MSS; peer > 0 && (mss <= 0 || peer < mss) {
+			mss = peer
+		}
+		measured++
+		if abs(wnd-window.ReceiveWindow(mss, 0)) < 1<<scale {
+			same++
+		} else {
+			windows[wnd]++
+		}
+	}
+	if measured == 0 || same*2 >= measured {
+		return 0
+	}
+	return mostCommon(windows)
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// mostCommon возвращает самое частое значение, при равенстве - меньшее.
+func mostCommon[T cmp.Ordered](counts map[T]int) T {
+	var best T
+	n := 0
+	for v, c := range counts {
+		if c > n || (c == n && v < best) {
+			best, n = v, c
+		}
+	}
+	return best
+}
+
+// initialTTL возвращает начальный ttl для профиля. Вместо 255 пишется
+// stack.MaxTTL: больше стек на проводе не покажет, а наблюдаемое значение
+// остается в Observed.
+func initialTTL(ttl int) int {
+	for _, t := range initialTTLs {
+		if ttl <= t {
+			return min(t, stack.MaxTTL)
+		}
+	}
+	return stack.MaxTTL
+}
+
+// learnIPID определяет режим ip id по соседним SYN ipv4. Одного SYN с
+// ненулевым id мало, тогда режим остается на усмотрение стека.
+func learnIPID(syns []*TCPSegment) string {
+	var ids []uint16
+	for _, seg := range syns {
+		if seg.IPVersion == 4 {
+			ids = append(ids, seg.IPID)
+		}
+	}
+	if len(ids) == 0 {
+		return ""
+	}
+	zero, inc := 0, 0
+	for i, id := range ids {
+		if id == 0 {
+			zero++
+		}
+		if i > 0 {
+			if d := id - ids[i-1]; d > 0 && d <= ipidIncrementMax {
+				inc++
+			}
+		}
+	}
+	switch {
+	case zero == len(ids):
+		return stack.IPIDZero.String()
+	case len(ids) < 2:
+		return ""
+	case inc*5 >= (len(ids)-1)*4:
+		return stack.IPIDIncrement.String()
+	}
+	return stack.IPIDRandom.String()
+}
+
+func learnFlowLabel(syns []*TCPSegment) string {
+	seen := false
+	for _, seg := range syns {
+		if seg.IPVersion != 6 {
+			continue
+		}
+		if seg.FlowLabel != 0 {
+			return stack.FlowLabelRandom.String()
+		}
+		seen = true
+	}
+	if seen {
+		return stack.FlowLabelZero.String()
+	}
+	return ""
+}
+
+// learnTimestampHz измеряет частоту TSval внутри каждого соединения:
+// смещение часов может быть своим у каждого соединения, а частота общая.
+func learnTimestampHz(segments []*TCPSegment) int {
+	type span struct {
+		first, last *TCPSegment
+	}
+	spans := make(map[handshakeKey]*span)
+	for _, seg := range segments {
+		if !seg.HasTimestamps {
+			continue
+		}
+		key := handshakeKey{seg.SrcAddrPort(), seg.DstAddrPort()}
+		if s, ok := spans[key]; ok {
+			s.last = seg
+		} else {
+			spans[key] = &span{first: seg, last: seg}
+		}
+	}
+
+	var rates []float64
+	for _, s := range spans {
+		dt := s.last.Timestamp.Sub(s.first.Timestamp)
+		if dt < minTimestampSpan {
+			continue
+		}
+		ticks := s.last.TSVal - s.first.TSVal
+		if ticks == 0 || ticks > math.MaxInt32 {
+			continue
+		}
+		rates = append(rates, float64(ticks)/dt.Seconds())
+	}
+	if len(rates) == 0 {
+		return 0
+	}
+	sort.Float64s(rates)
+	rate := rates[len(rates)/2]
+	for _, r := range timestampRates {
+		if math.Abs(rate-r) <= r*timestampHzTolerance {
+			return int(r)
+		}
+	}
+	return int(math.Round(rate))
+}
+
+// learnISN сравнивает начальные номера SYN разных соединений по порядку.
+func learnISN(syns []*TCPSegment) string {
+	if len(syns) < 2 {
+		return ""
+	}
+	zero, same, inc := 0, 0, 0
+	for i, seg := range syns {
+		if seg.Seq == 0 {
+			zero++
+		}
+		if i == 0 {
+			continue
+		}
+		switch d := seg.Seq - syns[i-1].Seq; {
+		case d == 0:
+			same++
+		case d < 1<<24:
+			inc++
+		}
+	}
+	n := len(syns) - 1
+	switch {
+	case zero == len(syns):
+		return "zero"
+	case same == n:
+		return "constant"
+	case inc == n:
+		return "increment"
+	}
+	return "random"
+}
@@ -0,0 +1,297 @@
+package analyzer
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+
+	"custom-tcp-fingerprint/internal/stack"
+)
+
+func tsOption(val, ecr uint32) []byte {
+	b := binary.BigEndian.AppendUint32([]byte{8, 10}, val)
+	return binary.BigEndian.AppendUint32(b, ecr)
+}
+
+// learnCapture записывает четыре соединения хоста 192.0.2.10 с SYN как у
+// linux: ttl 57 после 7 хопов, окно 20 MSS, ip id по счетчику, случайные
+// ISN и часы TSval 1000 Гц со своим смещением в каждом соединении. SYN
+// первого соединения повторяется через 1 и 2 с, второго - через 1 с.
+// Окно первого ACK после SYN-ACK - 64256 при window scale 7. Еще один
+// SYN отправляет посторонний хост.
+func learnCapture(t *testing.T) string {
+	t.Helper()
+	const (
+		host   = "192.0.2.10"
+		server = "198.51.100.1"
+	)
+	isns := []uint32{0x1a2b3c4d, 0x9e8d7c6b, 0x05f4e3d2, 0xc0ffee00}
+	ids := []uint16{100, 107, 115, 121}
+	retries := [][]time.Duration{{time.Second, 3 * time.Second}, {time.Second}, nil, nil}
+
+	var packets []capturedPacket
+	for i, isn := range isns {
+		start := time.Duration(i) * 10 * time.Second
+		sport := uint16(41000 + i)
+		tsOffset := uint32(i+1) * 5000000
+		tsval := func(at time.Duration) uint32 { return tsOffset + uint32(at/time.Millisecond) }
+
+		last := time.Duration(0)
+		for n, at := range append([]time.Duration{0}, retries[i]...) {
+			syn := testPacket{
+				src: host, dst: server, ttl: 57, id: ids[i] + uint16(n), df: true,
+				sport: sport, dport: 443, seq: isn, flags: tcpFlagSYN, window: 29200,
+				tcpOptions: slices.Concat([]byte{2, 4, 0x05, 0xb4, 4, 2}, tsOption(tsval(at), 0), []byte{1, 3, 3, 7}),
+			}
+			packets = append(packets, capturedPacket{start + at, syn})
+			last = at
+		}
+
+		synack := testPacket{
+			src: server, dst: host, ttl: 50, df: true,
+			sport: 443, dport: sport, seq: 777, ack: isn + 1, flags: tcpFlagSYN | tcpFlagACK, window: 65160,
+			tcpOptions: slices.Concat([]byte{2, 4, 0x05, 0x78, 4, 2}, tsOption(9000, tsval(last)), []byte{1, 3, 3, 9}),
+		}
+		packets = append(packets, capturedPacket{start + last + 20*time.Millisecond, synack})
+		for _, at := range []time.Duration{last + 40*time.Millisecond, last + 300*time.Millisecond} {
+			ack := testPacket{
+				src: host, dst: server, ttl: 57, id: ids[i] + 10, df: true,
+				sport: sport, dport: 443, seq: isn + 1, ack: 778, flags: tcpFlagACK, window: 502,
+				tcpOptions: slices.Concat([]byte{1, 1}, tsOption(tsval(at), 9000)),
+			}
+			packets = append(packets, capturedPacket{start + at, ack})
+		}
+	}
+
+	other := linuxSYN()
+	other.src = "192.0.2.99"
+	packets = append(packets, capturedPacket{45 * time.Second, other})
+	return writeCapture(t, packets...)
+}
+
+func TestLearnProfile(t *testing.T) {
+	file := learnCapture(t)
+	p, err := LearnProfile(file, LearnOptions{Name: "learned"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := &stack.Profile{
+		Name:          "learned",
+		TTL:           64,
+		Window:        stack.WindowPolicy{Kind: stack.WindowMSS, Value: 20},
+		ReceiveBuffer: 502 << 7,
+		MSS:           1460,
+		WindowScale:   7,
+		Options:       "mss,sok,ts,nop,ws",
+		DF:            true,
+		IPID:          "increment",
+		Observed: &stack.ProfileObservations{
+			Capture:        file,
+			Source:         "192.0.2.10",
+			SYNs:           4,
+			TTL:            57,
+			WindowMSS:      20,
+			TimestampHz:    1000,
+			ISN:            "random",
+			SYNRetransmits: []string{"1s", "2s"},
+		},
+	}
+	if !reflect.DeepEqual(p, want) {
+		t.Errorf("профиль\n%+v\n%+v\nожидалось\n%+v\n%+v", p, p.Observed, want, want.Observed)
+	}
+
+	// Профиль загружается обратно так же, как файл из profile learn.
+	data, err := p.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "learned.yaml")
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := stack.NewRegistry().LoadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(loaded, p) {
+		t.Errorf("после загрузки\n%+v\n%+v\nожидалось\n%+v\n%+v", loaded, loaded.Observed, p, p.Observed)
+	}
+	opts, err := loaded.TCPOptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.SYNWindow(false) != 29200 || opts.IPID != stack.IPIDIncrement || !opts.TimestampsEnabled {
+		t.Errorf("параметры загруженного профиля: %+v", opts)
+	}
+}
+
+func TestLearnProfileSource(t *testing.T) {
+	file := learnCapture(t)
+	p, err := LearnProfile(file, LearnOptions{Source: netip.MustParseAddr("192.0.2.99")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Один SYN: режимы ip id и ISN не определить.
+	if p.Observed.SYNs != 1 || p.Observed.Source != "192.0.2.99" || p.TTL != 64 || p.IPID != "" || p.Observed.ISN != "" {
+		t.Errorf("профиль %+v, %+v", p, p.Observed)
+	}
+	if _, err := LearnProfile(file, LearnOptions{Source: netip.MustParseAddr("198.51.100.1")}); err == nil {
+		t.Error("источник без SYN: ошибки нет")
+	}
+}
+
+func TestSplitSYNAttempts(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	syn := func(port uint16, seq uint32, at time.Duration) *TCPSegment {
+		return &TCPSegment{
+			Timestamp: start.Add(at), IPVersion: 4,
+			Src: netip.MustParseAddr("192.0.2.10"), Dst: netip.MustParseAddr("198.51.100.1"),
+			SrcPort: port, DstPort: 443, Seq: seq, Flags: tcpFlagSYN,
+		}
+	}
+	segments := []*TCPSegment{
+		syn(1000, 1, 0),
+		syn(1001, 2, 100*time.Millisecond),
+		syn(1000, 1, time.Second),
+		syn(1002, 3, 1200*time.Millisecond),
+		syn(1001, 2, 1100*time.Millisecond),
+		syn(1000, 1, 3*time.Second),
+		// Тот же порт с новым ISN - новое соединение.
+		syn(1000, 9, 10*time.Second),
+		syn(1002, 3, 2400*time.Millisecond),
+		{Flags: tcpFlagSYN | tcpFlagACK},
+	}
+	first, retransmits := splitSYNAttempts(segments)
+	if len(first) != 4 || first[0] != segments[0] || first[1] != segments[1] || first[2] != segments[3] || first[3] != segments[6] {
+		t.Errorf("первые SYN: %v", first)
+	}
+	// Первые повторы: 1 с, 1 с, 1.2 с - медиана 1 с; второй повтор один.
+	if want := []time.Duration{time.Second, 2 * time.Second}; !slices.Equal(retransmits, want) {
+		t.Errorf("паузы %v, ожидалось %v", retransmits, want)
+	}
+}
+
+func TestLearnIPID(t *testing.T) {
+	tests := []struct {
+		name string
+		ids  []uint16
+		want string
+	}{
+		{"нули", []uint16{0, 0, 0}, "zero"},
+		{"счетчик", []uint16{10, 11, 15, 40}, "increment"},
+		{"счетчик через ноль", []uint16{0xfffd, 0xffff, 0x0002, 0x0009}, "increment"},
+		// Один скачок из пяти пар еще считается счетчиком.
+		{"счетчик со скачком", []uint16{10, 11, 12, 5000, 5001, 5002}, "increment"},
+		{"случайный", []uint16{0x1234, 0x9000, 0x2000, 0xf00d}, "random"},
+		{"один ненулевой", []uint16{77}, ""},
+		{"нет ipv4", nil, ""},
+	}
+	for _, tt := range tests {
+		syns := []*TCPSegment{{IPVersion: 6}}
+		for _, id := range tt.ids {
+			syns = append(syns, &TCPSegment{IPVersion: 4, IPID: id})
+		}
+		if got := learnIPID(syns); got != tt.want {
+			t.Errorf("%s: %q, ожидалось %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestLearnISN(t *testing.T) {
+	tests := []struct {
+		name string
+		seqs []uint32
+		want string
+	}{
+		{"нули", []uint32{0, 0, 0}, "zero"},
+		{"постоянный", []uint32{5, 5, 5}, "constant"},
+		{"счетчик", []uint32{1000, 64000, 1 << 20}, "increment"},
+		{"счетчик через ноль", []uint32{0xfffff000, 0x00001000}, "increment"},
+		{"случайный", []uint32{0x1a2b3c4d, 0x9e8d7c6b, 0x05f4e3d2}, "random"},
+		{"один SYN", []uint32{42}, ""},
+	}
+	for _, tt := range tests {
+		var syns []*TCPSegment
+		for _, seq := range tt.seqs {
+			syns = append(syns, &TCPSegment{Seq: seq})
+		}
+		if got := learnISN(syns); got != tt.want {
+			t.Errorf("%s: %q, ожидалось %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestLearnTimestampHz(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	tests := []struct {
+		name  string
+		span  time.Duration
+		ticks uint32
+		want  int
+	}{
+		{"1000 Гц", time.Second, 1000, 1000},
+		{"округление к 100 Гц", time.Second, 110, 100},
+		{"округление к 1 МГц", 500 * time.Millisecond, 520000, 1000000},
+		{"нестандартная частота", 2 * time.Second, 74, 37},
+		{"короткое соединение", 100 * time.Millisecond, 100, 0},
+		{"часы назад", time.Second, 0xffffff00, 0},
+	}
+	for _, tt := range tests {
+		// В каждом соединении свое смещение часов, частота общая.
+		var segments []*TCPSegment
+		for i := range 3 {
+			port := uint16(40000 + i)
+			base := uint32(i) * 0x10000000
+			segments = append(segments,
+				&TCPSegment{Timestamp: start, SrcPort: port, HasTimestamps: true, TSVal: base},
+				&TCPSegment{Timestamp: start.Add(tt.span / 2), SrcPort: port},
+				&TCPSegment{Timestamp: start.Add(tt.span), SrcPort: port, HasTimestamps: true, TSVal: base + tt.ticks},
+			)
+		}
+		if got := learnTimestampHz(segments); got != tt.want {
+			t.Errorf("%s: %d Гц, ожидалось %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestLearnSYNFieldsTTL(t *testing.T) {
+	tests := []struct {
+		name     string
+		ttls     []uint8
+		hopLimit uint8
+		ttl      int
+		want     int
+	}{
+		{"linux", []uint8{50, 57}, 0, 64, 0},
+		{"windows", []uint8{113, 120}, 0, 128, 0},
+		// 255 на проводе не получить, профиль получает MaxTTL.
+		{"cisco", []uint8{250}, 0, stack.MaxTTL, 0},
+		{"hop limit отличается", []uint8{120}, 60, 128, 64},
+		{"hop limit совпадает", []uint8{120}, 110, 128, 0},
+		{"только ipv6", nil, 250, stack.MaxTTL, 0},
+	}
+	for _, tt := range tests {
+		var syns []*TCPSegment
+		observed := 0
+		for _, ttl := range tt.ttls {
+			syns = append(syns, &TCPSegment{IPVersion: 4, TTL: ttl, MSS: 1460, WindowScale: -1, Window: 8192})
+			observed = max(observed, int(ttl))
+		}
+		if tt.hopLimit > 0 {
+			syns = append(syns, &TCPSegment{IPVersion: 6, TTL: tt.hopLimit, MSS: 1440, WindowScale: -1, Window: 8192})
+			observed = max(observed, int(tt.hopLimit))
+		}
+		p := &stack.Profile{Observed: &stack.ProfileObservations{}}
+		learnSYNFields(p, syns)
+		if p.TTL != tt.ttl || p.HopLimit != tt.want || p.Observed.TTL != observed {
+			t.Errorf("%s: ttl %d, hop limit %d, наблюдаемый %d; ожидалось %d, %d, %d",
+				tt.name, p.TTL, p.HopLimit, p.Observed.TTL, tt.ttl, tt.want, observed)
+		}
+	}
+}
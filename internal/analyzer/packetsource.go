@@ -0,0 +1,133 @@
+package analyzer
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// maxPacketSize - буфер чтения: больше любого MTU, в том числе с GRO.
+const maxPacketSize = 1 << 16
+
+// PacketSource читает пакеты интерфейса через сокет AF_PACKET в режиме
+// SOCK_DGRAM: ядро снимает канальный заголовок, поэтому TUN и Ethernet
+// дают одинаковые IP-пакеты (LinkTypeRaw). Пакеты других протоколов
+// (ARP и т. п.) пропускаются. Видны оба направления.
+type PacketSource struct {
+	iface string
+	f     *os.File
+	rc    syscall.RawConn
+	buf   []byte
+
+	closed atomic.Bool
+}
+
+// OpenPacketSource открывает сокет на интерфейсе iface. Сокет привязан к
+// network namespace, в котором вызвана функция. Непустой filter
+// компилируется CompileFilter и выполняется в ядре (SO_ATTACH_FILTER).
+func OpenPacketSource(iface, filter string) (*PacketSource, error) {
+	ifi, err := net.InterfaceByName(iface)
+	if err != nil {
+		return nil, fmt.Errorf("interface %s does not exist: %w", iface, err)
+	}
+	var prog []unix.SockFilter
+	if filter != "" {
+		if prog, err = CompileFilter(filter, maxPacketSize); err != nil {
+			return nil, err
+		}
+	}
+
+	// Сокет с нулевым протоколом не получает пакетов до bind, поэтому
+	// фильтр успевает встать раньше первого пакета.
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC|unix.SOCK_NONBLOCK, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open packet socket: %w", err)
+	}
+	if prog != nil {
+		fprog := unix.SockFprog{Len: uint16(len(prog)), Filter: &prog[0]}
+		if err := unix.SetsockoptSockFprog(fd, unix.SOL_SOCKET, unix.SO_ATTACH_FILTER, &fprog); err != nil {
+			unix.Close(fd)
+			return nil, fmt.Errorf("failed to attach filter: %w", err)
+		}
+	}
+	if err := unix.Bind(fd, &unix.SockaddrLinklayer{Protocol: htons(unix.ETH_P_ALL), Ifindex: ifi.Index}); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("failed to bind packet socket to %s: %w", iface, err)
+	}
+
+	f := os.NewFile(uintptr(fd), "packet:"+iface)
+	rc, err := f.SyscallConn()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &PacketSource{iface: iface, f: f, rc: rc, buf: make([]byte, maxPacketSize)}, nil
+}
+
+func (s *PacketSource) Interface() string {
+	return s.iface
+}
+
+func (s *PacketSource) LinkType() LinkType {
+	return LinkTypeRaw
+}
+
+// ReadPacket ждет следующий IP-пакет и возвращает его. Длина на проводе
+// может быть больше len(Data), если пакет не поместился в буфер. После
+// Close или истечения SetReadDeadline возвращает ошибку.
+func (s *PacketSource) ReadPacket() (*Packet, error) {
+	buf := s.buf
+	for {
+		var n int
+		var from unix.Sockaddr
+		var recvErr error
+		err := s.rc.Read(func(fd uintptr) bool {
+			n, from, recvErr = unix.Recvfrom(int(fd), buf, unix.MSG_TRUNC)
+			return !errors.Is(recvErr, unix.EAGAIN)
+		})
+		if err != nil {
+			// RawConn не оборачивает ошибку закрытого файла в os.ErrClosed.
+			if s.closed.Load() {
+				return nil, os.ErrClosed
+			}
+			return nil, err
+		}
+		if recvErr != nil {
+			return nil, recvErr
+		}
+
+		ll, ok := from.(*unix.SockaddrLinklayer)
+		if !ok || (ll.Protocol != htons(unix.ETH_P_IP) && ll.Protocol != htons(unix.ETH_P_IPV6)) {
+			continue
+		}
+		data := append([]byte(nil), buf[:min(n, len(buf))]...)
+		return &Packet{
+			Timestamp: time.Now(),
+			LinkType:  LinkTypeRaw,
+			Data:      data,
+			OrigLen:   n,
+		}, nil
+	}
+}
+
+func (s *PacketSource) SetReadDeadline(t time.Time) error {
+	return s.f.SetReadDeadline(t)
+}
+
+// Close прерывает ожидающий ReadPacket; тот возвращает os.ErrClosed.
+func (s *PacketSource) Close() error {
+	if s.closed.Swap(true) {
+		return nil
+	}
+	return s.f.Close()
+}
+
+func htons(v uint16) uint16 {
+	return v<<8 | v>>8
+}
@@ -0,0 +1,292 @@
+package analyzer
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+	"os"
+	"time"
+)
+
+const (
+	pcapMagicMicro = 0xa1b2c3d4
+	pcapMagicNano  = 0xa1b23c4d
+
+	pcapngBlockSHB = 0x0a0d0d0a
+	pcapngBlockIDB = 0x00000001
+	pcapngBlockSPB = 0x00000003
+	pcapngBlockEPB = 0x00000006
+
+	pcapngByteOrderMagic = 0x1a2b3c4d
+
+	maxPcapBlockSize = 16 << 20
+)
+
+type LinkType uint32
+
+const (
+	LinkTypeNull      LinkType = 0
+	LinkTypeEthernet  LinkType = 1
+	LinkTypeRaw       LinkType = 101
+	LinkTypeLinuxSLL  LinkType = 113
+	LinkTypeIPv4      LinkType = 228
+	LinkTypeIPv6      LinkType = 229
+	LinkTypeLinuxSLL2 LinkType = 276
+)
+
+type Packet struct {
+	Timestamp time.Time
+	LinkType  LinkType
+	Interface int
+	Data      []byte
+	OrigLen   int
+}
+
+type PcapReader struct {
+	r     *bufio.Reader
+	ng    bool
+	order binary.ByteOrder
+
+	linkType LinkType
+	nano     bool
+
+	interfaces []pcapngInterface
+}
+
+type pcapngInterface struct {
+	linkType LinkType
+	// tsRate - число тиков отметки времени в секунде.
+	tsRate uint64
+}
+
+func OpenPcapFile(path string) (*PcapReader, *os.File, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("не удалось открыть pcap файл: %w", err)
+	}
+
+	r, err := NewPcapReader(f)
+	if err != nil {
+		f.Close()
+		return nil, nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return r, f, nil
+}
+
+// NewPcapReader определяет формат по первому блоку: классический pcap
+// (микро- или наносекунды, любой порядок байт) или pcapng.
+func NewPcapReader(r io.Reader) (*PcapReader, error) {
+	pr := &PcapReader{r: bufio.NewReader(r)}
+
+	magic, err := pr.r.Peek(4)
+	if err != nil {
+		return nil, fmt.Errorf("не удалось прочитать заголовок pcap: %w", err)
+	}
+
+	if binary.LittleEndian.Uint32(magic) == pcapngBlockSHB {
+		pr.ng = true
+		return pr, nil
+	}
+
+	hdr := make([]byte, 24)
+	if _, err := io.ReadFull(pr.r, hdr); err != nil {
+		return nil, fmt.Errorf("не удалось прочитать заголовок pcap: %w", err)
+	}
+
+	switch {
+	case binary.LittleEndian.Uint32(hdr) == pcapMagicMicro:
+		pr.order = binary.LittleEndian
+	case binary.BigEndian.Uint32(hdr) == pcapMagicMicro:
+		pr.order = binary.BigEndian
+	case binary.LittleEndian.Uint32(hdr) == pcapMagicNano:
+		pr.order, pr.nano = binary.LittleEndian, true
+	case binary.BigEndian.Uint32(hdr) == pcapMagicNano:
+		pr.order, pr.nano = binary.BigEndian, true
+	default:
+		return nil, fmt.Errorf("неизвестный формат файла: magic %x", hdr[:4])
+	}
+
+	pr.linkType = LinkType(pr.order.Uint32(hdr[20:24]) & 0x0fffffff)
+	return pr, nil
+}
+
+// Next возвращает очередной пакет или io.EOF в конце файла.
+func (pr *PcapReader) Next() (*Packet, error) {
+	if pr.ng {
+		return pr.nextNG()
+	}
+	return pr.nextPcap()
+}
+
+func (pr *PcapReader) nextPcap() (*Packet, error) {
+	hdr := make([]byte, 16)
+	if _, err := io.ReadFull(pr.r, hdr); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, io.EOF
+		}
+		return nil, err
+	}
+
+	sec := int64(pr.order.Uint32(hdr[0:4]))
+	frac := int64(pr.order.Uint32(hdr[4:8]))
+	capLen := pr.order.Uint32(hdr[8:12])
+	origLen := pr.order.Uint32(hdr[12:16])
+	if capLen > maxPcapBlockSize {
+		return nil, fmt.Errorf("слишком большой пакет в pcap: %d байт", capLen)
+	}
+
+	data := make([]byte, capLen)
+	if _, err := io.ReadFull(pr.r, data); err != nil {
+		return nil, io.EOF
+	}
+
+	if !pr.nano {
+		frac *= 1000
+	}
+	return &Packet{
+		Timestamp: time.Unix(sec, frac),
+		LinkType:  pr.linkType,
+		Data:      data,
+		OrigLen:   int(origLen),
+	}, nil
+}
+
+func (pr *PcapReader) nextNG() (*Packet, error) {
+	for {
+		head := make([]byte, 8)
+		if _, err := io.ReadFull(pr.r, head); err != nil {
+			if errors.Is(err, io.ErrUnexpectedEOF) {
+				return nil, io.EOF
+			}
+			return nil, err
+		}
+
+		blockType := binary.LittleEndian.Uint32(head[0:4])
+		if blockType == pcapngBlockSHB {
+			bom, err := pr.r.Peek(4)
+			if err != nil {
+				return nil, io.EOF
+			}
+			if binary.LittleEndian.Uint32(bom) == pcapngByteOrderMagic {
+				pr.order = binary.LittleEndian
+			} else {
+				pr.order = binary.BigEndian
+			}
+			pr.interfaces = nil
+		} else if pr.order == nil {
+			return nil, fmt.Errorf("pcapng: блок %#x до section header", blockType)
+		}
+		blockType = pr.order.Uint32(head[0:4])
+
+		total := pr.order.Uint32(head[4:8])
+		if total < 12 || total > maxPcapBlockSize || total%4 != 0 {
+			return nil, fmt.Errorf("pcapng: некорректная длина блока %d", total)
+		}
+
+		body := make([]byte, total-8)
+		if _, err := io.ReadFull(pr.r, body); err != nil {
+			return nil, io.EOF
+		}
+		body = body[:len(body)-4]
+
+		switch blockType {
+		case pcapngBlockIDB:
+			if len(body) < 8 {
+				return nil, fmt.Errorf("pcapng: короткий interface description block")
+			}
+			iface := pcapngInterface{
+				linkType: LinkType(pr.order.Uint16(body[0:2])),
+				tsRate:   1e6,
+			}
+			if rate, ok := pr.tsResolution(body[8:]); ok {
+				iface.tsRate = rate
+			}
+			pr.interfaces = append(pr.interfaces, iface)
+
+		case pcapngBlockEPB:
+			if len(body) < 20 {
+				return nil, fmt.Errorf("pcapng: короткий enhanced packet block")
+			}
+			ifID := int(pr.order.Uint32(body[0:4]))
+			if ifID >= len(pr.interfaces) {
+				return nil, fmt.Errorf("pcapng: пакет ссылается на неизвестный интерфейс %d", ifID)
+			}
+			iface := pr.interfaces[ifID]
+			ts := uint64(pr.order.Uint32(body[4:8]))<<32 | uint64(pr.order.Uint32(body[8:12]))
+			capLen := int(pr.order.Uint32(body[12:16]))
+			origLen := int(pr.order.Uint32(body[16:20]))
+			if 20+capLen > len(body) {
+				return nil, fmt.Errorf("pcapng: длина пакета %d выходит за блок", capLen)
+			}
+			return &Packet{
+				Timestamp: pcapngTime(ts, iface.tsRate),
+				LinkType:  iface.linkType,
+				Interface: ifID,
+				Data:      body[20 : 20+capLen],
+				OrigLen:   origLen,
+			}, nil
+
+		case pcapngBlockSPB:
+			if len(body) < 4 || len(pr.interfaces) == 0 {
+				return nil, fmt.Errorf("pcapng: некорректный simple packet block")
+			}
+			origLen := int(pr.order.Uint32(body[0:4]))
+			data := body[4:]
+			if origLen < len(data) {
+				data = data[:origLen]
+			}
+			return &Packet{
+				LinkType: pr.interfaces[0].linkType,
+				Data:     data,
+				OrigLen:  origLen,
+			}, nil
+		}
+	}
+}
+
+// tsResolution разбирает опцию if_tsresol (код 9) из interface description
+// block и возвращает число тиков в секунде. Двоичные единицы не выражаются
+// целым числом наносекунд, поэтому считаем в тиках, а не в time.Duration.
+func (pr *PcapReader) tsResolution(options []byte) (uint64, bool) {
+	for len(options) >= 4 {
+		code := pr.order.Uint16(options[0:2])
+		length := int(pr.order.Uint16(options[2:4]))
+		options = options[4:]
+		if code == 0 || length > len(options) {
+			return 0, false
+		}
+		if code == 9 && length >= 1 {
+			v := options[0]
+			if v&0x80 != 0 {
+				if v&0x7f > 63 {
+					return 0, false
+				}
+				return uint64(1) << (v & 0x7f), true
+			}
+			if v > 19 {
+				return 0, false
+			}
+			rate := uint64(1)
+			for range v {
+				rate *= 10
+			}
+			return rate, true
+		}
+		options = options[(length+3)&^3:]
+	}
+	return 0, false
+}
+
+func pcapngTime(ts, rate uint64) time.Time {
+	if rate == 0 {
+		rate = 1e6
+	}
+	// frac < rate, поэтому старшая половина произведения меньше делителя и
+	// Div64 не паникует.
+	hi, lo := bits.Mul64(ts%rate, uint64(time.Second))
+	nanos, _ := bits.Div64(hi, lo, rate)
+	return time.Unix(int64(ts/rate), int64(nanos))
+}
@@ -0,0 +1,354 @@
+package analyzer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// byteOrder объединяет чтение и дописывание: нужен для сборки блоков pcapng.
+type byteOrder interface {
+	binary.ByteOrder
+	binary.AppendByteOrder
+}
+
+func pcapFile(order binary.ByteOrder, magic uint32, linkType LinkType, records ...[]byte) []byte {
+	hdr := make([]byte, 24)
+	order.PutUint32(hdr[0:4], magic)
+	order.PutUint16(hdr[4:6], 2)
+	order.PutUint16(hdr[6:8], 4)
+	order.PutUint32(hdr[16:20], 65535)
+	order.PutUint32(hdr[20:24], uint32(linkType))
+	for _, r := range records {
+		hdr = append(hdr, r...)
+	}
+	return hdr
+}
+
+func pcapRecord(order binary.ByteOrder, sec, frac uint32, data []byte) []byte {
+	rec := make([]byte, 16)
+	order.PutUint32(rec[0:4], sec)
+	order.PutUint32(rec[4:8], frac)
+	order.PutUint32(rec[8:12], uint32(len(data)))
+	order.PutUint32(rec[12:16], uint32(len(data)+100))
+	return append(rec, data...)
+}
+
+// ngBlock собирает блок pcapng с длиной в начале и в конце; total, если не
+// 0, записывается вместо настоящей длины.
+func ngBlock(order byteOrder, blockType uint32, body []byte, total uint32) []byte {
+	body = pad4(append([]byte(nil), body...))
+	if total == 0 {
+		total = uint32(12 + len(body))
+	}
+	b := order.AppendUint32(nil, blockType)
+	b = order.AppendUint32(b, total)
+	b = append(b, body...)
+	return order.AppendUint32(b, total)
+}
+
+func ngSHB(order byteOrder) []byte {
+	body := order.AppendUint32(nil, pcapngByteOrderMagic)
+	body = order.AppendUint16(body, 1)
+	body = order.AppendUint16(body, 0)
+	body = order.AppendUint64(body, ^uint64(0))
+	return ngBlock(order, pcapngBlockSHB, body, 0)
+}
+
+func ngIDB(order byteOrder, linkType LinkType, tsresol []byte) []byte {
+	body := order.AppendUint16(nil, uint16(linkType))
+	body = order.AppendUint16(body, 0)
+	body = order.AppendUint32(body, 0)
+	if tsresol != nil {
+		body = order.AppendUint16(body, pcapngOptTsResol)
+		body = order.AppendUint16(body, uint16(len(tsresol)))
+		body = pad4(append(body, tsresol...))
+		body = order.AppendUint32(body, 0)
+	}
+	return ngBlock(order, pcapngBlockIDB, body, 0)
+}
+
+func ngEPB(order byteOrder, iface uint32, ts uint64, data []byte) []byte {
+	body := order.AppendUint32(nil, iface)
+	body = order.AppendUint32(body, uint32(ts>>32))
+	body = order.AppendUint32(body, uint32(ts))
+	body = order.AppendUint32(body, uint32(len(data)))
+	body = order.AppendUint32(body, uint32(len(data)))
+	return ngBlock(order, pcapngBlockEPB, append(body, data...), 0)
+}
+
+func concat(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+// capturedPacket - пакет захвата и его время от начала захвата.
+type capturedPacket struct {
+	at  time.Duration
+	pkt testPacket
+}
+
+// writeCapture записывает пакеты в файл pcapng с интерфейсом без
+// канального заголовка и возвращает путь к нему.
+func writeCapture(t *testing.T, packets ...capturedPacket) string {
+	t.Helper()
+	var buf bytes.Buffer
+	w, err := NewPcapngWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	iface, err := w.AddInterface("tun0", LinkTypeRaw, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Unix(1700000000, 0)
+	for _, p := range packets {
+		if err := w.WritePacket(iface, start.Add(p.at), p.pkt.bytes(), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "capture.pcapng")
+	if err := os.WriteFile(path, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func readAll(t *testing.T, data []byte) ([]*Packet, error) {
+	t.Helper()
+	r, err := NewPcapReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	var pkts []*Packet
+	for {
+		pkt, err := r.Next()
+		if errors.Is(err, io.EOF) {
+			return pkts, nil
+		}
+		if err != nil {
+			return pkts, err
+		}
+		pkts = append(pkts, pkt)
+	}
+}
+
+func TestPcapClassic(t *testing.T) {
+	syn := linuxSYN().bytes()
+	tests := []struct {
+		name  string
+		order binary.ByteOrder
+		magic uint32
+		frac  uint32
+		want  time.Duration
+	}{
+		{"little endian, мкс", binary.LittleEndian, pcapMagicMicro, 250000, 250 * time.Millisecond},
+		{"big endian, мкс", binary.BigEndian, pcapMagicMicro, 1, time.Microsecond},
+		{"little endian, нс", binary.LittleEndian, pcapMagicNano, 7, 7},
+		{"big endian, нс", binary.BigEndian, pcapMagicNano, 999999999, 999999999},
+	}
+	for _, tt := range tests {
+		data := pcapFile(tt.order, tt.magic, LinkTypeRaw,
+			pcapRecord(tt.order, 1700000000, tt.frac, syn),
+			pcapRecord(tt.order, 1700000001, 0, syn[:20]))
+		pkts, err := readAll(t, data)
+		if err != nil || len(pkts) != 2 {
+			t.Errorf("%s: %d пакетов, ошибка %v", tt.name, len(pkts), err)
+			continue
+		}
+		want := time.Unix(1700000000, 0).Add(tt.want)
+		if !pkts[0].Timestamp.Equal(want) {
+			t.Errorf("%s: время %v, ожидалось %v", tt.name, pkts[0].Timestamp, want)
+		}
+		if pkts[0].LinkType != LinkTypeRaw || !bytes.Equal(pkts[0].Data, syn) || pkts[0].OrigLen != len(syn)+100 {
+			t.Errorf("%s: пакет разобран неверно: %+v", tt.name, pkts[0])
+		}
+		if len(pkts[1].Data) != 20 {
+			t.Errorf("%s: длина второго пакета %d", tt.name, len(pkts[1].Data))
+		}
+	}
+}
+
+func TestPcapClassicErrors(t *testing.T) {
+	le := binary.LittleEndian
+	syn := linuxSYN().bytes()
+	full := pcapFile(le, pcapMagicMicro, LinkTypeRaw, pcapRecord(le, 1, 0, syn))
+
+	if _, err := NewPcapReader(bytes.NewReader([]byte("GIF89a, not a capture"))); err == nil {
+		t.Errorf("неизвестный magic: ошибки нет")
+	}
+	if _, err := NewPcapReader(bytes.NewReader(full[:10])); err == nil {
+		t.Errorf("обрезанный заголовок файла: ошибки нет")
+	}
+
+	// Обрезанная запись - конец файла, а не ошибка: так заканчиваются
+	// захваты, прерванные на середине записи.
+	for _, n := range []int{24 + 8, 24 + 16 + 10} {
+		pkts, err := readAll(t, full[:n])
+		if err != nil || len(pkts) != 0 {
+			t.Errorf("обрезано до %d байт: %d пакетов, ошибка %v", n, len(pkts), err)
+		}
+	}
+
+	huge := pcapRecord(le, 1, 0, nil)
+	le.PutUint32(huge[8:12], maxPcapBlockSize+1)
+	if _, err := readAll(t, pcapFile(le, pcapMagicMicro, LinkTypeRaw, huge)); err == nil {
+		t.Errorf("запись больше %d байт: ошибки нет", maxPcapBlockSize)
+	}
+}
+
+func TestPcapngTimestampResolution(t *testing.T) {
+	le := binary.LittleEndian
+	tests := []struct {
+		name    string
+		tsresol []byte
+		ts      uint64
+		want    time.Time
+	}{
+		{"по умолчанию мкс", nil, 1700000000_000001, time.Unix(1700000000, 1000)},
+		{"10^-6", []byte{6}, 1700000000_500000, time.Unix(1700000000, 500000000)},
+		{"10^-9", []byte{9}, 1700000000_000000007, time.Unix(1700000000, 7)},
+		{"10^-3", []byte{3}, 1700000000_250, time.Unix(1700000000, 250000000)},
+		{"10^0", []byte{0}, 1700000000, time.Unix(1700000000, 0)},
+		{"2^-10", []byte{0x80 | 10}, 1700000000<<10 | 512, time.Unix(1700000000, 500000000)},
+		{"2^-20", []byte{0x80 | 20}, 1<<20 | 1<<18, time.Unix(1, 250000000)},
+		{"2^-30", []byte{0x80 | 30}, 1700000000<<30 | 1<<29, time.Unix(1700000000, 500000000)},
+	}
+	for _, tt := range tests {
+		data := concat(ngSHB(le), ngIDB(le, LinkTypeRaw, tt.tsresol), ngEPB(le, 0, tt.ts, linuxSYN().bytes()))
+		pkts, err := readAll(t, data)
+		if err != nil || len(pkts) != 1 {
+			t.Errorf("%s: %d пакетов, ошибка %v", tt.name, len(pkts), err)
+			continue
+		}
+		if !pkts[0].Timestamp.Equal(tt.want) {
+			t.Errorf("%s: время %v, ожидалось %v", tt.name, pkts[0].Timestamp, tt.want)
+		}
+	}
+}
+
+func TestPcapngBlocks(t *testing.T) {
+	syn := linuxSYN().bytes()
+	for _, order := range []byteOrder{binary.LittleEndian, binary.BigEndian} {
+		spb := ngBlock(order, pcapngBlockSPB, append(order.AppendUint32(nil, uint32(len(syn))), syn...), 0)
+		unknown := ngBlock(order, 0x0bad, []byte{1, 2, 3, 4}, 0)
+		data := concat(ngSHB(order),
+			ngIDB(order, LinkTypeRaw, []byte{9}),
+			ngIDB(order, LinkTypeEthernet, nil),
+			unknown,
+			ngEPB(order, 1, 5, append(make([]byte, 12), 0x08, 0x00)),
+			spb,
+			// Новая секция сбрасывает интерфейсы.
+			ngSHB(order),
+			ngIDB(order, LinkTypeIPv4, nil),
+			ngEPB(order, 0, 5, syn))
+
+		pkts, err := readAll(t, data)
+		if err != nil || len(pkts) != 3 {
+			t.Fatalf("%v: %d пакетов, ошибка %v", order, len(pkts), err)
+		}
+		if pkts[0].Interface != 1 || pkts[0].LinkType != LinkTypeEthernet || len(pkts[0].Data) != 14 {
+			t.Errorf("%v: пакет enhanced block разобран неверно: %+v", order, pkts[0])
+		}
+		if pkts[1].LinkType != LinkTypeRaw || !bytes.Equal(pkts[1].Data, syn) {
+			t.Errorf("%v: пакет simple block разобран неверно: %+v", order, pkts[1])
+		}
+		if pkts[2].LinkType != LinkTypeIPv4 || pkts[2].Interface != 0 {
+			t.Errorf("%v: пакет второй секции разобран неверно: %+v", order, pkts[2])
+		}
+	}
+}
+
+func TestPcapngErrors(t *testing.T) {
+	le := binary.LittleEndian
+	syn := linuxSYN().bytes()
+	shb, idb := ngSHB(le), ngIDB(le, LinkTypeRaw, nil)
+
+	epbOverflow := ngEPB(le, 0, 1, syn)
+	le.PutUint32(epbOverflow[8+12:], uint32(len(syn)+8))
+
+	tests := []struct {
+		name string
+		data []byte
+		err  string
+	}{
+		{"длина блока меньше 12", concat(shb, ngBlock(le, pcapngBlockIDB, nil, 8)), "некорректная длина блока 8"},
+		{"длина блока не кратна 4", concat(shb, idb, ngBlock(le, pcapngBlockEPB, make([]byte, 20), 34)), "некорректная длина блока 34"},
+		{"длина блока больше предела", concat(shb, ngBlock(le, pcapngBlockEPB, nil, maxPcapBlockSize+4)), "некорректная длина блока"},
+		{"неизвестный интерфейс", concat(shb, idb, ngEPB(le, 1, 1, syn)), "неизвестный интерфейс 1"},
+		{"пакет без интерфейсов", concat(shb, ngEPB(le, 0, 1, syn)), "неизвестный интерфейс 0"},
+		{"пакет за концом блока", concat(shb, idb, epbOverflow), "выходит за блок"},
+		{"короткий enhanced block", concat(shb, idb, ngBlock(le, pcapngBlockEPB, make([]byte, 12), 0)), "короткий enhanced packet block"},
+		{"короткий interface block", concat(shb, ngBlock(le, pcapngBlockIDB, make([]byte, 4), 0)), "короткий interface description block"},
+		{"simple block без интерфейса", concat(shb, ngBlock(le, pcapngBlockSPB, make([]byte, 8), 0)), "simple packet block"},
+	}
+	for _, tt := range tests {
+		_, err := readAll(t, tt.data)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: ошибка %v, ожидалась %q", tt.name, err, tt.err)
+		}
+	}
+}
+
+// TestPcapngTruncated читает все префиксы корректного файла: обрезанный
+// блок должен давать конец файла или ошибку, но не панику и не мусор.
+func TestPcapngTruncated(t *testing.T) {
+	le := binary.LittleEndian
+	syn := linuxSYN().bytes()
+	data := concat(ngSHB(le), ngIDB(le, LinkTypeRaw, []byte{9}), ngEPB(le, 0, 1, syn), ngEPB(le, 0, 2, syn))
+	for n := 4; n < len(data); n++ {
+		pkts, _ := readAll(t, data[:n])
+		for _, pkt := range pkts {
+			if !bytes.Equal(pkt.Data, syn) {
+				t.Fatalf("префикс %d байт: пакет %x", n, pkt.Data)
+			}
+		}
+		if n < len(data)-len(ngEPB(le, 0, 2, syn)) && len(pkts) > 1 {
+			t.Fatalf("префикс %d байт: %d пакетов", n, len(pkts))
+		}
+	}
+}
+
+func TestPcapngWriterRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewPcapngWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, _ := w.AddInterface("tun0", LinkTypeRaw, 0)
+	short, _ := w.AddInterface("", LinkTypeEthernet, 16)
+	syn := linuxSYN().bytes()
+	ts := time.Unix(1700000000, 123456789)
+	if err := w.WritePacket(raw, ts, syn, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WritePacket(short, ts, syn, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WritePacket(2, ts, syn, 0); err == nil {
+		t.Errorf("неизвестный интерфейс: ошибки нет")
+	}
+	w.Flush()
+	if w.Size() != int64(buf.Len()) {
+		t.Errorf("Size = %d, записано %d", w.Size(), buf.Len())
+	}
+
+	pkts, err := readAll(t, buf.Bytes())
+	if err != nil || len(pkts) != 2 {
+		t.Fatalf("%d пакетов, ошибка %v", len(pkts), err)
+	}
+	if !pkts[0].Timestamp.Equal(ts) || !bytes.Equal(pkts[0].Data, syn) || pkts[0].OrigLen != len(syn) {
+		t.Errorf("пакет прочитан неверно: %+v", pkts[0])
+	}
+	if len(pkts[1].Data) != 16 || pkts[1].OrigLen != len(syn) || pkts[1].LinkType != LinkTypeEthernet {
+		t.Errorf("snaplen не применен: %+v", pkts[1])
+	}
+}
@@ -0,0 +1,138 @@
+package analyzer
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Коды опций pcapng, которые пишет PcapngWriter.
+const (
+	pcapngOptEnd      = 0
+	pcapngOptUserAppl = 4
+	pcapngOptIfName   = 2
+	pcapngOptTsResol  = 9
+
+	// pcapngTsResolNano - if_tsresol для наносекундных меток времени.
+	pcapngTsResolNano = 9
+)
+
+// PcapngWriter пишет одну секцию pcapng: section header block при
+// создании, затем interface description и enhanced packet blocks. Порядок
+// байт - little endian, метки времени - в наносекундах.
+type PcapngWriter struct {
+	w      *bufio.Writer
+	size   int64
+	ifaces []pcapngWriterIface
+}
+
+type pcapngWriterIface struct {
+	snaplen int
+}
+
+func NewPcapngWriter(w io.Writer) (*PcapngWriter, error) {
+	pw := &PcapngWriter{w: bufio.NewWriter(w)}
+
+	body := make([]byte, 16)
+	binary.LittleEndian.PutUint32(body[0:4], pcapngByteOrderMagic)
+	binary.LittleEndian.PutUint16(body[4:6], 1)
+	binary.LittleEndian.PutUint16(body[6:8], 0)
+	// Длина секции неизвестна заранее.
+	binary.LittleEndian.PutUint64(body[8:16], ^uint64(0))
+	body = appendPcapngOption(body, pcapngOptUserAppl, []byte("tcpcustom"))
+	body = appendPcapngOption(body, pcapngOptEnd, nil)
+
+	if err := pw.writeBlock(pcapngBlockSHB, body); err != nil {
+		return nil, err
+	}
+	return pw, nil
+}
+
+// AddInterface описывает интерфейс захвата и возвращает его номер для
+// WritePacket. snaplen 0 означает пакеты без ограничения длины.
+func (pw *PcapngWriter) AddInterface(name string, linkType LinkType, snaplen int) (int, error) {
+	body := make([]byte, 8)
+	binary.LittleEndian.PutUint16(body[0:2], uint16(linkType))
+	binary.LittleEndian.PutUint32(body[4:8], uint32(snaplen))
+	if name != "" {
+		body = appendPcapngOption(body, pcapngOptIfName, []byte(name))
+	}
+	body = appendPcapngOption(body, pcapngOptTsResol, []byte{pcapngTsResolNano})
+	body = appendPcapngOption(body, pcapngOptEnd, nil)
+
+	if err := pw.writeBlock(pcapngBlockIDB, body); err != nil {
+		return 0, err
+	}
+	pw.ifaces = append(pw.ifaces, pcapngWriterIface{snaplen: snaplen})
+	return len(pw.ifaces) - 1, nil
+}
+
+// WritePacket пишет enhanced packet block. origLen - длина пакета на
+// проводе; data обрезается до snaplen интерфейса.
+func (pw *PcapngWriter) WritePacket(iface int, ts time.Time, data []byte, origLen int) error {
+	if iface < 0 || iface >= len(pw.ifaces) {
+		return fmt.Errorf("pcapng: неизвестный интерфейс %d", iface)
+	}
+	if origLen < len(data) {
+		origLen = len(data)
+	}
+	if snaplen := pw.ifaces[iface].snaplen; snaplen > 0 && len(data) > snaplen {
+		data = data[:snaplen]
+	}
+
+	body := make([]byte, 20, 20+len(data)+3)
+	nanos := uint64(ts.UnixNano())
+	binary.LittleEndian.PutUint32(body[0:4], uint32(iface))
+	binary.LittleEndian.PutUint32(body[4:8], uint32(nanos>>32))
+	binary.LittleEndian.PutUint32(body[8:12], uint32(nanos))
+	binary.LittleEndian.PutUint32(body[12:16], uint32(len(data)))
+	binary.LittleEndian.PutUint32(body[16:20], uint32(origLen))
+	body = append(body, data...)
+	body = pad4(body)
+
+	return pw.writeBlock(pcapngBlockEPB, body)
+}
+
+// Size возвращает число байт, записанных в секцию, включая буфер.
+func (pw *PcapngWriter) Size() int64 {
+	return pw.size
+}
+
+func (pw *PcapngWriter) Flush() error {
+	return pw.w.Flush()
+}
+
+func (pw *PcapngWriter) writeBlock(blockType uint32, body []byte) error {
+	total := uint32(12 + len(body))
+	var head [8]byte
+	binary.LittleEndian.PutUint32(head[0:4], blockType)
+	binary.LittleEndian.PutUint32(head[4:8], total)
+	var tail [4]byte
+	binary.LittleEndian.PutUint32(tail[:], total)
+
+	for _, b := range [][]byte{head[:], body, tail[:]} {
+		if _, err := pw.w.Write(b); err != nil {
+			return fmt.Errorf("pcapng: ошибка записи: %w", err)
+		}
+	}
+	pw.size += int64(total)
+	return nil
+}
+
+func appendPcapngOption(b []byte, code uint16, value []byte) []byte {
+	var head [4]byte
+	binary.LittleEndian.PutUint16(head[0:2], code)
+	binary.LittleEndian.PutUint16(head[2:4], uint16(len(value)))
+	b = append(b, head[:]...)
+	b = append(b, value...)
+	return pad4(b)
+}
+
+func pad4(b []byte) []byte {
+	for len(b)%4 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
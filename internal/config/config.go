@@ -0,0 +1,434 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"custom-tcp-fingerprint/internal/analyzer"
+	"custom-tcp-fingerprint/internal/logging"
+	"custom-tcp-fingerprint/internal/policy"
+	"custom-tcp-fingerprint/internal/stack"
+)
+
+type Config struct {
+	Network     NetworkConfig     `yaml:"network"`
+	Proxy       ProxyConfig       `yaml:"proxy"`
+	Fingerprint FingerprintConfig `yaml:"fingerprint"`
+	Capture     CaptureConfig     `yaml:"capture"`
+	Logging     LoggingConfig     `yaml:"logging"`
+	Bonus       BonusConfig       `yaml:"bonus"`
+}
+
+type NetworkConfig struct {
+	Tun    TunConfig    `yaml:"tun"`
+	Target TargetConfig `yaml:"target"`
+	Local  LocalConfig  `yaml:"local"`
+
+	// Firewall - бэкенд правил пересылки: nftables (по умолчанию) или iptables.
+	Firewall string `yaml:"firewall"`
+
+	// Netns - имя network namespace для tun, правил и маршрутов; пустое
+	// значение - работа в namespace хоста.
+	Netns string `yaml:"netns"`
+
+	// Mappings - пересылки режима forward, которые обслуживает один стек.
+	// Пустой список означает одну пересылку с local.port на target.
+	Mappings []MappingConfig `yaml:"mappings"`
+}
+
+type TunConfig struct {
+	Name string `yaml:"name"`
+	MTU  int    `yaml:"mtu"`
+}
+
+type TargetConfig struct {
+	Host string `yaml:"host"`
+	Port int    `yaml:"port"`
+}
+
+type LocalConfig struct {
+	Port int `yaml:"port"`
+}
+
+// MappingConfig - одна пересылка: адрес, на котором слушает прокси, цель
+// в виде host:port, профиль отпечатка (пустой - fingerprint.type с
+// fingerprint.parameters) и необязательный адрес источника на хосте.
+type MappingConfig struct {
+	Listen      string `yaml:"listen"`
+	Target      string `yaml:"target"`
+	Fingerprint string `yaml:"fingerprint"`
+	Source      string `yaml:"source"`
+}
+
+// ProxyConfig задает режим локального прокси: forward пересылает все
+// соединения на network.target, socks5 и http соединяются с адресом,
+// который запросил клиент, transparent - с исходным адресом соединений,
+// перехваченных правилами REDIRECT.
+type ProxyConfig struct {
+	Mode string `yaml:"mode"`
+
+	// Users - логины и пароли SOCKS5 (RFC 1929) или HTTP Basic; пустой
+	// список отключает аутентификацию.
+	Users map[string]string `yaml:"users"`
+
+	Transparent TransparentConfig `yaml:"transparent"`
+}
+
+// TransparentConfig выбирает, чьи соединения перехватываются в режиме
+// transparent: процессы хоста по uid или пути cgroup v2 относительно
+// /sys/fs/cgroup, транзитный трафик - по подсети источника.
+type TransparentConfig struct {
+	UIDs    []int    `yaml:"uids"`
+	Cgroups []string `yaml:"cgroups"`
+	Sources []string `yaml:"sources"`
+}
+
+type FingerprintConfig struct {
+	Type       string                `yaml:"type"`
+	P0fFile    string                `yaml:"p0f_file"`
+	Parameters FingerprintParameters `yaml:"parameters"`
+
+	// ProfileDir - каталог файлов профилей YAML и JSON, ProfileFiles -
+	// отдельные файлы (например, из tcpcustom profile learn). Их профили
+	// дополняют встроенные и доступны по имени в Type, правилах и ротации.
+	ProfileDir   string   `yaml:"profile_dir"`
+	ProfileFiles []string `yaml:"profile_files"`
+
+	// Rules выбирают профиль для каждого исходящего соединения; первое
+	// сработавшее правило побеждает, без совпадений остается Type.
+	Rules []ProfileRuleConfig `yaml:"rules"`
+
+	Rotation RotationConfig `yaml:"rotation"`
+}
+
+// RotationConfig заменяет один профиль Type взвешенным набором, из которого
+// профиль выбирается для каждого соединения (connection), интервала времени
+// (window) или адреса назначения (destination), и задает случайные
+// отклонения полей. Seed 0 означает случайный seed, который выводится в лог,
+// чтобы запуск можно было повторить.
+type RotationConfig struct {
+	Mode     string                  `yaml:"mode"`
+	Interval time.Duration           `yaml:"interval"`
+	Seed     uint64                  `yaml:"seed"`
+	Profiles []WeightedProfileConfig `yaml:"profiles"`
+	Jitter   JitterConfig            `yaml:"jitter"`
+}
+
+type WeightedProfileConfig struct {
+	Profile string `yaml:"profile"`
+	Weight  int    `yaml:"weight"`
+}
+
+// JitterConfig - границы отклонений: окно выбирается как MSS, умноженный на
+// число из WindowMSS ([от, до]), а ttl уменьшается на 0..MaxHops.
+type JitterConfig struct {
+	WindowMSS []int `yaml:"window_mss"`
+	MaxHops   int   `yaml:"max_hops"`
+}
+
+// Enabled сообщает, задана ли ротация или хотя бы отклонения полей.
+func (r RotationConfig) Enabled() bool {
+	return len(r.Profiles) > 0 || len(r.Jitter.WindowMSS) > 0 || r.Jitter.MaxHops > 0
+}
+
+// ProfileRuleConfig - правило выбора профиля. Поля объединяются по "и",
+// значения внутри поля - по "или"; пустое поле не проверяется.
+type ProfileRuleConfig struct {
+	Profile string `yaml:"profile"`
+	// Dst и Sources - подсети или адреса назначения и клиента прокси.
+	Dst     []string `yaml:"dst"`
+	Sources []string `yaml:"sources"`
+	// Hosts - шаблоны имени назначения вида *.example.com.
+	Hosts []string `yaml:"hosts"`
+	// Ports - порты назначения или диапазоны вида 8000-8100.
+	Ports []string `yaml:"ports"`
+	// Users - логины SOCKS5 или HTTP-прокси.
+	Users []string `yaml:"users"`
+}
+
+// Rule переводит правило в policy.Rule.
+func (r ProfileRuleConfig) Rule() (policy.Rule, error) {
+	rule := policy.Rule{Profile: r.Profile, Hosts: r.Hosts, Users: r.Users}
+	if r.Profile == "" {
+		return rule, errors.New("профиль не задан")
+	}
+	for _, s := range r.Dst {
+		p, err := policy.ParsePrefix(s)
+		if err != nil {
+			return rule, fmt.Errorf("dst: некорректная подсеть %q", s)
+		}
+		rule.Dst = append(rule.Dst, p)
+	}
+	for _, s := range r.Sources {
+		p, err := policy.ParsePrefix(s)
+		if err != nil {
+			return rule, fmt.Errorf("sources: некорректная подсеть %q", s)
+		}
+		rule.Sources = append(rule.Sources, p)
+	}
+	for _, s := range r.Hosts {
+		if s == "" || !policy.ValidHostPattern(s) {
+			return rule, fmt.Errorf("hosts: некорректный шаблон %q", s)
+		}
+	}
+	for _, s := range r.Ports {
+		pr, err := policy.ParsePortRange(s)
+		if err != nil {
+			return rule, fmt.Errorf("ports: %w", err)
+		}
+		rule.Ports = append(rule.Ports, pr)
+	}
+	for _, s := range r.Users {
+		if s == "" {
+			return rule, errors.New("users: пустой логин")
+		}
+	}
+	return rule, nil
+}
+
+// FingerprintParameters переопределяют значения профиля. Нулевые значения и
+// отсутствующие поля оставляют значение из профиля.
+type FingerprintParameters struct {
+	WindowSize         int   `yaml:"window_size"`
+	TTL                int   `yaml:"ttl"`
+	TimestampsEnabled  *bool `yaml:"timestamps_enabled"`
+	MSS                int   `yaml:"mss"`
+	WindowScaleEnabled *bool `yaml:"window_scale_enabled"`
+	WindowScaleValue   *int  `yaml:"window_scale_value"`
+
+	// HopLimit - hop limit для ipv6; 0 берет значение профиля.
+	HopLimit int `yaml:"hop_limit"`
+	// FlowLabel - метка потока ipv6: stack, zero или random; пустое
+	// значение берет политику профиля.
+	FlowLabel string `yaml:"flow_label"`
+}
+
+// CaptureConfig - захват трафика TUN в pcapng. Duration в секундах,
+// MaxPackets - число пакетов, RotateSizeMB - размер файла в мегабайтах,
+// после которого захват продолжается в следующем файле; 0 снимает
+// ограничение. Filter - выражение фильтра pcap, выполняемое в ядре.
+// Handshakes включает запись в лог каждого рукопожатия TCP на TUN; фильтр
+// действует и на него, файл для этого не нужен.
+type CaptureConfig struct {
+	Enabled      bool   `yaml:"enabled"`
+	File         string `yaml:"file"`
+	Duration     int    `yaml:"duration"`
+	MaxPackets   int    `yaml:"max_packets"`
+	RotateSizeMB int    `yaml:"rotate_size_mb"`
+	Filter       string `yaml:"filter"`
+	Handshakes   bool   `yaml:"handshakes"`
+}
+
+type LoggingConfig struct {
+	Level string `yaml:"level"`
+	File  string `yaml:"file"`
+}
+
+type BonusConfig struct {
+	L2Tunnel L2TunnelConfig `yaml:"l2tunnel"`
+}
+
+type L2TunnelConfig struct {
+	Type     string `yaml:"type"`
+	LocalIP  string `yaml:"local_ip"`
+	RemoteIP string `yaml:"remote_ip"`
+	ID       int    `yaml:"id"`
+}
+
+func Default() *Config {
+	return &Config{
+		Network: NetworkConfig{
+			Tun:      TunConfig{Name: "tun0", MTU: 1500},
+			Target:   TargetConfig{Host: "example.com", Port: 80},
+			Local:    LocalConfig{Port: 8080},
+			Firewall: "nftables",
+		},
+		Proxy:       ProxyConfig{Mode: "forward"},
+		Fingerprint: FingerprintConfig{Type: "windows"},
+		Logging:     LoggingConfig{Level: "info"},
+	}
+}
+
+// Load читает yaml поверх значений по умолчанию. Неизвестные ключи считаются
+// ошибкой, чтобы опечатки в файле не пропадали молча.
+func Load(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("не удалось прочитать конфигурацию: %w", err)
+	}
+
+	cfg := Default()
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(cfg); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, field, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s: %s", field, fmt.Sprintf(format, args...)))
+		}
+	}
+
+	n := c.Network
+	check(n.Tun.Name != "", "network.tun.name", "имя интерфейса не задано")
+	check(len(n.Tun.Name) < 16, "network.tun.name", "имя %q длиннее 15 символов", n.Tun.Name)
+	check(n.Tun.MTU >= 576 && n.Tun.MTU <= 65535, "network.tun.mtu", "должно быть от 576 до 65535, получено %d", n.Tun.MTU)
+	check(!strings.ContainsRune(n.Netns, '/') && n.Netns != "." && n.Netns != "..", "network.netns",
+		"некорректное имя namespace %q", n.Netns)
+	if c.Proxy.Mode == "forward" && len(n.Mappings) == 0 {
+		check(n.Target.Host != "", "network.target.host", "целевой хост не задан")
+		check(validPort(n.Target.Port), "network.target.port", "должно быть от 1 до 65535, получено %d", n.Target.Port)
+	}
+	check(len(n.Mappings) == 0 || c.Proxy.Mode == "forward", "network.mappings", "пересылки поддерживаются только в режиме forward")
+	listenPorts := make(map[int]bool)
+	sources := 0
+	for i, m := range n.Mappings {
+		field := fmt.Sprintf("network.mappings[%d]", i)
+		host, port, err := splitHostPort(m.Listen)
+		check(err == nil && (host == "" || net.ParseIP(host) != nil), field+".listen", "ожидалось [ip]:port, получено %q", m.Listen)
+		check(err != nil || !listenPorts[port], field+".listen", "порт %d уже занят другой пересылкой", port)
+		listenPorts[port] = true
+		host, _, err = splitHostPort(m.Target)
+		check(err == nil && host != "", field+".target", "ожидалось host:port, получено %q", m.Target)
+		if m.Source != "" {
+			sources++
+			addr, err := netip.ParseAddr(m.Source)
+			check(err == nil && !addr.Is4In6() && addr.Zone() == "", field+".source", "некорректный ip-адрес %q", m.Source)
+			check(n.Netns == "", field+".source", "адрес источника не поддерживается вместе с network.netns")
+		}
+	}
+	check(sources <= maxMappingSources, "network.mappings", "адрес источника задан у %d пересылок, допустимо не больше %d", sources, maxMappingSources)
+	check(validPort(n.Local.Port), "network.local.port", "должно быть от 1 до 65535, получено %d", n.Local.Port)
+	check(n.Firewall == "nftables" || n.Firewall == "iptables", "network.firewall",
+		"ожидалось nftables или iptables, получено %q", n.Firewall)
+
+	pr := c.Proxy
+	switch pr.Mode {
+	case "forward", "socks5", "http", "transparent":
+	default:
+		check(false, "proxy.mode", "ожидалось forward, socks5, http или transparent, получено %q", pr.Mode)
+	}
+	check(len(pr.Users) == 0 || pr.Mode == "socks5" || pr.Mode == "http", "proxy.users",
+		"аутентификация поддерживается только в режимах socks5 и http")
+	for user, pass := range pr.Users {
+		check(user != "" && len(user) <= 255, "proxy.users", "логин должен быть от 1 до 255 байт, получено %d", len(user))
+		check(pass != "" && len(pass) <= 255, "proxy.users", "пароль пользователя %q должен быть от 1 до 255 байт", user)
+	}
+
+	tp := pr.Transparent
+	if pr.Mode == "transparent" {
+		check(len(tp.UIDs)+len(tp.Cgroups)+len(tp.Sources) > 0, "proxy.transparent",
+			"не задано ни одного uid, cgroup или подсети для перехвата")
+	}
+	for _, uid := range tp.UIDs {
+		check(uid >= 0 && uid < 1<<32-1, "proxy.transparent.uids", "некорректный uid %d", uid)
+	}
+	for _, cg := range tp.Cgroups {
+		check(cg != "" && !strings.Contains("/"+cg+"/", "/../"), "proxy.transparent.cgroups", "некорректный путь cgroup %q", cg)
+	}
+	for _, src := range tp.Sources {
+		prefix, err := netip.ParsePrefix(src)
+		check(err == nil && !prefix.Addr().Is4In6(), "proxy.transparent.sources", "ожидалась подсеть ipv4 или ipv6, получено %q", src)
+	}
+
+	f := c.Fingerprint
+	p := f.Parameters
+	check(f.Type != "", "fingerprint.type", "тип отпечатка не задан")
+	check(p.WindowSize >= 0 && p.WindowSize <= 65535, "fingerprint.parameters.window_size", "должно быть от 0 до 65535, получено %d", p.WindowSize)
+	check(p.TTL >= 0 && p.TTL <= stack.MaxTTL, "fingerprint.parameters.ttl", "должно быть от 0 до %d, получено %d", stack.MaxTTL, p.TTL)
+	check(p.MSS == 0 || (p.MSS >= 88 && p.MSS <= n.Tun.MTU-40), "fingerprint.parameters.mss",
+		"должно быть от 88 до mtu-40 (%d), получено %d", n.Tun.MTU-40, p.MSS)
+	check(p.HopLimit >= 0 && p.HopLimit <= stack.MaxTTL, "fingerprint.parameters.hop_limit", "должно быть от 0 до %d, получено %d", stack.MaxTTL, p.HopLimit)
+	switch p.FlowLabel {
+	case "", "stack", "zero", "random":
+	default:
+		check(false, "fingerprint.parameters.flow_label", "ожидалось stack, zero или random, получено %q", p.FlowLabel)
+	}
+	if p.WindowScaleValue != nil {
+		check(*p.WindowScaleValue >= 0 && *p.WindowScaleValue <= 14, "fingerprint.parameters.window_scale_value",
+			"должно быть от 0 до 14, получено %d", *p.WindowScaleValue)
+	}
+	for i, r := range f.Rules {
+		_, err := r.Rule()
+		check(err == nil, fmt.Sprintf("fingerprint.rules[%d]", i), "%v", err)
+	}
+	rot := f.Rotation
+	mode, err := policy.ParseRotationMode(rot.Mode)
+	check(err == nil, "fingerprint.rotation.mode", "ожидалось connection, window или destination, получено %q", rot.Mode)
+	check(mode != policy.RotateWindow || rot.Interval > 0, "fingerprint.rotation.interval", "для режима window нужен положительный интервал")
+	check(rot.Interval >= 0, "fingerprint.rotation.interval", "не может быть отрицательным, получено %s", rot.Interval)
+	for i, w := range rot.Profiles {
+		field := fmt.Sprintf("fingerprint.rotation.profiles[%d]", i)
+		check(w.Profile != "", field+".profile", "профиль не задан")
+		check(w.Weight > 0, field+".weight", "должно быть положительным, получено %d", w.Weight)
+	}
+	if wm := rot.Jitter.WindowMSS; len(wm) > 0 {
+		check(len(wm) == 2 && wm[0] >= 1 && wm[0] <= wm[1], "fingerprint.rotation.jitter.window_mss",
+			"ожидалось [от, до] с 1 <= от <= до, получено %v", wm)
+	}
+	check(rot.Jitter.MaxHops >= 0 && rot.Jitter.MaxHops <= 64, "fingerprint.rotation.jitter.max_hops",
+		"должно быть от 0 до 64, получено %d", rot.Jitter.MaxHops)
+
+	check(c.Capture.Duration >= 0, "capture.duration", "не может быть отрицательной, получено %d", c.Capture.Duration)
+	check(!c.Capture.Enabled || c.Capture.File != "", "capture.file", "захват включен, но файл не задан")
+	check(c.Capture.MaxPackets >= 0, "capture.max_packets", "не может быть отрицательным, получено %d", c.Capture.MaxPackets)
+	check(c.Capture.RotateSizeMB >= 0, "capture.rotate_size_mb", "не может быть отрицательным, получено %d", c.Capture.RotateSizeMB)
+	if _, err := analyzer.CompileFilter(c.Capture.Filter, 0); err != nil {
+		check(false, "capture.filter", "%v", err)
+	}
+
+	_, err = logging.ParseLevel(c.Logging.Level)
+	check(err == nil, "logging.level", "%v", err)
+
+	t := c.Bonus.L2Tunnel
+	switch t.Type {
+	case "":
+	case "gre", "gretap", "vxlan":
+		check(net.ParseIP(t.LocalIP) != nil, "bonus.l2tunnel.local_ip", "некорректный ip-адрес %q", t.LocalIP)
+		check(net.ParseIP(t.RemoteIP) != nil, "bonus.l2tunnel.remote_ip", "некорректный ip-адрес %q", t.RemoteIP)
+		check(t.ID >= 0 && t.ID < 1<<24, "bonus.l2tunnel.id", "должно быть от 0 до 16777215, получено %d", t.ID)
+	default:
+		check(false, "bonus.l2tunnel.type", "ожидалось gre, gretap или vxlan, получено %q", t.Type)
+	}
+
+	return errors.Join(errs...)
+}
+
+// maxMappingSources совпадает с network.MaxSourceStackAddrs: каждой
+// пересылке с адресом источника нужен свой адрес стека.
+const maxMappingSources = 250
+
+func validPort(port int) bool {
+	return port > 0 && port <= 65535
+}
+
+// splitHostPort разбирает host:port с числовым портом от 1 до 65535.
+func splitHostPort(s string) (string, int, error) {
+	host, portStr, err := net.SplitHostPort(s)
+	if err != nil {
+		return "", 0, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || !validPort(port) {
+		return "", 0, fmt.Errorf("некорректный порт %q", portStr)
+	}
+	return host, port, nil
+}
@@ -0,0 +1,138 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadExampleConfig(t *testing.T) {
+	cfg, err := Load("../../configs/config.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Fingerprint.Type != "windows" || cfg.Network.Tun.Name != "tun0" {
+		t.Errorf("конфигурация %+v", cfg)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	scale := 15
+	tests := []struct {
+		name  string
+		edit  func(c *Config)
+		field string
+	}{
+		{"по умолчанию", func(c *Config) {}, ""},
+		{"уровень warning", func(c *Config) { c.Logging.Level = "warning" }, ""},
+		{"уровень warn", func(c *Config) { c.Logging.Level = "warn" }, ""},
+		{"пустой уровень", func(c *Config) { c.Logging.Level = "" }, ""},
+		{"неизвестный уровень", func(c *Config) { c.Logging.Level = "verbose" }, "logging.level"},
+		{"уровень в верхнем регистре", func(c *Config) { c.Logging.Level = "INFO" }, "logging.level"},
+		{"длинное имя tun", func(c *Config) { c.Network.Tun.Name = "tun-with-long-name" }, "network.tun.name"},
+		{"маленький mtu", func(c *Config) { c.Network.Tun.MTU = 500 }, "network.tun.mtu"},
+		{"namespace с путем", func(c *Config) { c.Network.Netns = "../x" }, "network.netns"},
+		{"порт цели", func(c *Config) { c.Network.Target.Port = 0 }, "network.target.port"},
+		{"межсетевой экран", func(c *Config) { c.Network.Firewall = "pf" }, "network.firewall"},
+		{"пересылки", func(c *Config) {
+			c.Network.Mappings = []MappingConfig{{Listen: ":8081", Target: "example.com:80"}, {Listen: "127.0.0.1:8081", Target: "example.com:80"}}
+		}, "network.mappings[1].listen"},
+		{"цель пересылки", func(c *Config) {
+			c.Network.Mappings = []MappingConfig{{Listen: ":8081", Target: "example.com"}}
+		}, "network.mappings[0].target"},
+		{"режим прокси", func(c *Config) { c.Proxy.Mode = "tproxy" }, "proxy.mode"},
+		{"пользователи в forward", func(c *Config) { c.Proxy.Users = map[string]string{"u": "p"} }, "proxy.users"},
+		{"transparent без целей", func(c *Config) { c.Proxy.Mode = "transparent" }, "proxy.transparent"},
+		{"ttl 254", func(c *Config) { c.Fingerprint.Parameters.TTL = 254 }, ""},
+		{"ttl 255", func(c *Config) { c.Fingerprint.Parameters.TTL = 255 }, "fingerprint.parameters.ttl"},
+		{"hop limit 255", func(c *Config) { c.Fingerprint.Parameters.HopLimit = 255 }, "fingerprint.parameters.hop_limit"},
+		{"окно", func(c *Config) { c.Fingerprint.Parameters.WindowSize = 70000 }, "fingerprint.parameters.window_size"},
+		{"mss больше mtu", func(c *Config) { c.Fingerprint.Parameters.MSS = 1480 }, "fingerprint.parameters.mss"},
+		{"window scale", func(c *Config) { c.Fingerprint.Parameters.WindowScaleValue = &scale }, "fingerprint.parameters.window_scale_value"},
+		{"flow label", func(c *Config) { c.Fingerprint.Parameters.FlowLabel = "fixed" }, "fingerprint.parameters.flow_label"},
+		{"правило без профиля", func(c *Config) {
+			c.Fingerprint.Rules = []ProfileRuleConfig{{Ports: []string{"443"}}}
+		}, "fingerprint.rules[0]"},
+		{"режим ротации", func(c *Config) { c.Fingerprint.Rotation.Mode = "packet" }, "fingerprint.rotation.mode"},
+		{"window без интервала", func(c *Config) { c.Fingerprint.Rotation.Mode = "window" }, "fingerprint.rotation.interval"},
+		{"window с интервалом", func(c *Config) {
+			c.Fingerprint.Rotation.Mode, c.Fingerprint.Rotation.Interval = "window", time.Minute
+		}, ""},
+		{"вес профиля", func(c *Config) {
+			c.Fingerprint.Rotation.Profiles = []WeightedProfileConfig{{Profile: "linux"}}
+		}, "fingerprint.rotation.profiles[0].weight"},
+		{"jitter окна", func(c *Config) { c.Fingerprint.Rotation.Jitter.WindowMSS = []int{20, 10} }, "fingerprint.rotation.jitter.window_mss"},
+		{"захват без файла", func(c *Config) { c.Capture.Enabled = true }, "capture.file"},
+		{"фильтр захвата", func(c *Config) { c.Capture.Filter = "tcp port" }, "capture.filter"},
+		{"тип туннеля", func(c *Config) { c.Bonus.L2Tunnel.Type = "ipip" }, "bonus.l2tunnel.type"},
+	}
+	for _, tt := range tests {
+		cfg := Default()
+		tt.edit(cfg)
+		err := cfg.Validate()
+		if tt.field == "" {
+			if err != nil {
+				t.Errorf("%s: %v", tt.name, err)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("%s: ошибки нет", tt.name)
+			continue
+		}
+		if !strings.HasPrefix(err.Error(), tt.field+": ") {
+			t.Errorf("%s: ошибка %q, ожидалась ошибка поля %s", tt.name, err, tt.field)
+		}
+	}
+}
+
+func TestValidateJoinsErrors(t *testing.T) {
+	cfg := Default()
+	cfg.Network.Tun.MTU = 0
+	cfg.Logging.Level = "loud"
+	err := cfg.Validate()
+	if err == nil {
+		t.Fatal("ошибки нет")
+	}
+	lines := strings.Split(err.Error(), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], "network.tun.mtu: ") || !strings.HasPrefix(lines[1], "logging.level: ") {
+		t.Errorf("ошибки %q", lines)
+	}
+}
+
+func TestLoad(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want string
+	}{
+		{"уровень warning", "logging:\n  level: warning\n", ""},
+		{"неизвестный ключ", "logging:\n  levle: debug\n", "field levle not found"},
+		{"неверный тип", "network:\n  tun:\n    mtu: много\n", "cannot unmarshal"},
+		{"неверное значение", "proxy:\n  mode: socks4\n", "proxy.mode"},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), "config.yaml")
+		if err := os.WriteFile(path, []byte(tt.data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		cfg, err := Load(path)
+		if tt.want == "" {
+			if err != nil {
+				t.Errorf("%s: %v", tt.name, err)
+			} else if cfg.Logging.Level != "warning" || cfg.Network.Tun.MTU != 1500 {
+				t.Errorf("%s: значения по умолчанию не сохранены: %+v", tt.name, cfg)
+			}
+			continue
+		}
+		if err == nil || !strings.HasPrefix(err.Error(), path+": ") || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: ошибка %v, ожидалась ошибка с %q", tt.name, err, tt.want)
+		}
+	}
+
+	if _, err := Load(filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Error("нет файла: ошибки нет")
+	}
+}
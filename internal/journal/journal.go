@@ -0,0 +1,175 @@
+package journal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const DefaultDir = "/run/tcpcustom"
+
+// Step - шаг отката. Аргументы хранятся строками, чтобы журнал можно было
+// воспроизвести другим процессом после аварийного завершения.
+type Step struct {
+	Kind string            `json:"kind"`
+	Args map[string]string `json:"args,omitempty"`
+	Time time.Time         `json:"time"`
+}
+
+func (s Step) String() string {
+	keys := make([]string, 0, len(s.Args))
+	for k := range s.Args {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	parts := []string{s.Kind}
+	for _, k := range keys {
+		parts = append(parts, k+"="+s.Args[k])
+	}
+	return strings.Join(parts, " ")
+}
+
+type UndoFunc func(Step) error
+
+// Journal хранит шаги отката одного запуска в <dir>/<pid>.json. Файл
+// перезаписывается атомарно после каждого изменения, поэтому после SIGKILL
+// на диске остается последнее согласованное состояние.
+type Journal struct {
+	mu      sync.Mutex
+	path    string
+	PID     int       `json:"pid"`
+	Started time.Time `json:"started"`
+	Steps   []Step    `json:"steps"`
+}
+
+func Create(dir string) (*Journal, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("не удалось создать каталог журнала: %w", err)
+	}
+
+	j := &Journal{
+		path:    filepath.Join(dir, strconv.Itoa(os.Getpid())+".json"),
+		PID:     os.Getpid(),
+		Started: time.Now(),
+	}
+	if err := j.save(); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+func Load(path string) (*Journal, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("не удалось прочитать журнал: %w", err)
+	}
+
+	j := &Journal{path: path}
+	if err := json.Unmarshal(data, j); err != nil {
+		return nil, fmt.Errorf("поврежденный журнал %s: %w", path, err)
+	}
+	return j, nil
+}
+
+// List загружает все журналы из dir, начиная с самого нового. В этом
+// порядке их и нужно откатывать: более поздний запуск записывает значения,
+// которые уже изменил более ранний, и исходное состояние хранит только
+// самый старый журнал.
+func List(dir string) ([]*Journal, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	var journals []*Journal
+	var errs []error
+	for _, p := range paths {
+		j, err := Load(p)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		journals = append(journals, j)
+	}
+	sort.Slice(journals, func(a, b int) bool {
+		return journals[a].Started.After(journals[b].Started)
+	})
+	return journals, errors.Join(errs...)
+}
+
+func (j *Journal) Path() string {
+	return j.path
+}
+
+// Alive сообщает, жив ли процесс, создавший журнал.
+func (j *Journal) Alive() bool {
+	if j.PID == os.Getpid() {
+		return true
+	}
+	err := syscall.Kill(j.PID, 0)
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
+
+// Record добавляет шаг отката. Вызывается до изменения, которое шаг
+// отменяет, поэтому все шаги должны быть идемпотентны.
+func (j *Journal) Record(kind string, args map[string]string) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.Steps = append(j.Steps, Step{Kind: kind, Args: args, Time: time.Now()})
+	return j.save()
+}
+
+// Rollback выполняет шаги в обратном порядке. Успешные шаги удаляются из
+// журнала, неудачные остаются для повторного запуска cleanup; когда
+// журнал пустеет, файл удаляется.
+func (j *Journal) Rollback(undo UndoFunc) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	var failed []Step
+	var errs []error
+	for i := len(j.Steps) - 1; i >= 0; i-- {
+		step := j.Steps[i]
+		if err := undo(step); err != nil {
+			errs = append([]error{fmt.Errorf("%s: %w", step, err)}, errs...)
+			failed = append([]Step{step}, failed...)
+		}
+		j.Steps = append(j.Steps[:i], failed...)
+		if err := j.save(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if len(j.Steps) == 0 {
+		if err := os.Remove(j.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			errs = append(errs, fmt.Errorf("не удалось удалить журнал: %w", err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (j *Journal) save() error {
+	data, err := json.MarshalIndent(j, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := j.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("не удалось записать журнал: %w", err)
+	}
+	if err := os.Rename(tmp, j.path); err != nil {
+		return fmt.Errorf("не удалось записать журнал: %w", err)
+	}
+	return nil
+}
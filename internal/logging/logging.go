@@ -0,0 +1,91 @@
+package logging
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync/atomic"
+)
+
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func ParseLevel(s string) (Level, error) {
+	switch s {
+	case "debug":
+		return LevelDebug, nil
+	case "", "info":
+		return LevelInfo, nil
+	case "warn", "warning":
+		return LevelWarn, nil
+	case "error":
+		return LevelError, nil
+	}
+	return LevelInfo, fmt.Errorf("неизвестный уровень логирования: %q (debug, info, warn, error)", s)
+}
+
+// threshold - наименьший выводимый уровень; до Setup выводится все от info.
+var threshold atomic.Int32
+
+func init() {
+	threshold.Store(int32(LevelInfo))
+}
+
+// Setup направляет стандартный логгер в файл (пустой путь - stderr) и
+// задает наименьший уровень для Debugf, Infof, Warnf и Errorf. Прямые
+// вызовы log (в том числе log.Fatal) выводятся всегда. Возвращает функцию
+// закрытия файла.
+func Setup(level string, file string) (func() error, error) {
+	lvl, err := ParseLevel(level)
+	if err != nil {
+		return nil, err
+	}
+
+	var out io.Writer = os.Stderr
+	closeFn := func() error { return nil }
+	if file != "" {
+		f, err := os.OpenFile(file, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("не удалось открыть фаил лога: %w", err)
+		}
+		out = f
+		closeFn = f.Close
+	}
+
+	flags := log.LstdFlags
+	if lvl == LevelDebug {
+		flags |= log.Lshortfile
+	}
+	log.SetFlags(flags)
+	log.SetOutput(out)
+	threshold.Store(int32(lvl))
+	return closeFn, nil
+}
+
+// Enabled сообщает, будут ли выведены сообщения уровня level.
+func Enabled(level Level) bool {
+	return int32(level) >= threshold.Load()
+}
+
+func Debugf(format string, args ...interface{}) { output(LevelDebug, format, args...) }
+
+func Infof(format string, args ...interface{}) { output(LevelInfo, format, args...) }
+
+func Warnf(format string, args ...interface{}) { output(LevelWarn, format, args...) }
+
+func Errorf(format string, args ...interface{}) { output(LevelError, format, args...) }
+
+func output(level Level, format string, args ...interface{}) {
+	if !Enabled(level) {
+		return
+	}
+	// 3: output, функция уровня и ее вызывающий - для log.Lshortfile.
+	log.Output(3, fmt.Sprintf(format, args...))
+}
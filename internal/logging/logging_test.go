@@ -0,0 +1,50 @@
+package logging
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLevels(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "tcpcustom.log")
+	closeLog, err := Setup("warn", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Setup("info", "")
+
+	Debugf("debug %d", 1)
+	Infof("ошибка в тексте не повышает уровень")
+	Warnf("warn %d", 2)
+	Errorf("failed to enable IP forwarding: %v", os.ErrPermission)
+	closeLog()
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := string(data)
+	for _, want := range []string{"warn 2", "failed to enable IP forwarding: permission denied"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("в логе нет %q:\n%s", want, out)
+		}
+	}
+	for _, unwanted := range []string{"debug 1", "ошибка в тексте"} {
+		if strings.Contains(out, unwanted) {
+			t.Errorf("в логе есть %q:\n%s", unwanted, out)
+		}
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	for in, want := range map[string]Level{"": LevelInfo, "debug": LevelDebug, "warning": LevelWarn, "error": LevelError} {
+		if got, err := ParseLevel(in); err != nil || got != want {
+			t.Errorf("ParseLevel(%q) = %v, %v", in, got, err)
+		}
+	}
+	if _, err := ParseLevel("trace"); err == nil {
+		t.Errorf(`ParseLevel("trace"): ошибки нет`)
+	}
+}
@@ -0,0 +1,123 @@
+package netns
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	"golang.org/x/sys/unix"
+)
+
+// Dir - каталог именованных namespace, совместимый с ip netns.
+const Dir = "/var/run/netns"
+
+func Path(name string) string {
+	return filepath.Join(Dir, name)
+}
+
+func Exists(name string) bool {
+	var st unix.Statfs_t
+	if err := unix.Statfs(Path(name), &st); err != nil {
+		return false
+	}
+	return st.Type == unix.NSFS_MAGIC
+}
+
+// Open возвращает дескриптор namespace для setns и перемещения интерфейсов.
+func Open(name string) (*os.File, error) {
+	f, err := os.Open(Path(name))
+	if err != nil {
+		return nil, fmt.Errorf("не удалось открыть namespace %s: %w", name, err)
+	}
+	return f, nil
+}
+
+// Create создает именованный namespace так же, как ip netns add: новый
+// namespace закрепляется bind-mount'ом на файл в Dir.
+func Create(name string) error {
+	if err := os.MkdirAll(Dir, 0755); err != nil {
+		return fmt.Errorf("не удалось создать %s: %w", Dir, err)
+	}
+
+	path := Path(name)
+	f, err := os.OpenFile(path, os.O_RDONLY|os.O_CREATE|os.O_EXCL, 0444)
+	if err != nil {
+		return fmt.Errorf("не удалось создать файл namespace %s: %w", name, err)
+	}
+	f.Close()
+
+	// unshare меняет namespace только текущего потока; поток не
+	// разблокируется и завершается вместе с горутиной.
+	errCh := make(chan error, 1)
+	go func() {
+		runtime.LockOSThread()
+
+		if err := unix.Unshare(unix.CLONE_NEWNET); err != nil {
+			errCh <- fmt.Errorf("unshare: %w", err)
+			return
+		}
+		self := fmt.Sprintf("/proc/self/task/%d/ns/net", unix.Gettid())
+		if err := unix.Mount(self, path, "none", unix.MS_BIND, ""); err != nil {
+			errCh <- fmt.Errorf("bind mount: %w", err)
+			return
+		}
+		errCh <- nil
+	}()
+
+	if err := <-errCh; err != nil {
+		os.Remove(path)
+		return fmt.Errorf("не удалось создать namespace %s: %w", name, err)
+	}
+	return nil
+}
+
+// Delete удаляет именованный namespace; отсутствующий namespace не ошибка.
+func Delete(name string) error {
+	path := Path(name)
+	if err := unix.Unmount(path, unix.MNT_DETACH); err != nil && !errors.Is(err, unix.EINVAL) &&
+		!errors.Is(err, unix.ENOENT) {
+		return fmt.Errorf("не удалось отмонтировать namespace %s: %w", name, err)
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("не удалось удалить namespace %s: %w", name, err)
+	}
+	return nil
+}
+
+// Do выполняет fn в потоке, переключенном в namespace name. Пустое имя
+// означает текущий namespace. Внутри fn нельзя полагаться на новые
+// горутины: они работают в исходном namespace.
+func Do(name string, fn func() error) error {
+	if name == "" {
+		return fn()
+	}
+
+	target, err := Open(name)
+	if err != nil {
+		return err
+	}
+	defer target.Close()
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	origin, err := os.Open(fmt.Sprintf("/proc/self/task/%d/ns/net", unix.Gettid()))
+	if err != nil {
+		return fmt.Errorf("не удалось открыть текущий namespace: %w", err)
+	}
+	defer origin.Close()
+
+	if err := unix.Setns(int(target.Fd()), unix.CLONE_NEWNET); err != nil {
+		return fmt.Errorf("не удалось войти в namespace %s: %w", name, err)
+	}
+	defer func() {
+		// Если вернуться не удалось, поток нельзя отдавать обратно в пул.
+		if err := unix.Setns(int(origin.Fd()), unix.CLONE_NEWNET); err != nil {
+			panic(fmt.Sprintf("не удалось вернуться из namespace %s: %v", name, err))
+		}
+	}()
+
+	return fn()
+}
@@ -0,0 +1,109 @@
+package network
+
+import (
+	"fmt"
+	"net/netip"
+)
+
+// RuleSpec описывает правила, нужные для пересылки трафика из tun наружу.
+// Пустой TargetHosts означает любой адрес назначения: так работают режимы
+// прокси, в которых цель выбирает клиент. LocalPorts - порты, на которых
+// слушает прокси.
+type RuleSpec struct {
+	TunName     string
+	TargetHosts []string
+	LocalPorts  []int
+	SNAT        []SNAT
+}
+
+// SNAT подменяет адрес источника у помеченных пакетов, которые стек
+// отправил с адреса Stack, на Source вместо masquerade.
+type SNAT struct {
+	Stack  netip.Addr
+	Source netip.Addr
+}
+
+// UplinkSpec описывает NAT на хосте для трафика, приходящего из
+// namespace через интерфейс Iface с адресов Subnets (ipv4 и, если есть,
+// ipv6).
+type UplinkSpec struct {
+	Iface   string
+	Subnets []netip.Prefix
+}
+
+// RedirectSpec описывает прозрачный режим: tcp-соединения выбранных
+// пользователей, cgroup и подсетей перенаправляются (REDIRECT) на
+// локальный порт прокси. Cgroups - пути cgroup v2 относительно CgroupRoot.
+// Правила по uid и cgroup ставятся для обоих семейств.
+type RedirectSpec struct {
+	TunName   string
+	LocalPort int
+	UIDs      []uint32
+	Cgroups   []string
+	Sources   []netip.Prefix
+}
+
+// CgroupRoot - точка монтирования cgroup v2.
+const CgroupRoot = "/sys/fs/cgroup"
+
+type RuleBackend interface {
+	Name() string
+	Setup(spec RuleSpec) error
+	Cleanup(spec RuleSpec) error
+	SetupUplink(spec UplinkSpec) error
+	CleanupUplink(spec UplinkSpec) error
+	SetupRedirect(spec RedirectSpec) error
+	CleanupRedirect(spec RedirectSpec) error
+}
+
+const (
+	BackendNftables = "nftables"
+	BackendIptables = "iptables"
+)
+
+// ruleTargets разрешает цели RuleSpec и определяет, для каких семейств
+// нужны правила. Без целей адресов нет: ipv4 нужен всегда, ipv6 - если у
+// хоста есть маршрут ipv6 по умолчанию. Семейства правил SNAT добавляются
+// в любом случае.
+func ruleTargets(spec RuleSpec) (addrs []netip.Addr, v4, v6 bool, err error) {
+	if len(spec.TargetHosts) == 0 {
+		v4, v6 = true, hasIPv6Uplink()
+	}
+	seen := make(map[netip.Addr]bool)
+	for _, host := range spec.TargetHosts {
+		resolved, err := resolveAddrs(host)
+		if err != nil {
+			return nil, false, false, err
+		}
+		for _, a := range resolved {
+			if seen[a] {
+				continue
+			}
+			seen[a] = true
+			addrs = append(addrs, a)
+			if a.Is4() {
+				v4 = true
+			} else {
+				v6 = true
+			}
+		}
+	}
+	for _, n := range spec.SNAT {
+		if n.Stack.Is4() {
+			v4 = true
+		} else {
+			v6 = true
+		}
+	}
+	return addrs, v4, v6, nil
+}
+
+func NewRuleBackend(name string) (RuleBackend, error) {
+	switch name {
+	case "", BackendNftables:
+		return nftablesBackend{}, nil
+	case BackendIptables:
+		return iptablesBackend{}, nil
+	}
+	return nil, fmt.Errorf("unknown firewall backend: %s (nftables, iptables)", name)
+}
@@ -2,17 +2,28 @@ package network
 
 import (
 	"fmt"
-	"log"
+	"net/netip"
 	"os"
 	"os/exec"
 	"strings"
+
+	"custom-tcp-fingerprint/internal/logging"
+	"custom-tcp-fingerprint/internal/rtnl"
+	"custom-tcp-fingerprint/internal/sysctl"
+
+	"github.com/vishvananda/netlink"
 )
 
 const (
 	MARK_VALUE = "0x1337"
 )
 
-func SetupIptablesRules(tunName, targetHost string, localPort int) error {
+func SetupIptablesRules(spec RuleSpec) error {
+	targets, v4, v6, err := ruleTargets(spec)
+	if err != nil {
+		return err
+	}
+
 	chains := []struct {
 		table string
 		chain string
@@ -26,71 +37,175 @@ func SetupIptablesRules(tunName, targetHost string, localPort int) error {
 		{"mangle", "OUTPUT"},
 	}
 
-	for _, c := range chains {
-		if err := checkAndCreateChain(c.table, c.chain); err != nil {
-			return fmt.Errorf("failed to check/create chain %s in table %s: %w", c.chain, c.table, err)
+	for _, bin := range iptablesBinaries(v4, v6) {
+		for _, c := range chains {
+			if err := checkAndCreateChain(bin, c.table, c.chain); err != nil {
+				return fmt.Errorf("failed to check/create chain %s in table %s: %w", c.chain, c.table, err)
+			}
+		}
+		if err := applyIptablesRules(bin, tunRules("-A", spec, familyTargets(targets, bin), bin)); err != nil {
+			return err
 		}
 	}
 
-	rules := [][]string{
-		{"filter", "-A", "INPUT", "-p", "tcp", "--dport", fmt.Sprintf("%d", localPort), "-j", "ACCEPT"},
+	return enableForwarding(v4, v6)
+}
 
-		{"mangle", "-A", "OUTPUT", "-p", "tcp", "--sport", fmt.Sprintf("%d", localPort), "-j", "MARK", "--set-mark", MARK_VALUE},
+func CleanupIptables(spec RuleSpec) error {
+	targets, v4, v6, err := ruleTargets(spec)
+	if err != nil {
+		return err
+	}
+	for _, bin := range iptablesBinaries(v4, v6) {
+		deleteIptablesRules(bin, reverseRules(tunRules("-D", spec, familyTargets(targets, bin), bin)))
+	}
+	return nil
+}
 
-		{"mangle", "-A", "OUTPUT", "-p", "tcp", "-d", targetHost, "-j", "MARK", "--set-mark", MARK_VALUE},
+// tunRules возвращает правила семейства bin в порядке добавления. Правила
+// SNAT идут раньше MASQUERADE, так как срабатывает первое из них.
+func tunRules(op string, spec RuleSpec, targets []netip.Addr, bin string) [][]string {
+	tunName := spec.TunName
+	var rules [][]string
+	for _, port := range spec.LocalPorts {
+		rules = append(rules, []string{"filter", op, "INPUT", "-p", "tcp", "--dport", fmt.Sprintf("%d", port), "-j", "ACCEPT"})
+	}
+	if len(targets) == 0 {
+		rules = append(rules, markRule(op, tunName, ""))
+	}
+	for _, ip := range targets {
+		rules = append(rules, markRule(op, tunName, ip.String()))
+	}
+	rules = append(rules,
+		[]string{"filter", op, "FORWARD", "-i", tunName, "-m", "mark", "--mark", MARK_VALUE, "-j", "ACCEPT"},
+		[]string{"filter", op, "FORWARD", "-o", tunName, "-m", "conntrack", "--ctstate", "ESTABLISHED,RELATED", "-j", "ACCEPT"},
+	)
+	for _, n := range spec.SNAT {
+		if n.Stack.Is6() != (bin == "ip6tables") {
+			continue
+		}
+		rules = append(rules, []string{"nat", op, "POSTROUTING", "!", "-o", tunName, "-s", n.Stack.String(),
+			"-m", "mark", "--mark", MARK_VALUE, "-j", "SNAT", "--to-source", n.Source.String()})
+	}
+	return append(rules,
+		[]string{"nat", op, "POSTROUTING", "!", "-o", tunName, "-m", "mark", "--mark", MARK_VALUE, "-j", "MASQUERADE"},
+	)
+}
 
-		{"filter", "-A", "FORWARD", "-i", "lo", "-o", tunName, "-m", "mark", "--mark", MARK_VALUE, "-j", "ACCEPT"},
-		{"filter", "-A", "FORWARD", "-i", tunName, "-o", "lo", "-m", "mark", "--mark", MARK_VALUE, "-j", "ACCEPT"},
+// markRule помечает tcp из tun; без targetHost помечается трафик к любому
+// адресу.
+func markRule(op, tunName, targetHost string) []string {
+	rule := []string{"mangle", op, "PREROUTING", "-i", tunName, "-p", "tcp"}
+	if targetHost != "" {
+		rule = append(rule, "-d", targetHost)
+	}
+	return append(rule, "-j", "MARK", "--set-mark", MARK_VALUE)
+}
 
-		{"nat", "-A", "POSTROUTING", "-o", tunName, "-j", "MASQUERADE"},
+// iptablesBinaries возвращает утилиты для нужных семейств: iptables для
+// ipv4 и ip6tables для ipv6.
+func iptablesBinaries(v4, v6 bool) []string {
+	var bins []string
+	if v4 {
+		bins = append(bins, "iptables")
 	}
+	if v6 {
+		bins = append(bins, "ip6tables")
+	}
+	return bins
+}
 
-	for _, rule := range rules {
-		cmd := exec.Command("iptables", append([]string{"-t", rule[0]}, rule[1:]...)...)
-		if output, err := cmd.CombinedOutput(); err != nil {
-			return fmt.Errorf("failed to apply iptables rule: %s, error: %w, output: %s",
-				strings.Join(rule, " "), err, string(output))
+// familyTargets оставляет адреса семейства, которое обслуживает bin.
+func familyTargets(addrs []netip.Addr, bin string) []netip.Addr {
+	var out []netip.Addr
+	for _, a := range addrs {
+		if a.Is6() == (bin == "ip6tables") {
+			out = append(out, a)
 		}
-		log.Printf("применено правило iptables: %s", strings.Join(rule, " "))
 	}
+	return out
+}
 
-	if err := enableIPForwarding(); err != nil {
-		return fmt.Errorf("failed to enable IP forwarding: %w", err)
+func reverseRules(rules [][]string) [][]string {
+	for i, j := 0, len(rules)-1; i < j; i, j = i+1, j-1 {
+		rules[i], rules[j] = rules[j], rules[i]
 	}
+	return rules
+}
 
+func (iptablesBackend) SetupRedirect(spec RedirectSpec) error {
+	for _, bin := range iptablesBinaries(true, true) {
+		if err := applyIptablesRules(bin, redirectRules(bin, "-A", spec)); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-func CleanupIptables(tunName, targetHost string, localPort int) error {
-	rules := [][]string{
-		{"nat", "-D", "POSTROUTING", "-o", tunName, "-j", "MASQUERADE"},
+func (iptablesBackend) CleanupRedirect(spec RedirectSpec) error {
+	for _, bin := range iptablesBinaries(true, true) {
+		deleteIptablesRules(bin, reverseRules(redirectRules(bin, "-D", spec)))
+	}
+	return nil
+}
 
-		{"filter", "-D", "FORWARD", "-i", tunName, "-o", "lo", "-m", "mark", "--mark", MARK_VALUE, "-j", "ACCEPT"},
-		{"filter", "-D", "FORWARD", "-i", "lo", "-o", tunName, "-m", "mark", "--mark", MARK_VALUE, "-j", "ACCEPT"},
+// redirectRules возвращает правила перенаправления для bin: правила по uid
+// и cgroup ставятся в оба семейства, по источнику - только в семейство
+// подсети.
+func redirectRules(bin, op string, spec RedirectSpec) [][]string {
+	to := []string{"-j", "REDIRECT", "--to-ports", fmt.Sprintf("%d", spec.LocalPort)}
+	loopback := "127.0.0.0/8"
+	if bin == "ip6tables" {
+		loopback = "::1/128"
+	}
 
-		{"mangle", "-D", "OUTPUT", "-p", "tcp", "-d", targetHost, "-j", "MARK", "--set-mark", MARK_VALUE},
-		{"mangle", "-D", "OUTPUT", "-p", "tcp", "--sport", fmt.Sprintf("%d", localPort), "-j", "MARK", "--set-mark", MARK_VALUE},
+	var rules [][]string
+	for _, uid := range spec.UIDs {
+		rule := []string{"nat", op, "OUTPUT", "-p", "tcp", "!", "-d", loopback, "-m", "owner", "--uid-owner", fmt.Sprintf("%d", uid)}
+		rules = append(rules, append(rule, to...))
+	}
+	for _, path := range spec.Cgroups {
+		rule := []string{"nat", op, "OUTPUT", "-p", "tcp", "!", "-d", loopback, "-m", "cgroup", "--path", path}
+		rules = append(rules, append(rule, to...))
+	}
+	for _, src := range spec.Sources {
+		if src.Addr().Is6() != (bin == "ip6tables") {
+			continue
+		}
+		rule := []string{"nat", op, "PREROUTING", "!", "-i", spec.TunName, "-p", "tcp", "-s", src.Masked().String()}
+		rules = append(rules, append(rule, to...))
+	}
+	return rules
+}
 
-		{"filter", "-D", "INPUT", "-p", "tcp", "--dport", fmt.Sprintf("%d", localPort), "-j", "ACCEPT"},
+func applyIptablesRules(bin string, rules [][]string) error {
+	for _, rule := range rules {
+		cmd := exec.Command(bin, append([]string{"-t", rule[0]}, rule[1:]...)...)
+		if output, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("failed to apply %s rule: %s, error: %w, output: %s",
+				bin, strings.Join(rule, " "), err, string(output))
+		}
+		logging.Infof("применено правило %s: %s", bin, strings.Join(rule, " "))
 	}
+	return nil
+}
 
+func deleteIptablesRules(bin string, rules [][]string) {
 	for _, rule := range rules {
-		cmd := exec.Command("iptables", append([]string{"-t", rule[0]}, rule[1:]...)...)
+		cmd := exec.Command(bin, append([]string{"-t", rule[0]}, rule[1:]...)...)
 		if output, err := cmd.CombinedOutput(); err != nil {
-			log.Printf("предупреждение: не удалось удалить правило iptables: %s, ошибка: %v, вывод: %s",
-				strings.Join(rule, " "), err, string(output))
+			logging.Warnf("предупреждение: не удалось удалить правило %s: %s, ошибка: %v, вывод: %s",
+				bin, strings.Join(rule, " "), err, string(output))
 		} else {
-			log.Printf("удалено правило iptables: %s", strings.Join(rule, " "))
+			logging.Infof("удалено правило %s: %s", bin, strings.Join(rule, " "))
 		}
 	}
-
-	return nil
 }
 
-func checkAndCreateChain(table, chain string) error {
-	cmd := exec.Command("iptables", "-t", table, "-L", chain)
+func checkAndCreateChain(bin, table, chain string) error {
+	cmd := exec.Command(bin, "-t", table, "-L", chain)
 	if err := cmd.Run(); err != nil {
-		createCmd := exec.Command("iptables", "-t", table, "-N", chain)
+		createCmd := exec.Command(bin, "-t", table, "-N", chain)
 		if output, err := createCmd.CombinedOutput(); err != nil {
 			return fmt.Errorf("failed to create chain: %s, output: %s", err, string(output))
 		}
@@ -102,23 +217,109 @@ func enableIPForwarding() error {
 	cmd := exec.Command("cat", "/proc/sys/net/ipv4/ip_forward")
 	out, err := cmd.CombinedOutput()
 	if err == nil && strings.TrimSpace(string(out)) == "1" {
-		log.Println("ip forwarding уже включон")
+		logging.Infof("ip forwarding уже включон")
 		return nil
 	}
 
 	cmd = exec.Command("sysctl", "-w", "net.ipv4.ip_forward=1")
 	out, err = cmd.CombinedOutput()
 	if err != nil {
-		log.Printf("предупреждение: не удалось включить ip forwarding через sysctl: %v", err)
+		logging.Warnf("предупреждение: не удалось включить ip forwarding через sysctl: %v", err)
 
 		err = os.WriteFile("/proc/sys/net/ipv4/ip_forward", []byte("1\n"), 0644)
 		if err != nil {
-			log.Printf("предупреждение: не удалось включить ip forwarding через запись в файл: %v", err)
-			log.Printf("продолжаем без ip forwarding, некоторые функции могут не работать")
+			logging.Warnf("предупреждение: не удалось включить ip forwarding через запись в файл: %v", err)
+			logging.Warnf("продолжаем без ip forwarding, некоторые функции могут не работать")
 			return nil
 		}
 	}
 
-	log.Println("ip forwarding успешно включен")
+	logging.Infof("ip forwarding успешно включен")
+	return nil
+}
+
+// enableForwarding включает пересылку для нужных семейств. Включение
+// net.ipv6.conf.all.forwarding отключает прием router advertisement на
+// интерфейсах с accept_ra=1, поэтому для маршрута по умолчанию из RA
+// выводится предупреждение.
+func enableForwarding(v4, v6 bool) error {
+	if v4 {
+		if err := enableIPForwarding(); err != nil {
+			return fmt.Errorf("failed to enable IP forwarding: %w", err)
+		}
+	}
+	if !v6 {
+		return nil
+	}
+
+	if value, err := sysctl.Get("net.ipv6.conf.all.forwarding"); err == nil && value == "1" {
+		logging.Infof("ipv6 forwarding уже включен")
+		return nil
+	}
+	if err := sysctl.Set("net.ipv6.conf.all.forwarding", "1"); err != nil {
+		return fmt.Errorf("failed to enable IPv6 forwarding: %w", err)
+	}
+	logging.Infof("ipv6 forwarding успешно включен")
+
+	if routes, err := rtnl.DefaultRoutes(netlink.FAMILY_V6); err == nil {
+		for _, r := range routes {
+			if !r.FromRA {
+				continue
+			}
+			if ra, err := sysctl.Get("net.ipv6.conf." + r.Dev + ".accept_ra"); err == nil && ra == "1" {
+				logging.Warnf("предупреждение: на %s accept_ra=1, при включенном forwarding ядро перестанет принимать router advertisement; задайте accept_ra=2", r.Dev)
+			}
+		}
+	}
+	return nil
+}
+
+type iptablesBackend struct{}
+
+func (iptablesBackend) Name() string {
+	return BackendIptables
+}
+
+func (iptablesBackend) Setup(spec RuleSpec) error {
+	return SetupIptablesRules(spec)
+}
+
+func (iptablesBackend) Cleanup(spec RuleSpec) error {
+	return CleanupIptables(spec)
+}
+
+func (iptablesBackend) SetupUplink(spec UplinkSpec) error {
+	var v4, v6 bool
+	for _, subnet := range spec.Subnets {
+		bin := "iptables"
+		if subnet.Addr().Is6() {
+			bin, v6 = "ip6tables", true
+		} else {
+			v4 = true
+		}
+		if err := applyIptablesRules(bin, uplinkRules("-A", spec.Iface, subnet)); err != nil {
+			return err
+		}
+	}
+	return enableForwarding(v4, v6)
+}
+
+func (iptablesBackend) CleanupUplink(spec UplinkSpec) error {
+	for _, subnet := range spec.Subnets {
+		bin := "iptables"
+		if subnet.Addr().Is6() {
+			bin = "ip6tables"
+		}
+		deleteIptablesRules(bin, reverseRules(uplinkRules("-D", spec.Iface, subnet)))
+	}
 	return nil
 }
+
+func uplinkRules(op, iface string, subnet netip.Prefix) [][]string {
+	return [][]string{
+		{"filter", op, "FORWARD", "-i", iface, "-j", "ACCEPT"},
+		{"filter", op, "FORWARD", "-o", iface, "-m", "conntrack", "--ctstate", "ESTABLISHED,RELATED", "-j", "ACCEPT"},
+
+		{"nat", op, "POSTROUTING", "-s", subnet.Masked().String(), "!", "-o", iface, "-j", "MASQUERADE"},
+	}
+}
@@ -0,0 +1,46 @@
+package network
+
+import (
+	"fmt"
+	"net/netip"
+
+	"custom-tcp-fingerprint/internal/logging"
+	"custom-tcp-fingerprint/internal/rtnl"
+)
+
+type L2Tunnel struct {
+	Type     string
+	LocalIP  string
+	RemoteIP string
+	ID       int
+}
+
+func (t L2Tunnel) Name() string {
+	return fmt.Sprintf("%s%d", t.Type, t.ID)
+}
+
+func SetupL2Tunnel(t L2Tunnel) error {
+	local, err := netip.ParseAddr(t.LocalIP)
+	if err != nil {
+		return fmt.Errorf("invalid tunnel local address: %w", err)
+	}
+	remote, err := netip.ParseAddr(t.RemoteIP)
+	if err != nil {
+		return fmt.Errorf("invalid tunnel remote address: %w", err)
+	}
+
+	err = rtnl.EnsureTunnel(rtnl.Tunnel{
+		Name:   t.Name(),
+		Kind:   rtnl.TunnelKind(t.Type),
+		Local:  local,
+		Remote: remote,
+		ID:     uint32(t.ID),
+	})
+	if err != nil {
+		rtnl.DeleteLink(t.Name())
+		return fmt.Errorf("failed to create %s tunnel: %w", t.Type, err)
+	}
+
+	logging.Infof("создан %s-туннель %s: %s -> %s", t.Type, t.Name(), t.LocalIP, t.RemoteIP)
+	return nil
+}
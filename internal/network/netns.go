@@ -0,0 +1,149 @@
+package network
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net/netip"
+
+	"custom-tcp-fingerprint/internal/logging"
+	"custom-tcp-fingerprint/internal/netns"
+	"custom-tcp-fingerprint/internal/rtnl"
+)
+
+// NetnsLink - пара veth между хостом и namespace, через которую уходит
+// трафик из tun. Имена и подсети выводятся из имени namespace, чтобы
+// несколько экземпляров с разными namespace не пересекались. Subnet6
+// задается, только если у хоста есть маршрут ipv6 по умолчанию.
+type NetnsLink struct {
+	Netns    string
+	HostVeth string
+	PeerVeth string
+	Subnet   netip.Prefix
+	Subnet6  netip.Prefix
+}
+
+func NewNetnsLink(name string) NetnsLink {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	sum := h.Sum32()
+
+	// 10.201.0.0/16 делится на 16384 подсети /30.
+	idx := sum & 0x3fff
+	base := netip.AddrFrom4([4]byte{10, 201, byte(idx >> 6), byte(idx&0x3f) << 2})
+	l := NetnsLink{
+		Netns:    name,
+		HostVeth: fmt.Sprintf("tcnh%07x", sum&0xfffffff),
+		PeerVeth: fmt.Sprintf("tcnn%07x", sum&0xfffffff),
+		Subnet:   netip.PrefixFrom(base, 30),
+	}
+	if hasIPv6Uplink() {
+		// fd00:201::/32 делится на подсети /64 по полному хешу.
+		base6 := [16]byte{0xfd, 0x00, 0x02, 0x01, byte(sum >> 24), byte(sum >> 16), byte(sum >> 8), byte(sum)}
+		l.Subnet6 = netip.PrefixFrom(netip.AddrFrom16(base6), 64)
+	}
+	return l
+}
+
+// Subnets возвращает подсети veth, для которых на хосте нужен NAT.
+func (l NetnsLink) Subnets() []netip.Prefix {
+	subnets := []netip.Prefix{l.Subnet}
+	if l.Subnet6.IsValid() {
+		subnets = append(subnets, l.Subnet6)
+	}
+	return subnets
+}
+
+func (l NetnsLink) HostAddr() netip.Addr {
+	return l.Subnet.Addr().Next()
+}
+
+func (l NetnsLink) PeerAddr() netip.Addr {
+	return l.HostAddr().Next()
+}
+
+func (l NetnsLink) HostAddr6() netip.Addr {
+	return l.Subnet6.Addr().Next()
+}
+
+func (l NetnsLink) PeerAddr6() netip.Addr {
+	return l.HostAddr6().Next()
+}
+
+// SetupNetnsLink создает пару veth, назначает адреса и маршрут по
+// умолчанию внутри namespace через адрес хоста.
+func SetupNetnsLink(l NetnsLink) error {
+	ns, err := netns.Open(l.Netns)
+	if err != nil {
+		return err
+	}
+	defer ns.Close()
+
+	if err := rtnl.EnsureVeth(l.HostVeth, l.PeerVeth, int(ns.Fd())); err != nil {
+		return fmt.Errorf("failed to create veth pair: %w", err)
+	}
+	if err := rtnl.EnsureAddr(l.HostVeth, netip.PrefixFrom(l.HostAddr(), l.Subnet.Bits())); err != nil {
+		return fmt.Errorf("failed to assign IP to host veth: %w", err)
+	}
+	if l.Subnet6.IsValid() {
+		if err := rtnl.EnsureAddr(l.HostVeth, netip.PrefixFrom(l.HostAddr6(), l.Subnet6.Bits())); err != nil {
+			return fmt.Errorf("failed to assign IPv6 to host veth: %w", err)
+		}
+	}
+
+	err = netns.Do(l.Netns, func() error {
+		if err := rtnl.EnsureLinkUp("lo", 0); err != nil {
+			return err
+		}
+		if err := rtnl.EnsureLinkUp(l.PeerVeth, 0); err != nil {
+			return err
+		}
+		if err := rtnl.EnsureAddr(l.PeerVeth, netip.PrefixFrom(l.PeerAddr(), l.Subnet.Bits())); err != nil {
+			return err
+		}
+		if err := rtnl.EnsureRoute(rtnl.Route{
+			Dst:     netip.PrefixFrom(netip.IPv4Unspecified(), 0),
+			Gateway: l.HostAddr(),
+			Dev:     l.PeerVeth,
+		}); err != nil {
+			return err
+		}
+		if !l.Subnet6.IsValid() {
+			return nil
+		}
+		if err := rtnl.EnsureAddr(l.PeerVeth, netip.PrefixFrom(l.PeerAddr6(), l.Subnet6.Bits())); err != nil {
+			return err
+		}
+		return rtnl.EnsureRoute(rtnl.Route{
+			Dst:     netip.PrefixFrom(netip.IPv6Unspecified(), 0),
+			Gateway: l.HostAddr6(),
+			Dev:     l.PeerVeth,
+		})
+	})
+	if err != nil {
+		return fmt.Errorf("failed to configure namespace %s: %w", l.Netns, err)
+	}
+
+	logging.Infof("namespace %s подключен к хосту: %s (%s) <-> %s (%s)",
+		l.Netns, l.HostVeth, l.HostAddr(), l.PeerVeth, l.PeerAddr())
+	if l.Subnet6.IsValid() {
+		logging.Infof("ipv6 для namespace %s: %s <-> %s", l.Netns, l.HostAddr6(), l.PeerAddr6())
+	}
+	return nil
+}
+
+// MoveTunToNetns переносит tun-интерфейс в namespace и поднимает его там.
+// Открытый дескриптор tun при этом остается рабочим.
+func MoveTunToNetns(tunName, name string, mtu int) error {
+	ns, err := netns.Open(name)
+	if err != nil {
+		return err
+	}
+	defer ns.Close()
+
+	if err := rtnl.MoveLink(tunName, int(ns.Fd())); err != nil {
+		return fmt.Errorf("failed to move TUN interface to namespace %s: %w", name, err)
+	}
+	return netns.Do(name, func() error {
+		return rtnl.EnsureLinkUp(tunName, mtu)
+	})
+}
@@ -0,0 +1,431 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+
+	"custom-tcp-fingerprint/internal/logging"
+)
+
+const (
+	NftTableName = "tcpcustom"
+
+	redirectTableName = NftTableName + "-redirect"
+
+	markValue uint32 = 0x1337
+)
+
+// nftablesBackend держит все правила в отдельной таблице tcpcustom.
+// Таблица создается и удаляется одной транзакцией netlink, поэтому
+// частично примененных правил не бывает. Все таблицы семейства inet:
+// одни и те же цепочки обслуживают ipv4 и ipv6.
+type nftablesBackend struct{}
+
+func (nftablesBackend) Name() string {
+	return BackendNftables
+}
+
+func (nftablesBackend) Setup(spec RuleSpec) error {
+	targets, v4, v6, err := ruleTargets(spec)
+	if err != nil {
+		return err
+	}
+
+	conn, err := nftables.New()
+	if err != nil {
+		return fmt.Errorf("failed to open nftables netlink connection: %w", err)
+	}
+
+	// add+del+add в одном батче пересоздает таблицу, оставшуюся после
+	// аварийного завершения, без отдельной проверки существования.
+	table := &nftables.Table{Family: nftables.TableFamilyINet, Name: NftTableName}
+	conn.AddTable(table)
+	conn.DelTable(table)
+	conn.AddTable(table)
+
+	input := conn.AddChain(&nftables.Chain{
+		Name: "input", Table: table, Type: nftables.ChainTypeFilter,
+		Hooknum: nftables.ChainHookInput, Priority: nftables.ChainPriorityFilter,
+	})
+	prerouting := conn.AddChain(&nftables.Chain{
+		Name: "prerouting", Table: table, Type: nftables.ChainTypeFilter,
+		Hooknum: nftables.ChainHookPrerouting, Priority: nftables.ChainPriorityMangle,
+	})
+	forward := conn.AddChain(&nftables.Chain{
+		Name: "forward", Table: table, Type: nftables.ChainTypeFilter,
+		Hooknum: nftables.ChainHookForward, Priority: nftables.ChainPriorityFilter,
+	})
+	postrouting := conn.AddChain(&nftables.Chain{
+		Name: "postrouting", Table: table, Type: nftables.ChainTypeNAT,
+		Hooknum: nftables.ChainHookPostrouting, Priority: nftables.ChainPriorityNATSource,
+	})
+
+	for _, port := range spec.LocalPorts {
+		conn.AddRule(&nftables.Rule{Table: table, Chain: input, Exprs: concat(
+			matchTCP(),
+			[]expr.Any{
+				&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2},
+				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.BigEndian.PutUint16(uint16(port))},
+				&expr.Verdict{Kind: expr.VerdictAccept},
+			},
+		)})
+	}
+
+	setMark := []expr.Any{
+		&expr.Immediate{Register: 1, Data: binaryutil.NativeEndian.PutUint32(markValue)},
+		&expr.Meta{Key: expr.MetaKeyMARK, SourceRegister: true, Register: 1},
+	}
+	if len(targets) == 0 {
+		conn.AddRule(&nftables.Rule{Table: table, Chain: prerouting, Exprs: concat(
+			matchIfname(unix.NFT_META_IIFNAME, expr.CmpOpEq, spec.TunName),
+			matchTCP(),
+			setMark,
+		)})
+	}
+	for _, ip := range targets {
+		conn.AddRule(&nftables.Rule{Table: table, Chain: prerouting, Exprs: concat(
+			matchIfname(unix.NFT_META_IIFNAME, expr.CmpOpEq, spec.TunName),
+			matchTCP(),
+			matchAddr(addrDst, netip.PrefixFrom(ip, ip.BitLen()), expr.CmpOpEq),
+			setMark,
+		)})
+	}
+
+	conn.AddRule(&nftables.Rule{Table: table, Chain: forward, Exprs: concat(
+		matchIfname(unix.NFT_META_IIFNAME, expr.CmpOpEq, spec.TunName),
+		matchMark(),
+		[]expr.Any{&expr.Verdict{Kind: expr.VerdictAccept}},
+	)})
+	conn.AddRule(&nftables.Rule{Table: table, Chain: forward, Exprs: concat(
+		matchIfname(unix.NFT_META_OIFNAME, expr.CmpOpEq, spec.TunName),
+		matchEstablished(),
+		[]expr.Any{&expr.Verdict{Kind: expr.VerdictAccept}},
+	)})
+
+	// Первое сработавшее правило nat определяет адрес, поэтому SNAT идет
+	// раньше masquerade.
+	for _, n := range spec.SNAT {
+		family := byte(unix.NFPROTO_IPV4)
+		if n.Source.Is6() {
+			family = unix.NFPROTO_IPV6
+		}
+		conn.AddRule(&nftables.Rule{Table: table, Chain: postrouting, Exprs: concat(
+			matchIfname(unix.NFT_META_OIFNAME, expr.CmpOpNeq, spec.TunName),
+			matchMark(),
+			matchAddr(addrSrc, netip.PrefixFrom(n.Stack, n.Stack.BitLen()), expr.CmpOpEq),
+			[]expr.Any{
+				&expr.Immediate{Register: 1, Data: n.Source.AsSlice()},
+				&expr.NAT{Type: expr.NATTypeSourceNAT, Family: uint32(family), RegAddrMin: 1},
+			},
+		)})
+	}
+	conn.AddRule(&nftables.Rule{Table: table, Chain: postrouting, Exprs: concat(
+		matchIfname(unix.NFT_META_OIFNAME, expr.CmpOpNeq, spec.TunName),
+		matchMark(),
+		[]expr.Any{&expr.Masq{}},
+	)})
+
+	if err := conn.Flush(); err != nil {
+		return fmt.Errorf("failed to apply nftables table %s: %w", NftTableName, err)
+	}
+	marked := fmt.Sprint(targets)
+	if len(targets) == 0 {
+		marked = "любой адрес"
+	}
+	logging.Infof("создана таблица nftables %s: прием на портах %v, маркировка %s -> %s, forward и masquerade для %s",
+		NftTableName, spec.LocalPorts, spec.TunName, marked, spec.TunName)
+	for _, n := range spec.SNAT {
+		logging.Infof("пакеты стека с адреса %s получают адрес источника %s", n.Stack, n.Source)
+	}
+
+	return enableForwarding(v4, v6)
+}
+
+func (nftablesBackend) Cleanup(spec RuleSpec) error {
+	return deleteNftTable(NftTableName)
+}
+
+// SetupUplink создает на хосте отдельную таблицу для NAT трафика из
+// namespace, чтобы ее удаление не задевало таблицу tcpcustom самого хоста.
+func (nftablesBackend) SetupUplink(spec UplinkSpec) error {
+	conn, err := nftables.New()
+	if err != nil {
+		return fmt.Errorf("failed to open nftables netlink connection: %w", err)
+	}
+
+	name := uplinkTableName(spec.Iface)
+	table := &nftables.Table{Family: nftables.TableFamilyINet, Name: name}
+	conn.AddTable(table)
+	conn.DelTable(table)
+	conn.AddTable(table)
+
+	forward := conn.AddChain(&nftables.Chain{
+		Name: "forward", Table: table, Type: nftables.ChainTypeFilter,
+		Hooknum: nftables.ChainHookForward, Priority: nftables.ChainPriorityFilter,
+	})
+	postrouting := conn.AddChain(&nftables.Chain{
+		Name: "postrouting", Table: table, Type: nftables.ChainTypeNAT,
+		Hooknum: nftables.ChainHookPostrouting, Priority: nftables.ChainPriorityNATSource,
+	})
+
+	conn.AddRule(&nftables.Rule{Table: table, Chain: forward, Exprs: concat(
+		matchIfname(unix.NFT_META_IIFNAME, expr.CmpOpEq, spec.Iface),
+		[]expr.Any{&expr.Verdict{Kind: expr.VerdictAccept}},
+	)})
+	conn.AddRule(&nftables.Rule{Table: table, Chain: forward, Exprs: concat(
+		matchIfname(unix.NFT_META_OIFNAME, expr.CmpOpEq, spec.Iface),
+		matchEstablished(),
+		[]expr.Any{&expr.Verdict{Kind: expr.VerdictAccept}},
+	)})
+
+	var v4, v6 bool
+	for _, subnet := range spec.Subnets {
+		if subnet.Addr().Is4() {
+			v4 = true
+		} else {
+			v6 = true
+		}
+		conn.AddRule(&nftables.Rule{Table: table, Chain: postrouting, Exprs: concat(
+			matchAddr(addrSrc, subnet, expr.CmpOpEq),
+			matchIfname(unix.NFT_META_OIFNAME, expr.CmpOpNeq, spec.Iface),
+			[]expr.Any{&expr.Masq{}},
+		)})
+	}
+
+	if err := conn.Flush(); err != nil {
+		return fmt.Errorf("failed to apply nftables table %s: %w", name, err)
+	}
+	logging.Infof("создана таблица nftables %s: forward и masquerade для %v через %s", name, spec.Subnets, spec.Iface)
+
+	return enableForwarding(v4, v6)
+}
+
+func (nftablesBackend) CleanupUplink(spec UplinkSpec) error {
+	return deleteNftTable(uplinkTableName(spec.Iface))
+}
+
+// SetupRedirect создает таблицу tcpcustom-redirect. Соединения процессов
+// хоста перехватываются в output по uid или cgroup, транзитные - в
+// prerouting по адресу источника; трафик из tun и на loopback не
+// трогается, чтобы не зациклить прокси.
+func (nftablesBackend) SetupRedirect(spec RedirectSpec) error {
+	conn, err := nftables.New()
+	if err != nil {
+		return fmt.Errorf("failed to open nftables netlink connection: %w", err)
+	}
+
+	table := &nftables.Table{Family: nftables.TableFamilyINet, Name: redirectTableName}
+	conn.AddTable(table)
+	conn.DelTable(table)
+	conn.AddTable(table)
+
+	output := conn.AddChain(&nftables.Chain{
+		Name: "output", Table: table, Type: nftables.ChainTypeNAT,
+		Hooknum: nftables.ChainHookOutput, Priority: nftables.ChainPriorityNATDest,
+	})
+	prerouting := conn.AddChain(&nftables.Chain{
+		Name: "prerouting", Table: table, Type: nftables.ChainTypeNAT,
+		Hooknum: nftables.ChainHookPrerouting, Priority: nftables.ChainPriorityNATDest,
+	})
+
+	redirect := []expr.Any{
+		&expr.Immediate{Register: 1, Data: binaryutil.BigEndian.PutUint16(uint16(spec.LocalPort))},
+		&expr.Redir{RegisterProtoMin: 1},
+	}
+	// Loopback исключается отдельно для каждого семейства, поэтому правила
+	// по uid и cgroup дублируются.
+	loopbacks := []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8"), netip.MustParsePrefix("::1/128")}
+
+	for _, uid := range spec.UIDs {
+		for _, lo := range loopbacks {
+			conn.AddRule(&nftables.Rule{Table: table, Chain: output, Exprs: concat(
+				matchTCP(),
+				matchAddr(addrDst, lo, expr.CmpOpNeq),
+				[]expr.Any{
+					&expr.Meta{Key: expr.MetaKeySKUID, Register: 1},
+					&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.NativeEndian.PutUint32(uid)},
+				},
+				redirect,
+			)})
+		}
+	}
+
+	for _, path := range spec.Cgroups {
+		id, level, err := cgroupID(path)
+		if err != nil {
+			return err
+		}
+		for _, lo := range loopbacks {
+			conn.AddRule(&nftables.Rule{Table: table, Chain: output, Exprs: concat(
+				matchTCP(),
+				matchAddr(addrDst, lo, expr.CmpOpNeq),
+				[]expr.Any{
+					&expr.Socket{Key: expr.SocketKeyCgroupv2, Level: level, Register: 1},
+					&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.NativeEndian.PutUint64(id)},
+				},
+				redirect,
+			)})
+		}
+	}
+
+	for _, src := range spec.Sources {
+		conn.AddRule(&nftables.Rule{Table: table, Chain: prerouting, Exprs: concat(
+			matchIfname(unix.NFT_META_IIFNAME, expr.CmpOpNeq, spec.TunName),
+			matchTCP(),
+			matchAddr(addrSrc, src, expr.CmpOpEq),
+			redirect,
+		)})
+	}
+
+	if err := conn.Flush(); err != nil {
+		return fmt.Errorf("failed to apply nftables table %s: %w", redirectTableName, err)
+	}
+	logging.Infof("создана таблица nftables %s: перенаправление на порт %d для uid %v, cgroup %v, источников %v",
+		redirectTableName, spec.LocalPort, spec.UIDs, spec.Cgroups, spec.Sources)
+	return nil
+}
+
+func (nftablesBackend) CleanupRedirect(spec RedirectSpec) error {
+	return deleteNftTable(redirectTableName)
+}
+
+func uplinkTableName(iface string) string {
+	return NftTableName + "-" + iface
+}
+
+// deleteNftTable удаляет таблицу inet. Таблицы семейства ip, которые
+// создавали версии до поддержки ipv6, удаляются заодно, чтобы cleanup
+// справлялся и со старыми журналами.
+func deleteNftTable(name string) error {
+	conn, err := nftables.New()
+	if err != nil {
+		return fmt.Errorf("failed to open nftables netlink connection: %w", err)
+	}
+
+	deleted := false
+	for _, family := range []nftables.TableFamily{nftables.TableFamilyINet, nftables.TableFamilyIPv4} {
+		conn.DelTable(&nftables.Table{Family: family, Name: name})
+		if err := conn.Flush(); err != nil {
+			if errors.Is(err, os.ErrNotExist) || errors.Is(err, unix.ENOENT) {
+				continue
+			}
+			return fmt.Errorf("failed to delete nftables table %s: %w", name, err)
+		}
+		deleted = true
+	}
+	if deleted {
+		logging.Infof("удалена таблица nftables %s", name)
+	}
+	return nil
+}
+
+// cgroupID возвращает идентификатор cgroup v2 (номер inode ее каталога) и
+// глубину вложенности, которые сравнивает выражение socket cgroupv2.
+func cgroupID(path string) (uint64, uint32, error) {
+	clean := strings.Trim(filepath.Clean("/"+path), "/")
+	dir := filepath.Join(CgroupRoot, clean)
+
+	var fs unix.Statfs_t
+	if err := unix.Statfs(dir, &fs); err != nil {
+		return 0, 0, fmt.Errorf("failed to stat cgroup %s: %w", path, err)
+	}
+	if fs.Type != unix.CGROUP2_SUPER_MAGIC {
+		return 0, 0, fmt.Errorf("%s is not on a cgroup v2 filesystem", dir)
+	}
+
+	var st unix.Stat_t
+	if err := unix.Stat(dir, &st); err != nil {
+		return 0, 0, fmt.Errorf("failed to stat cgroup %s: %w", path, err)
+	}
+	level := 0
+	if clean != "" {
+		level = strings.Count(clean, "/") + 1
+	}
+	return st.Ino, uint32(level), nil
+}
+
+func matchTCP() []expr.Any {
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{unix.IPPROTO_TCP}},
+	}
+}
+
+type addrField int
+
+const (
+	addrSrc addrField = iota
+	addrDst
+)
+
+// matchAddr сравнивает адрес источника или назначения с подсетью. В
+// таблице inet перед чтением заголовка проверяется семейство пакета.
+func matchAddr(field addrField, prefix netip.Prefix, op expr.CmpOp) []expr.Any {
+	prefix = prefix.Masked()
+	nfproto, offset, size := byte(unix.NFPROTO_IPV4), uint32(12), uint32(4)
+	if prefix.Addr().Is6() {
+		nfproto, offset, size = unix.NFPROTO_IPV6, 8, 16
+	}
+	if field == addrDst {
+		offset += size
+	}
+
+	exprs := []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{nfproto}},
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: offset, Len: size},
+	}
+	if prefix.Bits() < prefix.Addr().BitLen() {
+		mask := make([]byte, size)
+		for i := 0; i < prefix.Bits(); i++ {
+			mask[i/8] |= 0x80 >> (i % 8)
+		}
+		exprs = append(exprs, &expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: size, Mask: mask, Xor: make([]byte, size)})
+	}
+	return append(exprs, &expr.Cmp{Op: op, Register: 1, Data: prefix.Addr().AsSlice()})
+}
+
+func matchMark() []expr.Any {
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyMARK, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.NativeEndian.PutUint32(markValue)},
+	}
+}
+
+func matchEstablished() []expr.Any {
+	return []expr.Any{
+		&expr.Ct{Register: 1, Key: expr.CtKeySTATE},
+		&expr.Bitwise{
+			SourceRegister: 1, DestRegister: 1, Len: 4,
+			Mask: binaryutil.NativeEndian.PutUint32(expr.CtStateBitESTABLISHED | expr.CtStateBitRELATED),
+			Xor:  binaryutil.NativeEndian.PutUint32(0),
+		},
+		&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: binaryutil.NativeEndian.PutUint32(0)},
+	}
+}
+
+func matchIfname(key expr.MetaKey, op expr.CmpOp, name string) []expr.Any {
+	data := make([]byte, unix.IFNAMSIZ)
+	copy(data, name)
+	return []expr.Any{
+		&expr.Meta{Key: key, Register: 1},
+		&expr.Cmp{Op: op, Register: 1, Data: data},
+	}
+}
+
+func concat(parts ...[]expr.Any) []expr.Any {
+	var out []expr.Any
+	for _, p := range parts {
+		out = append(out, p...)
+	}
+	return out
+}
@@ -1,101 +1,196 @@
 package network
 
 import (
+	"errors"
 	"fmt"
-	"log"
 	"net"
-	"os/exec"
-	"strings"
+	"net/netip"
+
+	"custom-tcp-fingerprint/internal/logging"
+	"custom-tcp-fingerprint/internal/rtnl"
+
+	"github.com/vishvananda/netlink"
 )
 
-func SetupRouting(tunName, targetHost string) error {
-	targetIPs, err := net.LookupIP(targetHost)
+// RoutingTable - таблица policy routing для помеченных пакетов из tun.
+const RoutingTable = 100
+
+// SetupRouting направляет помеченные пакеты из tun через таблицу
+// RoutingTable в обоих семействах. Пустой targetHosts означает любой
+// адрес: маршруты в таблицу не добавляются, и поиск продолжается в
+// основной таблице, как для обычного трафика хоста.
+func SetupRouting(tunName string, targetHosts []string) error {
+	targets, _, _, err := ruleTargets(RuleSpec{TargetHosts: targetHosts})
 	if err != nil {
-		return fmt.Errorf("failed to resolve target host: %w", err)
+		return err
+	}
+	if len(targets) > 0 {
+		logging.Infof("целевые ip: %v", targets)
 	}
 
-	var targetIP net.IP
-	for _, ip := range targetIPs {
-		if ip.To4() != nil {
-			targetIP = ip
-			break
+	for _, prefix := range tunHostPrefixes() {
+		if err := rtnl.EnsureAddr(tunName, prefix); err != nil {
+			return fmt.Errorf("failed to assign IP %s to TUN interface: %w", prefix, err)
 		}
 	}
 
-	if targetIP == nil {
-		return fmt.Errorf("no IPv4 address found for target host: %s", targetHost)
+	for _, rule := range routingRules() {
+		if err := rtnl.EnsureRule(rule); err != nil {
+			return fmt.Errorf("failed to add routing rule: %w", err)
+		}
+		logging.Infof("применено правило маршрутизации: %s", rule)
 	}
 
-	log.Printf("целевой ip: %s", targetIP.String())
-
-	cmd := exec.Command("ip", "addr", "add", "10.0.0.1/24", "dev", tunName)
-	if output, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("failed to assign IP to TUN interface: %s, output: %s", err, string(output))
+	if len(targets) == 0 {
+		logging.Infof("целевой хост не задан, помеченные пакеты маршрутизируются по основной таблице")
+		return nil
 	}
 
-	cmds := [][]string{
-		{"ip", "rule", "add", "fwmark", MARK_VALUE, "table", "100"},
-
-		{"ip", "route", "add", targetIP.String(), "dev", tunName, "table", "100"},
-
-		{"ip", "route", "add", "default", "via", "10.0.0.1", "dev", tunName, "table", "100"},
-	}
+	routed := 0
+	for _, ip := range targets {
+		uplink, err := lookupUplinkRoute(ip)
+		if err != nil {
+			// Без маршрута к одному из адресов цели остаются доступны по
+			// остальным, поэтому ошибкой считается только отсутствие всех.
+			logging.Warnf("предупреждение: %v", err)
+			continue
+		}
+		routed++
 
-	for _, cmd := range cmds {
-		command := exec.Command(cmd[0], cmd[1:]...)
-		if output, err := command.CombinedOutput(); err != nil {
-			return fmt.Errorf("failed to run command '%s': %s, output: %s",
-				strings.Join(cmd, " "), err, string(output))
+		route := rtnl.Route{
+			Dst:     netip.PrefixFrom(ip, ip.BitLen()),
+			Gateway: uplink.Gateway,
+			Dev:     uplink.Dev,
+			Table:   RoutingTable,
+		}
+		if err := rtnl.EnsureRoute(route); err != nil {
+			return fmt.Errorf("failed to add route: %w", err)
 		}
-		log.Printf("применена команда маршрутизации: %s", strings.Join(cmd, " "))
+		logging.Infof("применен маршрут: %s", route)
+	}
+	if routed == 0 {
+		return fmt.Errorf("no uplink route found for %v", targets)
 	}
 
 	return nil
 }
 
-func CleanupRouting(tunName, targetHost string) error {
-	targetIPs, err := net.LookupIP(targetHost)
+// CleanupRouting удаляет маршруты, правила и адреса tun. Уже удаленные
+// объекты не считаются ошибкой, поэтому функцию можно вызывать повторно.
+func CleanupRouting(tunName string, targetHosts []string) error {
+	targets, _, _, err := ruleTargets(RuleSpec{TargetHosts: targetHosts})
 	if err != nil {
-		log.Printf("предупреждение: не удалось разрешить целевой хост: %v", err)
-		return nil
+		return err
 	}
 
-	var targetIP net.IP
-	for _, ip := range targetIPs {
-		if ip.To4() != nil {
-			targetIP = ip
-			break
+	var errs []error
+	for _, ip := range targets {
+		route := rtnl.Route{Dst: netip.PrefixFrom(ip, ip.BitLen()), Table: RoutingTable}
+		if err := rtnl.RemoveRoute(route); err != nil {
+			errs = append(errs, fmt.Errorf("failed to delete route %s: %w", route, err))
+		} else {
+			logging.Infof("удален маршрут: %s", route)
 		}
 	}
 
-	if targetIP == nil {
-		log.Printf("предупреждение: не наиден ipv4 адрес для целевого хоста: %s", targetHost)
-		return nil
+	for _, rule := range routingRules() {
+		if err := rtnl.RemoveRule(rule); err != nil {
+			errs = append(errs, fmt.Errorf("failed to delete routing rule %s: %w", rule, err))
+		} else {
+			logging.Infof("удалено правило маршрутизации: %s", rule)
+		}
 	}
 
-	cmds := [][]string{
-		{"ip", "route", "del", "default", "via", "10.0.0.1", "dev", tunName, "table", "100"},
+	for _, prefix := range tunHostPrefixes() {
+		if err := rtnl.RemoveAddr(tunName, prefix); err != nil {
+			errs = append(errs, fmt.Errorf("failed to remove IP %s from TUN interface: %w", prefix, err))
+		}
+	}
 
-		{"ip", "route", "del", targetIP.String(), "dev", tunName, "table", "100"},
+	return errors.Join(errs...)
+}
 
-		{"ip", "rule", "del", "fwmark", MARK_VALUE, "table", "100"},
+// ResolveTarget возвращает адрес, с которым прокси соединяется по
+// умолчанию: первый ipv4, а при его отсутствии - первый ipv6.
+func ResolveTarget(targetHost string) (netip.Addr, error) {
+	addrs, err := resolveAddrs(targetHost)
+	if err != nil {
+		return netip.Addr{}, err
 	}
+	return addrs[0], nil
+}
 
-	for _, cmd := range cmds {
-		command := exec.Command(cmd[0], cmd[1:]...)
-		if output, err := command.CombinedOutput(); err != nil {
-			log.Printf("предупреждение: не удалось выполнить команду '%s': %s, вывод: %s",
-				strings.Join(cmd, " "), err, string(output))
+// ResolveTargetFamily работает как ResolveTarget, но с заданным source
+// выбирает адрес его семейства.
+func ResolveTargetFamily(targetHost string, source netip.Addr) (netip.Addr, error) {
+	addrs, err := resolveAddrs(targetHost)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	for _, a := range addrs {
+		if !source.IsValid() || a.Is4() == source.Is4() {
+			return a, nil
+		}
+	}
+	return netip.Addr{}, fmt.Errorf("no address of the same family as %s found for target host: %s", source, targetHost)
+}
+
+// resolveAddrs возвращает все адреса хоста, ipv4 впереди; литеральный ip
+// возвращается как есть.
+func resolveAddrs(targetHost string) ([]netip.Addr, error) {
+	ips, err := net.LookupIP(targetHost)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve target host: %w", err)
+	}
+
+	var v4, v6 []netip.Addr
+	for _, ip := range ips {
+		addr, ok := netip.AddrFromSlice(ip)
+		if !ok {
+			continue
+		}
+		if addr = addr.Unmap(); addr.Is4() {
+			v4 = append(v4, addr)
 		} else {
-			log.Printf("удалена команда маршрутизации: %s", strings.Join(cmd, " "))
+			v6 = append(v6, addr)
 		}
 	}
+	if len(v4)+len(v6) == 0 {
+		return nil, fmt.Errorf("no IP address found for target host: %s", targetHost)
+	}
+	return append(v4, v6...), nil
+}
+
+// hasIPv6Uplink сообщает, есть ли у хоста маршрут ipv6 по умолчанию, то
+// есть имеет ли смысл ставить правила для ipv6 без конкретной цели.
+func hasIPv6Uplink() bool {
+	routes, err := rtnl.DefaultRoutes(netlink.FAMILY_V6)
+	return err == nil && len(routes) > 0
+}
 
-	cmd := exec.Command("ip", "addr", "del", "10.0.0.1/24", "dev", tunName)
-	if output, err := cmd.CombinedOutput(); err != nil {
-		log.Printf("предупреждение: не удалось удалить ip с tun интерфейса: %s, вывод: %s",
-			err, string(output))
+// lookupUplinkRoute возвращает шлюз и интерфейс маршрута до ip в основной
+// таблице: помеченные пакеты из tun уходят тем же путем, а не обратно в tun.
+func lookupUplinkRoute(ip netip.Addr) (rtnl.Route, error) {
+	route, err := rtnl.RouteGet(ip)
+	if err != nil {
+		return rtnl.Route{}, fmt.Errorf("failed to look up route to %s: %w", ip, err)
+	}
+	if route.Dev == "" {
+		return rtnl.Route{}, fmt.Errorf("no uplink route found for %s", ip)
 	}
+	return route, nil
+}
 
-	return nil
+func tunHostPrefixes() []netip.Prefix {
+	return []netip.Prefix{
+		netip.PrefixFrom(netip.MustParseAddr(TunHostAddr), TunPrefixLen),
+		netip.PrefixFrom(netip.MustParseAddr(TunHostAddr6), TunPrefixLen6),
+	}
+}
+
+func routingRules() []rtnl.Rule {
+	return []rtnl.Rule{
+		{Family: netlink.FAMILY_V4, Mark: markValue, Table: RoutingTable},
+		{Family: netlink.FAMILY_V6, Mark: markValue, Table: RoutingTable},
+	}
 }
@@ -2,49 +2,65 @@ package network
 
 import (
 	"fmt"
-	"os"
-	"os/exec"
-	"path/filepath"
-	"strconv"
+	"net/netip"
+
+	"custom-tcp-fingerprint/internal/rtnl"
+
+	"golang.org/x/sys/unix"
+	"gvisor.dev/gvisor/pkg/tcpip/link/tun"
 )
 
+const (
+	TunHostAddr  = "10.0.0.1"
+	TunStackAddr = "10.0.0.2"
+	TunPrefixLen = 24
+
+	TunHostAddr6  = "fd00:1337::1"
+	TunStackAddr6 = "fd00:1337::2"
+	TunPrefixLen6 = 64
+
+	// MaxSourceStackAddrs - сколько дополнительных адресов стека можно
+	// выделить пересылкам с собственным адресом источника.
+	MaxSourceStackAddrs = 250
+)
+
+// SourceStackAddr возвращает index-й дополнительный адрес стека в подсети
+// tun. С него открываются соединения пересылки, для которых задан адрес
+// источника, и по нему правило SNAT отличает их пакеты.
+func SourceStackAddr(index int, v6 bool) netip.Addr {
+	if v6 {
+		a := netip.MustParseAddr(TunStackAddr6).As16()
+		a[15] += byte(index + 1)
+		return netip.AddrFrom16(a)
+	}
+	a := netip.MustParseAddr(TunStackAddr).As4()
+	a[3] += byte(index + 1)
+	return netip.AddrFrom4(a)
+}
+
 type TUNInterface struct {
 	name   string
-	file   *os.File
+	fd     int
 	active bool
 }
 
+// CreateTunInterface создает новый tun-интерфейс и открывает его. Если
+// интерфейс с таким именем уже есть, возвращается ошибка rtnl.ErrExists, а
+// чужой интерфейс не трогается; Close удаляет только созданный здесь.
 func CreateTunInterface(tunName string, mtu int) (*TUNInterface, error) {
-	cmd := exec.Command("ip", "tuntap", "add", "dev", tunName, "mode", "tun")
-	if output, err := cmd.CombinedOutput(); err != nil {
-		return nil, fmt.Errorf("не удалось создать tun интерфейс: %s, вывод: %s", err, string(output))
-	}
-
-	cmd = exec.Command("ip", "link", "set", "dev", tunName, "mtu", strconv.Itoa(mtu))
-	if output, err := cmd.CombinedOutput(); err != nil {
-		exec.Command("ip", "tuntap", "del", "dev", tunName, "mode", "tun").Run()
-		return nil, fmt.Errorf("не удалось установить mtu: %s, вывод: %s", err, string(output))
-	}
-
-	cmd = exec.Command("ip", "link", "set", "dev", tunName, "up")
-	if output, err := cmd.CombinedOutput(); err != nil {
-		exec.Command("ip", "tuntap", "del", "dev", tunName, "mode", "tun").Run()
-		return nil, fmt.Errorf("не удалось поднять интерфейс: %s, вывод: %s", err, string(output))
+	if err := rtnl.AddTun(tunName, mtu); err != nil {
+		return nil, fmt.Errorf("не удалось создать tun интерфейс: %w", err)
 	}
 
-	path := filepath.Join("/dev", tunName)
-	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	fd, err := tun.Open(tunName)
 	if err != nil {
-		file, err = os.OpenFile("/dev/net/tun", os.O_RDWR, 0)
-		if err != nil {
-			exec.Command("ip", "tuntap", "del", "dev", tunName, "mode", "tun").Run()
-			return nil, fmt.Errorf("не удалось открыть файловый дескриптор: %w", err)
-		}
+		rtnl.DeleteLink(tunName)
+		return nil, fmt.Errorf("не удалось открыть файловый дескриптор: %w", err)
 	}
 
 	return &TUNInterface{
 		name:   tunName,
-		file:   file,
+		fd:     fd,
 		active: true,
 	}, nil
 }
@@ -53,8 +69,8 @@ func (t *TUNInterface) Name() string {
 	return t.name
 }
 
-func (t *TUNInterface) File() *os.File {
-	return t.file
+func (t *TUNInterface) Fd() int {
+	return t.fd
 }
 
 func (t *TUNInterface) Close() error {
@@ -62,13 +78,12 @@ func (t *TUNInterface) Close() error {
 		return nil
 	}
 
-	if err := t.file.Close(); err != nil {
+	if err := unix.Close(t.fd); err != nil {
 		return fmt.Errorf("не удалось закрыть файловый дескриптор: %w", err)
 	}
 
-	cmd := exec.Command("ip", "tuntap", "del", "dev", t.name, "mode", "tun")
-	if output, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("не удалось удалить tun интерфейс: %s, вывод: %s", err, string(output))
+	if err := rtnl.DeleteLink(t.name); err != nil {
+		return fmt.Errorf("не удалось удалить tun интерфейс: %w", err)
 	}
 
 	t.active = false
@@ -0,0 +1,316 @@
+package p0f
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	sectionTCPRequest  = "tcp:request"
+	sectionTCPResponse = "tcp:response"
+)
+
+type Label struct {
+	Generic bool
+	Class   string
+	Name    string
+	Flavor  string
+}
+
+func ParseLabel(s string) (Label, error) {
+	parts := strings.SplitN(s, ":", 4)
+	if len(parts) != 4 {
+		return Label{}, fmt.Errorf("некорректная метка p0f: %q", s)
+	}
+
+	var label Label
+	switch parts[0] {
+	case "s":
+	case "g":
+		label.Generic = true
+	default:
+		return Label{}, fmt.Errorf("некорректный тип метки p0f: %q", s)
+	}
+	label.Class = parts[1]
+	label.Name = parts[2]
+	label.Flavor = parts[3]
+	return label, nil
+}
+
+func (l Label) String() string {
+	kind := "s"
+	if l.Generic {
+		kind = "g"
+	}
+	return fmt.Sprintf("%s:%s:%s:%s", kind, l.Class, l.Name, l.Flavor)
+}
+
+// OS возвращает метку в виде "Name:Flavor", по которой профиль выбирается флагом -fp.
+func (l Label) OS() string {
+	if l.Flavor == "" {
+		return l.Name
+	}
+	return l.Name + ":" + l.Flavor
+}
+
+// Matches сравнивает метку с полной записью, "Name:Flavor" или только именем
+// ОС, без учета регистра.
+func (l Label) Matches(name string) bool {
+	return strings.EqualFold(l.String(), name) ||
+		strings.EqualFold(l.OS(), name) ||
+		strings.EqualFold(l.Name, name)
+}
+
+type WindowKind int
+
+const (
+	WindowAny WindowKind = iota
+	WindowFixed
+	WindowMSS
+	WindowMTU
+	WindowMod
+)
+
+type Window struct {
+	Kind  WindowKind
+	Value int
+}
+
+func ParseWindow(s string) (Window, error) {
+	switch {
+	case s == "*":
+		return Window{Kind: WindowAny}, nil
+	case strings.HasPrefix(s, "mss*"):
+		n, err := strconv.Atoi(s[len("mss*"):])
+		return Window{Kind: WindowMSS, Value: n}, err
+	case strings.HasPrefix(s, "mtu*"):
+		n, err := strconv.Atoi(s[len("mtu*"):])
+		return Window{Kind: WindowMTU, Value: n}, err
+	case strings.HasPrefix(s, "%"):
+		n, err := strconv.Atoi(s[1:])
+		return Window{Kind: WindowMod, Value: n}, err
+	}
+	n, err := strconv.Atoi(s)
+	return Window{Kind: WindowFixed, Value: n}, err
+}
+
+func (w Window) String() string {
+	switch w.Kind {
+	case WindowAny:
+		return "*"
+	case WindowMSS:
+		return fmt.Sprintf("mss*%d", w.Value)
+	case WindowMTU:
+		return fmt.Sprintf("mtu*%d", w.Value)
+	case WindowMod:
+		return fmt.Sprintf("%%%d", w.Value)
+	}
+	return strconv.Itoa(w.Value)
+}
+
+// Signature - tcp-сигнатура p0f v3:
+// ver:ittl:olen:mss:wsize,scale:olayout:quirks:pclass.
+// Значение -1 в числовых полях означает "*".
+type Signature struct {
+	Label        Label
+	Version      int
+	ITTL         int
+	BadTTL       bool
+	OptLen       int
+	MSS          int
+	Window       Window
+	Scale        int
+	OptionLayout string
+	Quirks       []string
+	PayloadClass string
+	Raw          string
+}
+
+func ParseSignature(s string) (*Signature, error) {
+	fields := strings.Split(strings.TrimSpace(s), ":")
+	if len(fields) != 8 {
+		return nil, fmt.Errorf("сигнатура p0f должна содержать 8 полей, получено %d: %q", len(fields), s)
+	}
+
+	sig := &Signature{Raw: strings.TrimSpace(s)}
+	var err error
+
+	switch fields[0] {
+	case "*":
+		sig.Version = -1
+	case "4", "6":
+		sig.Version, _ = strconv.Atoi(fields[0])
+	default:
+		return nil, fmt.Errorf("некорректная версия ip %q в сигнатуре %q", fields[0], s)
+	}
+
+	ittl := fields[1]
+	if strings.HasSuffix(ittl, "-") {
+		sig.BadTTL = true
+		ittl = strings.TrimSuffix(ittl, "-")
+	}
+	if base, _, ok := strings.Cut(ittl, "+"); ok {
+		ittl = base
+	}
+	if sig.ITTL, err = strconv.Atoi(ittl); err != nil || sig.ITTL < 1 || sig.ITTL > 255 {
+		return nil, fmt.Errorf("некорректный начальный ttl %q в сигнатуре %q", fields[1], s)
+	}
+
+	if sig.OptLen, err = strconv.Atoi(fields[2]); err != nil {
+		return nil, fmt.Errorf("некорректная длина ip опций %q в сигнатуре %q", fields[2], s)
+	}
+
+	if sig.MSS, err = parseWildcard(fields[3]); err != nil {
+		return nil, fmt.Errorf("некорректный mss %q в сигнатуре %q", fields[3], s)
+	}
+
+	wsize, scale, ok := strings.Cut(fields[4], ",")
+	if !ok {
+		return nil, fmt.Errorf("некорректное поле wsize,scale %q в сигнатуре %q", fields[4], s)
+	}
+	if sig.Window, err = ParseWindow(wsize); err != nil {
+		return nil, fmt.Errorf("некорректный размер окна %q в сигнатуре %q", wsize, s)
+	}
+	if sig.Scale, err = parseWildcard(scale); err != nil || sig.Scale > 14 {
+		return nil, fmt.Errorf("некорректный window scale %q в сигнатуре %q", scale, s)
+	}
+
+	sig.OptionLayout = fields[5]
+	if fields[6] != "" {
+		sig.Quirks = strings.Split(fields[6], ",")
+	}
+	sig.PayloadClass = fields[7]
+
+	return sig, nil
+}
+
+func (s *Signature) HasQuirk(quirk string) bool {
+	for _, q := range s.Quirks {
+		if q == quirk {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Signature) String() string {
+	return s.Raw
+}
+
+func parseWildcard(s string) (int, error) {
+	if s == "*" {
+		return -1, nil
+	}
+	return strconv.Atoi(s)
+}
+
+type Database struct {
+	Requests  []*Signature
+	Responses []*Signature
+}
+
+func Load(path string) (*Database, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("не удалось открыть базу p0f: %w", err)
+	}
+	defer f.Close()
+
+	db, err := Parse(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return db, nil
+}
+
+// Parse читает p0f.fp и берет только секции [tcp:request] и [tcp:response];
+// остальные секции (mtu, http) пропускаются.
+func Parse(r io.Reader) (*Database, error) {
+	db := &Database{}
+	scanner := bufio.NewScanner(r)
+
+	section := ""
+	var label *Label
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, ";") {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = line[1 : len(line)-1]
+			label = nil
+			continue
+		}
+		if section != sectionTCPRequest && section != sectionTCPResponse {
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("строка %d: ожидалось key = value", lineNo)
+		}
+		key = strings.TrimSpace(key)
+		value = strings.TrimSpace(value)
+
+		switch key {
+		case "label":
+			l, err := ParseLabel(value)
+			if err != nil {
+				return nil, fmt.Errorf("строка %d: %w", lineNo, err)
+			}
+			label = &l
+		case "sig":
+			if label == nil {
+				return nil, fmt.Errorf("строка %d: сигнатура без метки", lineNo)
+			}
+			sig, err := ParseSignature(value)
+			if err != nil {
+				return nil, fmt.Errorf("строка %d: %w", lineNo, err)
+			}
+			sig.Label = *label
+			if section == sectionTCPRequest {
+				db.Requests = append(db.Requests, sig)
+			} else {
+				db.Responses = append(db.Responses, sig)
+			}
+		case "sys", "classes", "ua_os":
+		default:
+			return nil, fmt.Errorf("строка %d: неизвестный ключ %q", lineNo, key)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return db, nil
+}
+
+// Lookup ищет первую SYN-сигнатуру с подходящей меткой (см. Label.Matches).
+func (db *Database) Lookup(name string) (*Signature, error) {
+	for _, sig := range db.Requests {
+		if sig.Label.Matches(name) {
+			return sig, nil
+		}
+	}
+	return nil, fmt.Errorf("метка %q не найдена в базе p0f", name)
+}
+
+func (db *Database) Labels() []string {
+	var labels []string
+	seen := make(map[string]bool)
+	for _, sig := range db.Requests {
+		os := sig.Label.OS()
+		if !seen[os] {
+			seen[os] = true
+			labels = append(labels, os)
+		}
+	}
+	return labels
+}
@@ -0,0 +1,174 @@
+package p0f
+
+import (
+	"os"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseSignature(t *testing.T) {
+	tests := []struct {
+		sig     string
+		version int
+		ittl    int
+		badTTL  bool
+		mss     int
+		window  Window
+		scale   int
+		layout  string
+		quirks  []string
+	}{
+		// Строки из configs/p0f.fp.
+		{"*:64:0:*:mss*20,10:mss,sok,ts,nop,ws:df,id+:0", -1, 64, false, -1,
+			Window{WindowMSS, 20}, 10, "mss,sok,ts,nop,ws", []string{"df", "id+"}},
+		{"*:128:0:*:64240,8:mss,nop,ws,nop,nop,sok:df,id+:0", -1, 128, false, -1,
+			Window{WindowFixed, 64240}, 8, "mss,nop,ws,nop,nop,sok", []string{"df", "id+"}},
+		{"*:64:0:*:65535,1:mss,nop,ws,nop,nop,ts,sok,eol+1:df,id+:0", -1, 64, false, -1,
+			Window{WindowFixed, 65535}, 1, "mss,nop,ws,nop,nop,ts,sok,eol+1", []string{"df", "id+"}},
+		{"*:128:0:*:8192,0:mss:df,id+:0", -1, 128, false, -1,
+			Window{WindowFixed, 8192}, 0, "mss", []string{"df", "id+"}},
+		// Формы из полной базы p0f.
+		{"4:64+1:0:1460:mtu*4,*:mss,nop,nop,sok::0", 4, 64, false, 1460,
+			Window{WindowMTU, 4}, -1, "mss,nop,nop,sok", nil},
+		{"6:255-:0:*:*,0:mss,nop,ws:flow,ecn,0+:+", 6, 255, true, -1,
+			Window{WindowAny, 0}, 0, "mss,nop,ws", []string{"flow", "ecn", "0+"}},
+		{"*:128:0:*:%8192,*:mss,nop,nop,sok:df,id+:0", -1, 128, false, -1,
+			Window{WindowMod, 8192}, -1, "mss,nop,nop,sok", []string{"df", "id+"}},
+	}
+	for _, tt := range tests {
+		sig, err := ParseSignature(tt.sig)
+		if err != nil {
+			t.Errorf("%q: %v", tt.sig, err)
+			continue
+		}
+		if sig.Version != tt.version || sig.ITTL != tt.ittl || sig.BadTTL != tt.badTTL || sig.MSS != tt.mss ||
+			sig.Window != tt.window || sig.Scale != tt.scale || sig.OptionLayout != tt.layout ||
+			!slices.Equal(sig.Quirks, tt.quirks) {
+			t.Errorf("%q: разобрано %+v", tt.sig, sig)
+		}
+		if sig.String() != tt.sig {
+			t.Errorf("%q: String() = %q", tt.sig, sig.String())
+		}
+	}
+}
+
+func TestParseSignatureErrors(t *testing.T) {
+	for _, sig := range []string{
+		"*:64:0:*:mss*20,10:mss,sok,ts,nop,ws:df,id+",
+		"*:64:0:*:mss*20,10:mss,sok,ts,nop,ws:df,id+:0:extra",
+		"5:64:0:*:8192,0:mss::0",
+		"*:0:0:*:8192,0:mss::0",
+		"*:256:0:*:8192,0:mss::0",
+		"*:x:0:*:8192,0:mss::0",
+		"*:64:x:*:8192,0:mss::0",
+		"*:64:0:big:8192,0:mss::0",
+		"*:64:0:*:8192:mss::0",
+		"*:64:0:*:mss*x,0:mss::0",
+		"*:64:0:*:mtu*,0:mss::0",
+		"*:64:0:*:%x,0:mss::0",
+		"*:64:0:*:large,0:mss::0",
+		"*:64:0:*:8192,15:mss::0",
+		"*:64:0:*:8192,x:mss::0",
+	} {
+		if _, err := ParseSignature(sig); err == nil {
+			t.Errorf("%q: ошибки нет", sig)
+		}
+	}
+}
+
+func TestParseLabel(t *testing.T) {
+	l, err := ParseLabel("g:unix:Linux:3.11 and newer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !l.Generic || l.Class != "unix" || l.Name != "Linux" || l.Flavor != "3.11 and newer" {
+		t.Fatalf("метка %+v", l)
+	}
+	if l.String() != "g:unix:Linux:3.11 and newer" || l.OS() != "Linux:3.11 and newer" {
+		t.Errorf("String() = %q, OS() = %q", l.String(), l.OS())
+	}
+	for _, name := range []string{"linux", "Linux:3.11 and newer", "G:UNIX:linux:3.11 AND NEWER"} {
+		if !l.Matches(name) {
+			t.Errorf("метка не совпала с %q", name)
+		}
+	}
+	if l.Matches("Linux:2.6.x") {
+		t.Errorf("метка совпала с другой версией")
+	}
+	for _, s := range []string{"s:unix:Linux", "x:unix:Linux:3.x"} {
+		if _, err := ParseLabel(s); err == nil {
+			t.Errorf("%q: ошибки нет", s)
+		}
+	}
+}
+
+func TestParseConfigDatabase(t *testing.T) {
+	f, err := os.Open("../../configs/p0f.fp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	db, err := Parse(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(db.Requests) != 18 || len(db.Responses) != 8 {
+		t.Fatalf("сигнатур SYN %d, SYN-ACK %d", len(db.Requests), len(db.Responses))
+	}
+
+	tests := []struct {
+		name, label, sig string
+	}{
+		{"windows", "s:win:Windows:10 or 11", "*:128:0:*:64240,8:mss,nop,ws,nop,nop,sok:df,id+:0"},
+		{"Windows:XP", "s:win:Windows:XP", "*:128:0:*:16384,0:mss,nop,nop,sok:df,id+:0"},
+		{"s:unix:Mac OS X:11 or newer", "s:unix:Mac OS X:11 or newer", "*:64:0:*:65535,6:mss,nop,ws,nop,nop,ts,sok,eol+1:df,id+:0"},
+		{"freebsd", "s:unix:FreeBSD:9.x or newer", "*:64:0:*:65535,6:mss,nop,ws,sok,ts:df,id+:0"},
+	}
+	for _, tt := range tests {
+		sig, err := db.Lookup(tt.name)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if sig.Label.String() != tt.label || sig.Raw != tt.sig {
+			t.Errorf("%s: найдено %s %s", tt.name, sig.Label, sig.Raw)
+		}
+	}
+	// Сигнатуры SYN-ACK по Lookup не находятся.
+	if _, err := db.Lookup("Linux:3.x"); err == nil {
+		t.Errorf("Lookup нашел сигнатуру из [tcp:response]")
+	}
+
+	labels := db.Labels()
+	if len(labels) != 9 || labels[0] != "Linux:3.11 and newer" {
+		t.Errorf("метки %q", labels)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name, db string
+	}{
+		{"сигнатура без метки", "[tcp:request]\nsig = *:64:0:*:8192,0:mss::0\n"},
+		{"строка без =", "[tcp:request]\nlabel = s:unix:Linux:3.x\nsig *:64:0:*:8192,0:mss::0\n"},
+		{"неизвестный ключ", "[tcp:request]\nlabel = s:unix:Linux:3.x\nfoo = 1\n"},
+		{"неверная метка", "[tcp:request]\nlabel = Linux\n"},
+		{"неверная сигнатура", "[tcp:response]\nlabel = s:unix:Linux:3.x\nsig = *:64:0:*:8192:mss::0\n"},
+		// Метка не переходит в следующую секцию.
+		{"метка из другой секции", "[tcp:request]\nlabel = s:unix:Linux:3.x\n[tcp:response]\nsig = *:64:0:*:8192,0:mss::0\n"},
+	}
+	for _, tt := range tests {
+		if _, err := Parse(strings.NewReader(tt.db)); err == nil {
+			t.Errorf("%s: ошибки нет", tt.name)
+		} else if !strings.HasPrefix(err.Error(), "строка ") {
+			t.Errorf("%s: в ошибке нет номера строки: %v", tt.name, err)
+		}
+	}
+
+	// Секции кроме tcp пропускаются вместе с их ключами.
+	db, err := Parse(strings.NewReader("[mtu]\nlabel = Ethernet\nsig = 1500\n[http:request]\nua_os = Linux\n"))
+	if err != nil || len(db.Requests)+len(db.Responses) != 0 {
+		t.Errorf("чужие секции: %v, %+v", err, db)
+	}
+}
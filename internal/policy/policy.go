@@ -0,0 +1,224 @@
+package policy
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"net/netip"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Client - сведения о клиенте прокси, от имени которого открывается
+// соединение. Прокси кладут их в контекст вызова Dialer.
+type Client struct {
+	User   string
+	Source netip.Addr
+}
+
+type clientKey struct{}
+
+func NewContext(ctx context.Context, c Client) context.Context {
+	return context.WithValue(ctx, clientKey{}, c)
+}
+
+func FromContext(ctx context.Context) Client {
+	c, _ := ctx.Value(clientKey{}).(Client)
+	return c
+}
+
+// Request - исходящее соединение, для которого выбирается профиль. Host -
+// имя назначения в том виде, в каком его передал клиент (для IP-адреса -
+// сам адрес), Addr - адрес, к которому идет подключение.
+type Request struct {
+	Host string
+	Addr netip.Addr
+	Port int
+	Client
+}
+
+// PortRange - диапазон портов включительно; один порт задается с From == To.
+type PortRange struct {
+	From, To int
+}
+
+// Rule срабатывает, если соединение подходит под каждое заданное поле;
+// внутри поля достаточно совпадения с любым значением. Правило без условий
+// срабатывает всегда.
+type Rule struct {
+	Profile string
+	Dst     []netip.Prefix
+	Hosts   []string
+	Ports   []PortRange
+	Users   []string
+	Sources []netip.Prefix
+}
+
+// Policy - упорядоченный список правил: выбирается первое сработавшее, а
+// если таких нет - профиль ротации или, без нее, Default.
+type Policy struct {
+	Rules    []Rule
+	Default  string
+	Rotation *Rotation
+}
+
+// Choice - выбранный профиль и генератор для случайных отклонений его
+// полей; без ротации Rand равен nil.
+type Choice struct {
+	Profile string
+	Rand    *rand.Rand
+}
+
+// Select выбирает профиль для соединения. Ротация опрашивается и тогда,
+// когда сработало правило: ее генератор задает отклонения полей.
+func (p *Policy) Select(req Request) Choice {
+	choice := Choice{Profile: p.Default}
+	if p.Rotation != nil {
+		choice.Profile, choice.Rand = p.Rotation.Pick(req)
+	}
+	for i := range p.Rules {
+		if p.Rules[i].Match(req) {
+			choice.Profile = p.Rules[i].Profile
+			break
+		}
+	}
+	return choice
+}
+
+// Profiles возвращает имена всех профилей, на которые ссылается политика,
+// без повторов.
+func (p *Policy) Profiles() []string {
+	var names []string
+	seen := map[string]bool{}
+	all := append([]string{p.Default}, ruleProfiles(p.Rules)...)
+	if p.Rotation != nil {
+		for _, w := range p.Rotation.Profiles {
+			all = append(all, w.Profile)
+		}
+	}
+	for _, name := range all {
+		if name != "" && !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func ruleProfiles(rules []Rule) []string {
+	names := make([]string, len(rules))
+	for i, r := range rules {
+		names[i] = r.Profile
+	}
+	return names
+}
+
+func (r *Rule) Match(req Request) bool {
+	if len(r.Dst) > 0 && !matchPrefix(r.Dst, req.Addr) {
+		return false
+	}
+	if len(r.Hosts) > 0 && !matchHost(r.Hosts, req.Host) {
+		return false
+	}
+	if len(r.Ports) > 0 && !matchPort(r.Ports, req.Port) {
+		return false
+	}
+	if len(r.Users) > 0 && !matchUser(r.Users, req.User) {
+		return false
+	}
+	if len(r.Sources) > 0 && !matchPrefix(r.Sources, req.Source) {
+		return false
+	}
+	return true
+}
+
+func matchPrefix(prefixes []netip.Prefix, addr netip.Addr) bool {
+	if !addr.IsValid() {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, p := range prefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchHost сравнивает имя с шаблонами без учета регистра и завершающей
+// точки. Шаблон "*.example.com" не совпадает с самим example.com, как и в
+// path.Match.
+func matchHost(patterns []string, host string) bool {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if host == "" {
+		return false
+	}
+	for _, p := range patterns {
+		if ok, _ := path.Match(strings.ToLower(p), host); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func matchPort(ranges []PortRange, port int) bool {
+	for _, r := range ranges {
+		if port >= r.From && port <= r.To {
+			return true
+		}
+	}
+	return false
+}
+
+func matchUser(users []string, user string) bool {
+	for _, u := range users {
+		if u == user {
+			return true
+		}
+	}
+	return false
+}
+
+// ParsePrefix принимает подсеть в нотации CIDR или отдельный адрес, который
+// считается подсетью /32 или /128.
+func ParsePrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		return p.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// ParsePortRange принимает порт ("443") или диапазон ("8000-8100").
+func ParsePortRange(s string) (PortRange, error) {
+	from, to, isRange := strings.Cut(s, "-")
+	if !isRange {
+		to = from
+	}
+	a, err := strconv.Atoi(strings.TrimSpace(from))
+	if err != nil {
+		return PortRange{}, fmt.Errorf("некорректный порт %q", s)
+	}
+	b, err := strconv.Atoi(strings.TrimSpace(to))
+	if err != nil {
+		return PortRange{}, fmt.Errorf("некорректный порт %q", s)
+	}
+	if a < 1 || b > 65535 || a > b {
+		return PortRange{}, fmt.Errorf("некорректный диапазон портов %q", s)
+	}
+	return PortRange{From: a, To: b}, nil
+}
+
+// ValidHostPattern сообщает, является ли s корректным шаблоном имени.
+func ValidHostPattern(s string) bool {
+	_, err := path.Match(s, "")
+	return err == nil
+}
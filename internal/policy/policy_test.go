@@ -0,0 +1,175 @@
+package policy
+
+import (
+	"context"
+	"net/netip"
+	"slices"
+	"testing"
+)
+
+func mustPrefix(t *testing.T, s string) netip.Prefix {
+	t.Helper()
+	p, err := ParsePrefix(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestSelectRulesBeforeRotation(t *testing.T) {
+	rot, err := NewRotation(RotateConnection, 0, []Weighted{{"linux", 1}, {"macos", 1}}, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &Policy{
+		Rules: []Rule{
+			{Profile: "windows", Dst: []netip.Prefix{mustPrefix(t, "203.0.113.0/24")}},
+			{Profile: "windows10", Ports: []PortRange{{From: 443, To: 443}}},
+		},
+		Default:  "linux",
+		Rotation: rot,
+	}
+
+	for i := range 20 {
+		c := p.Select(Request{Addr: netip.AddrFrom4([4]byte{203, 0, 113, byte(i)}), Port: 443})
+		if c.Profile != "windows" {
+			t.Fatalf("первое сработавшее правило: профиль %s, ожидался windows", c.Profile)
+		}
+		if c.Rand == nil {
+			t.Fatalf("при сработавшем правиле нет генератора ротации")
+		}
+	}
+	if c := p.Select(Request{Addr: netip.MustParseAddr("192.0.2.1"), Port: 443}); c.Profile != "windows10" {
+		t.Fatalf("второе правило: профиль %s, ожидался windows10", c.Profile)
+	}
+
+	seen := make(map[string]bool)
+	for i := range 20 {
+		c := p.Select(Request{Addr: netip.AddrFrom4([4]byte{192, 0, 2, byte(i)}), Port: 80})
+		seen[c.Profile] = true
+	}
+	if len(seen) != 2 || !seen["linux"] || !seen["macos"] {
+		t.Fatalf("без правил выбирает ротация, получено %v", seen)
+	}
+}
+
+func TestSelectDefault(t *testing.T) {
+	p := &Policy{Default: "linux"}
+	c := p.Select(Request{Addr: netip.MustParseAddr("192.0.2.1")})
+	if c.Profile != "linux" || c.Rand != nil {
+		t.Fatalf("Select = %+v, ожидался linux без генератора", c)
+	}
+}
+
+func TestRuleMatch(t *testing.T) {
+	rule := Rule{
+		Profile: "windows",
+		Dst:     []netip.Prefix{mustPrefix(t, "10.0.0.0/8"), mustPrefix(t, "2001:db8::/32")},
+		Hosts:   []string{"*.example.com", "Example.org"},
+		Ports:   []PortRange{{From: 80, To: 80}, {From: 8000, To: 8100}},
+		Users:   []string{"alice"},
+		Sources: []netip.Prefix{mustPrefix(t, "192.168.1.10")},
+	}
+	ok := Request{
+		Host:   "www.example.com",
+		Addr:   netip.MustParseAddr("10.1.2.3"),
+		Port:   8080,
+		Client: Client{User: "alice", Source: netip.MustParseAddr("::ffff:192.168.1.10")},
+	}
+
+	tests := []struct {
+		name   string
+		modify func(r *Request)
+		want   bool
+	}{
+		{"все поля", func(r *Request) {}, true},
+		{"ipv6 назначение", func(r *Request) { r.Addr = netip.MustParseAddr("2001:db8::1") }, true},
+		{"имя с точкой и регистром", func(r *Request) { r.Host = "EXAMPLE.ORG." }, true},
+		{"назначение вне подсети", func(r *Request) { r.Addr = netip.MustParseAddr("11.0.0.1") }, false},
+		{"шаблон не совпадает с доменом", func(r *Request) { r.Host = "example.com" }, false},
+		{"порт вне диапазона", func(r *Request) { r.Port = 8101 }, false},
+		{"другой пользователь", func(r *Request) { r.User = "bob" }, false},
+		{"другой источник", func(r *Request) { r.Source = netip.MustParseAddr("192.168.1.11") }, false},
+		{"нет адреса", func(r *Request) { r.Addr = netip.Addr{} }, false},
+	}
+	for _, tt := range tests {
+		req := ok
+		tt.modify(&req)
+		if got := rule.Match(req); got != tt.want {
+			t.Errorf("%s: Match = %v, ожидалось %v", tt.name, got, tt.want)
+		}
+	}
+
+	if !(&Rule{Profile: "linux"}).Match(Request{}) {
+		t.Errorf("правило без условий должно срабатывать всегда")
+	}
+}
+
+func TestProfiles(t *testing.T) {
+	rot, err := NewRotation(RotateConnection, 0, []Weighted{{"linux", 1}, {"macos", 1}}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &Policy{
+		Rules:    []Rule{{Profile: "windows"}, {Profile: "linux"}},
+		Default:  "linux",
+		Rotation: rot,
+	}
+	want := []string{"linux", "windows", "macos"}
+	if got := p.Profiles(); !slices.Equal(got, want) {
+		t.Fatalf("Profiles = %v, ожидалось %v", got, want)
+	}
+}
+
+func TestParsePrefix(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"10.1.2.3/8", "10.0.0.0/8"},
+		{"192.0.2.1", "192.0.2.1/32"},
+		{"2001:db8::1", "2001:db8::1/128"},
+	}
+	for _, tt := range tests {
+		got, err := ParsePrefix(tt.in)
+		if err != nil || got.String() != tt.want {
+			t.Errorf("ParsePrefix(%q) = %v, %v; ожидалось %s", tt.in, got, err, tt.want)
+		}
+	}
+	for _, in := range []string{"", "10.0.0.0/33", "host"} {
+		if _, err := ParsePrefix(in); err == nil {
+			t.Errorf("ParsePrefix(%q): ошибки нет", in)
+		}
+	}
+}
+
+func TestParsePortRange(t *testing.T) {
+	tests := []struct {
+		in   string
+		want PortRange
+	}{
+		{"443", PortRange{443, 443}},
+		{"8000-8100", PortRange{8000, 8100}},
+		{" 1 - 65535 ", PortRange{1, 65535}},
+	}
+	for _, tt := range tests {
+		got, err := ParsePortRange(tt.in)
+		if err != nil || got != tt.want {
+			t.Errorf("ParsePortRange(%q) = %v, %v; ожидалось %v", tt.in, got, err, tt.want)
+		}
+	}
+	for _, in := range []string{"", "0", "65536", "100-10", "http"} {
+		if _, err := ParsePortRange(in); err == nil {
+			t.Errorf("ParsePortRange(%q): ошибки нет", in)
+		}
+	}
+}
+
+func TestContext(t *testing.T) {
+	c := Client{User: "alice", Source: netip.MustParseAddr("192.0.2.1")}
+	if got := FromContext(NewContext(context.Background(), c)); got != c {
+		t.Fatalf("FromContext = %+v, ожидалось %+v", got, c)
+	}
+	if got := FromContext(context.Background()); got != (Client{}) {
+		t.Fatalf("FromContext без клиента = %+v", got)
+	}
+}
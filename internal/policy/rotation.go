@@ -0,0 +1,122 @@
+package policy
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+// RotationMode задает, как часто меняется профиль, выбранный ротацией.
+type RotationMode int
+
+const (
+	// RotateConnection выбирает профиль заново для каждого соединения.
+	RotateConnection RotationMode = iota
+	// RotateWindow держит профиль в пределах интервала времени.
+	RotateWindow
+	// RotateDestination закрепляет профиль за адресом назначения.
+	RotateDestination
+)
+
+func ParseRotationMode(s string) (RotationMode, error) {
+	switch s {
+	case "", "connection":
+		return RotateConnection, nil
+	case "window":
+		return RotateWindow, nil
+	case "destination":
+		return RotateDestination, nil
+	}
+	return 0, fmt.Errorf("неизвестный режим ротации %q", s)
+}
+
+func (m RotationMode) String() string {
+	switch m {
+	case RotateWindow:
+		return "window"
+	case RotateDestination:
+		return "destination"
+	}
+	return "connection"
+}
+
+// Weighted - профиль ротации и его вес.
+type Weighted struct {
+	Profile string
+	Weight  int
+}
+
+// Rotation выбирает профиль из взвешенного набора. Весь выбор выводится из
+// seed, поэтому при одинаковом seed и одинаковой последовательности
+// соединений результат повторяется.
+type Rotation struct {
+	Mode     RotationMode
+	Interval time.Duration
+	Profiles []Weighted
+
+	// Now - источник времени для RotateWindow; nil означает time.Now.
+	Now func() time.Time
+
+	seed  uint64
+	total int
+
+	mu  sync.Mutex
+	rng *rand.Rand
+}
+
+func NewRotation(mode RotationMode, interval time.Duration, profiles []Weighted, seed uint64) (*Rotation, error) {
+	r := &Rotation{Mode: mode, Interval: interval, Profiles: profiles, seed: seed}
+	for _, p := range profiles {
+		if p.Weight <= 0 {
+			return nil, fmt.Errorf("вес профиля %s должен быть положительным, получено %d", p.Profile, p.Weight)
+		}
+		r.total += p.Weight
+	}
+	if r.total == 0 {
+		return nil, fmt.Errorf("набор профилей ротации пуст")
+	}
+	if mode == RotateWindow && interval <= 0 {
+		return nil, fmt.Errorf("для режима window нужен положительный интервал")
+	}
+	r.rng = rand.New(rand.NewPCG(seed, 0))
+	return r, nil
+}
+
+// Pick выбирает профиль для соединения и возвращает генератор, из которого
+// берутся случайные отклонения полей этого соединения. В режимах window и
+// destination генератор зависит только от окна или адреса, так что в их
+// пределах совпадают и профиль, и отклонения.
+func (r *Rotation) Pick(req Request) (string, *rand.Rand) {
+	var rng *rand.Rand
+	switch r.Mode {
+	case RotateWindow:
+		now := time.Now
+		if r.Now != nil {
+			now = r.Now
+		}
+		window := uint64(now().UnixNano() / int64(r.Interval))
+		rng = rand.New(rand.NewPCG(r.seed, window))
+	case RotateDestination:
+		h := fnv.New64a()
+		h.Write(req.Addr.AsSlice())
+		if !req.Addr.IsValid() {
+			h.Write([]byte(req.Host))
+		}
+		rng = rand.New(rand.NewPCG(r.seed, h.Sum64()))
+	default:
+		r.mu.Lock()
+		rng = rand.New(rand.NewPCG(r.rng.Uint64(), r.rng.Uint64()))
+		r.mu.Unlock()
+	}
+
+	n := rng.IntN(r.total)
+	for _, p := range r.Profiles {
+		if n < p.Weight {
+			return p.Profile, rng
+		}
+		n -= p.Weight
+	}
+	return r.Profiles[len(r.Profiles)-1].Profile, rng
+}
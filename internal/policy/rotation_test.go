@@ -0,0 +1,180 @@
+package policy
+
+import (
+	"net/netip"
+	"slices"
+	"testing"
+	"time"
+)
+
+var testProfiles = []Weighted{
+	{Profile: "windows", Weight: 3},
+	{Profile: "linux", Weight: 2},
+	{Profile: "macos", Weight: 1},
+}
+
+func testRequest(i int) Request {
+	return Request{
+		Host: "example.com",
+		Addr: netip.AddrFrom4([4]byte{192, 0, 2, byte(i % 7)}),
+		Port: 443,
+	}
+}
+
+// picks возвращает профили и первые числа генераторов для n соединений.
+func picks(t *testing.T, r *Rotation, n int, advance func(i int)) ([]string, []uint64) {
+	t.Helper()
+	var profiles []string
+	var draws []uint64
+	for i := range n {
+		if advance != nil {
+			advance(i)
+		}
+		profile, rng := r.Pick(testRequest(i))
+		if rng == nil {
+			t.Fatalf("соединение %d: нет генератора", i)
+		}
+		profiles = append(profiles, profile)
+		draws = append(draws, rng.Uint64())
+	}
+	return profiles, draws
+}
+
+func TestRotationSeedRepeats(t *testing.T) {
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, mode := range []RotationMode{RotateConnection, RotateWindow, RotateDestination} {
+		t.Run(mode.String(), func(t *testing.T) {
+			run := func(seed uint64) ([]string, []uint64) {
+				r, err := NewRotation(mode, time.Minute, testProfiles, seed)
+				if err != nil {
+					t.Fatal(err)
+				}
+				now := base
+				r.Now = func() time.Time { return now }
+				return picks(t, r, 50, func(i int) { now = base.Add(time.Duration(i) * 20 * time.Second) })
+			}
+
+			p1, d1 := run(42)
+			p2, d2 := run(42)
+			if !slices.Equal(p1, p2) || !slices.Equal(d1, d2) {
+				t.Fatalf("при одном seed последовательности различаются:\n%v\n%v", p1, p2)
+			}
+			_, d3 := run(43)
+			if slices.Equal(d1, d3) {
+				t.Fatalf("при разных seed последовательности совпали")
+			}
+		})
+	}
+}
+
+func TestRotationWindow(t *testing.T) {
+	r, err := NewRotation(RotateWindow, time.Minute, testProfiles, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	r.Now = func() time.Time { return now }
+
+	first, rng := r.Pick(testRequest(0))
+	draw := rng.Uint64()
+	now = now.Add(59 * time.Second)
+	for i := 1; i < 10; i++ {
+		profile, rng := r.Pick(testRequest(i))
+		if profile != first || rng.Uint64() != draw {
+			t.Fatalf("соединение %d в том же окне: профиль %s, ожидался %s", i, profile, first)
+		}
+	}
+
+	// За десять окон профиль должен смениться хотя бы раз.
+	changed := false
+	for i := 1; i <= 10; i++ {
+		now = now.Add(time.Minute)
+		if profile, _ := r.Pick(testRequest(0)); profile != first {
+			changed = true
+		}
+	}
+	if !changed {
+		t.Fatalf("профиль %s не сменился за десять окон", first)
+	}
+}
+
+func TestRotationDestination(t *testing.T) {
+	r, err := NewRotation(RotateDestination, 0, testProfiles, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := make(map[netip.Addr]string)
+	for i := range 20 {
+		req := testRequest(i)
+		want[req.Addr], _ = r.Pick(req)
+	}
+	// Порядок соединений не влияет на выбор.
+	for i := 19; i >= 0; i-- {
+		req := testRequest(i)
+		if profile, _ := r.Pick(req); profile != want[req.Addr] {
+			t.Fatalf("адрес %s: профиль %s, ранее %s", req.Addr, profile, want[req.Addr])
+		}
+	}
+
+	// Без адреса профиль закрепляется за именем.
+	a, _ := r.Pick(Request{Host: "a.example"})
+	for range 5 {
+		if b, _ := r.Pick(Request{Host: "a.example"}); b != a {
+			t.Fatalf("имя a.example: профиль %s, ранее %s", b, a)
+		}
+	}
+}
+
+func TestRotationWeights(t *testing.T) {
+	r, err := NewRotation(RotateConnection, 0, testProfiles, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const n = 6000
+	counts := make(map[string]int)
+	for i := range n {
+		profile, _ := r.Pick(testRequest(i))
+		counts[profile]++
+	}
+	for _, p := range testProfiles {
+		want := float64(p.Weight) / 6
+		got := float64(counts[p.Profile]) / n
+		if got < want-0.03 || got > want+0.03 {
+			t.Errorf("доля %s = %.3f, ожидалось %.3f", p.Profile, got, want)
+		}
+	}
+}
+
+func TestNewRotationErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		mode     RotationMode
+		interval time.Duration
+		profiles []Weighted
+	}{
+		{"пустой набор", RotateConnection, 0, nil},
+		{"нулевой вес", RotateConnection, 0, []Weighted{{"linux", 0}}},
+		{"отрицательный вес", RotateConnection, 0, []Weighted{{"linux", 1}, {"macos", -1}}},
+		{"окно без интервала", RotateWindow, 0, []Weighted{{"linux", 1}}},
+	}
+	for _, tt := range tests {
+		if _, err := NewRotation(tt.mode, tt.interval, tt.profiles, 1); err == nil {
+			t.Errorf("%s: ошибки нет", tt.name)
+		}
+	}
+}
+
+func TestParseRotationMode(t *testing.T) {
+	for _, mode := range []RotationMode{RotateConnection, RotateWindow, RotateDestination} {
+		got, err := ParseRotationMode(mode.String())
+		if err != nil || got != mode {
+			t.Errorf("ParseRotationMode(%q) = %v, %v", mode.String(), got, err)
+		}
+	}
+	if got, err := ParseRotationMode(""); err != nil || got != RotateConnection {
+		t.Errorf(`ParseRotationMode("") = %v, %v`, got, err)
+	}
+	if _, err := ParseRotationMode("hourly"); err == nil {
+		t.Errorf(`ParseRotationMode("hourly"): ошибки нет`)
+	}
+}
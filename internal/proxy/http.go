@@ -0,0 +1,313 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"custom-tcp-fingerprint/internal/logging"
+)
+
+// Заголовки, которые относятся к конкретному соединению и не передаются
+// дальше (RFC 9110, раздел 7.6.1).
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// HTTPServer - HTTP/1.1 прокси: туннели CONNECT host:port и обычные
+// запросы с абсолютным URI. Если Users не пуст, клиент обязан передать
+// Proxy-Authorization: Basic.
+type HTTPServer struct {
+	Dialer Dialer
+	Users  map[string]string
+}
+
+// Serve принимает соединения до закрытия l; закрытие слушающего сокета
+// не считается ошибкой.
+func (s *HTTPServer) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *HTTPServer) handle(conn net.Conn) {
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			if err != io.EOF && !isClosed(err) && !errors.Is(err, io.ErrUnexpectedEOF) {
+				logging.Errorf("http: ошибка чтения запроса от %s: %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+		conn.SetReadDeadline(time.Time{})
+
+		if !s.authorized(req) {
+			req.Body.Close()
+			writeHTTPError(conn, http.StatusProxyAuthRequired, "требуется аутентификация",
+				http.Header{"Proxy-Authenticate": {`Basic realm="tcpcustom"`}})
+			continue
+		}
+
+		if req.Method == http.MethodConnect {
+			s.tunnel(conn, br, req)
+			return
+		}
+		if !s.forward(conn, req) {
+			return
+		}
+	}
+}
+
+func (s *HTTPServer) authorized(req *http.Request) bool {
+	if len(s.Users) == 0 {
+		return true
+	}
+	user, pass, ok := parseProxyAuth(req.Header.Get("Proxy-Authorization"))
+	if !ok {
+		return false
+	}
+	expected, found := s.Users[user]
+	return found && subtle.ConstantTimeCompare([]byte(pass), []byte(expected)) == 1
+}
+
+// parseProxyAuth разбирает Proxy-Authorization тем же кодом, что и
+// Authorization в net/http.
+func parseProxyAuth(value string) (string, string, bool) {
+	if value == "" {
+		return "", "", false
+	}
+	r := &http.Request{Header: http.Header{"Authorization": {value}}}
+	return r.BasicAuth()
+}
+
+// tunnel обслуживает CONNECT: после ответа 200 соединение клиента
+// становится прозрачным туннелем до цели.
+func (s *HTTPServer) tunnel(conn net.Conn, br *bufio.Reader, req *http.Request) {
+	host, port, err := splitHostPort(req.RequestURI, 0)
+	if err != nil {
+		writeHTTPError(conn, http.StatusBadRequest, err.Error(), nil)
+		return
+	}
+
+	remote, err := s.dial(conn, req, host, port)
+	if err != nil {
+		writeHTTPError(conn, statusForError(err), err.Error(), nil)
+		return
+	}
+	defer remote.Close()
+
+	if _, err := io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+		return
+	}
+
+	// Клиент мог отправить начало TLS вместе с CONNECT, и эти байты уже
+	// лежат в буфере.
+	client := conn
+	if br.Buffered() > 0 {
+		client = &bufferedConn{Conn: conn, r: br}
+	}
+	if err := Relay(client, remote); err != nil {
+		logging.Warnf("http: туннель до %s прерван: %v", req.RequestURI, err)
+	}
+}
+
+// forward пересылает запрос с абсолютным URI и возвращает false, если
+// соединение с клиентом нужно закрыть.
+func (s *HTTPServer) forward(conn net.Conn, req *http.Request) bool {
+	defer req.Body.Close()
+
+	if !req.URL.IsAbs() {
+		writeHTTPError(conn, http.StatusBadRequest, "ожидался абсолютный URI или CONNECT", nil)
+		return false
+	}
+	if req.URL.Scheme != "http" {
+		writeHTTPError(conn, http.StatusNotImplemented,
+			fmt.Sprintf("схема %s не поддерживается, используйте CONNECT", req.URL.Scheme), nil)
+		return false
+	}
+
+	host, port, err := splitHostPort(req.URL.Host, 80)
+	if err != nil {
+		writeHTTPError(conn, http.StatusBadRequest, err.Error(), nil)
+		return false
+	}
+
+	remote, err := s.dial(conn, req, host, port)
+	if err != nil {
+		writeHTTPError(conn, statusForError(err), err.Error(), nil)
+		return false
+	}
+	defer remote.Close()
+
+	clientClose := req.Close
+	removeHopHeaders(req.Header)
+	req.Close = true
+	if err := req.Write(remote); err != nil {
+		writeHTTPError(conn, http.StatusBadGateway, err.Error(), nil)
+		return false
+	}
+
+	rec := &headerRecorder{r: remote}
+	resp, err := http.ReadResponse(bufio.NewReader(rec), req)
+	if err != nil {
+		writeHTTPError(conn, http.StatusBadGateway, err.Error(), nil)
+		return false
+	}
+	defer resp.Body.Close()
+
+	// ReadResponse удаляет Connection, если в нем есть close, и вместе с
+	// ним теряется список заголовков, которые тоже нужно убрать.
+	if connection := rec.connection(); len(connection) > 0 {
+		resp.Header["Connection"] = connection
+	}
+	removeHopHeaders(resp.Header)
+	resp.Close = clientClose
+	if err := resp.Write(conn); err != nil {
+		logging.Errorf("http: ошибка передачи ответа %s: %v", req.URL, err)
+		return false
+	}
+	// resp.Write сам выставляет Close для ответа без длины.
+	return !resp.Close
+}
+
+func (s *HTTPServer) dial(client net.Conn, req *http.Request, host string, port int) (net.Conn, error) {
+	target := net.JoinHostPort(host, strconv.Itoa(port))
+	logging.Infof("http: соединение с %s", target)
+
+	// Пользователь уже проверен в authorized, здесь он нужен только для
+	// выбора профиля.
+	var user string
+	if len(s.Users) > 0 {
+		user, _, _ = parseProxyAuth(req.Header.Get("Proxy-Authorization"))
+	}
+	ctx, cancel := dialContext(client, user)
+	defer cancel()
+	conn, err := s.Dialer.DialContext(ctx, host, port)
+	if err != nil {
+		logging.Errorf("http: не удалось соединиться с %s: %v", target, err)
+		return nil, err
+	}
+	return conn, nil
+}
+
+func splitHostPort(hostport string, defaultPort int) (string, int, error) {
+	host, portStr, err := net.SplitHostPort(hostport)
+	if err != nil {
+		if defaultPort == 0 || !strings.Contains(err.Error(), "missing port") {
+			return "", 0, fmt.Errorf("некорректный адрес %q", hostport)
+		}
+		return strings.Trim(hostport, "[]"), defaultPort, nil
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port <= 0 || port > 65535 {
+		return "", 0, fmt.Errorf("некорректный порт в адресе %q", hostport)
+	}
+	return host, port, nil
+}
+
+func removeHopHeaders(h http.Header) {
+	for _, field := range h.Values("Connection") {
+		for _, name := range strings.Split(field, ",") {
+			h.Del(strings.TrimSpace(name))
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
+func writeHTTPError(w io.Writer, code int, msg string, header http.Header) {
+	resp := &http.Response{
+		StatusCode:    code,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {"text/plain; charset=utf-8"}},
+		ContentLength: int64(len(msg) + 1),
+		Body:          io.NopCloser(strings.NewReader(msg + "\n")),
+	}
+	for k, v := range header {
+		resp.Header[k] = v
+	}
+	resp.Write(w)
+}
+
+func statusForError(err error) int {
+	if replyForError(err) == socksReplyTTLExpired {
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
+
+// headerRecorder запоминает прочитанные байты, пока не разобран заголовок
+// ответа: поле Connection нужно в исходном виде.
+type headerRecorder struct {
+	r    io.Reader
+	buf  bytes.Buffer
+	done bool
+}
+
+func (h *headerRecorder) Read(p []byte) (int, error) {
+	n, err := h.r.Read(p)
+	if !h.done {
+		h.buf.Write(p[:n])
+	}
+	return n, err
+}
+
+// connection возвращает значения Connection из заголовка ответа и
+// перестает запоминать данные.
+func (h *headerRecorder) connection() []string {
+	h.done = true
+	tp := textproto.NewReader(bufio.NewReader(&h.buf))
+	if _, err := tp.ReadLine(); err != nil {
+		return nil
+	}
+	header, _ := tp.ReadMIMEHeader()
+	h.buf = bytes.Buffer{}
+	return header.Values("Connection")
+}
+
+// bufferedConn отдает сначала данные, уже прочитанные в bufio.Reader.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *bufferedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
@@ -0,0 +1,254 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func basicAuth(user, pass string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+pass))
+}
+
+// httpExchange отправляет сырой запрос и читает ответ на него.
+func httpExchange(t *testing.T, conn net.Conn, br *bufio.Reader, raw string) *http.Response {
+	t.Helper()
+	if _, err := io.WriteString(conn, raw); err != nil {
+		t.Fatalf("запись запроса: %v", err)
+	}
+	req, err := http.ReadRequest(bufio.NewReader(strings.NewReader(raw)))
+	if err != nil {
+		t.Fatalf("разбор собственного запроса: %v", err)
+	}
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		t.Fatalf("чтение ответа: %v", err)
+	}
+	return resp
+}
+
+func TestHTTPConnect(t *testing.T) {
+	tests := []struct {
+		name   string
+		target string
+		host   string
+		port   int
+	}{
+		{"имя", "example.com:443", "example.com", 443},
+		{"ipv6", "[2001:db8::1]:8443", "2001:db8::1", 8443},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &fakeDialer{}
+			conn := pipeTo(t, (&HTTPServer{Dialer: d}).handle)
+			br := bufio.NewReader(conn)
+
+			// Начало TLS приходит одним пакетом с CONNECT и оказывается в
+			// буфере сервера до ответа 200.
+			raw := "CONNECT " + tt.target + " HTTP/1.1\r\nHost: " + tt.target + "\r\n\r\n"
+			if _, err := io.WriteString(conn, raw+"HELLO"); err != nil {
+				t.Fatal(err)
+			}
+			req, _ := http.ReadRequest(bufio.NewReader(strings.NewReader(raw)))
+			resp, err := http.ReadResponse(br, req)
+			if err != nil || resp.StatusCode != http.StatusOK {
+				t.Fatalf("ответ на CONNECT: %v, %v", resp, err)
+			}
+			expectBuffered(t, br, "HELLO")
+
+			io.WriteString(conn, "after")
+			expectBuffered(t, br, "after")
+
+			if dials := d.records(); len(dials) != 1 || dials[0].host != tt.host || dials[0].port != tt.port {
+				t.Fatalf("соединения %+v, ожидалось %s:%d", dials, tt.host, tt.port)
+			}
+		})
+	}
+}
+
+func expectBuffered(t *testing.T, br *bufio.Reader, want string) {
+	t.Helper()
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(br, got); err != nil || string(got) != want {
+		t.Fatalf("получено %q (%v), ожидалось %q", got, err, want)
+	}
+}
+
+func TestHTTPProxyAuth(t *testing.T) {
+	d := &fakeDialer{}
+	conn := pipeTo(t, (&HTTPServer{Dialer: d, Users: map[string]string{"alice": "secret"}}).handle)
+	br := bufio.NewReader(conn)
+
+	for _, auth := range []string{"", basicAuth("alice", "wrong"), basicAuth("bob", "secret"), "Bearer abc"} {
+		raw := "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n"
+		if auth != "" {
+			raw += "Proxy-Authorization: " + auth + "\r\n"
+		}
+		resp := httpExchange(t, conn, br, raw+"\r\n")
+		io.Copy(io.Discard, resp.Body)
+		if resp.StatusCode != http.StatusProxyAuthRequired {
+			t.Fatalf("%q: статус %d, ожидался 407", auth, resp.StatusCode)
+		}
+		if got := resp.Header.Get("Proxy-Authenticate"); got != `Basic realm="tcpcustom"` {
+			t.Fatalf("%q: Proxy-Authenticate = %q", auth, got)
+		}
+	}
+	if len(d.records()) != 0 {
+		t.Fatalf("соединение установлено без аутентификации")
+	}
+
+	// После 407 то же соединение принимает запрос с верным паролем.
+	resp := httpExchange(t, conn, br, "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n"+
+		"Proxy-Authorization: "+basicAuth("alice", "secret")+"\r\n\r\n")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("статус %d с верным паролем", resp.StatusCode)
+	}
+	if dials := d.records(); len(dials) != 1 || dials[0].client.User != "alice" {
+		t.Fatalf("соединения %+v, ожидался пользователь alice", dials)
+	}
+}
+
+func TestHTTPForwardStripsHopHeaders(t *testing.T) {
+	upstream := make(chan *http.Request, 2)
+	d := &fakeDialer{serve: func(conn net.Conn) {
+		defer conn.Close()
+		req, err := http.ReadRequest(bufio.NewReader(conn))
+		if err != nil {
+			return
+		}
+		io.Copy(io.Discard, req.Body)
+		upstream <- req
+		io.WriteString(conn, "HTTP/1.1 200 OK\r\n"+
+			"Content-Length: 2\r\n"+
+			"Connection: close, X-Resp-Hop\r\n"+
+			"X-Resp-Hop: 1\r\n"+
+			"Keep-Alive: timeout=5\r\n"+
+			"Proxy-Authenticate: Basic\r\n"+
+			"X-Resp: ok\r\n\r\nhi")
+	}}
+	conn := pipeTo(t, (&HTTPServer{Dialer: d, Users: map[string]string{"alice": "secret"}}).handle)
+	br := bufio.NewReader(conn)
+
+	raw := "GET http://example.com:8080/path?q=1 HTTP/1.1\r\n" +
+		"Host: example.com:8080\r\n" +
+		"Connection: keep-alive, X-Hop\r\n" +
+		"X-Hop: 1\r\n" +
+		"Keep-Alive: timeout=5\r\n" +
+		"Proxy-Connection: keep-alive\r\n" +
+		"Proxy-Authorization: " + basicAuth("alice", "secret") + "\r\n" +
+		"Te: trailers\r\n" +
+		"Upgrade: websocket\r\n" +
+		"X-Keep: yes\r\n\r\n"
+
+	for i := range 2 {
+		resp := httpExchange(t, conn, br, raw)
+		body, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusOK || string(body) != "hi" {
+			t.Fatalf("запрос %d: статус %d, тело %q", i, resp.StatusCode, body)
+		}
+		for _, name := range []string{"X-Resp-Hop", "Keep-Alive", "Proxy-Authenticate"} {
+			if v := resp.Header.Get(name); v != "" {
+				t.Errorf("ответ содержит %s: %q", name, v)
+			}
+		}
+		if resp.Header.Get("X-Resp") != "ok" {
+			t.Errorf("ответ потерял X-Resp: %v", resp.Header)
+		}
+		// Клиент не просил закрыть соединение, поэтому оно остается
+		// открытым для следующего запроса.
+		if resp.Close {
+			t.Fatalf("запрос %d: прокси закрывает соединение клиента", i)
+		}
+
+		req := <-upstream
+		if req.RequestURI != "/path?q=1" || req.Host != "example.com:8080" {
+			t.Errorf("запрос к серверу: %s %s", req.Host, req.RequestURI)
+		}
+		for _, name := range []string{"X-Hop", "Keep-Alive", "Proxy-Connection", "Proxy-Authorization", "Te", "Upgrade"} {
+			if v := req.Header.Get(name); v != "" {
+				t.Errorf("запрос к серверу содержит %s: %q", name, v)
+			}
+		}
+		if req.Header.Get("X-Keep") != "yes" || !req.Close {
+			t.Errorf("запрос к серверу: заголовки %v, close %v", req.Header, req.Close)
+		}
+	}
+
+	dials := d.records()
+	if len(dials) != 2 || dials[0].host != "example.com" || dials[0].port != 8080 || dials[0].client.User != "alice" {
+		t.Fatalf("соединения %+v", dials)
+	}
+}
+
+func TestHTTPErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		raw     string
+		dialErr error
+		status  int
+	}{
+		{"относительный uri", "GET /path HTTP/1.1\r\nHost: example.com\r\n\r\n", nil, http.StatusBadRequest},
+		{"https без CONNECT", "GET https://example.com/ HTTP/1.1\r\nHost: example.com\r\n\r\n", nil, http.StatusNotImplemented},
+		{"CONNECT без порта", "CONNECT example.com HTTP/1.1\r\nHost: example.com\r\n\r\n", nil, http.StatusBadRequest},
+		{"CONNECT с нулевым портом", "CONNECT example.com:0 HTTP/1.1\r\nHost: example.com\r\n\r\n", nil, http.StatusBadRequest},
+		{"соединение отвергнуто", "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com\r\n\r\n",
+			errors.New("connection refused"), http.StatusBadGateway},
+		{"таймаут", "GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\n\r\n",
+			context.DeadlineExceeded, http.StatusGatewayTimeout},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := pipeTo(t, (&HTTPServer{Dialer: &fakeDialer{err: tt.dialErr}}).handle)
+			resp := httpExchange(t, conn, bufio.NewReader(conn), tt.raw)
+			if resp.StatusCode != tt.status {
+				t.Fatalf("статус %d, ожидался %d", resp.StatusCode, tt.status)
+			}
+		})
+	}
+}
+
+func TestRemoveHopHeaders(t *testing.T) {
+	h := http.Header{
+		"Connection":        {"X-A, x-b", "Keep-Alive"},
+		"X-A":               {"1"},
+		"X-B":               {"2"},
+		"Keep-Alive":        {"timeout=5"},
+		"Transfer-Encoding": {"chunked"},
+		"Trailer":           {"X-T"},
+		"X-C":               {"3"},
+	}
+	removeHopHeaders(h)
+	if len(h) != 1 || h.Get("X-C") != "3" {
+		t.Fatalf("осталось %v", h)
+	}
+}
+
+func TestSplitHostPort(t *testing.T) {
+	tests := []struct {
+		in          string
+		defaultPort int
+		host        string
+		port        int
+		ok          bool
+	}{
+		{"example.com:8080", 80, "example.com", 8080, true},
+		{"example.com", 80, "example.com", 80, true},
+		{"[2001:db8::1]", 80, "2001:db8::1", 80, true},
+		{"[2001:db8::1]:443", 0, "2001:db8::1", 443, true},
+		{"example.com", 0, "", 0, false},
+		{"example.com:http", 80, "", 0, false},
+		{"example.com:65536", 80, "", 0, false},
+	}
+	for _, tt := range tests {
+		host, port, err := splitHostPort(tt.in, tt.defaultPort)
+		if (err == nil) != tt.ok || host != tt.host || port != tt.port {
+			t.Errorf("splitHostPort(%q, %d) = %q, %d, %v", tt.in, tt.defaultPort, host, port, err)
+		}
+	}
+}
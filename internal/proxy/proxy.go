@@ -0,0 +1,69 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+
+	"custom-tcp-fingerprint/internal/policy"
+)
+
+// Dialer устанавливает исходящее соединение через сетевой стек с
+// подмененным отпечатком; его реализует stack.GvisorStack.
+type Dialer interface {
+	DialContext(ctx context.Context, host string, port int) (net.Conn, error)
+}
+
+const (
+	dialTimeout      = 10 * time.Second
+	handshakeTimeout = 30 * time.Second
+)
+
+// dialContext возвращает контекст для Dialer с таймаутом соединения и
+// сведениями о клиенте conn, по которым выбирается профиль.
+func dialContext(conn net.Conn, user string) (context.Context, context.CancelFunc) {
+	client := policy.Client{User: user}
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		client.Source = addr.AddrPort().Addr().Unmap()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+	return policy.NewContext(ctx, client), cancel
+}
+
+// Relay копирует данные в обе стороны до закрытия обоих направлений.
+// Конец потока в одну сторону передается как half-close, если соединение
+// это поддерживает.
+func Relay(a, b net.Conn) error {
+	errCh := make(chan error, 2)
+	pipe := func(dst, src net.Conn) {
+		_, err := io.Copy(dst, src)
+		if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+		} else {
+			dst.Close()
+		}
+		errCh <- err
+	}
+	go pipe(a, b)
+	go pipe(b, a)
+
+	err1, err2 := <-errCh, <-errCh
+	if err1 != nil && !isClosed(err1) {
+		return err1
+	}
+	if err2 != nil && !isClosed(err2) {
+		return err2
+	}
+	return nil
+}
+
+// isClosed отличает обычное завершение соединения одной из сторон от
+// настоящих ошибок.
+func isClosed(err error) bool {
+	return errors.Is(err, net.ErrClosed) || errors.Is(err, syscall.ECONNRESET) ||
+		strings.Contains(err.Error(), "use of closed")
+}
@@ -0,0 +1,268 @@
+package proxy
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"custom-tcp-fingerprint/internal/logging"
+)
+
+const (
+	socksVersion        = 5
+	socksAuthVersion    = 1
+	socksMethodNoAuth   = 0x00
+	socksMethodPassword = 0x02
+	socksMethodNone     = 0xff
+
+	socksCmdConnect = 1
+
+	socksAtypIPv4   = 1
+	socksAtypDomain = 3
+	socksAtypIPv6   = 4
+)
+
+// Коды ответа из RFC 1928, раздел 6.
+const (
+	socksReplySucceeded          = 0x00
+	socksReplyGeneralFailure     = 0x01
+	socksReplyNetworkUnreachable = 0x03
+	socksReplyHostUnreachable    = 0x04
+	socksReplyConnectionRefused  = 0x05
+	socksReplyTTLExpired         = 0x06
+	socksReplyCommandUnsupported = 0x07
+	socksReplyAddressUnsupported = 0x08
+)
+
+// SOCKS5Server - сервер SOCKS5 (RFC 1928) с командой CONNECT. Если Users
+// не пуст, клиент обязан пройти аутентификацию по логину и паролю
+// (RFC 1929).
+type SOCKS5Server struct {
+	Dialer Dialer
+	Users  map[string]string
+}
+
+// Serve принимает соединения до закрытия l; закрытие слушающего сокета
+// не считается ошибкой.
+func (s *SOCKS5Server) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *SOCKS5Server) handle(conn net.Conn) {
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	host, port, user, err := s.handshake(conn)
+	if err != nil {
+		logging.Errorf("socks5: ошибка согласования с %s: %v", conn.RemoteAddr(), err)
+		return
+	}
+
+	target := net.JoinHostPort(host, strconv.Itoa(port))
+	logging.Infof("socks5: %s -> %s", conn.RemoteAddr(), target)
+
+	ctx, cancel := dialContext(conn, user)
+	remote, err := s.Dialer.DialContext(ctx, host, port)
+	cancel()
+	if err != nil {
+		logging.Errorf("socks5: не удалось соединиться с %s: %v", target, err)
+		writeSOCKSReply(conn, replyForError(err), nil)
+		return
+	}
+	defer remote.Close()
+
+	if err := writeSOCKSReply(conn, socksReplySucceeded, remote.LocalAddr()); err != nil {
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	if err := Relay(conn, remote); err != nil {
+		logging.Warnf("socks5: соединение с %s прервано: %v", target, err)
+	}
+}
+
+// handshake выполняет выбор метода, аутентификацию и разбор запроса,
+// возвращая адрес назначения и имя пользователя (пустое без
+// аутентификации).
+func (s *SOCKS5Server) handshake(conn net.Conn) (string, int, string, error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+		return "", 0, "", err
+	}
+	if hdr[0] != socksVersion {
+		return "", 0, "", fmt.Errorf("неподдерживаемая версия протокола %d", hdr[0])
+	}
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return "", 0, "", err
+	}
+
+	want := byte(socksMethodNoAuth)
+	if len(s.Users) > 0 {
+		want = socksMethodPassword
+	}
+	if !containsByte(methods, want) {
+		conn.Write([]byte{socksVersion, socksMethodNone})
+		return "", 0, "", errors.New("клиент не предложил подходящий метод аутентификации")
+	}
+	if _, err := conn.Write([]byte{socksVersion, want}); err != nil {
+		return "", 0, "", err
+	}
+
+	var user string
+	if want == socksMethodPassword {
+		var err error
+		if user, err = s.authenticate(conn); err != nil {
+			return "", 0, "", err
+		}
+	}
+
+	var req [4]byte
+	if _, err := io.ReadFull(conn, req[:]); err != nil {
+		return "", 0, "", err
+	}
+	if req[0] != socksVersion {
+		return "", 0, "", fmt.Errorf("неподдерживаемая версия протокола %d", req[0])
+	}
+
+	host, err := readSOCKSAddr(conn, req[3])
+	if err != nil {
+		writeSOCKSReply(conn, socksReplyAddressUnsupported, nil)
+		return "", 0, "", err
+	}
+	var portBuf [2]byte
+	if _, err := io.ReadFull(conn, portBuf[:]); err != nil {
+		return "", 0, "", err
+	}
+
+	if req[1] != socksCmdConnect {
+		writeSOCKSReply(conn, socksReplyCommandUnsupported, nil)
+		return "", 0, "", fmt.Errorf("неподдерживаемая команда %d", req[1])
+	}
+	return host, int(binary.BigEndian.Uint16(portBuf[:])), user, nil
+}
+
+func (s *SOCKS5Server) authenticate(conn net.Conn) (string, error) {
+	var ver [1]byte
+	if _, err := io.ReadFull(conn, ver[:]); err != nil {
+		return "", err
+	}
+	if ver[0] != socksAuthVersion {
+		return "", fmt.Errorf("неподдерживаемая версия аутентификации %d", ver[0])
+	}
+	user, err := readSOCKSString(conn)
+	if err != nil {
+		return "", err
+	}
+	pass, err := readSOCKSString(conn)
+	if err != nil {
+		return "", err
+	}
+
+	expected, ok := s.Users[user]
+	if !ok || subtle.ConstantTimeCompare([]byte(pass), []byte(expected)) != 1 {
+		conn.Write([]byte{socksAuthVersion, 1})
+		return "", fmt.Errorf("неверный логин или пароль для %q", user)
+	}
+	_, err = conn.Write([]byte{socksAuthVersion, 0})
+	return user, err
+}
+
+func readSOCKSAddr(r io.Reader, atyp byte) (string, error) {
+	switch atyp {
+	case socksAtypIPv4:
+		var b [4]byte
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return "", err
+		}
+		return net.IP(b[:]).String(), nil
+	case socksAtypIPv6:
+		var b [16]byte
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return "", err
+		}
+		return net.IP(b[:]).String(), nil
+	case socksAtypDomain:
+		return readSOCKSString(r)
+	}
+	return "", fmt.Errorf("неподдерживаемый тип адреса %d", atyp)
+}
+
+func readSOCKSString(r io.Reader) (string, error) {
+	var n [1]byte
+	if _, err := io.ReadFull(r, n[:]); err != nil {
+		return "", err
+	}
+	b := make([]byte, n[0])
+	if _, err := io.ReadFull(r, b); err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func writeSOCKSReply(w io.Writer, code byte, bound net.Addr) error {
+	reply := []byte{socksVersion, code, 0}
+
+	var ip net.IP
+	var port int
+	if tcp, ok := bound.(*net.TCPAddr); ok {
+		ip, port = tcp.IP, tcp.Port
+	}
+	if ip4 := ip.To4(); ip4 != nil || ip == nil {
+		if ip4 == nil {
+			ip4 = net.IPv4zero.To4()
+		}
+		reply = append(reply, socksAtypIPv4)
+		reply = append(reply, ip4...)
+	} else {
+		reply = append(reply, socksAtypIPv6)
+		reply = append(reply, ip.To16()...)
+	}
+	reply = binary.BigEndian.AppendUint16(reply, uint16(port))
+
+	_, err := w.Write(reply)
+	return err
+}
+
+// replyForError сопоставляет ошибку исходящего соединения с кодом ответа.
+// gvisor возвращает ошибки tcpip в виде текста, поэтому сравнение идет по
+// строке.
+func replyForError(err error) byte {
+	msg := err.Error()
+	switch {
+	case errors.Is(err, context.DeadlineExceeded), strings.Contains(msg, "timed out"):
+		return socksReplyTTLExpired
+	case strings.Contains(msg, "refused"):
+		return socksReplyConnectionRefused
+	case strings.Contains(msg, "network is unreachable"):
+		return socksReplyNetworkUnreachable
+	case strings.Contains(msg, "unreachable"), strings.Contains(msg, "не удалось разрешить"):
+		return socksReplyHostUnreachable
+	}
+	return socksReplyGeneralFailure
+}
+
+func containsByte(b []byte, v byte) bool {
+	for _, x := range b {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
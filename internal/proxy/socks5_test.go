@@ -0,0 +1,247 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"custom-tcp-fingerprint/internal/policy"
+)
+
+type dialRecord struct {
+	host   string
+	port   int
+	client policy.Client
+}
+
+// fakeDialer вместо стека отдает один конец net.Pipe, а другой обслуживает
+// serve (по умолчанию эхо). Если err не nil, соединение не создается.
+type fakeDialer struct {
+	mu    sync.Mutex
+	dials []dialRecord
+	err   error
+	serve func(conn net.Conn)
+}
+
+func (d *fakeDialer) DialContext(ctx context.Context, host string, port int) (net.Conn, error) {
+	d.mu.Lock()
+	d.dials = append(d.dials, dialRecord{host: host, port: port, client: policy.FromContext(ctx)})
+	d.mu.Unlock()
+	if d.err != nil {
+		return nil, d.err
+	}
+	local, remote := net.Pipe()
+	serve := d.serve
+	if serve == nil {
+		serve = func(conn net.Conn) {
+			defer conn.Close()
+			io.Copy(conn, conn)
+		}
+	}
+	go serve(remote)
+	return local, nil
+}
+
+func (d *fakeDialer) records() []dialRecord {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]dialRecord(nil), d.dials...)
+}
+
+// pipeTo запускает handle на серверной стороне net.Pipe и возвращает
+// клиентскую сторону.
+func pipeTo(t *testing.T, handle func(net.Conn)) net.Conn {
+	t.Helper()
+	client, server := net.Pipe()
+	go handle(server)
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func expectBytes(t *testing.T, conn net.Conn, want []byte) {
+	t.Helper()
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatalf("чтение %v: %v", want, err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("получено %v, ожидалось %v", got, want)
+	}
+}
+
+func expectClosed(t *testing.T, conn net.Conn) {
+	t.Helper()
+	if n, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatalf("соединение не закрыто, прочитано %d байт", n)
+	}
+}
+
+// socksSucceeded - ответ на CONNECT, когда у исходящего соединения нет
+// TCP-адреса (net.Pipe): 0.0.0.0:0.
+var socksSucceeded = []byte{socksVersion, socksReplySucceeded, 0, socksAtypIPv4, 0, 0, 0, 0, 0, 0}
+
+func TestSOCKS5Connect(t *testing.T) {
+	tests := []struct {
+		name string
+		addr []byte
+		host string
+	}{
+		{"ipv4", []byte{socksAtypIPv4, 192, 0, 2, 1}, "192.0.2.1"},
+		{"ipv6", append([]byte{socksAtypIPv6}, net.ParseIP("2001:db8::1")...), "2001:db8::1"},
+		{"домен", append([]byte{socksAtypDomain, 11}, "example.com"...), "example.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &fakeDialer{}
+			s := &SOCKS5Server{Dialer: d}
+			conn := pipeTo(t, s.handle)
+
+			// Клиент предлагает оба метода, сервер без пользователей
+			// выбирает «без аутентификации».
+			conn.Write([]byte{socksVersion, 2, socksMethodPassword, socksMethodNoAuth})
+			expectBytes(t, conn, []byte{socksVersion, socksMethodNoAuth})
+
+			req := append([]byte{socksVersion, socksCmdConnect, 0}, tt.addr...)
+			conn.Write(append(req, 0x01, 0xbb))
+			expectBytes(t, conn, socksSucceeded)
+
+			conn.Write([]byte("ping"))
+			expectBytes(t, conn, []byte("ping"))
+
+			dials := d.records()
+			if len(dials) != 1 || dials[0].host != tt.host || dials[0].port != 443 || dials[0].client.User != "" {
+				t.Fatalf("соединения %+v, ожидалось %s:443", dials, tt.host)
+			}
+		})
+	}
+}
+
+func socksAuthRequest(user, pass string) []byte {
+	b := []byte{socksAuthVersion, byte(len(user))}
+	b = append(b, user...)
+	b = append(b, byte(len(pass)))
+	return append(b, pass...)
+}
+
+func TestSOCKS5Auth(t *testing.T) {
+	users := map[string]string{"alice": "secret"}
+
+	t.Run("верный пароль", func(t *testing.T) {
+		d := &fakeDialer{}
+		conn := pipeTo(t, (&SOCKS5Server{Dialer: d, Users: users}).handle)
+		conn.Write([]byte{socksVersion, 2, socksMethodNoAuth, socksMethodPassword})
+		expectBytes(t, conn, []byte{socksVersion, socksMethodPassword})
+		conn.Write(socksAuthRequest("alice", "secret"))
+		expectBytes(t, conn, []byte{socksAuthVersion, 0})
+		conn.Write([]byte{socksVersion, socksCmdConnect, 0, socksAtypIPv4, 192, 0, 2, 1, 0, 80})
+		expectBytes(t, conn, socksSucceeded)
+
+		if dials := d.records(); len(dials) != 1 || dials[0].client.User != "alice" {
+			t.Fatalf("соединения %+v, ожидался пользователь alice", dials)
+		}
+	})
+
+	for name, creds := range map[string][2]string{
+		"неверный пароль":          {"alice", "wrong"},
+		"неизвестный пользователь": {"bob", "secret"},
+		"пустой пароль":            {"alice", ""},
+	} {
+		t.Run(name, func(t *testing.T) {
+			d := &fakeDialer{}
+			conn := pipeTo(t, (&SOCKS5Server{Dialer: d, Users: users}).handle)
+			conn.Write([]byte{socksVersion, 1, socksMethodPassword})
+			expectBytes(t, conn, []byte{socksVersion, socksMethodPassword})
+			conn.Write(socksAuthRequest(creds[0], creds[1]))
+			expectBytes(t, conn, []byte{socksAuthVersion, 1})
+			expectClosed(t, conn)
+			if len(d.records()) != 0 {
+				t.Fatalf("соединение установлено без аутентификации")
+			}
+		})
+	}
+
+	t.Run("клиент без пароля", func(t *testing.T) {
+		conn := pipeTo(t, (&SOCKS5Server{Dialer: &fakeDialer{}, Users: users}).handle)
+		conn.Write([]byte{socksVersion, 1, socksMethodNoAuth})
+		expectBytes(t, conn, []byte{socksVersion, socksMethodNone})
+		expectClosed(t, conn)
+	})
+
+	t.Run("сервер без пользователей", func(t *testing.T) {
+		conn := pipeTo(t, (&SOCKS5Server{Dialer: &fakeDialer{}}).handle)
+		conn.Write([]byte{socksVersion, 1, socksMethodPassword})
+		expectBytes(t, conn, []byte{socksVersion, socksMethodNone})
+		expectClosed(t, conn)
+	})
+
+	t.Run("версия аутентификации", func(t *testing.T) {
+		conn := pipeTo(t, (&SOCKS5Server{Dialer: &fakeDialer{}, Users: users}).handle)
+		conn.Write([]byte{socksVersion, 1, socksMethodPassword})
+		expectBytes(t, conn, []byte{socksVersion, socksMethodPassword})
+		req := socksAuthRequest("alice", "secret")
+		req[0] = 2
+		conn.Write(req[:1])
+		expectClosed(t, conn)
+	})
+}
+
+func TestSOCKS5RequestErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		request []byte
+		dialErr error
+		reply   byte
+	}{
+		{"команда bind", []byte{socksVersion, 2, 0, socksAtypIPv4, 192, 0, 2, 1, 0, 80}, nil, socksReplyCommandUnsupported},
+		{"команда udp associate", []byte{socksVersion, 3, 0, socksAtypIPv4, 0, 0, 0, 0, 0, 0}, nil, socksReplyCommandUnsupported},
+		{"тип адреса", []byte{socksVersion, socksCmdConnect, 0, 5}, nil, socksReplyAddressUnsupported},
+		{"соединение отвергнуто", []byte{socksVersion, socksCmdConnect, 0, socksAtypIPv4, 192, 0, 2, 1, 0, 80},
+			errors.New("connect tcp 192.0.2.1:80: connection refused"), socksReplyConnectionRefused},
+		{"таймаут", []byte{socksVersion, socksCmdConnect, 0, socksAtypIPv4, 192, 0, 2, 1, 0, 80},
+			context.DeadlineExceeded, socksReplyTTLExpired},
+		{"имя не разрешено", append([]byte{socksVersion, socksCmdConnect, 0, socksAtypDomain, 7}, "invalid\x00\x50"...),
+			errors.New("не удалось разрешить invalid"), socksReplyHostUnreachable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &fakeDialer{err: tt.dialErr}
+			conn := pipeTo(t, (&SOCKS5Server{Dialer: d}).handle)
+			conn.Write([]byte{socksVersion, 1, socksMethodNoAuth})
+			expectBytes(t, conn, []byte{socksVersion, socksMethodNoAuth})
+			conn.Write(tt.request)
+			expectBytes(t, conn, []byte{socksVersion, tt.reply, 0, socksAtypIPv4, 0, 0, 0, 0, 0, 0})
+			expectClosed(t, conn)
+		})
+	}
+
+	t.Run("версия протокола", func(t *testing.T) {
+		conn := pipeTo(t, (&SOCKS5Server{Dialer: &fakeDialer{}}).handle)
+		conn.Write([]byte{4, 1})
+		expectClosed(t, conn)
+	})
+}
+
+func TestWriteSOCKSReply(t *testing.T) {
+	tests := []struct {
+		addr net.Addr
+		want []byte
+	}{
+		{nil, []byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0}},
+		{&net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 40000}, []byte{5, 0, 0, 1, 10, 0, 0, 2, 0x9c, 0x40}},
+		{&net.TCPAddr{IP: net.ParseIP("fd00::2"), Port: 443},
+			append(append([]byte{5, 0, 0, 4}, net.ParseIP("fd00::2")...), 0x01, 0xbb)},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		writeSOCKSReply(&buf, socksReplySucceeded, tt.addr)
+		if !bytes.Equal(buf.Bytes(), tt.want) {
+			t.Errorf("%v: %v, ожидалось %v", tt.addr, buf.Bytes(), tt.want)
+		}
+	}
+}
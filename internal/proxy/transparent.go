@@ -0,0 +1,115 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+
+	"custom-tcp-fingerprint/internal/logging"
+)
+
+// TransparentServer принимает соединения, перенаправленные на него
+// правилами REDIRECT, и открывает их заново через Dialer к исходному
+// адресу назначения.
+type TransparentServer struct {
+	Dialer Dialer
+}
+
+// Serve принимает соединения до закрытия l; закрытие слушающего сокета
+// не считается ошибкой.
+func (s *TransparentServer) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *TransparentServer) handle(conn net.Conn) {
+	defer conn.Close()
+
+	dst, err := OriginalDst(conn)
+	if err != nil {
+		logging.Errorf("transparent: не удалось получить исходный адрес для %s: %v", conn.RemoteAddr(), err)
+		return
+	}
+	// Прямое подключение к порту прокси не перенаправлялось: исходным
+	// адресом будет сам прокси, и соединение зациклится.
+	if local, ok := conn.LocalAddr().(*net.TCPAddr); ok && local.AddrPort().Addr().Unmap() == dst.Addr() && local.Port == int(dst.Port()) {
+		logging.Warnf("transparent: отклонено прямое подключение от %s", conn.RemoteAddr())
+		return
+	}
+
+	target := dst.String()
+	logging.Infof("transparent: %s -> %s", conn.RemoteAddr(), target)
+
+	ctx, cancel := dialContext(conn, "")
+	remote, err := s.Dialer.DialContext(ctx, dst.Addr().String(), int(dst.Port()))
+	cancel()
+	if err != nil {
+		logging.Errorf("transparent: не удалось соединиться с %s: %v", target, err)
+		return
+	}
+	defer remote.Close()
+
+	if err := Relay(conn, remote); err != nil {
+		logging.Warnf("transparent: соединение с %s прервано: %v", target, err)
+	}
+}
+
+// OriginalDst возвращает адрес назначения соединения до REDIRECT/DNAT
+// (SO_ORIGINAL_DST из conntrack, для ipv6 - IP6T_SO_ORIGINAL_DST).
+func OriginalDst(conn net.Conn) (netip.AddrPort, error) {
+	tcp, ok := conn.(*net.TCPConn)
+	if !ok {
+		return netip.AddrPort{}, fmt.Errorf("ожидалось tcp-соединение, получено %T", conn)
+	}
+	raw, err := tcp.SyscallConn()
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	local, _ := tcp.LocalAddr().(*net.TCPAddr)
+	ipv6 := local != nil && !local.AddrPort().Addr().Unmap().Is4()
+
+	// struct sockaddr_in занимает 16 байт, как и ipv6_mreq, а sockaddr_in6
+	// помещается в начало ipv6_mtuinfo, поэтому для чтения подходят
+	// GetsockoptIPv6Mreq и GetsockoptIPv6MTUInfo.
+	var mreq *unix.IPv6Mreq
+	var mtuinfo *unix.IPv6MTUInfo
+	var serr error
+	if err := raw.Control(func(fd uintptr) {
+		if ipv6 {
+			mtuinfo, serr = unix.GetsockoptIPv6MTUInfo(int(fd), unix.IPPROTO_IPV6, ip6tSOOriginalDst)
+		} else {
+			mreq, serr = unix.GetsockoptIPv6Mreq(int(fd), unix.IPPROTO_IP, unix.SO_ORIGINAL_DST)
+		}
+	}); err != nil {
+		return netip.AddrPort{}, err
+	}
+	if serr != nil {
+		return netip.AddrPort{}, fmt.Errorf("SO_ORIGINAL_DST: %w", serr)
+	}
+
+	if ipv6 {
+		sa := mtuinfo.Addr
+		port := binary.BigEndian.Uint16((*[2]byte)(unsafe.Pointer(&sa.Port))[:])
+		return netip.AddrPortFrom(netip.AddrFrom16(sa.Addr), port), nil
+	}
+	sa := mreq.Multiaddr
+	port := binary.BigEndian.Uint16(sa[2:4])
+	addr := netip.AddrFrom4([4]byte(sa[4:8]))
+	return netip.AddrPortFrom(addr, port), nil
+}
+
+// ip6tSOOriginalDst - IP6T_SO_ORIGINAL_DST из linux/netfilter_ipv6/ip6_tables.h.
+const ip6tSOOriginalDst = 80
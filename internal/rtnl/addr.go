@@ -0,0 +1,58 @@
+package rtnl
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// EnsureAddr назначает адрес интерфейсу; повторный вызов ничего не меняет.
+// Для ipv6 проверка дубликатов (DAD) отключается, иначе адрес несколько
+// секунд остается tentative и не годится для маршрутов.
+func EnsureAddr(dev string, prefix netip.Prefix) error {
+	l, err := netlink.LinkByName(dev)
+	if err != nil {
+		return opError("link get", dev, err)
+	}
+	addr := &netlink.Addr{IPNet: ipNet(prefix)}
+	if familyOf(prefix.Addr()) == netlink.FAMILY_V6 {
+		addr.Flags = unix.IFA_F_NODAD
+	}
+	if err := netlink.AddrReplace(l, addr); err != nil {
+		return opError("addr add", prefix.String()+" dev "+dev, err)
+	}
+	return nil
+}
+
+// RemoveAddr снимает адрес; отсутствующий адрес или интерфейс не ошибка.
+func RemoveAddr(dev string, prefix netip.Prefix) error {
+	l, err := netlink.LinkByName(dev)
+	if err != nil {
+		if errors.As(err, new(netlink.LinkNotFoundError)) {
+			return nil
+		}
+		return opError("link get", dev, err)
+	}
+	err = opError("addr del", prefix.String()+" dev "+dev, netlink.AddrDel(l, &netlink.Addr{IPNet: ipNet(prefix)}))
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	return err
+}
+
+func ipNet(p netip.Prefix) *net.IPNet {
+	return &net.IPNet{
+		IP:   p.Addr().AsSlice(),
+		Mask: net.CIDRMask(p.Bits(), p.Addr().BitLen()),
+	}
+}
+
+func familyOf(a netip.Addr) int {
+	if a.Unmap().Is4() {
+		return netlink.FAMILY_V4
+	}
+	return netlink.FAMILY_V6
+}
@@ -0,0 +1,53 @@
+package rtnl
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+var (
+	ErrNotFound   = errors.New("not found")
+	ErrExists     = errors.New("already exists")
+	ErrPermission = errors.New("permission denied")
+)
+
+// OpError описывает неудачную операцию rtnetlink. errors.Is сопоставляет
+// errno ядра с ErrNotFound, ErrExists и ErrPermission.
+type OpError struct {
+	Op     string
+	Object string
+	Err    error
+}
+
+func (e *OpError) Error() string {
+	return fmt.Sprintf("%s %s: %v", e.Op, e.Object, e.Err)
+}
+
+func (e *OpError) Unwrap() error {
+	return e.Err
+}
+
+func (e *OpError) Is(target error) bool {
+	var notFound netlink.LinkNotFoundError
+	switch target {
+	case ErrNotFound:
+		return errors.As(e.Err, &notFound) || errors.Is(e.Err, unix.ENOENT) ||
+			errors.Is(e.Err, unix.ESRCH) || errors.Is(e.Err, unix.ENODEV) ||
+			errors.Is(e.Err, unix.EADDRNOTAVAIL)
+	case ErrExists:
+		return errors.Is(e.Err, unix.EEXIST)
+	case ErrPermission:
+		return errors.Is(e.Err, unix.EPERM) || errors.Is(e.Err, unix.EACCES)
+	}
+	return false
+}
+
+func opError(op, object string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &OpError{Op: op, Object: object, Err: err}
+}
@@ -0,0 +1,180 @@
+package rtnl
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+
+	"github.com/vishvananda/netlink"
+)
+
+type Link struct {
+	Name  string
+	Index int
+	MTU   int
+	Up    bool
+}
+
+func LinkByName(name string) (*Link, error) {
+	l, err := netlink.LinkByName(name)
+	if err != nil {
+		return nil, opError("link get", name, err)
+	}
+	attrs := l.Attrs()
+	return &Link{
+		Name:  attrs.Name,
+		Index: attrs.Index,
+		MTU:   attrs.MTU,
+		Up:    attrs.RawFlags&1 != 0,
+	}, nil
+}
+
+// AddTun создает постоянный tun-интерфейс без заголовка pi и поднимает его
+// с нужным mtu. Существующий интерфейс с тем же именем может принадлежать
+// другому процессу, поэтому он не используется: возвращается ErrExists.
+// Если интерфейс не удалось поднять, созданный интерфейс удаляется.
+func AddTun(name string, mtu int) error {
+	// TUNSETIFF подключается к существующему постоянному tun вместо
+	// ошибки EEXIST, поэтому наличие интерфейса проверяется заранее.
+	if _, err := netlink.LinkByName(name); err == nil {
+		return opError("tun add", name, ErrExists)
+	}
+	tun := &netlink.Tuntap{
+		LinkAttrs: netlink.LinkAttrs{Name: name},
+		Mode:      netlink.TUNTAP_MODE_TUN,
+		Flags:     netlink.TUNTAP_NO_PI,
+	}
+	if err := netlink.LinkAdd(tun); err != nil {
+		return opError("tun add", name, err)
+	}
+
+	l, err := netlink.LinkByName(name)
+	if err == nil {
+		err = ensureLinkUp(l, mtu)
+	} else {
+		err = opError("link get", name, err)
+	}
+	if err != nil {
+		DeleteLink(name)
+		return err
+	}
+	return nil
+}
+
+type TunnelKind string
+
+const (
+	TunnelGRE    TunnelKind = "gre"
+	TunnelGRETap TunnelKind = "gretap"
+	TunnelVXLAN  TunnelKind = "vxlan"
+)
+
+type Tunnel struct {
+	Name   string
+	Kind   TunnelKind
+	Local  netip.Addr
+	Remote netip.Addr
+	ID     uint32
+}
+
+// EnsureTunnel создает gre/gretap/vxlan-интерфейс. Существующий интерфейс
+// с тем же именем считается уже созданным.
+func EnsureTunnel(t Tunnel) error {
+	var link netlink.Link
+	attrs := netlink.LinkAttrs{Name: t.Name}
+	local, remote := t.Local.AsSlice(), t.Remote.AsSlice()
+	switch t.Kind {
+	case TunnelGRE:
+		link = &netlink.Gretun{LinkAttrs: attrs, Local: local, Remote: remote,
+			IKey: t.ID, OKey: t.ID, IFlags: greKeyFlag, OFlags: greKeyFlag}
+	case TunnelGRETap:
+		link = &netlink.Gretap{LinkAttrs: attrs, Local: local, Remote: remote,
+			IKey: t.ID, OKey: t.ID, IFlags: greKeyFlag, OFlags: greKeyFlag}
+	case TunnelVXLAN:
+		link = &netlink.Vxlan{LinkAttrs: attrs, VxlanId: int(t.ID), SrcAddr: local, Group: remote, Port: 4789}
+	default:
+		return opError("tunnel add", t.Name, fmt.Errorf("unsupported tunnel kind %q", t.Kind))
+	}
+
+	if err := opError("tunnel add", t.Name, netlink.LinkAdd(link)); err != nil && !errors.Is(err, ErrExists) {
+		return err
+	}
+
+	l, err := netlink.LinkByName(t.Name)
+	if err != nil {
+		return opError("link get", t.Name, err)
+	}
+	return ensureLinkUp(l, 0)
+}
+
+// EnsureVeth создает пару veth; второй конец сразу помещается в namespace
+// с дескриптором peerNS. Существующая пара не пересоздается.
+func EnsureVeth(name, peer string, peerNS int) error {
+	veth := &netlink.Veth{
+		LinkAttrs:     netlink.LinkAttrs{Name: name},
+		PeerName:      peer,
+		PeerNamespace: netlink.NsFd(peerNS),
+	}
+	if err := opError("veth add", name, netlink.LinkAdd(veth)); err != nil && !errors.Is(err, ErrExists) {
+		return err
+	}
+	return EnsureLinkUp(name, 0)
+}
+
+// MoveLink переносит интерфейс в namespace nsFd. Ядро при этом опускает
+// интерфейс и снимает с него адреса.
+func MoveLink(name string, nsFd int) error {
+	l, err := netlink.LinkByName(name)
+	if err != nil {
+		return opError("link get", name, err)
+	}
+	return opError("link set netns", name, netlink.LinkSetNsFd(l, nsFd))
+}
+
+// EnsureLinkUp поднимает интерфейс и, если mtu > 0, выставляет mtu.
+func EnsureLinkUp(name string, mtu int) error {
+	l, err := netlink.LinkByName(name)
+	if err != nil {
+		return opError("link get", name, err)
+	}
+	return ensureLinkUp(l, mtu)
+}
+
+// GRE_KEY из linux/if_tunnel.h.
+const greKeyFlag = 0x2000
+
+// DeleteLink удаляет интерфейс; отсутствие интерфейса не считается ошибкой.
+func DeleteLink(name string) error {
+	l, err := netlink.LinkByName(name)
+	if err != nil {
+		if errors.As(err, new(netlink.LinkNotFoundError)) {
+			return nil
+		}
+		return opError("link get", name, err)
+	}
+	if err := opError("link del", name, netlink.LinkDel(l)); err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	return nil
+}
+
+func ensureLinkUp(l netlink.Link, mtu int) error {
+	attrs := l.Attrs()
+	if mtu > 0 && attrs.MTU != mtu {
+		if err := netlink.LinkSetMTU(l, mtu); err != nil {
+			return opError("link set mtu", attrs.Name, err)
+		}
+	}
+	if err := netlink.LinkSetUp(l); err != nil {
+		return opError("link set up", attrs.Name, err)
+	}
+	return nil
+}
+
+func linkIndex(name string) (int, error) {
+	l, err := netlink.LinkByName(name)
+	if err != nil {
+		return 0, opError("link get", name, err)
+	}
+	return l.Attrs().Index, nil
+}
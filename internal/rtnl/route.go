@@ -0,0 +1,229 @@
+package rtnl
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+const MainTable = unix.RT_TABLE_MAIN
+
+// RouteAttrs - метрики маршрута (RTAX_*), влияющие на tcp-соединения ядра.
+// Нулевое значение означает "не задано".
+type RouteAttrs struct {
+	AdvMSS   int
+	InitCwnd int
+	InitRwnd int
+	Window   int
+	RTOMin   time.Duration
+	Features uint32
+}
+
+// RTAX_FEATURE_* из linux/rtnetlink.h.
+const (
+	FeatureECN       uint32 = 1 << 0
+	FeatureSACK      uint32 = 1 << 1
+	FeatureTimestamp uint32 = 1 << 2
+	FeatureAllFrag   uint32 = 1 << 3
+)
+
+func (a RouteAttrs) String() string {
+	var parts []string
+	add := func(name string, v int) {
+		if v != 0 {
+			parts = append(parts, fmt.Sprintf("%s %d", name, v))
+		}
+	}
+	add("advmss", a.AdvMSS)
+	add("initcwnd", a.InitCwnd)
+	add("initrwnd", a.InitRwnd)
+	add("window", a.Window)
+	if a.RTOMin != 0 {
+		parts = append(parts, "rto_min "+a.RTOMin.String())
+	}
+	if a.Features != 0 {
+		parts = append(parts, fmt.Sprintf("features %#x", a.Features))
+	}
+	return strings.Join(parts, " ")
+}
+
+type Route struct {
+	Dst     netip.Prefix
+	Gateway netip.Addr
+	Dev     string
+	Table   int
+	Attrs   RouteAttrs
+
+	// FromRA - маршрут получен из router advertisement; только для чтения.
+	FromRA bool
+}
+
+func (r Route) String() string {
+	s := r.Dst.String()
+	if !r.Dst.IsValid() || r.Dst.Bits() == 0 {
+		s = "default"
+	}
+	if r.Gateway.IsValid() {
+		s += " via " + r.Gateway.String()
+	}
+	if r.Dev != "" {
+		s += " dev " + r.Dev
+	}
+	if r.Table != 0 && r.Table != MainTable {
+		s += fmt.Sprintf(" table %d", r.Table)
+	}
+	if attrs := r.Attrs.String(); attrs != "" {
+		s += " " + attrs
+	}
+	return s
+}
+
+func (r Route) netlinkRoute() (*netlink.Route, error) {
+	nr := &netlink.Route{
+		Table:    r.Table,
+		AdvMSS:   r.Attrs.AdvMSS,
+		InitCwnd: r.Attrs.InitCwnd,
+		InitRwnd: r.Attrs.InitRwnd,
+		Window:   r.Attrs.Window,
+		RtoMin:   int(r.Attrs.RTOMin / time.Millisecond),
+		Features: int(r.Attrs.Features),
+	}
+	if r.Dst.IsValid() {
+		nr.Dst = ipNet(r.Dst.Masked())
+		nr.Family = familyOf(r.Dst.Addr())
+	}
+	if r.Gateway.IsValid() {
+		nr.Gw = r.Gateway.AsSlice()
+		nr.Family = familyOf(r.Gateway)
+	}
+	if r.Dev != "" {
+		idx, err := linkIndex(r.Dev)
+		if err != nil {
+			return nil, err
+		}
+		nr.LinkIndex = idx
+	}
+	if !r.Gateway.IsValid() {
+		nr.Scope = netlink.SCOPE_LINK
+	}
+	return nr, nil
+}
+
+// EnsureRoute создает маршрут или заменяет существующий с тем же
+// назначением (ip route replace).
+func EnsureRoute(r Route) error {
+	nr, err := r.netlinkRoute()
+	if err != nil {
+		return err
+	}
+	return opError("route replace", r.String(), netlink.RouteReplace(nr))
+}
+
+// RemoveRoute удаляет маршрут; отсутствующий маршрут не ошибка.
+func RemoveRoute(r Route) error {
+	nr, err := r.netlinkRoute()
+	if errors.Is(err, ErrNotFound) {
+		nr, err = (Route{Dst: r.Dst, Gateway: r.Gateway, Table: r.Table}).netlinkRoute()
+	}
+	if err != nil {
+		return err
+	}
+	// scope nowhere совпадает с маршрутом любой области, как в ip route del.
+	nr.Scope = netlink.SCOPE_NOWHERE
+	err = opError("route del", r.String(), netlink.RouteDel(nr))
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	return err
+}
+
+// RouteGet возвращает маршрут, который ядро выбрало бы для dst (ip route get).
+func RouteGet(dst netip.Addr) (Route, error) {
+	routes, err := netlink.RouteGet(dst.AsSlice())
+	if err != nil {
+		return Route{}, opError("route get", dst.String(), err)
+	}
+	if len(routes) == 0 {
+		return Route{}, opError("route get", dst.String(), ErrNotFound)
+	}
+	return fromNetlink(routes[0])
+}
+
+// DefaultRoutes возвращает маршруты по умолчанию из основной таблицы.
+func DefaultRoutes(family int) ([]Route, error) {
+	filter := &netlink.Route{Table: MainTable}
+	routes, err := netlink.RouteListFiltered(family, filter, netlink.RT_FILTER_TABLE)
+	if err != nil {
+		return nil, opError("route list", "default", err)
+	}
+
+	var out []Route
+	for _, nr := range routes {
+		if nr.Dst != nil {
+			if ones, _ := nr.Dst.Mask.Size(); ones != 0 {
+				continue
+			}
+		}
+		r, err := fromNetlink(nr)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, r)
+	}
+	return out, nil
+}
+
+// SetDefaultRouteAttrs переписывает метрики всех маршрутов по умолчанию.
+func SetDefaultRouteAttrs(family int, attrs RouteAttrs) error {
+	routes, err := DefaultRoutes(family)
+	if err != nil {
+		return err
+	}
+	if len(routes) == 0 {
+		return opError("route list", "default", ErrNotFound)
+	}
+	for _, r := range routes {
+		r.Attrs = attrs
+		if err := EnsureRoute(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func fromNetlink(nr netlink.Route) (Route, error) {
+	r := Route{
+		Table:  nr.Table,
+		FromRA: nr.Protocol == unix.RTPROT_RA,
+		Attrs: RouteAttrs{
+			AdvMSS:   nr.AdvMSS,
+			InitCwnd: nr.InitCwnd,
+			InitRwnd: nr.InitRwnd,
+			Window:   nr.Window,
+			RTOMin:   time.Duration(nr.RtoMin) * time.Millisecond,
+			Features: uint32(nr.Features),
+		},
+	}
+	if nr.Dst != nil {
+		addr, _ := netip.AddrFromSlice(nr.Dst.IP)
+		ones, _ := nr.Dst.Mask.Size()
+		r.Dst = netip.PrefixFrom(addr.Unmap(), ones)
+	}
+	if nr.Gw != nil {
+		r.Gateway, _ = netip.AddrFromSlice(nr.Gw)
+		r.Gateway = r.Gateway.Unmap()
+	}
+	if nr.LinkIndex > 0 {
+		l, err := netlink.LinkByIndex(nr.LinkIndex)
+		if err != nil {
+			return Route{}, opError("link get", fmt.Sprintf("index %d", nr.LinkIndex), err)
+		}
+		r.Dev = l.Attrs().Name
+	}
+	return r, nil
+}
@@ -0,0 +1,70 @@
+package rtnl
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/vishvananda/netlink"
+)
+
+// Rule - правило policy routing вида "fwmark Mark lookup Table".
+type Rule struct {
+	Family int
+	Mark   uint32
+	Table  int
+}
+
+func (r Rule) String() string {
+	s := fmt.Sprintf("fwmark %#x table %d", r.Mark, r.Table)
+	if r.Family == netlink.FAMILY_V6 {
+		s = "ipv6 " + s
+	}
+	return s
+}
+
+func (r Rule) netlinkRule() *netlink.Rule {
+	nr := netlink.NewRule()
+	nr.Family = r.Family
+	if nr.Family == 0 {
+		nr.Family = netlink.FAMILY_V4
+	}
+	nr.Mark = r.Mark
+	nr.Table = r.Table
+	return nr
+}
+
+func (r Rule) exists() (bool, error) {
+	nr := r.netlinkRule()
+	rules, err := netlink.RuleListFiltered(nr.Family, nr, netlink.RT_FILTER_MARK|netlink.RT_FILTER_TABLE)
+	if err != nil {
+		return false, opError("rule list", r.String(), err)
+	}
+	return len(rules) > 0, nil
+}
+
+// EnsureRule добавляет правило, только если такого еще нет, чтобы повторный
+// запуск не плодил дубликаты.
+func EnsureRule(r Rule) error {
+	ok, err := r.exists()
+	if err != nil || ok {
+		return err
+	}
+	return opError("rule add", r.String(), netlink.RuleAdd(r.netlinkRule()))
+}
+
+// RemoveRule удаляет все копии правила; отсутствие правила не ошибка.
+func RemoveRule(r Rule) error {
+	for {
+		ok, err := r.exists()
+		if err != nil || !ok {
+			return err
+		}
+		err = opError("rule del", r.String(), netlink.RuleDel(r.netlinkRule()))
+		if errors.Is(err, ErrNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -2,9 +2,17 @@ package stack
 
 import (
 	"fmt"
-	"log"
-	"os/exec"
+	"sort"
+	"strconv"
 	"strings"
+
+	"custom-tcp-fingerprint/internal/logging"
+	"custom-tcp-fingerprint/internal/sysctl"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
 )
 
 type SystemTCPOptions struct {
@@ -17,127 +25,131 @@ type SystemTCPOptions struct {
 }
 
 func ConfigureTCPFingerprint(gs *GvisorStack, osType string, windowSize int, ttl int) error {
-	log.Printf("настройка tcp-отпечатка под %s с размером окна %d и ttl %d",
-		osType, windowSize, ttl)
-
-	opts, err := GetSystemTCPOptions(osType, windowSize, ttl)
+	opts, err := GetTCPOptions(osType, windowSize, ttl)
 	if err != nil {
 		return fmt.Errorf("не удалось получить tcp опции: %w", err)
 	}
+	return ConfigureTCPOptions(gs, opts)
+}
 
-	if err := executeCommand("sysctl", "-w", fmt.Sprintf("net.ipv4.ip_default_ttl=%d", opts.TTL)); err != nil {
-		log.Printf("предупреждение: не удалось установить ttl: %v", err)
-	}
-
-	tcpRmemCmd := fmt.Sprintf("net.ipv4.tcp_rmem=\"4096 %d 6291456\"", opts.WindowSize)
-	if err := executeCommand("sysctl", "-w", tcpRmemCmd); err != nil {
-		log.Printf("предупреждение: не удалось устоновить размер tcp окна: %v", err)
-	}
+func ConfigureTCPOptions(gs *GvisorStack, opts *TCPOptions) error {
+	logging.Infof("настройка tcp-отпечатка под %s с окном %s, ttl %d и опциями %s",
+		opts.OSType, opts.Window, opts.TTL, opts.Layout())
 
-	timestampsValue := "0"
-	if opts.TimestampsEnabled {
-		timestampsValue = "1"
-	}
-	if err := executeCommand("sysctl", "-w", fmt.Sprintf("net.ipv4.tcp_timestamps=%s", timestampsValue)); err != nil {
-		log.Printf("предупреждение: не удалось установить tcp timestamps: %v", err)
+	if err := gs.SetTCPOptions(opts); err != nil {
+		return fmt.Errorf("не удалось применить tcp опции к сетевому стеку: %w", err)
 	}
 
-	if err := executeCommand("ip", "link", "set", "dev", gs.tunName, "mtu", fmt.Sprintf("%d", opts.MSS)); err != nil {
-		log.Printf("предупреждение: не удалось установить mtu для интерфейса: %v", err)
-	}
-
-	log.Printf("tcp-отпечаток настроен успешно")
+	logging.Infof("tcp-отпечаток настроен успешно")
 	return nil
 }
 
 func GetSystemTCPOptions(osType string, windowSize int, ttl int) (*SystemTCPOptions, error) {
-	switch osType {
-	case "windows":
-		return &SystemTCPOptions{
-			WindowSize:        uint16(windowSize),
-			TimestampsEnabled: false,
-			MSS:               1460,
-			WindowScaleValue:  8,
-			TTL:               uint8(ttl),
-			OSType:            "windows",
-		}, nil
-
-	case "macos":
-		return &SystemTCPOptions{
-			WindowSize:        uint16(windowSize),
-			TimestampsEnabled: true,
-			MSS:               1460,
-			WindowScaleValue:  6,
-			TTL:               uint8(ttl),
-			OSType:            "macos",
-		}, nil
-
-	case "linux":
-		return &SystemTCPOptions{
-			WindowSize:        uint16(windowSize),
-			TimestampsEnabled: true,
-			MSS:               1460,
-			WindowScaleValue:  7,
-			TTL:               uint8(ttl),
-			OSType:            "linux",
-		}, nil
-
-	default:
-		return nil, fmt.Errorf("неизвестный тип отпечатка ос: %s", osType)
+	opts, err := GetTCPOptions(osType, windowSize, ttl)
+	if err != nil {
+		return nil, err
 	}
+
+	return &SystemTCPOptions{
+		WindowSize:        opts.SYNWindow(false),
+		TimestampsEnabled: opts.TimestampsEnabled,
+		MSS:               opts.MSS,
+		WindowScaleValue:  opts.WindowScaleValue,
+		TTL:               opts.TTL,
+		OSType:            opts.OSType,
+	}, nil
 }
 
-func GetCurrentFingerprint() map[string]interface{} {
-	fingerprint := make(map[string]interface{})
+// Fingerprint - снимок параметров отпечатка: имя параметра и его значение в
+// текстовом виде. Параметры sysctl хоста хранятся под своими ключами.
+type Fingerprint map[string]string
 
-	if ttl, err := getSysctlValue("net.ipv4.ip_default_ttl"); err == nil {
-		fingerprint["TTL"] = ttl
+func (f Fingerprint) String() string {
+	keys := make([]string, 0, len(f))
+	for k := range f {
+		keys = append(keys, k)
 	}
-
-	if windowSize, err := getSysctlValue("net.ipv4.tcp_rmem"); err == nil {
-		fingerprint["WindowSize"] = windowSize
+	sort.Strings(keys)
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		parts[i] = k + "=" + f[k]
 	}
+	return strings.Join(parts, " ")
+}
 
-	if timestamps, err := getSysctlValue("net.ipv4.tcp_timestamps"); err == nil {
-		fingerprint["Timestamps"] = timestamps
+// ProfileFingerprint - значения, которые стек должен показывать с профилем
+// opts.
+func ProfileFingerprint(opts *TCPOptions) Fingerprint {
+	layout := opts.Layout()
+	f := Fingerprint{
+		"ttl":        strconv.Itoa(int(opts.TTL)),
+		"hop_limit":  strconv.Itoa(int(opts.IPv6HopLimit())),
+		"sack":       strconv.FormatBool(layout.Has(OptionSACKPermitted)),
+		"window":     strconv.Itoa(int(opts.SYNWindow(false))),
+		"options":    layout.String(),
+		"df":         strconv.FormatBool(opts.DontFragment),
+		"ip_id":      opts.IPID.String(),
+		"flow_label": opts.FlowLabel.String(),
+	}
+	if layout.Has(OptionMSS) {
+		f["mss"] = strconv.Itoa(int(opts.MSS))
 	}
+	if layout.Has(OptionWS) {
+		f["wscale"] = strconv.Itoa(int(opts.WindowScaleValue))
+	}
+	return f
+}
 
-	cmd := exec.Command("ip", "route", "show")
-	if out, err := cmd.CombinedOutput(); err == nil {
-		routes := string(out)
-		if strings.Contains(routes, "advmss") {
-			parts := strings.Split(routes, "advmss")
-			if len(parts) > 1 {
-				mssParts := strings.Split(strings.TrimSpace(parts[1]), " ")
-				if len(mssParts) > 0 {
-					fingerprint["MSS"] = mssParts[0]
-				}
-			}
+// GetCurrentFingerprint читает действующие значения: профиль, по которому
+// link endpoint переписывает SYN, ttl, hop limit и sack из самого стека
+// gvisor и параметры sysctl хоста hostKeys. С gs nil читаются только
+// sysctl. Sack стека включает и первое соединение с профилем, где есть
+// sok, поэтому после него он может отличаться от профиля стека.
+func GetCurrentFingerprint(gs *GvisorStack, hostKeys ...string) Fingerprint {
+	f := make(Fingerprint)
+	for _, key := range hostKeys {
+		if value, err := sysctl.Get(key); err == nil {
+			f[key] = value
 		}
 	}
-
-	if sack, err := getSysctlValue("net.ipv4.tcp_sack"); err == nil {
-		fingerprint["SACK"] = sack
+	if gs == nil {
+		return f
 	}
 
-	return fingerprint
-}
-
-func getSysctlValue(param string) (string, error) {
-	cmd := exec.Command("sysctl", "-n", param)
-	out, err := cmd.CombinedOutput()
-	if err != nil {
-		return "", err
+	if opts := gs.link.options(); opts != nil {
+		for k, v := range ProfileFingerprint(opts) {
+			f[k] = v
+		}
 	}
-	return strings.TrimSpace(string(out)), nil
+	var ttl tcpip.DefaultTTLOption
+	if gs.netstack.NetworkProtocolOption(ipv4.ProtocolNumber, &ttl) == nil {
+		f["ttl"] = strconv.Itoa(int(wireTTL(uint8(ttl))))
+	}
+	if gs.netstack.NetworkProtocolOption(ipv6.ProtocolNumber, &ttl) == nil {
+		f["hop_limit"] = strconv.Itoa(int(wireTTL(uint8(ttl))))
+	}
+	var sack tcpip.TCPSACKEnabled
+	if gs.netstack.TransportProtocolOption(tcp.ProtocolNumber, &sack) == nil {
+		f["sack"] = strconv.FormatBool(bool(sack))
+	}
+	return f
 }
 
-func executeCommand(command string, args ...string) error {
-	cmd := exec.Command(command, args...)
-	out, err := cmd.CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("ошибка выполнения команды '%s %s': %w, вывод: %s",
-			command, strings.Join(args, " "), err, string(out))
+// DiffFingerprint перечисляет параметры want, значения которых в got
+// другие, в виде "ttl: 64 -> 128". Параметры, которых нет в want, не
+// сравниваются: так одна функция сравнивает и снимки sysctl до и после
+// запуска, и действующие значения с профилем.
+func DiffFingerprint(want, got Fingerprint) []string {
+	var diff []string
+	for k, w := range want {
+		g, ok := got[k]
+		if !ok {
+			g = "<нет>"
+		}
+		if g != w {
+			diff = append(diff, fmt.Sprintf("%s: %s -> %s", k, w, g))
+		}
 	}
-	return nil
+	sort.Strings(diff)
+	return diff
 }
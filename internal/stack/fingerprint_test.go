@@ -0,0 +1,51 @@
+package stack
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiffFingerprint(t *testing.T) {
+	want := Fingerprint{"ttl": "128", "window": "64240", "net.ipv4.ip_forward": "0"}
+	got := Fingerprint{"ttl": "64", "window": "64240", "mss": "1460"}
+	diff := DiffFingerprint(want, got)
+	expected := []string{"net.ipv4.ip_forward: 0 -> <нет>", "ttl: 128 -> 64"}
+	if !reflect.DeepEqual(diff, expected) {
+		t.Fatalf("разница %q, ожидалось %q", diff, expected)
+	}
+	if diff := DiffFingerprint(got, got); len(diff) != 0 {
+		t.Fatalf("разница снимка с самим собой: %q", diff)
+	}
+}
+
+func TestCurrentFingerprintMatchesProfile(t *testing.T) {
+	s, _ := newTestStack(t)
+	opts, err := GetTCPOptions("windows10", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetTCPOptions(opts); err != nil {
+		t.Fatal(err)
+	}
+
+	want := ProfileFingerprint(opts)
+	if want["ttl"] != "128" || want["options"] != "mss,nop,ws,nop,nop,sok" || want["sack"] != "true" {
+		t.Fatalf("отпечаток профиля %s", want)
+	}
+	got := GetCurrentFingerprint(s, "net.ipv4.ip_forward")
+	if diff := DiffFingerprint(want, got); len(diff) != 0 {
+		t.Fatalf("стек не совпадает с профилем: %q", diff)
+	}
+	if _, ok := got["net.ipv4.ip_forward"]; !ok {
+		t.Errorf("в отпечатке нет sysctl хоста: %s", got)
+	}
+
+	// Без sok в раскладке стек выключает sack, и это видно в отпечатке.
+	opts.OptionLayout, _ = ParseOptionLayout("mss,nop,ws")
+	if err := s.SetTCPOptions(opts); err != nil {
+		t.Fatal(err)
+	}
+	if got := GetCurrentFingerprint(s); got["sack"] != "false" || got["options"] != "mss,nop,ws" {
+		t.Fatalf("отпечаток после смены профиля: %s", got)
+	}
+}
@@ -2,101 +2,459 @@ package stack
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net"
-	"os/exec"
+	"net/netip"
+	"strconv"
+	"sync"
 	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/fdbased"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	tcpipstack "gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/waiter"
+
+	"custom-tcp-fingerprint/internal/logging"
+	"custom-tcp-fingerprint/internal/network"
+	"custom-tcp-fingerprint/internal/policy"
 )
 
+const nicID tcpip.NICID = 1
+
 type GvisorStack struct {
-	tunName     string
-	mtu         int
-	targetHost  string
-	targetPort  int
-	localPort   int
-	isConnected bool
+	tunName   string
+	mtu       int
+	netstack  *tcpipstack.Stack
+	link      *fingerprintEndpoint
+	listeners []net.Listener
+	rcvBuf    tcpip.TCPReceiveBufferSizeRangeOption
+	sack      bool
+	selector  ProfileSelector
+	mu        sync.Mutex
 }
 
-func NewGvisorStack(tunName string, mtu int) (*GvisorStack, error) {
-	cmd := exec.Command("ip", "link", "show", tunName)
-	if err := cmd.Run(); err == nil {
-		exec.Command("ip", "tuntap", "del", "dev", tunName, "mode", "tun").Run()
-	}
+// ProfileSelector выбирает профиль для соединения, открываемого без явного
+// DialOptions.TCP; nil означает профиль стека.
+type ProfileSelector func(req policy.Request) *TCPOptions
+
+// Mapping - одна пересылка: соединения, принятые на Listen, открываются
+// через стек к TargetHost:TargetPort с параметрами Dial.
+type Mapping struct {
+	Listen     string
+	TargetHost string
+	TargetPort int
+	Dial       DialOptions
+}
+
+// DialOptions - параметры отдельного исходящего соединения. Нулевое
+// значение означает профиль стека и его основной адрес.
+type DialOptions struct {
+	// TCP - профиль соединения вместо заданного SetTCPOptions.
+	TCP *TCPOptions
+	// Source - адрес стека, с которого открывается соединение; он должен
+	// быть добавлен через AddAddress.
+	Source netip.Addr
+}
 
-	cmd = exec.Command("ip", "tuntap", "add", "dev", tunName, "mode", "tun")
-	if out, err := cmd.CombinedOutput(); err != nil {
-		return nil, fmt.Errorf("ошыбка создания tun интерфейса: %s, вывод: %s", err, string(out))
+func NewGvisorStack(tunName string, fd int, mtu int) (*GvisorStack, error) {
+	fdEndpoint, err := fdbased.New(&fdbased.Options{
+		FDs: []int{fd},
+		MTU: uint32(mtu),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("ошибка создания link endpoint для %s: %w", tunName, err)
 	}
+	link := newFingerprintEndpoint(fdEndpoint)
+
+	s := tcpipstack.New(tcpipstack.Options{
+		NetworkProtocols:   []tcpipstack.NetworkProtocolFactory{ipv4.NewProtocol, ipv6.NewProtocol},
+		TransportProtocols: []tcpipstack.TransportProtocolFactory{tcp.NewProtocol},
+	})
 
-	cmd = exec.Command("ip", "link", "set", "dev", tunName, "mtu", fmt.Sprintf("%d", mtu))
-	if out, err := cmd.CombinedOutput(); err != nil {
-		return nil, fmt.Errorf("ошибка установки mtu: %s, вывод: %s", err, string(out))
+	if tcpErr := s.CreateNIC(nicID, link); tcpErr != nil {
+		s.Close()
+		return nil, fmt.Errorf("ошибка создания nic в сетевом стеке: %s", tcpErr)
 	}
 
-	cmd = exec.Command("ip", "link", "set", "dev", tunName, "up")
-	if out, err := cmd.CombinedOutput(); err != nil {
-		return nil, fmt.Errorf("ошибка активации интерфейса: %s, вывод: %s", err, string(out))
+	addrs := []struct {
+		proto  tcpip.NetworkProtocolNumber
+		addr   string
+		prefix int
+	}{
+		{ipv4.ProtocolNumber, network.TunStackAddr, network.TunPrefixLen},
+		{ipv6.ProtocolNumber, network.TunStackAddr6, network.TunPrefixLen6},
 	}
+	for _, a := range addrs {
+		protoAddr := tcpip.ProtocolAddress{
+			Protocol: a.proto,
+			AddressWithPrefix: tcpip.AddressWithPrefix{
+				Address:   tcpip.AddrFromSlice(netip.MustParseAddr(a.addr).AsSlice()),
+				PrefixLen: a.prefix,
+			},
+		}
+		if tcpErr := s.AddProtocolAddress(nicID, protoAddr, tcpipstack.AddressProperties{}); tcpErr != nil {
+			s.Close()
+			return nil, fmt.Errorf("ошибка назначения адреса %s: %s", a.addr, tcpErr)
+		}
+	}
+
+	s.SetRouteTable([]tcpip.Route{
+		{
+			Destination: header.IPv4EmptySubnet,
+			Gateway:     tcpip.AddrFromSlice(netip.MustParseAddr(network.TunHostAddr).AsSlice()),
+			NIC:         nicID,
+		},
+		{
+			Destination: header.IPv6EmptySubnet,
+			Gateway:     tcpip.AddrFromSlice(netip.MustParseAddr(network.TunHostAddr6).AsSlice()),
+			NIC:         nicID,
+		},
+	})
 
-	log.Printf("создан и настроен tun интерфейс: %s с mtu %d", tunName, mtu)
+	logging.Infof("создан сетевой стек gvisor на %s (адреса %s и %s, mtu %d)", tunName, network.TunStackAddr, network.TunStackAddr6, mtu)
 
+	var sack tcpip.TCPSACKEnabled
+	s.TransportProtocolOption(tcp.ProtocolNumber, &sack)
 	return &GvisorStack{
-		tunName:     tunName,
-		mtu:         mtu,
-		isConnected: false,
+		tunName:  tunName,
+		mtu:      mtu,
+		netstack: s,
+		link:     link,
+		sack:     bool(sack),
 	}, nil
 }
 
-func (g *GvisorStack) StartNetworking(localPort int, targetHost string, targetPort int) error {
-	g.localPort = localPort
-	g.targetHost = targetHost
-	g.targetPort = targetPort
+// AddAddress добавляет стеку адрес из подсети tun, например для
+// пересылки с собственным адресом источника.
+func (g *GvisorStack) AddAddress(addr netip.Addr) error {
+	proto, prefix := ipv4.ProtocolNumber, network.TunPrefixLen
+	if addr.Is6() {
+		proto, prefix = ipv6.ProtocolNumber, network.TunPrefixLen6
+	}
+	protoAddr := tcpip.ProtocolAddress{
+		Protocol: proto,
+		AddressWithPrefix: tcpip.AddressWithPrefix{
+			Address:   tcpip.AddrFromSlice(addr.AsSlice()),
+			PrefixLen: prefix,
+		},
+	}
+	if tcpErr := g.netstack.AddProtocolAddress(nicID, protoAddr, tcpipstack.AddressProperties{}); tcpErr != nil {
+		return fmt.Errorf("ошибка назначения адреса %s: %s", addr, tcpErr)
+	}
+	return nil
+}
 
-	addrs, err := net.LookupHost(targetHost)
-	if err != nil {
-		log.Printf("предупреждение: не удалось выполнить dns-запрос для %s: %v", targetHost, err)
-		log.Printf("продолжаем работу, но соединение может быть невозможно")
-	} else {
-		log.Printf("целевой хост %s разрешается в ip-адреса: %v", targetHost, addrs)
+func (g *GvisorStack) SetTCPOptions(opts *TCPOptions) error {
+	layout := opts.Layout()
+	if err := layout.Validate(); err != nil {
+		return err
 	}
 
-	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", localPort))
+	ttl := tcpip.DefaultTTLOption(forwardedTTL(opts.TTL))
+	if tcpErr := g.netstack.SetNetworkProtocolOption(ipv4.ProtocolNumber, &ttl); tcpErr != nil {
+		return fmt.Errorf("не удалось установить ttl: %s", tcpErr)
+	}
+	hopLimit := tcpip.DefaultTTLOption(forwardedTTL(opts.IPv6HopLimit()))
+	if tcpErr := g.netstack.SetNetworkProtocolOption(ipv6.ProtocolNumber, &hopLimit); tcpErr != nil {
+		return fmt.Errorf("не удалось установить hop limit: %s", tcpErr)
+	}
+
+	bufSize := receiveBufferForScale(opts.WindowScaleValue)
+	g.mu.Lock()
+	err := g.setSACKLocked(layout.Has(OptionSACKPermitted))
+	if err == nil {
+		g.rcvBuf.Default = bufSize
+		err = g.raiseReceiveBufferLocked(bufSize)
+	}
+	g.mu.Unlock()
 	if err != nil {
-		return fmt.Errorf("не удалось запустить слушающий сокет: %w", err)
+		return err
 	}
 
-	log.Printf("запущен прокси на порту %d, перенаправление на %s:%d", localPort, targetHost, targetPort)
-	g.isConnected = true
+	g.link.setOptions(opts)
+	return nil
+}
 
-	go func() {
-		for {
-			conn, err := listener.Accept()
-			if err != nil {
-				log.Printf("ошибка при принятии соединения: %v", err)
-				break
+// raiseReceiveBufferLocked задает диапазон буфера приема так, чтобы в него
+// помещались буферы всех профилей: стек ограничивает буфер соединения
+// максимумом диапазона, а от буфера зависит window scale в SYN.
+func (g *GvisorStack) raiseReceiveBufferLocked(bufSize int) error {
+	rcvBuf := g.rcvBuf
+	rcvBuf.Min = tcp.MinBufferSize
+	if rcvBuf.Default == 0 {
+		rcvBuf.Default = bufSize
+	}
+	if bufSize > rcvBuf.Max {
+		rcvBuf.Max = bufSize
+	}
+	if rcvBuf == g.rcvBuf {
+		return nil
+	}
+	if tcpErr := g.netstack.SetTransportProtocolOption(tcp.ProtocolNumber, &rcvBuf); tcpErr != nil {
+		return fmt.Errorf("не удалось установить размер tcp receive buffer: %s", tcpErr)
+	}
+	g.rcvBuf = rcvBuf
+	return nil
+}
+
+// setSACKLocked включает или выключает SACK стека. Стек читает опцию при
+// отправке SYN и разборе SYN-ACK, поэтому профиль соединения с sok
+// включает SACK до connect. Соединениям без sok включенный SACK не мешает:
+// link endpoint убирает sok из их SYN, и сервер SACK не согласует.
+func (g *GvisorStack) setSACKLocked(enabled bool) error {
+	if g.sack == enabled {
+		return nil
+	}
+	sack := tcpip.TCPSACKEnabled(enabled)
+	if tcpErr := g.netstack.SetTransportProtocolOption(tcp.ProtocolNumber, &sack); tcpErr != nil {
+		return fmt.Errorf("не удалось установить tcp sack: %s", tcpErr)
+	}
+	g.sack = enabled
+	return nil
+}
+
+func (g *GvisorStack) StartNetworking(localPort int, targetHost string, targetPort int) error {
+	return g.StartMappings([]Mapping{{
+		Listen:     fmt.Sprintf(":%d", localPort),
+		TargetHost: targetHost,
+		TargetPort: targetPort,
+	}})
+}
+
+// StartMappings открывает слушающие сокеты всех пересылок и обслуживает их
+// одновременно. При ошибке уже открытые сокеты закрываются.
+func (g *GvisorStack) StartMappings(mappings []Mapping) error {
+	var listeners []net.Listener
+	for _, m := range mappings {
+		addrs, err := net.LookupHost(m.TargetHost)
+		if err != nil {
+			logging.Warnf("предупреждение: не удалось выполнить dns-запрос для %s: %v", m.TargetHost, err)
+			logging.Warnf("продолжаем работу, но соединение может быть невозможно")
+		} else {
+			logging.Infof("целевой хост %s разрешается в ip-адреса: %v", m.TargetHost, addrs)
+		}
+
+		listener, err := net.Listen("tcp", m.Listen)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
 			}
-			go g.handleConnection(conn)
+			return fmt.Errorf("не удалось запустить слушающий сокет %s: %w", m.Listen, err)
 		}
-	}()
+		listeners = append(listeners, listener)
+
+		profile := "профиль стека"
+		if m.Dial.TCP != nil {
+			profile = m.Dial.TCP.OSType
+		}
+		logging.Infof("запущен прокси на %s, перенаправление на %s (%s)", listener.Addr(),
+			net.JoinHostPort(m.TargetHost, strconv.Itoa(m.TargetPort)), profile)
+	}
 
+	g.mu.Lock()
+	g.listeners = append(g.listeners, listeners...)
+	g.mu.Unlock()
+
+	for i, listener := range listeners {
+		go g.serve(listener, mappings[i])
+	}
 	return nil
 }
 
-func (g *GvisorStack) handleConnection(clientConn net.Conn) {
+func (g *GvisorStack) serve(listener net.Listener, m Mapping) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			logging.Errorf("ошибка при принятии соединения: %v", err)
+			return
+		}
+		go g.handleConnection(conn, m)
+	}
+}
+
+// SetProfileSelector задает выбор профиля по назначению и клиенту
+// соединения. Сведения о клиенте берутся из контекста (policy.NewContext).
+func (g *GvisorStack) SetProfileSelector(selector ProfileSelector) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.selector = selector
+}
+
+func (g *GvisorStack) DialContext(ctx context.Context, host string, port int) (net.Conn, error) {
+	return g.DialWith(ctx, host, port, DialOptions{})
+}
+
+// DialWith соединяется с host через сетевой стек, перебирая его адреса:
+// сначала ipv4, затем ipv6. С DialOptions.Source пробуются только адреса
+// того же семейства.
+func (g *GvisorStack) DialWith(ctx context.Context, host string, port int, opts DialOptions) (net.Conn, error) {
+	ips, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return nil, fmt.Errorf("не удалось разрешить %s: %w", host, err)
+	}
+	var v4, v6 []netip.Addr
+	for _, ip := range ips {
+		ip = ip.Unmap()
+		if opts.Source.IsValid() && ip.Is4() != opts.Source.Is4() {
+			continue
+		}
+		if ip.Is4() {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+	if len(v4)+len(v6) == 0 {
+		return nil, fmt.Errorf("у %s нет адресов семейства адреса источника %s", host, opts.Source)
+	}
+
+	g.mu.Lock()
+	selector := g.selector
+	g.mu.Unlock()
+
+	for _, ip := range append(v4, v6...) {
+		ipOpts := opts
+		if ipOpts.TCP == nil && selector != nil {
+			ipOpts.TCP = selector(policy.Request{Host: host, Addr: ip, Port: port, Client: policy.FromContext(ctx)})
+		}
+		var conn net.Conn
+		conn, err = g.dial(ctx, netip.AddrPortFrom(ip, uint16(port)), ipOpts)
+		if err == nil {
+			return conn, nil
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, err
+}
+
+// dial повторяет gonet.DialContextTCP, но до connect привязывает
+// соединение к порту и регистрирует его профиль, чтобы link endpoint
+// переписал SYN по нему, а ttl и буфер приема задает для самого сокета.
+func (g *GvisorStack) dial(ctx context.Context, dst netip.AddrPort, opts DialOptions) (net.Conn, error) {
+	proto := ipv4.ProtocolNumber
+	if dst.Addr().Is6() {
+		proto = ipv6.ProtocolNumber
+	}
+	remote := tcpip.FullAddress{NIC: nicID, Addr: tcpip.AddrFromSlice(dst.Addr().AsSlice()), Port: dst.Port()}
+	if opts.TCP == nil && !opts.Source.IsValid() {
+		return gonet.DialContextTCP(ctx, g.netstack, remote, proto)
+	}
+
+	if p := opts.TCP; p != nil {
+		g.mu.Lock()
+		err := g.raiseReceiveBufferLocked(receiveBufferForScale(p.WindowScaleValue))
+		if err == nil && p.Layout().Has(OptionSACKPermitted) {
+			err = g.setSACKLocked(true)
+		}
+		g.mu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var wq waiter.Queue
+	ep, tcpErr := g.netstack.NewEndpoint(tcp.ProtocolNumber, proto, &wq)
+	if tcpErr != nil {
+		return nil, fmt.Errorf("не удалось создать сокет: %s", tcpErr)
+	}
+	waitEntry, notifyCh := waiter.NewChannelEntry(waiter.WritableEvents)
+	wq.EventRegister(&waitEntry)
+	defer wq.EventUnregister(&waitEntry)
+
+	fail := func(format string, args ...interface{}) (net.Conn, error) {
+		ep.Close()
+		return nil, fmt.Errorf(format, args...)
+	}
+
+	if p := opts.TCP; p != nil {
+		ep.SocketOptions().SetReceiveBufferSize(int64(receiveBufferForScale(p.WindowScaleValue)), true)
+
+		opt, ttl := tcpip.IPv4TTLOption, p.TTL
+		if proto == ipv6.ProtocolNumber {
+			opt, ttl = tcpip.IPv6HopLimitOption, p.IPv6HopLimit()
+		}
+		if tcpErr := ep.SetSockOptInt(opt, int(forwardedTTL(ttl))); tcpErr != nil {
+			return fail("не удалось установить ttl: %s", tcpErr)
+		}
+	}
+
+	var local tcpip.FullAddress
+	if opts.Source.IsValid() {
+		local.Addr = tcpip.AddrFromSlice(opts.Source.AsSlice())
+	}
+	if tcpErr := ep.Bind(local); tcpErr != nil {
+		return fail("не удалось привязать сокет к %s: %s", opts.Source, tcpErr)
+	}
+	bound, tcpErr := ep.GetLocalAddress()
+	if tcpErr != nil {
+		return fail("не удалось получить локальный адрес: %s", tcpErr)
+	}
+	flow := flowKey{v6: proto == ipv6.ProtocolNumber, port: bound.Port}
+	if opts.TCP != nil {
+		g.link.registerFlow(flow, opts.TCP)
+	}
+	release := func() {
+		if opts.TCP != nil {
+			g.link.unregisterFlow(flow)
+		}
+	}
+
+	tcpErr = ep.Connect(remote)
+	if _, ok := tcpErr.(*tcpip.ErrConnectStarted); ok {
+		select {
+		case <-ctx.Done():
+			release()
+			ep.Close()
+			return nil, ctx.Err()
+		case <-notifyCh:
+		}
+		tcpErr = ep.LastError()
+	}
+	if tcpErr != nil {
+		release()
+		ep.Close()
+		return nil, &net.OpError{Op: "connect", Net: "tcp", Addr: net.TCPAddrFromAddrPort(dst), Err: errors.New(tcpErr.String())}
+	}
+
+	return &flowConn{TCPConn: gonet.NewTCPConn(&wq, ep), release: release}, nil
+}
+
+// flowConn снимает регистрацию профиля соединения при закрытии.
+type flowConn struct {
+	*gonet.TCPConn
+	once    sync.Once
+	release func()
+}
+
+func (c *flowConn) Close() error {
+	c.once.Do(c.release)
+	return c.TCPConn.Close()
+}
+
+func (g *GvisorStack) handleConnection(clientConn net.Conn, m Mapping) {
 	defer clientConn.Close()
 
-	targetAddr := fmt.Sprintf("%s:%d", g.targetHost, g.targetPort)
-	log.Printf("установка соединения с %s", targetAddr)
+	targetAddr := net.JoinHostPort(m.TargetHost, strconv.Itoa(m.TargetPort))
+	logging.Infof("установка соединения с %s", targetAddr)
 
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
+	if source, err := netip.ParseAddrPort(clientConn.RemoteAddr().String()); err == nil {
+		ctx = policy.NewContext(ctx, policy.Client{Source: source.Addr().Unmap()})
+	}
 
-	var dialer net.Dialer
-	serverConn, err := dialer.DialContext(ctx, "tcp", targetAddr)
+	serverConn, err := g.DialWith(ctx, m.TargetHost, m.TargetPort, m.Dial)
 	if err != nil {
-		log.Printf("ошибка при соединении с целевым хостом: %v", err)
+		logging.Errorf("ошибка при соединении с целевым хостом: %v", err)
 		return
 	}
 	defer serverConn.Close()
@@ -115,16 +473,57 @@ func (g *GvisorStack) handleConnection(clientConn net.Conn) {
 
 	err = <-errChan
 	if err != nil {
-		log.Printf("соединение прервоно: %v", err)
+		logging.Warnf("соединение прервоно: %v", err)
 	}
 }
 
 func (g *GvisorStack) Close() {
-	if g.isConnected {
-		cmd := exec.Command("ip", "tuntap", "del", "dev", g.tunName, "mode", "tun")
-		if out, err := cmd.CombinedOutput(); err != nil {
-			log.Printf("ошибка при удалении tun интерфейса: %s, вывод: %s", err, string(out))
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for _, l := range g.listeners {
+		if err := l.Close(); err != nil {
+			logging.Errorf("ошибка при закрытии слушающего сокета: %v", err)
 		}
-		g.isConnected = false
 	}
+	g.listeners = nil
+
+	if g.netstack != nil {
+		g.netstack.Close()
+		g.netstack.Wait()
+		g.netstack = nil
+	}
+}
+
+// MaxTTL - наибольший ttl и hop limit профиля. Ядро уменьшает ttl при
+// пересылке пакета из tun, а стек не может выставить больше 255, поэтому
+// на проводе не бывает больше 254.
+const MaxTTL = 254
+
+// forwardedTTL компенсирует уменьшение ttl ядром при пересылке пакета из tun
+// наружу, чтобы на проводе оказалось значение из профиля. Для ttl больше
+// MaxTTL компенсировать нечем: Validate такие профили отвергает.
+func forwardedTTL(ttl uint8) uint8 {
+	if ttl == 0 || ttl == 255 {
+		return ttl
+	}
+	return ttl + 1
+}
+
+// wireTTL - ttl, который покажет на проводе пакет стека с ttl, выставленным
+// forwardedTTL.
+func wireTTL(ttl uint8) uint8 {
+	if ttl <= 1 {
+		return ttl
+	}
+	return ttl - 1
+}
+
+// receiveBufferForScale подбирает наибольший буфер приема, для которого gvisor
+// объявит в SYN ровно указанный window scale.
+func receiveBufferForScale(scale uint8) int {
+	if scale > header.MaxWndScale {
+		scale = header.MaxWndScale
+	}
+	return 0xffff << scale
 }
@@ -0,0 +1,95 @@
+package stack
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+)
+
+// newTestStack создает стек на одном конце socketpair вместо tun; второй
+// конец возвращается для чтения отправленных пакетов.
+func newTestStack(t *testing.T) (*GvisorStack, int) {
+	t.Helper()
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_SEQPACKET, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewGvisorStack("test0", fds[0], 1500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		s.Close()
+		unix.Close(fds[0])
+		unix.Close(fds[1])
+	})
+	return s, fds[1]
+}
+
+func stackSACK(t *testing.T, s *GvisorStack) bool {
+	t.Helper()
+	var sack tcpip.TCPSACKEnabled
+	if tcpErr := s.netstack.TransportProtocolOption(tcp.ProtocolNumber, &sack); tcpErr != nil {
+		t.Fatal(tcpErr)
+	}
+	return bool(sack)
+}
+
+func TestDialEnablesSACK(t *testing.T) {
+	s, peer := newTestStack(t)
+
+	layout, err := ParseOptionLayout("mss,nop,ws")
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := &TCPOptions{OSType: "без sack", TTL: 64, MSS: 1460, Window: FixedWindow(8192),
+		WindowScaleEnabled: true, WindowScaleValue: 8, OptionLayout: layout}
+	if err := s.SetTCPOptions(base); err != nil {
+		t.Fatal(err)
+	}
+	if stackSACK(t, s) {
+		t.Fatalf("sack включен профилем стека без sok")
+	}
+
+	flow, err := GetTCPOptions("windows10", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Ответа на SYN не будет: соединение отменяется через контекст, и
+	// тест ждет завершения DialWith.
+	ctx, cancel := context.WithCancel(context.Background())
+	dialed := make(chan error, 1)
+	go func() {
+		conn, err := s.DialWith(ctx, "192.0.2.1", 443, DialOptions{TCP: flow})
+		if conn != nil {
+			conn.Close()
+		}
+		dialed <- err
+	}()
+	defer func() {
+		cancel()
+		select {
+		case err := <-dialed:
+			if !errors.Is(err, context.Canceled) {
+				t.Errorf("dial завершился с ошибкой %v, ожидалась отмена", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("dial не завершился после отмены")
+		}
+	}()
+
+	// SYN в socketpair означает, что соединение уже открыто.
+	tv := unix.NsecToTimeval((5 * time.Second).Nanoseconds())
+	unix.SetsockoptTimeval(peer, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &tv)
+	if _, err := unix.Read(peer, make([]byte, 1500)); err != nil {
+		t.Fatalf("syn не отправлен: %v", err)
+	}
+	if !stackSACK(t, s) {
+		t.Fatalf("sack не включен для профиля соединения с sok")
+	}
+}
@@ -0,0 +1,50 @@
+package stack
+
+import "math/rand/v2"
+
+// Jitter описывает допустимые случайные отклонения полей профиля. Границы
+// выбраны так, чтобы результат оставался похожим на настоящую ОС: окно -
+// целое число MSS, а ttl выглядит уменьшенным на число промежуточных хопов.
+type Jitter struct {
+	// WindowMSSMin и WindowMSSMax - диапазон множителя MSS для размера
+	// окна; нулевой WindowMSSMax оставляет окно профиля.
+	WindowMSSMin, WindowMSSMax int
+	// MaxHops - наибольшее число имитируемых хопов; ttl и hop limit
+	// уменьшаются на случайное число от 0 до MaxHops.
+	MaxHops int
+}
+
+func (j Jitter) Enabled() bool {
+	return j.WindowMSSMax > 0 || j.MaxHops > 0
+}
+
+// Apply возвращает копию opts с отклонениями, взятыми из rng. Множитель
+// окна ограничивается так, чтобы окно поместилось в 16 бит. Буфер приема
+// профиля при этом сбрасывается: он подобран под прежнее окно, а без него
+// окно после рукопожатия следует за новым.
+func (j Jitter) Apply(opts *TCPOptions, rng *rand.Rand) *TCPOptions {
+	out := *opts
+	if j.WindowMSSMax > 0 && opts.MSS > 0 {
+		hi := min(j.WindowMSSMax, 65535/int(opts.MSS))
+		lo := max(j.WindowMSSMin, 1)
+		if lo <= hi {
+			out.Window = WindowPolicy{Kind: WindowMSS, Value: lo + rng.IntN(hi-lo+1)}
+			out.ReceiveBuffer = 0
+		}
+	}
+	if j.MaxHops > 0 {
+		hops := rng.IntN(j.MaxHops + 1)
+		out.TTL = decrementTTL(opts.TTL, hops)
+		if opts.HopLimit > 0 {
+			out.HopLimit = decrementTTL(opts.HopLimit, hops)
+		}
+	}
+	return &out
+}
+
+func decrementTTL(ttl uint8, hops int) uint8 {
+	if int(ttl) <= hops {
+		return 1
+	}
+	return ttl - uint8(hops)
+}
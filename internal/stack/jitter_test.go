@@ -0,0 +1,84 @@
+package stack
+
+import (
+	"math/rand/v2"
+	"testing"
+)
+
+func TestJitterTTLFloor(t *testing.T) {
+	opts := &TCPOptions{TTL: 3, HopLimit: 2, MSS: 1460, Window: FixedWindow(8192)}
+	j := Jitter{MaxHops: 10}
+	rng := rand.New(rand.NewPCG(1, 2))
+	lowest := opts.TTL
+	for range 200 {
+		out := j.Apply(opts, rng)
+		if out.TTL < 1 || out.TTL > opts.TTL {
+			t.Fatalf("ttl %d вне [1, %d]", out.TTL, opts.TTL)
+		}
+		if out.HopLimit < 1 || out.HopLimit > opts.HopLimit {
+			t.Fatalf("hop limit %d вне [1, %d]", out.HopLimit, opts.HopLimit)
+		}
+		lowest = min(lowest, out.TTL)
+	}
+	if lowest != 1 {
+		t.Fatalf("наименьший ttl %d, ожидался 1", lowest)
+	}
+	if opts.TTL != 3 || opts.HopLimit != 2 {
+		t.Fatalf("Apply изменил исходный профиль")
+	}
+}
+
+func TestJitterWindowClamp(t *testing.T) {
+	tests := []struct {
+		name     string
+		mss      uint16
+		lo, hi   int
+		min, max int
+	}{
+		{"без ограничения", 1460, 20, 30, 20, 30},
+		{"множитель до 65535/mss", 1460, 40, 100, 40, 65535 / 1460},
+		{"нулевой минимум", 1460, 0, 2, 1, 2},
+	}
+	for _, tt := range tests {
+		opts := &TCPOptions{TTL: 64, MSS: tt.mss, Window: FixedWindow(8192), ReceiveBuffer: 262144}
+		j := Jitter{WindowMSSMin: tt.lo, WindowMSSMax: tt.hi}
+		rng := rand.New(rand.NewPCG(3, 4))
+		seen := make(map[int]bool)
+		for range 500 {
+			out := j.Apply(opts, rng)
+			if out.Window.Kind != WindowMSS {
+				t.Fatalf("%s: окно %s не кратно mss", tt.name, out.Window)
+			}
+			if n := out.Window.Value; n < tt.min || n > tt.max {
+				t.Fatalf("%s: множитель %d вне [%d, %d]", tt.name, n, tt.min, tt.max)
+			}
+			if out.ReceiveBuffer != 0 {
+				t.Fatalf("%s: буфер приема %d остался от прежнего окна", tt.name, out.ReceiveBuffer)
+			}
+			if err := out.Validate(0); err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+			seen[out.Window.Value] = true
+		}
+		if len(seen) != tt.max-tt.min+1 {
+			t.Errorf("%s: получено %d разных множителей из %d", tt.name, len(seen), tt.max-tt.min+1)
+		}
+	}
+}
+
+func TestJitterKeepsWindow(t *testing.T) {
+	opts := &TCPOptions{TTL: 64, Window: FixedWindow(8192), ReceiveBuffer: 262144}
+	rng := rand.New(rand.NewPCG(1, 1))
+
+	// Без mss множитель не к чему применить.
+	if out := (Jitter{WindowMSSMin: 10, WindowMSSMax: 20}).Apply(opts, rng); out.Window != opts.Window {
+		t.Fatalf("окно %s без mss, ожидалось %s", out.Window, opts.Window)
+	}
+	// Минимум больше допустимого максимума: окно остается прежним.
+	opts.MSS = 1460
+	out := (Jitter{WindowMSSMin: 50, WindowMSSMax: 60}).Apply(opts, rng)
+	if out.Window != opts.Window || out.ReceiveBuffer != opts.ReceiveBuffer {
+		t.Fatalf("окно %s и буфер %d при недостижимом минимуме, ожидалось %s и %d",
+			out.Window, out.ReceiveBuffer, opts.Window, opts.ReceiveBuffer)
+	}
+}
@@ -0,0 +1,399 @@
+package stack
+
+import (
+	"encoding/binary"
+	"hash/maphash"
+	"math/rand/v2"
+	"sync"
+	"sync/atomic"
+
+	"gvisor.dev/gvisor/pkg/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/checksum"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/nested"
+	tcpipstack "gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+// fingerprintEndpoint стоит между сетевым стеком и tun и переписывает
+// исходящие SYN так, чтобы каждое поле соответствовало профилю. В ipv6
+// flow label выставляется во всех пакетах соединения, а не только в SYN.
+// Соединения с собственным профилем регистрируются по локальному порту.
+// Окно после рукопожатия ограничивается окном приема профиля: предел
+// вычисляется по SYN-ACK, когда известны согласованные mss и window scale.
+type fingerprintEndpoint struct {
+	nested.Endpoint
+
+	mu      sync.RWMutex
+	opts    *TCPOptions
+	flows   map[flowKey]*TCPOptions
+	windows map[flowKey]uint16
+
+	ipID     atomic.Uint32
+	flowSeed maphash.Seed
+}
+
+func newFingerprintEndpoint(child tcpipstack.LinkEndpoint) *fingerprintEndpoint {
+	e := &fingerprintEndpoint{flowSeed: maphash.MakeSeed()}
+	e.ipID.Store(rand.Uint32())
+	e.Endpoint.Init(child, e)
+	return e
+}
+
+// flowLabel возвращает метку для пакета ipv6. Случайная метка, как в
+// linux и macos, стабильна в пределах соединения: это хеш адресов и портов
+// со случайным ключом.
+func (e *fingerprintEndpoint) flowLabel(mode FlowLabelMode, ipHdr header.IPv6, tcpHdr header.TCP) (uint32, bool) {
+	switch mode {
+	case FlowLabelZero:
+		return 0, true
+	case FlowLabelRandom:
+		var h maphash.Hash
+		h.SetSeed(e.flowSeed)
+		h.Write(ipHdr.SourceAddressSlice())
+		h.Write(ipHdr.DestinationAddressSlice())
+		h.Write(binary.BigEndian.AppendUint32(nil, uint32(tcpHdr.SourcePort())<<16|uint32(tcpHdr.DestinationPort())))
+		if label := uint32(h.Sum64()) & 0xfffff; label != 0 {
+			return label, true
+		}
+		return 1, true
+	}
+	return 0, false
+}
+
+func (e *fingerprintEndpoint) nextIPID(mode IPIDMode) (uint16, bool) {
+	switch mode {
+	case IPIDZero:
+		return 0, true
+	case IPIDIncrement:
+		for {
+			if id := uint16(e.ipID.Add(1)); id != 0 {
+				return id, true
+			}
+		}
+	case IPIDRandom:
+		return uint16(rand.N(0xffff)) + 1, true
+	}
+	return 0, false
+}
+
+func (e *fingerprintEndpoint) setOptions(opts *TCPOptions) {
+	e.mu.Lock()
+	e.opts = opts
+	e.mu.Unlock()
+}
+
+// flowKey - локальный порт соединения стека в своем семействе.
+type flowKey struct {
+	v6   bool
+	port uint16
+}
+
+func (e *fingerprintEndpoint) registerFlow(key flowKey, opts *TCPOptions) {
+	e.mu.Lock()
+	if e.flows == nil {
+		e.flows = make(map[flowKey]*TCPOptions)
+	}
+	e.flows[key] = opts
+	e.mu.Unlock()
+}
+
+func (e *fingerprintEndpoint) unregisterFlow(key flowKey) {
+	e.mu.Lock()
+	delete(e.flows, key)
+	delete(e.windows, key)
+	e.mu.Unlock()
+}
+
+// forgetWindow снимает предел окна, когда порт начинает новое соединение
+// или сбрасывает старое.
+func (e *fingerprintEndpoint) forgetWindow(key flowKey) {
+	e.mu.Lock()
+	delete(e.windows, key)
+	e.mu.Unlock()
+}
+
+func (e *fingerprintEndpoint) options() *TCPOptions {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.opts
+}
+
+// packetOptions возвращает профиль соединения, которому принадлежит пакет
+// tcp, или профиль стека, а также предел поля окна; 0 - предела нет.
+func (e *fingerprintEndpoint) packetOptions(pkt *tcpipstack.PacketBuffer, opts *TCPOptions) (*TCPOptions, uint16) {
+	tcpHdr := pkt.TransportHeader().Slice()
+	if len(tcpHdr) < 2 {
+		return opts, 0
+	}
+	key := flowKey{
+		v6:   pkt.NetworkProtocolNumber == header.IPv6ProtocolNumber,
+		port: header.TCP(tcpHdr).SourcePort(),
+	}
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	if flowOpts, ok := e.flows[key]; ok {
+		opts = flowOpts
+	}
+	return opts, e.windows[key]
+}
+
+// DeliverNetworkPacket смотрит входящие SYN-ACK и по ним задает предел
+// окна соединения.
+func (e *fingerprintEndpoint) DeliverNetworkPacket(protocol tcpip.NetworkProtocolNumber, pkt *tcpipstack.PacketBuffer) {
+	if opts := e.options(); opts != nil {
+		e.trackSYNACK(protocol, pkt, opts)
+	}
+	e.Endpoint.DeliverNetworkPacket(protocol, pkt)
+}
+
+func (e *fingerprintEndpoint) trackSYNACK(protocol tcpip.NetworkProtocolNumber, pkt *tcpipstack.PacketBuffer, opts *TCPOptions) {
+	var ipHdrLen int
+	switch protocol {
+	case header.IPv4ProtocolNumber:
+		b, ok := pkt.Data().PullUp(header.IPv4MinimumSize)
+		if !ok {
+			return
+		}
+		ipHdr := header.IPv4(b)
+		if ipHdr.TransportProtocol() != header.TCPProtocolNumber || ipHdr.FragmentOffset() != 0 || ipHdr.More() {
+			return
+		}
+		ipHdrLen = int(ipHdr.HeaderLength())
+	case header.IPv6ProtocolNumber:
+		b, ok := pkt.Data().PullUp(header.IPv6MinimumSize)
+		if !ok || header.IPv6(b).TransportProtocol() != header.TCPProtocolNumber {
+			return
+		}
+		ipHdrLen = header.IPv6MinimumSize
+	default:
+		return
+	}
+
+	b, ok := pkt.Data().PullUp(ipHdrLen + header.TCPMinimumSize)
+	if !ok {
+		return
+	}
+	tcpHdr := header.TCP(b[ipHdrLen:])
+	if tcpHdr.Flags()&(header.TCPFlagSyn|header.TCPFlagAck|header.TCPFlagRst) != header.TCPFlagSyn|header.TCPFlagAck {
+		return
+	}
+	tcpHdrLen := int(tcpHdr.DataOffset())
+	if tcpHdrLen < header.TCPMinimumSize {
+		return
+	}
+	if b, ok = pkt.Data().PullUp(ipHdrLen + tcpHdrLen); !ok {
+		return
+	}
+	tcpHdr = header.TCP(b[ipHdrLen:])
+	peer := header.ParseSynOptions(tcpHdr.Options(), true)
+
+	key := flowKey{v6: protocol == header.IPv6ProtocolNumber, port: tcpHdr.DestinationPort()}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if flowOpts, ok := e.flows[key]; ok {
+		opts = flowOpts
+	}
+	mss := opts.SYNMSS(key.v6)
+	if mss == 0 || peer.MSS < mss {
+		mss = peer.MSS
+	}
+	if e.windows == nil {
+		e.windows = make(map[flowKey]uint16)
+	}
+	e.windows[key] = opts.ReceiveWindowField(int(mss), peer.WS >= 0)
+}
+
+func (e *fingerprintEndpoint) WritePackets(pkts tcpipstack.PacketBufferList) (int, tcpip.Error) {
+	opts := e.options()
+	if opts == nil {
+		return e.Endpoint.WritePackets(pkts)
+	}
+
+	var out tcpipstack.PacketBufferList
+	var rewritten []*tcpipstack.PacketBuffer
+	for _, pkt := range pkts.AsSlice() {
+		opts, window := opts, uint16(0)
+		if pkt.TransportProtocolNumber == header.TCPProtocolNumber {
+			opts, window = e.packetOptions(pkt, opts)
+		}
+		if !isOutgoingSYN(pkt) {
+			if window != 0 {
+				e.limitWindow(pkt, window)
+			}
+			if isOutgoingTCPv6(pkt) {
+				e.setFlowLabel(header.IPv6(pkt.NetworkHeader().Slice()), header.TCP(pkt.TransportHeader().Slice()), opts)
+			}
+			out.PushBack(pkt)
+			continue
+		}
+
+		e.forgetWindow(flowKey{
+			v6:   pkt.NetworkProtocolNumber == header.IPv6ProtocolNumber,
+			port: header.TCP(pkt.TransportHeader().Slice()).SourcePort(),
+		})
+		raw := make([]byte, 0, pkt.Size())
+		for _, s := range pkt.AsSlices() {
+			raw = append(raw, s...)
+		}
+		if pkt.NetworkProtocolNumber == header.IPv6ProtocolNumber {
+			raw = rewriteSYN6(raw, opts)
+			e.setFlowLabel(header.IPv6(raw), header.TCP(raw[header.IPv6MinimumSize:]), opts)
+		} else {
+			raw = rewriteSYN(raw, opts, e.nextIPID)
+		}
+
+		newPkt := tcpipstack.NewPacketBuffer(tcpipstack.PacketBufferOptions{
+			Payload: buffer.MakeWithData(raw),
+		})
+		newPkt.NetworkProtocolNumber = pkt.NetworkProtocolNumber
+		newPkt.Hash = pkt.Hash
+		out.PushBack(newPkt)
+		rewritten = append(rewritten, newPkt)
+	}
+
+	n, err := e.Endpoint.WritePackets(out)
+	for _, pkt := range rewritten {
+		pkt.DecRef()
+	}
+	return n, err
+}
+
+// limitWindow уменьшает окно в заголовке tcp до window и поправляет
+// контрольную сумму по RFC 1624. Сбросом соединение заканчивается, и предел
+// порта снимается.
+func (e *fingerprintEndpoint) limitWindow(pkt *tcpipstack.PacketBuffer, window uint16) {
+	tcpHdr := header.TCP(pkt.TransportHeader().Slice())
+	if len(tcpHdr) < header.TCPMinimumSize {
+		return
+	}
+	if tcpHdr.Flags()&header.TCPFlagRst != 0 {
+		e.forgetWindow(flowKey{v6: pkt.NetworkProtocolNumber == header.IPv6ProtocolNumber, port: tcpHdr.SourcePort()})
+		return
+	}
+	old := tcpHdr.WindowSize()
+	if old <= window {
+		return
+	}
+	xsum := checksum.Combine(^tcpHdr.Checksum(), ^old)
+	tcpHdr.SetWindowSize(window)
+	tcpHdr.SetChecksum(^checksum.Combine(xsum, window))
+}
+
+// setFlowLabel меняет метку прямо в заголовке: она не входит в
+// контрольную сумму tcp.
+func (e *fingerprintEndpoint) setFlowLabel(ipHdr header.IPv6, tcpHdr header.TCP, opts *TCPOptions) {
+	if label, ok := e.flowLabel(opts.FlowLabel, ipHdr, tcpHdr); ok {
+		tc, _ := ipHdr.TOS()
+		ipHdr.SetTOS(tc, label)
+	}
+}
+
+func isOutgoingTCPv6(pkt *tcpipstack.PacketBuffer) bool {
+	return pkt.NetworkProtocolNumber == header.IPv6ProtocolNumber &&
+		pkt.TransportProtocolNumber == header.TCPProtocolNumber &&
+		len(pkt.NetworkHeader().Slice()) >= header.IPv6MinimumSize &&
+		len(pkt.TransportHeader().Slice()) >= 4
+}
+
+func isOutgoingSYN(pkt *tcpipstack.PacketBuffer) bool {
+	if pkt.NetworkProtocolNumber != header.IPv4ProtocolNumber && pkt.NetworkProtocolNumber != header.IPv6ProtocolNumber {
+		return false
+	}
+	if pkt.TransportProtocolNumber != header.TCPProtocolNumber {
+		return false
+	}
+	if pkt.NetworkProtocolNumber == header.IPv6ProtocolNumber && len(pkt.NetworkHeader().Slice()) != header.IPv6MinimumSize {
+		// Заголовки расширения gvisor для tcp не добавляет; такой пакет
+		// пропускается без изменений.
+		return false
+	}
+	tcpHdr := header.TCP(pkt.TransportHeader().Slice())
+	if len(tcpHdr) < header.TCPMinimumSize {
+		return false
+	}
+	return tcpHdr.Flags()&(header.TCPFlagSyn|header.TCPFlagAck) == header.TCPFlagSyn
+}
+
+// rewriteSYN собирает SYN заново: опции выкладываются по раскладке профиля
+// байт в байт, значения mss и ws берутся из профиля, временные метки - из
+// исходного пакета стека. DF и ip id выставляются по профилю.
+func rewriteSYN(raw []byte, opts *TCPOptions, nextIPID func(IPIDMode) (uint16, bool)) []byte {
+	ipHdr := header.IPv4(raw)
+	ipHdrLen := int(ipHdr.HeaderLength())
+	tcpHdr := header.TCP(raw[ipHdrLen:ipHdr.TotalLength()])
+	tcpHdrLen := int(tcpHdr.DataOffset())
+
+	parsed := header.ParseSynOptions(tcpHdr.Options(), false)
+	options := opts.Layout().encode(synOptionValues{
+		mss:   opts.MSS,
+		ws:    opts.WindowScaleValue,
+		tsVal: parsed.TSVal,
+		tsEcr: parsed.TSEcr,
+	})
+
+	out := make([]byte, 0, ipHdrLen+header.TCPMinimumSize+len(options)+len(tcpHdr)-tcpHdrLen)
+	out = append(out, raw[:ipHdrLen]...)
+	out = append(out, tcpHdr[:header.TCPMinimumSize]...)
+	out = append(out, options...)
+	out = append(out, tcpHdr[tcpHdrLen:]...)
+
+	ipHdr = header.IPv4(out)
+	ipHdr.SetTotalLength(uint16(len(out)))
+	flags := ipHdr.Flags() &^ header.IPv4FlagDontFragment
+	if opts.DontFragment {
+		flags |= header.IPv4FlagDontFragment
+	}
+	ipHdr.SetFlagsFragmentOffset(flags, 0)
+	if id, ok := nextIPID(opts.IPID); ok {
+		ipHdr.SetID(id)
+	}
+	tcpHdr = header.TCP(out[ipHdrLen:])
+	tcpHdr.SetDataOffset(uint8(header.TCPMinimumSize + len(options)))
+	tcpHdr.SetWindowSize(opts.SYNWindow(false))
+
+	ipHdr.SetChecksum(0)
+	ipHdr.SetChecksum(^ipHdr.CalculateChecksum())
+
+	tcpHdr.SetChecksum(0)
+	xsum := header.PseudoHeaderChecksum(header.TCPProtocolNumber,
+		ipHdr.SourceAddress(), ipHdr.DestinationAddress(), uint16(len(tcpHdr)))
+	tcpHdr.SetChecksum(^checksum.Checksum(tcpHdr, xsum))
+
+	return out
+}
+
+// rewriteSYN6 делает то же для ipv6: полей DF и ip id здесь нет, а mss
+// берется с поправкой на размер заголовка.
+func rewriteSYN6(raw []byte, opts *TCPOptions) []byte {
+	ipHdr := header.IPv6(raw)
+	tcpHdr := header.TCP(raw[header.IPv6MinimumSize : header.IPv6MinimumSize+int(ipHdr.PayloadLength())])
+	tcpHdrLen := int(tcpHdr.DataOffset())
+
+	parsed := header.ParseSynOptions(tcpHdr.Options(), false)
+	options := opts.Layout().encode(synOptionValues{
+		mss:   opts.IPv6MSS(),
+		ws:    opts.WindowScaleValue,
+		tsVal: parsed.TSVal,
+		tsEcr: parsed.TSEcr,
+	})
+
+	out := make([]byte, 0, header.IPv6MinimumSize+header.TCPMinimumSize+len(options)+len(tcpHdr)-tcpHdrLen)
+	out = append(out, raw[:header.IPv6MinimumSize]...)
+	out = append(out, tcpHdr[:header.TCPMinimumSize]...)
+	out = append(out, options...)
+	out = append(out, tcpHdr[tcpHdrLen:]...)
+
+	ipHdr = header.IPv6(out)
+	ipHdr.SetPayloadLength(uint16(len(out) - header.IPv6MinimumSize))
+	tcpHdr = header.TCP(out[header.IPv6MinimumSize:])
+	tcpHdr.SetDataOffset(uint8(header.TCPMinimumSize + len(options)))
+	tcpHdr.SetWindowSize(opts.SYNWindow(true))
+
+	tcpHdr.SetChecksum(0)
+	xsum := header.PseudoHeaderChecksum(header.TCPProtocolNumber,
+		ipHdr.SourceAddress(), ipHdr.DestinationAddress(), uint16(len(tcpHdr)))
+	tcpHdr.SetChecksum(^checksum.Checksum(tcpHdr, xsum))
+
+	return out
+}
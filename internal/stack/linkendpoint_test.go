@@ -0,0 +1,275 @@
+package stack
+
+import (
+	"bytes"
+	"testing"
+
+	"gvisor.dev/gvisor/pkg/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/checksum"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	tcpipstack "gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+var (
+	testSrc4 = tcpip.AddrFrom4([4]byte{10, 210, 0, 1})
+	testDst4 = tcpip.AddrFrom4([4]byte{10, 210, 0, 2})
+	testSrc6 = tcpip.AddrFrom16([16]byte{0x20, 0x01, 0x0d, 0xb8, 15: 1})
+	testDst6 = tcpip.AddrFrom16([16]byte{0x20, 0x01, 0x0d, 0xb8, 15: 2})
+)
+
+const (
+	testTSVal = 0x01020304
+	testTSEcr = 0
+)
+
+// gvisorSYNOptions - опции SYN в том виде, в каком их пишет gvisor: mss,
+// ws, ts и sack permitted, каждая выровнена nop.
+func gvisorSYNOptions(mss uint16) []byte {
+	b := make([]byte, 24)
+	i := header.EncodeMSSOption(uint32(mss), b)
+	i += header.EncodeNOP(b[i:])
+	i += header.EncodeWSOption(7, b[i:])
+	i += header.EncodeNOP(b[i:])
+	i += header.EncodeNOP(b[i:])
+	i += header.EncodeTSOption(testTSVal, testTSEcr, b[i:])
+	i += header.EncodeNOP(b[i:])
+	i += header.EncodeNOP(b[i:])
+	header.EncodeSACKPermittedOption(b[i:])
+	return b
+}
+
+func encodeSYN(tcpHdr header.TCP, options []byte) {
+	tcpHdr.Encode(&header.TCPFields{
+		SrcPort:    40000,
+		DstPort:    8000,
+		SeqNum:     1000,
+		DataOffset: uint8(header.TCPMinimumSize + len(options)),
+		Flags:      header.TCPFlagSyn,
+		WindowSize: 65535,
+	})
+	copy(tcpHdr[header.TCPMinimumSize:], options)
+}
+
+// gvisorSYN4 собирает SYN ipv4, каким его отправляет стек с ttl ttl.
+func gvisorSYN4(ttl uint8) []byte {
+	options := gvisorSYNOptions(65495)
+	raw := make([]byte, header.IPv4MinimumSize+header.TCPMinimumSize+len(options))
+	ipHdr := header.IPv4(raw)
+	ipHdr.Encode(&header.IPv4Fields{
+		TotalLength: uint16(len(raw)),
+		ID:          0x4242,
+		Flags:       header.IPv4FlagDontFragment,
+		TTL:         ttl,
+		Protocol:    uint8(header.TCPProtocolNumber),
+		SrcAddr:     testSrc4,
+		DstAddr:     testDst4,
+	})
+	ipHdr.SetChecksum(^ipHdr.CalculateChecksum())
+	tcpHdr := header.TCP(raw[header.IPv4MinimumSize:])
+	encodeSYN(tcpHdr, options)
+	xsum := header.PseudoHeaderChecksum(header.TCPProtocolNumber, testSrc4, testDst4, uint16(len(tcpHdr)))
+	tcpHdr.SetChecksum(^tcpHdr.CalculateChecksum(xsum))
+	return raw
+}
+
+func gvisorSYN6(hopLimit uint8) []byte {
+	options := gvisorSYNOptions(65475)
+	raw := make([]byte, header.IPv6MinimumSize+header.TCPMinimumSize+len(options))
+	header.IPv6(raw).Encode(&header.IPv6Fields{
+		PayloadLength:     uint16(len(raw) - header.IPv6MinimumSize),
+		TransportProtocol: header.TCPProtocolNumber,
+		HopLimit:          hopLimit,
+		SrcAddr:           testSrc6,
+		DstAddr:           testDst6,
+	})
+	tcpHdr := header.TCP(raw[header.IPv6MinimumSize:])
+	encodeSYN(tcpHdr, options)
+	xsum := header.PseudoHeaderChecksum(header.TCPProtocolNumber, testSrc6, testDst6, uint16(len(tcpHdr)))
+	tcpHdr.SetChecksum(^tcpHdr.CalculateChecksum(xsum))
+	return raw
+}
+
+func TestRewriteSYN(t *testing.T) {
+	noDF, err := GetTCPOptions("macos", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	noDF.DontFragment = false
+	noDF.IPID = IPIDStack
+
+	tests := []struct {
+		name    string
+		opts    *TCPOptions
+		options []byte
+		window  uint16
+		id      uint16
+	}{
+		{"windows10", mustTCPOptions(t, "windows10"), []byte{
+			2, 4, 0x05, 0xb4, 1, 3, 3, 8, 1, 1, 4, 2,
+		}, 64240, 7},
+		{"linux", mustTCPOptions(t, "linux"), []byte{
+			2, 4, 0x05, 0xb4, 4, 2, 8, 10, 1, 2, 3, 4, 0, 0, 0, 0, 1, 3, 3, 7,
+		}, 29200, 7},
+		// eol+1 дает байт EOL и байт нулевого заполнения.
+		{"macos без df и ip id", noDF, []byte{
+			2, 4, 0x05, 0xb4, 1, 3, 3, 6, 1, 1, 8, 10, 1, 2, 3, 4, 0, 0, 0, 0, 4, 2, 0, 0,
+		}, 65535, 0x4242},
+	}
+	for _, tt := range tests {
+		ttl := forwardedTTL(tt.opts.TTL)
+		var gotMode IPIDMode = -1
+		out := rewriteSYN(gvisorSYN4(ttl), tt.opts, func(mode IPIDMode) (uint16, bool) {
+			gotMode = mode
+			return 7, mode != IPIDStack
+		})
+
+		ipHdr := header.IPv4(out)
+		if !ipHdr.IsValid(len(out)) || int(ipHdr.TotalLength()) != len(out) {
+			t.Errorf("%s: неверный заголовок ip: длина %d при %d байт", tt.name, ipHdr.TotalLength(), len(out))
+			continue
+		}
+		if !ipHdr.IsChecksumValid() {
+			t.Errorf("%s: неверная контрольная сумма ip", tt.name)
+		}
+		if ipHdr.TTL() != ttl || wireTTL(ipHdr.TTL()) != tt.opts.TTL {
+			t.Errorf("%s: ttl %d, ожидалось %d", tt.name, ipHdr.TTL(), ttl)
+		}
+		if df := ipHdr.Flags()&header.IPv4FlagDontFragment != 0; df != tt.opts.DontFragment {
+			t.Errorf("%s: df %v, ожидалось %v", tt.name, df, tt.opts.DontFragment)
+		}
+		if gotMode != tt.opts.IPID {
+			t.Errorf("%s: режим ip id %v, ожидался %v", tt.name, gotMode, tt.opts.IPID)
+		}
+		if ipHdr.ID() != tt.id {
+			t.Errorf("%s: ip id %#x, ожидалось %#x", tt.name, ipHdr.ID(), tt.id)
+		}
+
+		tcpHdr := header.TCP(ipHdr.Payload())
+		if got := tcpHdr.Options(); !bytes.Equal(got, tt.options) {
+			t.Errorf("%s: опции % x, ожидалось % x", tt.name, got, tt.options)
+		}
+		if tcpHdr.WindowSize() != tt.window {
+			t.Errorf("%s: окно %d, ожидалось %d", tt.name, tcpHdr.WindowSize(), tt.window)
+		}
+		if tcpHdr.SourcePort() != 40000 || tcpHdr.SequenceNumber() != 1000 || tcpHdr.Flags() != header.TCPFlagSyn {
+			t.Errorf("%s: поля tcp изменились: порт %d, seq %d, флаги %v", tt.name,
+				tcpHdr.SourcePort(), tcpHdr.SequenceNumber(), tcpHdr.Flags())
+		}
+		if !tcpHdr.IsChecksumValid(testSrc4, testDst4, 0, 0) {
+			t.Errorf("%s: неверная контрольная сумма tcp", tt.name)
+		}
+	}
+}
+
+func TestRewriteSYN6(t *testing.T) {
+	opts := mustTCPOptions(t, "linux")
+	hopLimit := forwardedTTL(opts.IPv6HopLimit())
+	out := rewriteSYN6(gvisorSYN6(hopLimit), opts)
+
+	ipHdr := header.IPv6(out)
+	if !ipHdr.IsValid(len(out)) || int(ipHdr.PayloadLength()) != len(out)-header.IPv6MinimumSize {
+		t.Fatalf("неверный заголовок ipv6: длина %d при %d байт", ipHdr.PayloadLength(), len(out))
+	}
+	if ipHdr.HopLimit() != hopLimit {
+		t.Errorf("hop limit %d, ожидалось %d", ipHdr.HopLimit(), hopLimit)
+	}
+	tcpHdr := header.TCP(ipHdr.Payload())
+	// mss ipv6 на 20 байт меньше: 1440.
+	want := []byte{2, 4, 0x05, 0xa0, 4, 2, 8, 10, 1, 2, 3, 4, 0, 0, 0, 0, 1, 3, 3, 7}
+	if got := tcpHdr.Options(); !bytes.Equal(got, want) {
+		t.Errorf("опции % x, ожидалось % x", got, want)
+	}
+	if tcpHdr.WindowSize() != 28800 {
+		t.Errorf("окно %d, ожидалось 28800", tcpHdr.WindowSize())
+	}
+	if !tcpHdr.IsChecksumValid(testSrc6, testDst6, 0, 0) {
+		t.Error("неверная контрольная сумма tcp")
+	}
+}
+
+// tcpPacket собирает пакет ipv4 с сегментом данных так, как его отдает
+// стек: заголовки разобраны, контрольная сумма tcp посчитана полностью.
+func tcpPacket(t *testing.T, flags header.TCPFlags, window uint16, payload []byte) *tcpipstack.PacketBuffer {
+	t.Helper()
+	pkt := tcpipstack.NewPacketBuffer(tcpipstack.PacketBufferOptions{
+		ReserveHeaderBytes: header.IPv4MinimumSize + header.TCPMinimumSize,
+		Payload:            buffer.MakeWithData(payload),
+	})
+	t.Cleanup(pkt.DecRef)
+	tcpHdr := header.TCP(pkt.TransportHeader().Push(header.TCPMinimumSize))
+	pkt.TransportProtocolNumber = header.TCPProtocolNumber
+	tcpHdr.Encode(&header.TCPFields{
+		SrcPort:    40000,
+		DstPort:    8000,
+		SeqNum:     1001,
+		AckNum:     5001,
+		DataOffset: header.TCPMinimumSize,
+		Flags:      flags,
+		WindowSize: window,
+	})
+	tcpHdr.SetChecksum(^fullTCPChecksum(tcpHdr, payload))
+
+	ipHdr := header.IPv4(pkt.NetworkHeader().Push(header.IPv4MinimumSize))
+	pkt.NetworkProtocolNumber = header.IPv4ProtocolNumber
+	ipHdr.Encode(&header.IPv4Fields{
+		TotalLength: uint16(pkt.Size()),
+		TTL:         65,
+		Protocol:    uint8(header.TCPProtocolNumber),
+		SrcAddr:     testSrc4,
+		DstAddr:     testDst4,
+	})
+	return pkt
+}
+
+// fullTCPChecksum считает сумму сегмента с нуля, без поля контрольной суммы.
+func fullTCPChecksum(tcpHdr header.TCP, payload []byte) uint16 {
+	hdr := append(header.TCP(nil), tcpHdr...)
+	hdr.SetChecksum(0)
+	xsum := header.PseudoHeaderChecksum(header.TCPProtocolNumber, testSrc4, testDst4, uint16(len(hdr)+len(payload)))
+	xsum = checksum.Combine(xsum, checksum.Checksum(payload, 0))
+	return hdr.CalculateChecksum(xsum)
+}
+
+func TestLimitWindowChecksum(t *testing.T) {
+	payload := []byte("GET / HTTP/1.1\r\n\r\n")
+	tests := []struct {
+		name   string
+		flags  header.TCPFlags
+		window uint16
+		limit  uint16
+		want   uint16
+	}{
+		{"окно уменьшается", header.TCPFlagAck, 64240, 1024, 1024},
+		{"большое окно до 1", header.TCPFlagAck | header.TCPFlagPsh, 0xffff, 1, 1},
+		{"окно 0xff00", header.TCPFlagAck, 0xff00, 0x00ff, 0x00ff},
+		{"окно меньше предела", header.TCPFlagAck, 512, 1024, 512},
+		{"сброс не меняется", header.TCPFlagRst | header.TCPFlagAck, 64240, 1024, 64240},
+	}
+	for _, tt := range tests {
+		e := &fingerprintEndpoint{windows: map[flowKey]uint16{{port: 40000}: tt.limit}}
+		pkt := tcpPacket(t, tt.flags, tt.window, payload)
+		e.limitWindow(pkt, tt.limit)
+
+		tcpHdr := header.TCP(pkt.TransportHeader().Slice())
+		if tcpHdr.WindowSize() != tt.want {
+			t.Errorf("%s: окно %d, ожидалось %d", tt.name, tcpHdr.WindowSize(), tt.want)
+		}
+		if got, want := tcpHdr.Checksum(), ^fullTCPChecksum(tcpHdr, payload); got != want {
+			t.Errorf("%s: контрольная сумма %#04x, полный пересчет дает %#04x", tt.name, got, want)
+		}
+		_, limited := e.windows[flowKey{port: 40000}]
+		if reset := tt.flags&header.TCPFlagRst != 0; limited == reset {
+			t.Errorf("%s: предел окна сохранен: %v", tt.name, limited)
+		}
+	}
+}
+
+func mustTCPOptions(t *testing.T, name string) *TCPOptions {
+	t.Helper()
+	opts, err := GetTCPOptions(name, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return opts
+}
@@ -0,0 +1,261 @@
+package stack
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+type OptionKind uint8
+
+const (
+	OptionEOL OptionKind = iota
+	OptionNOP
+	OptionMSS
+	OptionWS
+	OptionSACKPermitted
+	OptionTS
+)
+
+const maxTCPOptionsLength = header.TCPHeaderMaximumSize - header.TCPMinimumSize
+
+// OptionLayout описывает точный порядок опций в SYN. EOLPadding - число
+// нулевых байт после EOL, как в записи eol+N у p0f.
+type OptionLayout struct {
+	Kinds      []OptionKind
+	EOLPadding int
+}
+
+func ParseOptionLayout(s string) (OptionLayout, error) {
+	var layout OptionLayout
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return layout, nil
+	}
+
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if layout.hasEOL() {
+			return OptionLayout{}, fmt.Errorf("опция %q после eol", item)
+		}
+
+		name, pad, hasPad := strings.Cut(item, "+")
+		switch strings.ToLower(name) {
+		case "eol", "e":
+			layout.Kinds = append(layout.Kinds, OptionEOL)
+			if hasPad {
+				n, err := strconv.Atoi(pad)
+				if err != nil || n < 0 {
+					return OptionLayout{}, fmt.Errorf("некорректное выравнивание после eol: %q", item)
+				}
+				layout.EOLPadding = n
+			}
+			continue
+		case "nop", "n":
+			layout.Kinds = append(layout.Kinds, OptionNOP)
+		case "mss", "m":
+			layout.Kinds = append(layout.Kinds, OptionMSS)
+		case "ws", "w":
+			layout.Kinds = append(layout.Kinds, OptionWS)
+		case "sok", "s":
+			layout.Kinds = append(layout.Kinds, OptionSACKPermitted)
+		case "ts", "t":
+			layout.Kinds = append(layout.Kinds, OptionTS)
+		default:
+			return OptionLayout{}, fmt.Errorf("неизвестная tcp опция в раскладке: %q", item)
+		}
+		if hasPad {
+			return OptionLayout{}, fmt.Errorf("выравнивание допустимо только после eol: %q", item)
+		}
+	}
+
+	if err := layout.Validate(); err != nil {
+		return OptionLayout{}, err
+	}
+	return layout, nil
+}
+
+func MustParseOptionLayout(s string) OptionLayout {
+	layout, err := ParseOptionLayout(s)
+	if err != nil {
+		panic(err)
+	}
+	return layout
+}
+
+func (l OptionLayout) String() string {
+	parts := make([]string, 0, len(l.Kinds))
+	for _, kind := range l.Kinds {
+		switch kind {
+		case OptionEOL:
+			parts = append(parts, fmt.Sprintf("eol+%d", l.EOLPadding))
+		case OptionNOP:
+			parts = append(parts, "nop")
+		case OptionMSS:
+			parts = append(parts, "mss")
+		case OptionWS:
+			parts = append(parts, "ws")
+		case OptionSACKPermitted:
+			parts = append(parts, "sok")
+		case OptionTS:
+			parts = append(parts, "ts")
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+func (l OptionLayout) IsEmpty() bool {
+	return len(l.Kinds) == 0
+}
+
+func (l OptionLayout) Has(kind OptionKind) bool {
+	for _, k := range l.Kinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+func (l OptionLayout) hasEOL() bool {
+	return l.Has(OptionEOL)
+}
+
+// Length возвращает длину опций в байтах с учетом выравнивания до 4 байт.
+func (l OptionLayout) Length() int {
+	n := l.EOLPadding
+	for _, kind := range l.Kinds {
+		n += optionLength(kind)
+	}
+	return (n + 3) &^ 3
+}
+
+func (l OptionLayout) Validate() error {
+	if n := l.Length(); n > maxTCPOptionsLength {
+		return fmt.Errorf("раскладка опций %s занимает %d байт, максимум %d", l, n, maxTCPOptionsLength)
+	}
+	return nil
+}
+
+func optionLength(kind OptionKind) int {
+	switch kind {
+	case OptionEOL, OptionNOP:
+		return 1
+	case OptionMSS:
+		return header.TCPOptionMSSLength
+	case OptionWS:
+		return header.TCPOptionWSLength
+	case OptionSACKPermitted:
+		return header.TCPOptionSackPermittedLength
+	case OptionTS:
+		return header.TCPOptionTSLength
+	}
+	return 0
+}
+
+// defaultOptionLayout повторяет tcp_options_write из linux для заданного
+// набора включенных опций.
+func defaultOptionLayout(opts *TCPOptions) OptionLayout {
+	kinds := []OptionKind{OptionMSS}
+	switch {
+	case opts.TimestampsEnabled && opts.SACKEnabled:
+		kinds = append(kinds, OptionSACKPermitted, OptionTS)
+	case opts.TimestampsEnabled:
+		kinds = append(kinds, OptionNOP, OptionNOP, OptionTS)
+	case opts.SACKEnabled:
+		kinds = append(kinds, OptionNOP, OptionNOP, OptionSACKPermitted)
+	}
+	if opts.WindowScaleEnabled {
+		kinds = append(kinds, OptionNOP, OptionWS)
+	}
+	return OptionLayout{Kinds: kinds}
+}
+
+type synOptionValues struct {
+	mss   uint16
+	ws    uint8
+	tsVal uint32
+	tsEcr uint32
+}
+
+// encode записывает опции строго в порядке раскладки; хвост до границы
+// 4 байт заполняется нулями.
+func (l OptionLayout) encode(v synOptionValues) []byte {
+	b := make([]byte, l.Length())
+	i := 0
+	for _, kind := range l.Kinds {
+		switch kind {
+		case OptionEOL:
+			b[i] = header.TCPOptionEOL
+			i += 1 + l.EOLPadding
+		case OptionNOP:
+			b[i] = header.TCPOptionNOP
+			i++
+		case OptionMSS:
+			b[i], b[i+1] = header.TCPOptionMSS, header.TCPOptionMSSLength
+			binary.BigEndian.PutUint16(b[i+2:], v.mss)
+			i += header.TCPOptionMSSLength
+		case OptionWS:
+			b[i], b[i+1], b[i+2] = header.TCPOptionWS, header.TCPOptionWSLength, v.ws
+			i += header.TCPOptionWSLength
+		case OptionSACKPermitted:
+			b[i], b[i+1] = header.TCPOptionSACKPermitted, header.TCPOptionSackPermittedLength
+			i += header.TCPOptionSackPermittedLength
+		case OptionTS:
+			b[i], b[i+1] = header.TCPOptionTS, header.TCPOptionTSLength
+			binary.BigEndian.PutUint32(b[i+2:], v.tsVal)
+			binary.BigEndian.PutUint32(b[i+6:], v.tsEcr)
+			i += header.TCPOptionTSLength
+		}
+	}
+	return b
+}
+
+// With возвращает раскладку, в которой опция kind включена или выключена.
+// Выключенная опция удаляется вместе с nop, стоящими прямо перед ней;
+// включенная добавляется перед eol с выравниванием, как это делает linux.
+func (l OptionLayout) With(kind OptionKind, enabled bool) OptionLayout {
+	if kind == OptionEOL || kind == OptionNOP || l.Has(kind) == enabled {
+		return l
+	}
+
+	out := OptionLayout{EOLPadding: l.EOLPadding}
+	if !enabled {
+		for _, k := range l.Kinds {
+			if k == kind {
+				for len(out.Kinds) > 0 && out.Kinds[len(out.Kinds)-1] == OptionNOP {
+					out.Kinds = out.Kinds[:len(out.Kinds)-1]
+				}
+				continue
+			}
+			out.Kinds = append(out.Kinds, k)
+		}
+		return out
+	}
+
+	if kind == OptionMSS {
+		out.Kinds = append([]OptionKind{OptionMSS}, l.Kinds...)
+		return out
+	}
+
+	var added []OptionKind
+	switch kind {
+	case OptionWS:
+		added = []OptionKind{OptionNOP, OptionWS}
+	default:
+		added = []OptionKind{OptionNOP, OptionNOP, kind}
+	}
+	for i, k := range l.Kinds {
+		if k == OptionEOL {
+			out.Kinds = append(out.Kinds, added...)
+			out.Kinds = append(out.Kinds, l.Kinds[i:]...)
+			return out
+		}
+		out.Kinds = append(out.Kinds, k)
+	}
+	out.Kinds = append(out.Kinds, added...)
+	return out
+}
@@ -0,0 +1,184 @@
+package stack
+
+import (
+	"bytes"
+	"testing"
+
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+var testOptionValues = synOptionValues{mss: 1460, ws: 7, tsVal: 0x01020304, tsEcr: 0}
+
+// Опции SYN настоящих ОС, байт в байт, с testOptionValues.
+var knownLayouts = []struct {
+	name   string
+	layout string
+	bytes  []byte
+}{
+	{"linux", "mss,sok,ts,nop,ws", []byte{
+		2, 4, 0x05, 0xb4,
+		4, 2,
+		8, 10, 1, 2, 3, 4, 0, 0, 0, 0,
+		1,
+		3, 3, 7,
+	}},
+	{"windows", "mss,nop,ws,nop,nop,sok", []byte{
+		2, 4, 0x05, 0xb4,
+		1,
+		3, 3, 7,
+		1, 1,
+		4, 2,
+	}},
+	{"macos", "mss,nop,ws,nop,nop,ts,sok,eol+1", []byte{
+		2, 4, 0x05, 0xb4,
+		1,
+		3, 3, 7,
+		1, 1,
+		8, 10, 1, 2, 3, 4, 0, 0, 0, 0,
+		4, 2,
+		0, 0,
+	}},
+}
+
+func TestOptionLayoutKnownOS(t *testing.T) {
+	for _, tt := range knownLayouts {
+		l, err := ParseOptionLayout(tt.layout)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got := l.String(); got != tt.layout {
+			t.Errorf("%s: String = %q, ожидалось %q", tt.name, got, tt.layout)
+		}
+		b := l.encode(testOptionValues)
+		if !bytes.Equal(b, tt.bytes) {
+			t.Errorf("%s: encode = %v\nожидалось %v", tt.name, b, tt.bytes)
+		}
+		if l.Length() != len(tt.bytes) {
+			t.Errorf("%s: Length = %d, ожидалось %d", tt.name, l.Length(), len(tt.bytes))
+		}
+
+		// Значения читаются обратно разбором gvisor.
+		syn := header.ParseSynOptions(b, false)
+		if syn.MSS != 1460 || syn.WS != 7 || !syn.SACKPermitted {
+			t.Errorf("%s: разобрано %+v", tt.name, syn)
+		}
+		if l.Has(OptionTS) && (!syn.TS || syn.TSVal != 0x01020304) {
+			t.Errorf("%s: timestamps разобраны неверно: %+v", tt.name, syn)
+		}
+	}
+}
+
+func TestParseOptionLayout(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"", ""},
+		{" M, N ,W,s,T ", "mss,nop,ws,sok,ts"},
+		{"mss,eol", "mss,eol+0"},
+		{"mss,e+3", "mss,eol+3"},
+	}
+	for _, tt := range tests {
+		l, err := ParseOptionLayout(tt.in)
+		if err != nil || l.String() != tt.want {
+			t.Errorf("ParseOptionLayout(%q) = %q, %v; ожидалось %q", tt.in, l, err, tt.want)
+		}
+	}
+
+	for _, in := range []string{
+		"mss,sack",
+		"mss,eol,ws",
+		"mss+1",
+		"eol+x",
+		"eol+-1",
+		"mss,,ws",
+	} {
+		if _, err := ParseOptionLayout(in); err == nil {
+			t.Errorf("ParseOptionLayout(%q): ошибки нет", in)
+		}
+	}
+}
+
+func TestOptionLayoutLimit(t *testing.T) {
+	ts4 := []OptionKind{OptionTS, OptionTS, OptionTS, OptionTS}
+	ts3 := ts4[:3:3]
+	tests := []struct {
+		layout OptionLayout
+		length int
+		ok     bool
+	}{
+		{OptionLayout{Kinds: ts4}, 40, true},
+		{OptionLayout{Kinds: append(ts3, OptionNOP, OptionNOP, OptionNOP, OptionNOP)}, 36, true},
+		{OptionLayout{Kinds: append(ts4[:4:4], OptionNOP)}, 44, false},
+		{OptionLayout{Kinds: append(ts3, OptionEOL), EOLPadding: 9}, 40, true},
+		{OptionLayout{Kinds: append(ts3, OptionEOL), EOLPadding: 10}, 44, false},
+	}
+	for _, tt := range tests {
+		if n := tt.layout.Length(); n != tt.length {
+			t.Errorf("%s: Length = %d, ожидалось %d", tt.layout, n, tt.length)
+		}
+		if n := len(tt.layout.encode(testOptionValues)); n != tt.length {
+			t.Errorf("%s: encode вернул %d байт", tt.layout, n)
+		}
+		if err := tt.layout.Validate(); (err == nil) != tt.ok {
+			t.Errorf("%s: Validate = %v", tt.layout, err)
+		}
+		if _, err := ParseOptionLayout(tt.layout.String()); (err == nil) != tt.ok {
+			t.Errorf("%s: ParseOptionLayout = %v", tt.layout, err)
+		}
+	}
+}
+
+func TestOptionLayoutWith(t *testing.T) {
+	tests := []struct {
+		name    string
+		layout  string
+		kind    OptionKind
+		enabled bool
+		want    string
+	}{
+		{"sok без nop перед ней", "mss,sok,ts,nop,ws", OptionSACKPermitted, false, "mss,ts,nop,ws"},
+		{"sok вместе с nop,nop", "mss,nop,ws,nop,nop,sok", OptionSACKPermitted, false, "mss,nop,ws"},
+		{"ws вместе с nop", "mss,nop,ws,nop,nop,sok", OptionWS, false, "mss,nop,nop,sok"},
+		{"ts перед eol", "mss,nop,ws,nop,nop,ts,sok,eol+1", OptionTS, false, "mss,nop,ws,sok,eol+1"},
+		{"mss", "mss,nop,ws", OptionMSS, false, "nop,ws"},
+		{"ts в конец", "mss,nop,ws,nop,nop,sok", OptionTS, true, "mss,nop,ws,nop,nop,sok,nop,nop,ts"},
+		{"ws в конец", "mss,sok,ts", OptionWS, true, "mss,sok,ts,nop,ws"},
+		{"sok перед eol", "mss,nop,ws,nop,nop,ts,eol+1", OptionSACKPermitted, true, "mss,nop,ws,nop,nop,ts,nop,nop,sok,eol+1"},
+		{"mss в начало", "nop,ws", OptionMSS, true, "mss,nop,ws"},
+		{"уже включена", "mss,sok", OptionSACKPermitted, true, "mss,sok"},
+		{"уже выключена", "mss,sok", OptionTS, false, "mss,sok"},
+		{"nop не меняется", "mss,nop,ws", OptionNOP, false, "mss,nop,ws"},
+		{"eol не меняется", "mss,eol+2", OptionEOL, false, "mss,eol+2"},
+	}
+	for _, tt := range tests {
+		l := MustParseOptionLayout(tt.layout)
+		got := l.With(tt.kind, tt.enabled)
+		if got.String() != tt.want {
+			t.Errorf("%s: With = %q, ожидалось %q", tt.name, got, tt.want)
+		}
+		if l.String() != tt.layout {
+			t.Errorf("%s: With изменил исходную раскладку: %q", tt.name, l)
+		}
+		if len(got.encode(testOptionValues))%4 != 0 {
+			t.Errorf("%s: длина опций не кратна 4", tt.name)
+		}
+	}
+}
+
+func TestDefaultOptionLayout(t *testing.T) {
+	tests := []struct {
+		ts, sack, ws bool
+		want         string
+	}{
+		{true, true, true, "mss,sok,ts,nop,ws"},
+		{true, false, true, "mss,nop,nop,ts,nop,ws"},
+		{false, true, true, "mss,nop,nop,sok,nop,ws"},
+		{false, false, false, "mss"},
+	}
+	for _, tt := range tests {
+		opts := &TCPOptions{TimestampsEnabled: tt.ts, SACKEnabled: tt.sack, WindowScaleEnabled: tt.ws}
+		if got := defaultOptionLayout(opts).String(); got != tt.want {
+			t.Errorf("ts=%v sack=%v ws=%v: %q, ожидалось %q", tt.ts, tt.sack, tt.ws, got, tt.want)
+		}
+	}
+}
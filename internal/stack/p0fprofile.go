@@ -0,0 +1,136 @@
+package stack
+
+import (
+	"fmt"
+	"sync"
+
+	"custom-tcp-fingerprint/internal/p0f"
+)
+
+const (
+	defaultP0fMSS   = 1460
+	defaultP0fScale = 7
+)
+
+var (
+	p0fMu       sync.RWMutex
+	p0fDatabase *p0f.Database
+)
+
+func LoadP0fProfiles(path string) error {
+	db, err := p0f.Load(path)
+	if err != nil {
+		return err
+	}
+
+	p0fMu.Lock()
+	p0fDatabase = db
+	p0fMu.Unlock()
+	return nil
+}
+
+func P0fProfileLabels() []string {
+	p0fMu.RLock()
+	defer p0fMu.RUnlock()
+
+	if p0fDatabase == nil {
+		return nil
+	}
+	return p0fDatabase.Labels()
+}
+
+func p0fTCPOptions(label string) (*TCPOptions, error) {
+	p0fMu.RLock()
+	db := p0fDatabase
+	p0fMu.RUnlock()
+
+	if db == nil {
+		return nil, fmt.Errorf("база p0f не загружена")
+	}
+
+	sig, err := db.Lookup(label)
+	if err != nil {
+		return nil, err
+	}
+	return TCPOptionsFromP0f(sig)
+}
+
+// TCPOptionsFromP0f превращает SYN-сигнатуру p0f в профиль. Поля со значением
+// "*" заменяются типичными значениями.
+func TCPOptionsFromP0f(sig *p0f.Signature) (*TCPOptions, error) {
+	layout, err := ParseOptionLayout(sig.OptionLayout)
+	if err != nil {
+		return nil, fmt.Errorf("сигнатура %q: %w", sig, err)
+	}
+
+	mss := sig.MSS
+	if mss < 0 {
+		mss = defaultP0fMSS
+	}
+
+	scale := sig.Scale
+	if scale < 0 {
+		scale = defaultP0fScale
+	}
+
+	ipid := IPIDIncrement
+	if sig.HasQuirk("id-") || (sig.HasQuirk("df") && !sig.HasQuirk("id+")) {
+		ipid = IPIDZero
+	}
+
+	// Квирк flow есть только в сигнатурах ipv6; для сигнатур ipv4 метка
+	// остается на усмотрение стека.
+	flow := FlowLabelStack
+	if sig.HasQuirk("flow") {
+		flow = FlowLabelRandom
+	} else if sig.Version == 6 {
+		flow = FlowLabelZero
+	}
+
+	// Начальный ttl 255 (cisco, solaris) на проводе не получить, ближайшее
+	// возможное - MaxTTL.
+	ttl := min(sig.ITTL, MaxTTL)
+
+	return &TCPOptions{
+		Window:             p0fWindow(sig.Window, mss),
+		TimestampsEnabled:  layout.Has(OptionTS),
+		MSS:                uint16(mss),
+		WindowScaleEnabled: layout.Has(OptionWS),
+		WindowScaleValue:   uint8(scale),
+		TTL:                uint8(ttl),
+		SACKEnabled:        layout.Has(OptionSACKPermitted),
+		OptionLayout:       layout,
+		DontFragment:       sig.HasQuirk("df"),
+		IPID:               ipid,
+		FlowLabel:          flow,
+		OSType:             sig.Label.OS(),
+	}, nil
+}
+
+// p0fWindow переводит окно сигнатуры в политику: mss*N остается кратным
+// MSS, остальные виды становятся фиксированным окном.
+func p0fWindow(w p0f.Window, mss int) WindowPolicy {
+	var size int
+	switch w.Kind {
+	case p0f.WindowFixed:
+		size = w.Value
+	case p0f.WindowMSS:
+		size = mss * w.Value
+		if size > 0 && size <= 0xffff {
+			return WindowPolicy{Kind: WindowMSS, Value: w.Value}
+		}
+	case p0f.WindowMTU:
+		size = (mss + 40) * w.Value
+	case p0f.WindowMod:
+		if w.Value > 0 {
+			size = 0xffff / w.Value * w.Value
+		}
+	default:
+		size = 0xffff
+	}
+
+	if size <= 0 || size > 0xffff {
+		size = 0xffff
+	}
+	return FixedWindow(size)
+}
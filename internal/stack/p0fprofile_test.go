@@ -0,0 +1,94 @@
+package stack
+
+import (
+	"testing"
+
+	"custom-tcp-fingerprint/internal/p0f"
+)
+
+func TestTCPOptionsFromP0f(t *testing.T) {
+	tests := []struct {
+		sig    string
+		window WindowPolicy
+		mss    uint16
+		scale  uint8
+		layout string
+		df     bool
+		ipid   IPIDMode
+		flow   FlowLabelMode
+	}{
+		// mss "*" заменяется на 1460, mss*20 остается кратным MSS.
+		{"*:64:0:*:mss*20,10:mss,sok,ts,nop,ws:df,id+:0", WindowPolicy{Kind: WindowMSS, Value: 20}, 1460, 10,
+			"mss,sok,ts,nop,ws", true, IPIDIncrement, FlowLabelStack},
+		{"*:64:0:*:65535,1:mss,nop,ws,nop,nop,ts,sok,eol+1:df,id+:0", FixedWindow(65535), 1460, 1,
+			"mss,nop,ws,nop,nop,ts,sok,eol+1", true, IPIDIncrement, FlowLabelStack},
+		// scale "*" заменяется на 7, mtu*N считается от mss+40.
+		{"4:64:0:*:mtu*4,*:mss,nop,ws,nop,nop,sok::0", FixedWindow((1460 + 40) * 4), 1460, 7,
+			"mss,nop,ws,nop,nop,sok", false, IPIDIncrement, FlowLabelStack},
+		// Окно mss*N больше 16 бит становится наибольшим фиксированным.
+		{"*:64:0:1400:mss*50,2:mss,nop,ws:df,id+:0", FixedWindow(65535), 1400, 2,
+			"mss,nop,ws", true, IPIDIncrement, FlowLabelStack},
+		{"*:128:0:*:%8192,8:mss,nop,ws:df:0", FixedWindow(57344), 1460, 8,
+			"mss,nop,ws", true, IPIDZero, FlowLabelStack},
+		{"*:64:0:*:*,0:mss:id-:0", FixedWindow(65535), 1460, 0,
+			"mss", false, IPIDZero, FlowLabelStack},
+		// Начальный ttl 255 становится MaxTTL.
+		{"*:255:0:*:8192,0:mss::0", FixedWindow(8192), 1460, 0,
+			"mss", false, IPIDIncrement, FlowLabelStack},
+		{"6:64:0:*:mss*10,7:mss,sok,ts,nop,ws:flow:0", WindowPolicy{Kind: WindowMSS, Value: 10}, 1460, 7,
+			"mss,sok,ts,nop,ws", false, IPIDIncrement, FlowLabelRandom},
+		{"6:64:0:*:mss*10,7:mss,sok,ts,nop,ws::0", WindowPolicy{Kind: WindowMSS, Value: 10}, 1460, 7,
+			"mss,sok,ts,nop,ws", false, IPIDIncrement, FlowLabelZero},
+	}
+	for _, tt := range tests {
+		sig, err := p0f.ParseSignature(tt.sig)
+		if err != nil {
+			t.Fatalf("%q: %v", tt.sig, err)
+		}
+		opts, err := TCPOptionsFromP0f(sig)
+		if err != nil {
+			t.Errorf("%q: %v", tt.sig, err)
+			continue
+		}
+		if opts.Window != tt.window || opts.MSS != tt.mss || opts.WindowScaleValue != tt.scale ||
+			opts.Layout().String() != tt.layout || opts.DontFragment != tt.df || opts.IPID != tt.ipid ||
+			opts.FlowLabel != tt.flow || int(opts.TTL) != min(sig.ITTL, MaxTTL) {
+			t.Errorf("%q: профиль %+v", tt.sig, opts)
+		}
+		layout := opts.Layout()
+		if opts.TimestampsEnabled != layout.Has(OptionTS) || opts.SACKEnabled != layout.Has(OptionSACKPermitted) ||
+			opts.WindowScaleEnabled != layout.Has(OptionWS) {
+			t.Errorf("%q: флаги опций не совпадают с раскладкой: %+v", tt.sig, opts)
+		}
+		if err := opts.Validate(1500); err != nil {
+			t.Errorf("%q: %v", tt.sig, err)
+		}
+	}
+
+	sig, _ := p0f.ParseSignature("*:64:0:*:8192,0:mss,foo::0")
+	if _, err := TCPOptionsFromP0f(sig); err == nil {
+		t.Errorf("неизвестная опция в раскладке: ошибки нет")
+	}
+}
+
+func TestP0fProfileByLabel(t *testing.T) {
+	if err := LoadP0fProfiles("../../configs/p0f.fp"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		p0fMu.Lock()
+		p0fDatabase = nil
+		p0fMu.Unlock()
+	})
+
+	opts, err := GetTCPOptions("Mac OS X:11 or newer", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.OSType != "Mac OS X:11 or newer" || opts.TTL != 64 || opts.Layout().EOLPadding != 1 {
+		t.Fatalf("профиль %+v", opts)
+	}
+	if _, err := GetTCPOptions("Plan 9", 0, 0); err == nil {
+		t.Errorf("неизвестная метка: ошибки нет")
+	}
+}
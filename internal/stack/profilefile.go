@@ -0,0 +1,107 @@
+package stack
+
+import (
+	"fmt"
+
+	"gopkg.in/yaml.v3"
+)
+
+// maxWindowScale - наибольший сдвиг окна по RFC 7323.
+const maxWindowScale = 14
+
+// Profile - профиль отпечатка в файле YAML или JSON. Поля SYN задаются как
+// в TCPOptions; timestamps, window scale и SACK включаются присутствием
+// опции в Options. Extends - имя профиля, поля которого берутся за основу.
+type Profile struct {
+	Name        string `yaml:"name" json:"name"`
+	Description string `yaml:"description,omitempty" json:"description,omitempty"`
+	Extends     string `yaml:"extends,omitempty" json:"extends,omitempty"`
+
+	TTL int `yaml:"ttl" json:"ttl"`
+	// HopLimit - hop limit для ipv6; 0 означает значение TTL.
+	HopLimit int `yaml:"hop_limit,omitempty" json:"hop_limit,omitempty"`
+	// Window - окно SYN: число, mss*N или rcvbuf.
+	Window WindowPolicy `yaml:"window" json:"window"`
+	// ReceiveBuffer - окно приема после рукопожатия в байтах; 0 - то же,
+	// что окно SYN при согласованном MSS.
+	ReceiveBuffer int    `yaml:"rcvbuf,omitempty" json:"rcvbuf,omitempty"`
+	MSS           int    `yaml:"mss" json:"mss"`
+	WindowScale   int    `yaml:"window_scale,omitempty" json:"window_scale,omitempty"`
+	Options       string `yaml:"options" json:"options"`
+	DF            bool   `yaml:"df" json:"df"`
+	IPID          string `yaml:"ip_id,omitempty" json:"ip_id,omitempty"`
+	FlowLabel     string `yaml:"flow_label,omitempty" json:"flow_label,omitempty"`
+
+	// Observed - то, что было измерено при обучении профиля по захвату.
+	// Сетевой стек эти значения не воспроизводит, они нужны для сравнения.
+	Observed *ProfileObservations `yaml:"observed,omitempty" json:"observed,omitempty"`
+}
+
+type ProfileObservations struct {
+	Capture string `yaml:"capture" json:"capture"`
+	Source  string `yaml:"source" json:"source"`
+	SYNs    int    `yaml:"syns" json:"syns"`
+	// TTL - наибольший ttl в захвате, по нему выбран начальный.
+	TTL int `yaml:"ttl" json:"ttl"`
+	// WindowMSS - окно как кратное MSS, если оно во всех SYN такое.
+	WindowMSS int `yaml:"window_mss,omitempty" json:"window_mss,omitempty"`
+	// TimestampHz - частота часов TSval.
+	TimestampHz int `yaml:"timestamp_hz,omitempty" json:"timestamp_hz,omitempty"`
+	// ISN - поведение начального номера: zero, constant, increment или random.
+	ISN string `yaml:"isn,omitempty" json:"isn,omitempty"`
+	// SYNRetransmits - паузы перед повторными SYN, например ["1s", "2s"].
+	SYNRetransmits []string `yaml:"syn_retransmits,omitempty" json:"syn_retransmits,omitempty"`
+}
+
+// Marshal возвращает профиль в YAML.
+func (p *Profile) Marshal() ([]byte, error) {
+	return yaml.Marshal(p)
+}
+
+// TCPOptions проверяет значения профиля и превращает его в TCPOptions.
+func (p *Profile) TCPOptions() (*TCPOptions, error) {
+	layout, err := ParseOptionLayout(p.Options)
+	if err != nil {
+		return nil, fmt.Errorf("профиль %s: %w", p.Name, err)
+	}
+	ipid, err := ParseIPIDMode(p.IPID)
+	if err != nil {
+		return nil, fmt.Errorf("профиль %s: %w", p.Name, err)
+	}
+	flow, err := ParseFlowLabelMode(p.FlowLabel)
+	if err != nil {
+		return nil, fmt.Errorf("профиль %s: %w", p.Name, err)
+	}
+
+	switch {
+	case p.TTL < 1 || p.TTL > MaxTTL:
+		return nil, fmt.Errorf("профиль %s: ttl должен быть от 1 до %d, получено %d", p.Name, MaxTTL, p.TTL)
+	case p.HopLimit < 0 || p.HopLimit > MaxTTL:
+		return nil, fmt.Errorf("профиль %s: hop_limit должен быть от 0 до %d, получено %d", p.Name, MaxTTL, p.HopLimit)
+	case p.MSS < 0 || p.MSS > 65535:
+		return nil, fmt.Errorf("профиль %s: mss должен быть от 0 до 65535, получено %d", p.Name, p.MSS)
+	case p.WindowScale < 0 || p.WindowScale > 255:
+		return nil, fmt.Errorf("профиль %s: window_scale должен быть от 0 до 255, получено %d", p.Name, p.WindowScale)
+	}
+
+	opts := &TCPOptions{
+		Window:             p.Window,
+		ReceiveBuffer:      p.ReceiveBuffer,
+		TimestampsEnabled:  layout.Has(OptionTS),
+		MSS:                uint16(p.MSS),
+		WindowScaleEnabled: layout.Has(OptionWS),
+		WindowScaleValue:   uint8(p.WindowScale),
+		TTL:                uint8(p.TTL),
+		SACKEnabled:        layout.Has(OptionSACKPermitted),
+		OptionLayout:       layout,
+		DontFragment:       p.DF,
+		IPID:               ipid,
+		HopLimit:           uint8(p.HopLimit),
+		FlowLabel:          flow,
+		OSType:             p.Name,
+	}
+	if err := opts.Validate(0); err != nil {
+		return nil, fmt.Errorf("профиль %s: %w", p.Name, err)
+	}
+	return opts, nil
+}
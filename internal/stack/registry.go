@@ -0,0 +1,235 @@
+package stack
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+//go:embed profiles/*.yaml
+var embeddedProfiles embed.FS
+
+// SourceEmbedded - источник встроенных профилей в Registry.Source.
+const SourceEmbedded = "встроенный"
+
+// Registry хранит профили по имени. Профиль может наследовать другой через
+// extends: его поля накладываются на поля родителя, так что в файле
+// достаточно указать отличия. Наследование разрешается при обращении, поэтому
+// родитель может быть загружен позже потомка или заменен.
+type Registry struct {
+	mu       sync.RWMutex
+	profiles map[string]registryEntry
+}
+
+type registryEntry struct {
+	node    *yaml.Node
+	extends string
+	source  string
+}
+
+func NewRegistry() *Registry {
+	return &Registry{profiles: make(map[string]registryEntry)}
+}
+
+// DefaultRegistry содержит встроенные профили; GetTCPOptions ищет профили в
+// нем.
+var DefaultRegistry = mustLoadEmbedded()
+
+func mustLoadEmbedded() *Registry {
+	r := NewRegistry()
+	entries, err := fs.ReadDir(embeddedProfiles, "profiles")
+	if err != nil {
+		panic(err)
+	}
+	for _, e := range entries {
+		data, err := embeddedProfiles.ReadFile("profiles/" + e.Name())
+		if err != nil {
+			panic(err)
+		}
+		if _, err := r.add(data, e.Name(), SourceEmbedded); err != nil {
+			panic(err)
+		}
+	}
+	for _, name := range r.Names() {
+		if _, err := r.TCPOptions(name); err != nil {
+			panic(err)
+		}
+	}
+	return r
+}
+
+// LoadFile загружает профиль из файла YAML или JSON и возвращает его с
+// учетом extends. Без поля name имя берется из имени файла. Профиль с уже
+// известным именем заменяет прежний.
+func (r *Registry) LoadFile(path string) (*Profile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	name, err := r.add(data, filepath.Base(path), path)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	p, err := r.Resolve(name)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if _, err := p.TCPOptions(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return p, nil
+}
+
+// LoadDir загружает все файлы *.yaml, *.yml и *.json каталога в порядке
+// имен. Профили проверяются после загрузки всех файлов, так что extends
+// может ссылаться на любой из них.
+func (r *Registry) LoadDir(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, e := range entries {
+		switch strings.ToLower(filepath.Ext(e.Name())) {
+		case ".yaml", ".yml", ".json":
+		default:
+			continue
+		}
+		if e.IsDir() {
+			continue
+		}
+		path := filepath.Join(dir, e.Name())
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		name, err := r.add(data, e.Name(), path)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		names = append(names, name)
+	}
+	for _, name := range names {
+		if _, err := r.TCPOptions(name); err != nil {
+			return nil, fmt.Errorf("%s: %w", r.Source(name), err)
+		}
+	}
+	return names, nil
+}
+
+func (r *Registry) add(data []byte, fileName, source string) (string, error) {
+	// Строгий разбор без наследования: опечатки в именах полей и значения
+	// не того типа видны сразу.
+	var p Profile
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&p); err != nil {
+		return "", fmt.Errorf("ошибка разбора профиля: %w", err)
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return "", fmt.Errorf("ошибка разбора профиля: %w", err)
+	}
+	if p.Name == "" {
+		p.Name = strings.TrimSuffix(fileName, filepath.Ext(fileName))
+	}
+
+	r.mu.Lock()
+	r.profiles[p.Name] = registryEntry{node: doc.Content[0], extends: p.Extends, source: source}
+	r.mu.Unlock()
+	return p.Name, nil
+}
+
+// Names возвращает имена профилей по алфавиту.
+func (r *Registry) Names() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	names := make([]string, 0, len(r.profiles))
+	for name := range r.profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Source возвращает файл, из которого загружен профиль, или SourceEmbedded.
+func (r *Registry) Source(name string) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.profiles[name].source
+}
+
+func (r *Registry) Has(name string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	_, ok := r.profiles[name]
+	return ok
+}
+
+// Resolve возвращает профиль с полями, унаследованными по цепочке extends.
+// Extends результата сохраняется, Observed и Description не наследуются.
+func (r *Registry) Resolve(name string) (*Profile, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.resolve(name, nil)
+}
+
+// resolve разрешает name; chain - профили, которые его наследуют.
+func (r *Registry) resolve(name string, chain []string) (*Profile, error) {
+	if slices.Contains(chain, name) {
+		return nil, fmt.Errorf("циклическое наследование профилей: %s", strings.Join(append(chain, name), " -> "))
+	}
+	e, ok := r.profiles[name]
+	if !ok {
+		if len(chain) > 0 {
+			return nil, fmt.Errorf("профиль %s наследует неизвестный профиль %s", chain[len(chain)-1], name)
+		}
+		return nil, fmt.Errorf("профиль %s не найден", name)
+	}
+
+	p := &Profile{}
+	if e.extends != "" {
+		parent, err := r.resolve(e.extends, append(chain, name))
+		if err != nil {
+			return nil, err
+		}
+		*p = *parent
+		p.Description = ""
+		p.Observed = nil
+	}
+	// Decode меняет только поля, которые есть в файле потомка.
+	if err := e.node.Decode(p); err != nil {
+		return nil, fmt.Errorf("профиль %s: %w", name, err)
+	}
+	p.Name = name
+	return p, nil
+}
+
+// TCPOptions возвращает проверенные параметры профиля name.
+func (r *Registry) TCPOptions(name string) (*TCPOptions, error) {
+	p, err := r.Resolve(name)
+	if err != nil {
+		return nil, err
+	}
+	return p.TCPOptions()
+}
+
+// LoadProfileFile загружает файл профиля в DefaultRegistry.
+func LoadProfileFile(path string) (*Profile, error) {
+	return DefaultRegistry.LoadFile(path)
+}
+
+// LoadProfileDir загружает каталог профилей в DefaultRegistry.
+func LoadProfileDir(dir string) ([]string, error) {
+	return DefaultRegistry.LoadDir(dir)
+}
@@ -0,0 +1,198 @@
+package stack
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeProfiles(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestEmbeddedWindows10ExtendsWindows(t *testing.T) {
+	base, err := DefaultRegistry.Resolve("windows")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := DefaultRegistry.Resolve("windows10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Extends != "windows" {
+		t.Errorf("extends = %q, ожидалось windows", p.Extends)
+	}
+	// Поля, которых нет в windows10.yaml, берутся из windows.
+	if p.TTL != base.TTL || p.MSS != base.MSS || p.WindowScale != base.WindowScale ||
+		p.Options != base.Options || p.DF != base.DF || p.IPID != base.IPID || p.FlowLabel != base.FlowLabel {
+		t.Errorf("windows10 не унаследовал поля windows:\n%+v\n%+v", p, base)
+	}
+	if p.Window != (WindowPolicy{Kind: WindowRcvBuf}) || p.ReceiveBuffer != 262144 {
+		t.Errorf("window = %v, rcvbuf = %d, ожидалось rcvbuf и 262144", p.Window, p.ReceiveBuffer)
+	}
+	if p.Description == base.Description {
+		t.Error("описание унаследовано от windows")
+	}
+	if DefaultRegistry.Source("windows10") != SourceEmbedded {
+		t.Errorf("источник %q, ожидался %q", DefaultRegistry.Source("windows10"), SourceEmbedded)
+	}
+
+	opts, err := DefaultRegistry.TCPOptions("windows10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := opts.Window.SYNWindow(int(opts.MSS), opts.ReceiveBuffer); got != 64240 {
+		t.Errorf("окно SYN %d, ожидалось 64240", got)
+	}
+}
+
+func TestRegistryExtends(t *testing.T) {
+	dir := writeProfiles(t, map[string]string{
+		// child загружается раньше родителя: extends разрешается при обращении.
+		"a-child.yaml": "extends: parent\nttl: 32\nobserved:\n  syns: 3\n",
+		"parent.yaml":  "name: parent\ndescription: родитель\nttl: 64\nwindow: mss*10\nmss: 1400\nwindow_scale: 7\noptions: mss,sok,ts,nop,ws\ndf: true\nobserved:\n  syns: 5\n",
+		"grand.json":   `{"name": "grand", "extends": "a-child", "mss": 1200}`,
+		"notes.txt":    "не профиль",
+	})
+	r := NewRegistry()
+	names, err := r.LoadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(names, ",") != "a-child,grand,parent" {
+		t.Errorf("загружены %v", names)
+	}
+
+	child, err := r.Resolve("a-child")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if child.TTL != 32 || child.MSS != 1400 || child.Window != (WindowPolicy{Kind: WindowMSS, Value: 10}) || !child.DF {
+		t.Errorf("a-child разрешен в %+v", child)
+	}
+	if child.Description != "" {
+		t.Errorf("описание унаследовано: %q", child.Description)
+	}
+	if child.Observed == nil || child.Observed.SYNs != 3 {
+		t.Errorf("observed = %+v, ожидались собственные значения a-child", child.Observed)
+	}
+
+	grand, err := r.Resolve("grand")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if grand.TTL != 32 || grand.MSS != 1200 || grand.WindowScale != 7 || grand.Extends != "a-child" {
+		t.Errorf("grand разрешен в %+v", grand)
+	}
+	if grand.Observed != nil {
+		t.Errorf("observed унаследован: %+v", grand.Observed)
+	}
+	if r.Source("grand") != filepath.Join(dir, "grand.json") {
+		t.Errorf("источник grand: %q", r.Source("grand"))
+	}
+}
+
+func TestRegistryExtendsErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		files map[string]string
+		want  string
+	}{
+		{"цикл", map[string]string{
+			"a.yaml": "extends: b\nttl: 64\n",
+			"b.yaml": "extends: a\n",
+		}, "циклическое наследование профилей: a -> b -> a"},
+		{"сам себя", map[string]string{
+			"a.yaml": "extends: a\nttl: 64\n",
+		}, "циклическое наследование профилей: a -> a"},
+		{"неизвестный родитель", map[string]string{
+			"a.yaml": "extends: missing\nttl: 64\n",
+		}, "профиль a наследует неизвестный профиль missing"},
+		{"неизвестное поле", map[string]string{
+			"a.yaml": "ttl: 64\nwindw: 8192\n",
+		}, "ошибка разбора профиля"},
+		{"неверный тип", map[string]string{
+			"a.yaml": "ttl: много\n",
+		}, "ошибка разбора профиля"},
+		{"неверное окно", map[string]string{
+			"a.yaml": "ttl: 64\nwindow: mss*0\n",
+		}, "некорректный множитель mss"},
+		{"неверный ttl", map[string]string{
+			"a.yaml": "ttl: 255\noptions: mss\n",
+		}, "ttl должен быть от 1 до 254"},
+		{"неверная раскладка", map[string]string{
+			"a.yaml": "ttl: 64\noptions: mss,bogus\n",
+		}, "профиль a"},
+	}
+	for _, tt := range tests {
+		r := NewRegistry()
+		_, err := r.LoadDir(writeProfiles(t, tt.files))
+		if err == nil {
+			t.Errorf("%s: ошибки нет", tt.name)
+			continue
+		}
+		if !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: ошибка %q не содержит %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestRegistryResolveUnknown(t *testing.T) {
+	if _, err := NewRegistry().Resolve("missing"); err == nil || err.Error() != "профиль missing не найден" {
+		t.Errorf("ошибка %v", err)
+	}
+}
+
+func TestRegistryOverrideEmbedded(t *testing.T) {
+	r := mustLoadEmbedded()
+	dir := writeProfiles(t, map[string]string{
+		"custom.yaml": "name: windows\nttl: 100\nwindow: 16384\nmss: 1400\noptions: mss,nop,ws\nwindow_scale: 2\n",
+	})
+	p, err := r.LoadFile(filepath.Join(dir, "custom.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Name != "windows" || p.TTL != 100 {
+		t.Errorf("загружен %+v", p)
+	}
+	if r.Source("windows") != filepath.Join(dir, "custom.yaml") {
+		t.Errorf("источник windows: %q", r.Source("windows"))
+	}
+
+	// windows10 наследует уже замененный профиль.
+	opts, err := r.TCPOptions("windows10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.TTL != 100 || opts.MSS != 1400 || opts.SACKEnabled || opts.WindowScaleValue != 2 {
+		t.Errorf("windows10 после замены windows: %+v", opts)
+	}
+
+	// Встроенный реестр не меняется.
+	if def, _ := DefaultRegistry.TCPOptions("windows10"); def.TTL != 128 {
+		t.Errorf("DefaultRegistry изменен: ttl %d", def.TTL)
+	}
+}
+
+func TestRegistryLoadFileInvalid(t *testing.T) {
+	dir := writeProfiles(t, map[string]string{
+		"bad.yaml": "ttl: 64\noptions: mss\nip_id: sometimes\n",
+	})
+	r := NewRegistry()
+	path := filepath.Join(dir, "bad.yaml")
+	_, err := r.LoadFile(path)
+	if err == nil || !strings.HasPrefix(err.Error(), path+": ") {
+		t.Errorf("ошибка %v, ожидалась ошибка с путем %s", err, path)
+	}
+	if _, err := r.LoadFile(filepath.Join(dir, "missing.yaml")); !os.IsNotExist(err) {
+		t.Errorf("ошибка %v, ожидалась os.ErrNotExist", err)
+	}
+}
@@ -2,14 +2,15 @@ package stack
 
 import (
 	"fmt"
-	"log"
-	"net"
-	"strconv"
-	"strings"
+
+	"gvisor.dev/gvisor/pkg/tcpip/header"
 )
 
 type TCPOptions struct {
-	WindowSize uint16
+	// Window - окно SYN; ReceiveBuffer - окно приема после рукопожатия в
+	// байтах, 0 - по Window при согласованном MSS.
+	Window        WindowPolicy
+	ReceiveBuffer int
 
 	TimestampsEnabled bool
 
@@ -22,134 +23,211 @@ type TCPOptions struct {
 
 	SACKEnabled bool
 
+	OptionLayout OptionLayout
+
+	DontFragment bool
+	IPID         IPIDMode
+
+	// HopLimit - hop limit для ipv6; 0 означает значение TTL.
+	HopLimit  uint8
+	FlowLabel FlowLabelMode
+
 	OSType string
 }
 
-func GetTCPOptions(osType string, windowSize int, ttl int) (*TCPOptions, error) {
-	switch osType {
-	case "windows":
-		return &TCPOptions{
-			WindowSize:         uint16(windowSize),
-			TimestampsEnabled:  false,
-			MSS:                1460,
-			WindowScaleEnabled: true,
-			WindowScaleValue:   8,
-			TTL:                uint8(ttl),
-			SACKEnabled:        true,
-			OSType:             "windows",
-		}, nil
-
-	case "macos":
-		return &TCPOptions{
-			WindowSize:         uint16(windowSize),
-			TimestampsEnabled:  true,
-			MSS:                1460,
-			WindowScaleEnabled: true,
-			WindowScaleValue:   6,
-			TTL:                uint8(ttl),
-			SACKEnabled:        true,
-			OSType:             "macos",
-		}, nil
-
-	case "linux":
-		return &TCPOptions{
-			WindowSize:         uint16(windowSize),
-			TimestampsEnabled:  true,
-			MSS:                1460,
-			WindowScaleEnabled: true,
-			WindowScaleValue:   7,
-			TTL:                uint8(ttl),
-			SACKEnabled:        true,
-			OSType:             "linux",
-		}, nil
-
-	default:
-		return nil, fmt.Errorf("неизвестный тип ос для имитации: %s", osType)
+type IPIDMode int
+
+const (
+	IPIDStack IPIDMode = iota
+	IPIDZero
+	IPIDIncrement
+	IPIDRandom
+)
+
+func ParseIPIDMode(s string) (IPIDMode, error) {
+	switch s {
+	case "", "stack":
+		return IPIDStack, nil
+	case "zero":
+		return IPIDZero, nil
+	case "increment":
+		return IPIDIncrement, nil
+	case "random":
+		return IPIDRandom, nil
+	}
+	return IPIDStack, fmt.Errorf("неизвестный режим ip id: %q (stack, zero, increment, random)", s)
+}
+
+func (m IPIDMode) String() string {
+	switch m {
+	case IPIDZero:
+		return "zero"
+	case IPIDIncrement:
+		return "increment"
+	case IPIDRandom:
+		return "random"
 	}
+	return "stack"
 }
 
-func ApplyTCPOptions(gs *GvisorStack, opts *TCPOptions) error {
-	log.Printf("применение настроек tcp для имитации ос: %s", opts.OSType)
+// FlowLabelMode задает flow label исходящих пакетов ipv6: stack оставляет
+// значение стека, zero - ноль (windows), random - случайная метка,
+// постоянная в пределах соединения (linux, macos).
+type FlowLabelMode int
+
+const (
+	FlowLabelStack FlowLabelMode = iota
+	FlowLabelZero
+	FlowLabelRandom
+)
 
-	if err := executeCommand("sysctl", "-w", fmt.Sprintf("net.ipv4.ip_default_ttl=%d", opts.TTL)); err != nil {
-		return fmt.Errorf("не удалось установить ttl: %w", err)
+func ParseFlowLabelMode(s string) (FlowLabelMode, error) {
+	switch s {
+	case "", "stack":
+		return FlowLabelStack, nil
+	case "zero":
+		return FlowLabelZero, nil
+	case "random":
+		return FlowLabelRandom, nil
 	}
+	return FlowLabelStack, fmt.Errorf("неизвестный режим flow label: %q (stack, zero, random)", s)
+}
 
-	if err := executeCommand("sysctl", "-w", fmt.Sprintf("net.ipv4.tcp_wmem='4096 %d %d'",
-		opts.WindowSize, opts.WindowSize*2)); err != nil {
-		return fmt.Errorf("не удалось установить tcp send buffer size: %w", err)
+func (m FlowLabelMode) String() string {
+	switch m {
+	case FlowLabelZero:
+		return "zero"
+	case FlowLabelRandom:
+		return "random"
 	}
+	return "stack"
+}
 
-	if err := executeCommand("sysctl", "-w", fmt.Sprintf("net.ipv4.tcp_rmem='4096 %d %d'",
-		opts.WindowSize, opts.WindowSize*2)); err != nil {
-		return fmt.Errorf("не удалось устоновить tcp receive buffer size: %w", err)
+// IPv6HopLimit возвращает hop limit для ipv6 с учетом значения по
+// умолчанию.
+func (o *TCPOptions) IPv6HopLimit() uint8 {
+	if o.HopLimit != 0 {
+		return o.HopLimit
 	}
+	return o.TTL
+}
 
-	timestampsValue := "0"
-	if opts.TimestampsEnabled {
-		timestampsValue = "1"
+// IPv6MSS возвращает mss для SYN ipv6: mss профиля задан для ipv4, а
+// заголовок ipv6 на 20 байт длиннее.
+func (o *TCPOptions) IPv6MSS() uint16 {
+	const delta = header.IPv6MinimumSize - header.IPv4MinimumSize
+	if o.MSS <= delta {
+		return o.MSS
 	}
-	if err := executeCommand("sysctl", "-w", fmt.Sprintf("net.ipv4.tcp_timestamps=%s", timestampsValue)); err != nil {
-		return fmt.Errorf("не удалось установить tcp timestamps: %w", err)
+	return o.MSS - delta
+}
+
+// SYNMSS возвращает mss, который объявляется в SYN семейства адреса.
+func (o *TCPOptions) SYNMSS(ipv6 bool) uint16 {
+	if ipv6 {
+		return o.IPv6MSS()
 	}
+	return o.MSS
+}
+
+// SYNWindow возвращает окно SYN при mss, который объявляется в семействе
+// адреса.
+func (o *TCPOptions) SYNWindow(ipv6 bool) uint16 {
+	return o.Window.SYNWindow(int(o.SYNMSS(ipv6)), o.ReceiveBuffer)
+}
 
-	windowScaleValue := "0"
-	if opts.WindowScaleEnabled {
-		windowScaleValue = "1"
-		if err := executeCommand("sysctl", "-w", fmt.Sprintf("net.ipv4.tcp_window_scaling=%s", windowScaleValue)); err != nil {
-			return fmt.Errorf("не удалось включить tcp window scaling: %w", err)
-		}
+// ReceiveWindowField возвращает наибольшее значение поля окна после
+// рукопожатия: окно приема при согласованном mss, сдвинутое на window
+// scale, если сервер его принял.
+func (o *TCPOptions) ReceiveWindowField(mss int, scaled bool) uint16 {
+	wnd := o.Window.ReceiveWindow(mss, o.ReceiveBuffer)
+	if scaled && o.Layout().Has(OptionWS) {
+		wnd >>= o.WindowScaleValue
 	}
+	return uint16(min(max(wnd, 1), 0xffff))
+}
 
-	routeCmd := fmt.Sprintf("ip route change default via $(ip route | grep default | awk '{print $3}') dev $(ip route | grep default | awk '{print $5}') advmss %d", opts.MSS)
-	if err := executeCommand("bash", "-c", routeCmd); err != nil {
-		log.Printf("предупреждение: не удалось установить mss: %v", err)
+func (o *TCPOptions) Layout() OptionLayout {
+	if !o.OptionLayout.IsEmpty() {
+		return o.OptionLayout
 	}
+	return defaultOptionLayout(o)
+}
 
-	sackValue := "0"
-	if opts.SACKEnabled {
-		sackValue = "1"
+// SetOptionEnabled включает или выключает опцию так, чтобы флаги и явная
+// раскладка профиля не расходились.
+func (o *TCPOptions) SetOptionEnabled(kind OptionKind, enabled bool) {
+	switch kind {
+	case OptionTS:
+		o.TimestampsEnabled = enabled
+	case OptionWS:
+		o.WindowScaleEnabled = enabled
+	case OptionSACKPermitted:
+		o.SACKEnabled = enabled
 	}
-	if err := executeCommand("sysctl", "-w", fmt.Sprintf("net.ipv4.tcp_sack=%s", sackValue)); err != nil {
-		return fmt.Errorf("не удалось установить tcp sack: %w", err)
+	if !o.OptionLayout.IsEmpty() {
+		o.OptionLayout = o.OptionLayout.With(kind, enabled)
 	}
-
-	log.Printf("настройки tcp успешно применены")
-	return nil
 }
 
-func GetSocketOptions(socket *net.TCPConn) (map[string]interface{}, error) {
-	socketOpts := make(map[string]interface{})
-
-	file, err := socket.File()
+func GetTCPOptions(osType string, windowSize int, ttl int) (*TCPOptions, error) {
+	opts, err := profileTCPOptions(osType)
 	if err != nil {
-		return nil, fmt.Errorf("не удалось получить файловый дескриптор: %w", err)
+		return nil, err
 	}
-	defer file.Close()
 
-	if ttl, err := getSysctlValue("net.ipv4.ip_default_ttl"); err == nil {
-		ttlInt, _ := strconv.Atoi(ttl)
-		socketOpts["TTL"] = ttlInt
+	if windowSize < 0 || windowSize > 0xffff {
+		return nil, fmt.Errorf("размер окна должен быть от 0 до 65535, получено %d", windowSize)
 	}
-
-	if windowSize, err := getSysctlValue("net.ipv4.tcp_rmem"); err == nil {
-		parts := strings.Split(windowSize, "\t")
-		if len(parts) >= 2 {
-			socketOpts["WindowSize"] = parts[1]
-		} else {
-			socketOpts["WindowSize"] = windowSize
-		}
+	if windowSize > 0 {
+		opts.Window = FixedWindow(windowSize)
 	}
-
-	if timestamps, err := getSysctlValue("net.ipv4.tcp_timestamps"); err == nil {
-		tsInt, _ := strconv.Atoi(timestamps)
-		socketOpts["TimestampsEnabled"] = (tsInt == 1)
+	if ttl < 0 || ttl > MaxTTL {
+		return nil, fmt.Errorf("ttl должен быть от 0 до %d, получено %d", MaxTTL, ttl)
 	}
+	if ttl > 0 {
+		opts.TTL = uint8(ttl)
+	}
+	return opts, nil
+}
 
-	if sack, err := getSysctlValue("net.ipv4.tcp_sack"); err == nil {
-		sackInt, _ := strconv.Atoi(sack)
-		socketOpts["SACKEnabled"] = (sackInt == 1)
+// profileTCPOptions ищет профиль в DefaultRegistry, а затем среди меток
+// загруженной базы p0f.
+func profileTCPOptions(osType string) (*TCPOptions, error) {
+	if DefaultRegistry.Has(osType) {
+		return DefaultRegistry.TCPOptions(osType)
 	}
+	opts, err := p0fTCPOptions(osType)
+	if err != nil {
+		return nil, fmt.Errorf("неизвестный тип ос для имитации: %s: %w", osType, err)
+	}
+	return opts, nil
+}
 
-	return socketOpts, nil
+// Validate отвергает значения, которых не бывает у настоящего стека:
+// window scale больше 14, MSS, не помещающийся в mtu, и окно SYN больше
+// 16 бит. mtu 0 ограничивает MSS только размером пакета ipv4.
+func (o *TCPOptions) Validate(mtu int) error {
+	if mtu <= 0 {
+		mtu = 65535
+	}
+	if o.WindowScaleEnabled && o.WindowScaleValue > maxWindowScale {
+		return fmt.Errorf("window scale %d больше %d", o.WindowScaleValue, maxWindowScale)
+	}
+	if maxMSS := mtu - header.IPv4MinimumSize - header.TCPMinimumSize; int(o.MSS) > maxMSS {
+		return fmt.Errorf("mss %d больше mtu-40 (%d)", o.MSS, maxMSS)
+	}
+	if o.TTL == 0 {
+		return fmt.Errorf("ttl не может быть нулевым")
+	}
+	if o.TTL > MaxTTL {
+		return fmt.Errorf("ttl %d больше %d: ядро уменьшает ttl при пересылке из tun", o.TTL, MaxTTL)
+	}
+	if hl := o.IPv6HopLimit(); hl > MaxTTL {
+		return fmt.Errorf("hop limit %d больше %d: ядро уменьшает его при пересылке из tun", hl, MaxTTL)
+	}
+	if err := o.Window.validate(int(o.MSS), o.ReceiveBuffer); err != nil {
+		return err
+	}
+	return o.Layout().Validate()
 }
@@ -0,0 +1,67 @@
+package stack
+
+import "testing"
+
+func TestGetTCPOptionsOverrides(t *testing.T) {
+	opts, err := GetTCPOptions("windows10", 8192, MaxTTL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.Window != FixedWindow(8192) || opts.TTL != MaxTTL {
+		t.Errorf("окно %v, ttl %d, ожидалось 8192 и %d", opts.Window, opts.TTL, MaxTTL)
+	}
+
+	tests := []struct {
+		name   string
+		window int
+		ttl    int
+	}{
+		{"отрицательное окно", -1, 0},
+		{"окно больше 16 бит", 0x10000, 0},
+		{"отрицательный ttl", 0, -1},
+		// ttl 255 на проводе стал бы 254 после пересылки из tun.
+		{"ttl 255", 0, 255},
+		{"ttl больше 255", 0, 300},
+	}
+	for _, tt := range tests {
+		if _, err := GetTCPOptions("windows10", tt.window, tt.ttl); err == nil {
+			t.Errorf("%s: ошибки нет", tt.name)
+		}
+	}
+}
+
+func TestValidateTTL(t *testing.T) {
+	tests := []struct {
+		name     string
+		ttl      uint8
+		hopLimit uint8
+		ok       bool
+	}{
+		{"ttl 1", 1, 0, true},
+		{"ttl 254", MaxTTL, 0, true},
+		{"ttl 0", 0, 0, false},
+		{"ttl 255", 255, 0, false},
+		{"hop limit 254 при ttl 64", 64, MaxTTL, true},
+		{"hop limit 255", 64, 255, false},
+	}
+	for _, tt := range tests {
+		opts, err := GetTCPOptions("linux", 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		opts.TTL, opts.HopLimit = tt.ttl, tt.hopLimit
+		err = opts.Validate(1500)
+		if tt.ok && err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		} else if !tt.ok && err == nil {
+			t.Errorf("%s: ошибки нет", tt.name)
+		}
+	}
+
+	// Значение на проводе совпадает с профилем во всем допустимом диапазоне.
+	for ttl := 1; ttl <= MaxTTL; ttl++ {
+		if got := wireTTL(forwardedTTL(uint8(ttl))); got != uint8(ttl) {
+			t.Errorf("ttl %d на проводе станет %d", ttl, got)
+		}
+	}
+}
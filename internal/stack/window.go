@@ -0,0 +1,159 @@
+package stack
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// maxReceiveBuffer - наибольшее окно приема, которое можно объявить с
+// window scale 14.
+const maxReceiveBuffer = 0xffff << maxWindowScale
+
+type WindowKind int
+
+const (
+	// WindowFixed - окно задано числом, как 8192 или 65535.
+	WindowFixed WindowKind = iota
+	// WindowMSS - окно кратно объявленному MSS, как у linux.
+	WindowMSS
+	// WindowRcvBuf - окно выводится из буфера приема так же, как в
+	// tcp_select_initial_window linux: 262144 байт дают 64240 при MSS 1460.
+	WindowRcvBuf
+)
+
+// WindowPolicy задает окно профиля: "64240", "mss*20" или "rcvbuf". В YAML
+// и JSON фиксированное окно пишется числом, остальные - строкой.
+type WindowPolicy struct {
+	Kind WindowKind
+	// Value - размер окна для WindowFixed и множитель MSS для WindowMSS.
+	Value int
+}
+
+func FixedWindow(size int) WindowPolicy {
+	return WindowPolicy{Kind: WindowFixed, Value: size}
+}
+
+func ParseWindowPolicy(s string) (WindowPolicy, error) {
+	s = strings.TrimSpace(s)
+	switch {
+	case s == "rcvbuf":
+		return WindowPolicy{Kind: WindowRcvBuf}, nil
+	case strings.HasPrefix(s, "mss*"):
+		n, err := strconv.Atoi(s[len("mss*"):])
+		if err != nil || n < 1 {
+			return WindowPolicy{}, fmt.Errorf("некорректный множитель mss в окне %q", s)
+		}
+		return WindowPolicy{Kind: WindowMSS, Value: n}, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 || n > 0xffff {
+		return WindowPolicy{}, fmt.Errorf("некорректное окно %q (число от 0 до 65535, mss*N или rcvbuf)", s)
+	}
+	return FixedWindow(n), nil
+}
+
+func (w WindowPolicy) String() string {
+	switch w.Kind {
+	case WindowMSS:
+		return fmt.Sprintf("mss*%d", w.Value)
+	case WindowRcvBuf:
+		return "rcvbuf"
+	}
+	return strconv.Itoa(w.Value)
+}
+
+// SYNWindow возвращает окно SYN при объявленном mss и буфере приема
+// rcvbuf. Окно SYN не масштабируется (RFC 7323), поэтому не превышает
+// 65535; окно по буферу, как в linux, округляется вниз до целого числа mss.
+func (w WindowPolicy) SYNWindow(mss, rcvbuf int) uint16 {
+	size := w.Value
+	switch w.Kind {
+	case WindowMSS:
+		size = mss * w.Value
+	case WindowRcvBuf:
+		size = min(rcvbuf, 0xffff)
+		if mss > 0 && size >= mss {
+			size -= size % mss
+		}
+	}
+	return uint16(min(max(size, 0), 0xffff))
+}
+
+// ReceiveWindow возвращает окно приема после рукопожатия в байтах: буфер
+// rcvbuf, если он задан, иначе окно SYN при согласованном mss.
+func (w WindowPolicy) ReceiveWindow(mss, rcvbuf int) int {
+	if rcvbuf > 0 {
+		return rcvbuf
+	}
+	return int(w.SYNWindow(mss, rcvbuf))
+}
+
+// validate проверяет, что окно SYN при mss профиля помещается в 16 бит без
+// усечения.
+func (w WindowPolicy) validate(mss, rcvbuf int) error {
+	if rcvbuf < 0 || rcvbuf > maxReceiveBuffer {
+		return fmt.Errorf("rcvbuf должен быть от 0 до %d, получено %d", maxReceiveBuffer, rcvbuf)
+	}
+	switch w.Kind {
+	case WindowFixed:
+		if w.Value < 0 || w.Value > 0xffff {
+			return fmt.Errorf("окно должно быть от 0 до 65535, получено %d", w.Value)
+		}
+	case WindowMSS:
+		if mss == 0 {
+			return fmt.Errorf("окно %s требует ненулевого mss", w)
+		}
+		if w.Value < 1 || mss*w.Value > 0xffff {
+			return fmt.Errorf("окно %s при mss %d больше 65535", w, mss)
+		}
+	case WindowRcvBuf:
+		if rcvbuf == 0 {
+			return fmt.Errorf("окно rcvbuf требует ненулевого rcvbuf")
+		}
+	}
+	return nil
+}
+
+func (w WindowPolicy) MarshalYAML() (interface{}, error) {
+	if w.Kind == WindowFixed {
+		return w.Value, nil
+	}
+	return w.String(), nil
+}
+
+func (w *WindowPolicy) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind != yaml.ScalarNode {
+		return fmt.Errorf("строка %d: окно должно быть числом или строкой", node.Line)
+	}
+	p, err := ParseWindowPolicy(node.Value)
+	if err != nil {
+		return fmt.Errorf("строка %d: %w", node.Line, err)
+	}
+	*w = p
+	return nil
+}
+
+func (w WindowPolicy) MarshalJSON() ([]byte, error) {
+	if w.Kind == WindowFixed {
+		return json.Marshal(w.Value)
+	}
+	return json.Marshal(w.String())
+}
+
+func (w *WindowPolicy) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		// Не строка: значение разбирается как число.
+		s = string(data)
+	}
+	p, err := ParseWindowPolicy(s)
+	if err != nil {
+		return err
+	}
+	*w = p
+	return nil
+}
@@ -0,0 +1,134 @@
+package stack
+
+import "testing"
+
+func TestParseWindowPolicy(t *testing.T) {
+	tests := []struct {
+		in   string
+		want WindowPolicy
+	}{
+		{"8192", FixedWindow(8192)},
+		{" 65535 ", FixedWindow(65535)},
+		{"0", FixedWindow(0)},
+		{"mss*20", WindowPolicy{Kind: WindowMSS, Value: 20}},
+		{"mss*1", WindowPolicy{Kind: WindowMSS, Value: 1}},
+		{"rcvbuf", WindowPolicy{Kind: WindowRcvBuf}},
+	}
+	for _, tt := range tests {
+		got, err := ParseWindowPolicy(tt.in)
+		if err != nil {
+			t.Errorf("%q: %v", tt.in, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%q: получено %+v, ожидалось %+v", tt.in, got, tt.want)
+		}
+		if back, err := ParseWindowPolicy(got.String()); err != nil || back != got {
+			t.Errorf("%q: String() = %q не разбирается обратно", tt.in, got.String())
+		}
+	}
+
+	for _, in := range []string{"", "mss*0", "mss*-1", "mss*x", "mss*", "-1", "65536", "100000", "rcvbuf*2", "window"} {
+		if _, err := ParseWindowPolicy(in); err == nil {
+			t.Errorf("%q: ошибки нет", in)
+		}
+	}
+}
+
+func TestSYNWindow(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy WindowPolicy
+		mss    int
+		rcvbuf int
+		want   uint16
+	}{
+		{"фиксированное", FixedWindow(8192), 1460, 65536, 8192},
+		{"фиксированное без mss", FixedWindow(65535), 0, 0, 65535},
+		{"mss*20", WindowPolicy{Kind: WindowMSS, Value: 20}, 1460, 0, 29200},
+		{"mss*10 при mss ipv6", WindowPolicy{Kind: WindowMSS, Value: 10}, 1440, 0, 14400},
+		{"mss*N больше 16 бит", WindowPolicy{Kind: WindowMSS, Value: 50}, 1460, 0, 65535},
+		// Как в linux: 262144 урезается до 65535 и округляется вниз до mss.
+		{"rcvbuf windows10", WindowPolicy{Kind: WindowRcvBuf}, 1460, 262144, 64240},
+		{"rcvbuf меньше 16 бит", WindowPolicy{Kind: WindowRcvBuf}, 1460, 16384, 16060},
+		{"rcvbuf меньше mss", WindowPolicy{Kind: WindowRcvBuf}, 1460, 1000, 1000},
+		{"rcvbuf без mss", WindowPolicy{Kind: WindowRcvBuf}, 0, 262144, 65535},
+	}
+	for _, tt := range tests {
+		if got := tt.policy.SYNWindow(tt.mss, tt.rcvbuf); got != tt.want {
+			t.Errorf("%s: окно %d, ожидалось %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestReceiveWindowField(t *testing.T) {
+	tests := []struct {
+		name   string
+		opts   TCPOptions
+		mss    int
+		scaled bool
+		want   uint16
+	}{
+		{"фиксированное без ws", TCPOptions{Window: FixedWindow(8192), MSS: 1460}, 1460, false, 8192},
+		{"mss*20 при меньшем согласованном mss",
+			TCPOptions{Window: WindowPolicy{Kind: WindowMSS, Value: 20}, MSS: 1460,
+				WindowScaleEnabled: true, WindowScaleValue: 7}, 1400, false, 28000},
+		// rcvbuf без window scale у сервера не сдвигается и урезается до 16 бит.
+		{"rcvbuf без wscale сервера",
+			TCPOptions{Window: WindowPolicy{Kind: WindowRcvBuf}, ReceiveBuffer: 262144, MSS: 1460,
+				WindowScaleEnabled: true, WindowScaleValue: 8}, 1460, false, 65535},
+		{"rcvbuf с wscale сервера",
+			TCPOptions{Window: WindowPolicy{Kind: WindowRcvBuf}, ReceiveBuffer: 262144, MSS: 1460,
+				WindowScaleEnabled: true, WindowScaleValue: 8}, 1460, true, 1024},
+		{"rcvbuf с большим сдвигом",
+			TCPOptions{Window: WindowPolicy{Kind: WindowRcvBuf}, ReceiveBuffer: 65536, MSS: 1460,
+				WindowScaleEnabled: true, WindowScaleValue: 14}, 1460, true, 4},
+		// Профиль без ws в раскладке не сдвигает окно, даже если сервер
+		// прислал свой wscale.
+		{"без ws в профиле",
+			TCPOptions{Window: FixedWindow(65535), ReceiveBuffer: 262144, MSS: 1460,
+				OptionLayout: mustLayout(t, "mss,nop,nop,sok")}, 1460, true, 65535},
+		{"нулевое окно", TCPOptions{Window: FixedWindow(0), MSS: 1460}, 1460, false, 1},
+	}
+	for _, tt := range tests {
+		if got := tt.opts.ReceiveWindowField(tt.mss, tt.scaled); got != tt.want {
+			t.Errorf("%s: поле окна %d, ожидалось %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestWindowPolicyValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy WindowPolicy
+		mss    int
+		rcvbuf int
+		ok     bool
+	}{
+		{"фиксированное", FixedWindow(65535), 0, 0, true},
+		{"фиксированное больше 16 бит", FixedWindow(0x10000), 1460, 0, false},
+		{"mss*44", WindowPolicy{Kind: WindowMSS, Value: 44}, 1460, 0, true},
+		{"mss*45 больше 65535", WindowPolicy{Kind: WindowMSS, Value: 45}, 1460, 0, false},
+		{"mss*N без mss", WindowPolicy{Kind: WindowMSS, Value: 10}, 0, 0, false},
+		{"rcvbuf", WindowPolicy{Kind: WindowRcvBuf}, 1460, 262144, true},
+		{"rcvbuf без буфера", WindowPolicy{Kind: WindowRcvBuf}, 1460, 0, false},
+		{"буфер больше предела", FixedWindow(8192), 1460, maxReceiveBuffer + 1, false},
+	}
+	for _, tt := range tests {
+		err := tt.policy.validate(tt.mss, tt.rcvbuf)
+		if tt.ok && err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		} else if !tt.ok && err == nil {
+			t.Errorf("%s: ошибки нет", tt.name)
+		}
+	}
+}
+
+func mustLayout(t *testing.T, s string) OptionLayout {
+	t.Helper()
+	l, err := ParseOptionLayout(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
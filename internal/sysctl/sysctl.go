@@ -0,0 +1,73 @@
+package sysctl
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const procSys = "/proc/sys"
+
+func path(key string) string {
+	return filepath.Join(procSys, strings.ReplaceAll(key, ".", "/"))
+}
+
+// Get читает значение параметра напрямую из /proc/sys. Табуляции, которыми
+// ядро разделяет поля (tcp_rmem), заменяются пробелами.
+func Get(key string) (string, error) {
+	data, err := os.ReadFile(path(key))
+	if err != nil {
+		return "", fmt.Errorf("не удалось прочитать %s: %w", key, err)
+	}
+	return strings.Join(strings.Fields(string(data)), " "), nil
+}
+
+func Set(key, value string) error {
+	if err := os.WriteFile(path(key), []byte(value+"\n"), 0644); err != nil {
+		return fmt.Errorf("не удалось записать %s=%s: %w", key, value, err)
+	}
+	return nil
+}
+
+type Value struct {
+	Key   string
+	Value string
+}
+
+// Snapshot - сохраненные значения параметров в порядке чтения.
+type Snapshot []Value
+
+// Take читает текущие значения keys. Отсутствующие в этом ядре параметры
+// пропускаются, остальные ошибки возвращаются.
+func Take(keys ...string) (Snapshot, error) {
+	var snap Snapshot
+	for _, key := range keys {
+		value, err := Get(key)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return nil, err
+		}
+		snap = append(snap, Value{Key: key, Value: value})
+	}
+	return snap, nil
+}
+
+// Restore возвращает сохраненные значения в обратном порядке, не трогая
+// параметры, которые и так совпадают со снимком.
+func (s Snapshot) Restore() error {
+	var errs []error
+	for i := len(s) - 1; i >= 0; i-- {
+		v := s[i]
+		if current, err := Get(v.Key); err == nil && current == v.Value {
+			continue
+		}
+		if err := Set(v.Key, v.Value); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,30 @@
+package sysctl
+
+import "testing"
+
+func TestTakeSkipsMissing(t *testing.T) {
+	snap, err := Take("net.ipv4.ip_forward", "net.ipv4.tcpcustom_missing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snap) != 1 || snap[0].Key != "net.ipv4.ip_forward" {
+		t.Fatalf("снимок %+v", snap)
+	}
+	// Совпадающее значение не записывается, поэтому Restore работает и без
+	// прав на запись в /proc/sys.
+	if err := snap.Restore(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGetJoinsFields(t *testing.T) {
+	v, err := Get("net.ipv4.tcp_rmem")
+	if err != nil {
+		t.Skip(err)
+	}
+	for _, c := range v {
+		if c == '\t' {
+			t.Fatalf("в значении %q осталась табуляция", v)
+		}
+	}
+}